@@ -0,0 +1,796 @@
+package bot_server
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed locales/*.yaml
+var localeFS embed.FS
+
+// defaultLocale is the last resort of every fallback chain, it must have all templates
+const defaultLocale = "en"
+
+// currentCatalog holds templates in use, the bundle embedded from locales/ unless replaced by LoadTemplates
+var currentCatalog atomic.Pointer[templateCatalog]
+
+func init() {
+	fsys, err := fs.Sub(localeFS, "locales")
+	if err != nil {
+		panic(err)
+	}
+	catalog, err := loadTemplateCatalog(fsys, reviewSessionMachine.commands())
+	if err != nil {
+		panic(err)
+	}
+	currentCatalog.Store(catalog)
+}
+
+func msgCatalog() *templateCatalog {
+	return currentCatalog.Load()
+}
+
+// LoadTemplates replaces message templates with the bundle in dir, the templates in use are kept if the bundle is
+// invalid. Sessions pick up new templates from their next reply.
+func LoadTemplates(dir string) error {
+	catalog, err := loadTemplateCatalog(os.DirFS(dir), reviewSessionMachine.commands())
+	if err != nil {
+		return err
+	}
+	currentCatalog.Store(catalog)
+	return nil
+}
+
+// CheckTemplates validates the bundle in dir without using it
+func CheckTemplates(dir string) error {
+	_, err := loadTemplateCatalog(os.DirFS(dir), reviewSessionMachine.commands())
+	return err
+}
+
+// msgTemplate is the key of a message in the template catalog
+type msgTemplate string
+
+// render looks the template up along the fallback chain of locale, an empty locale is the default one
+func (t msgTemplate) render(locale string, args ...templateArg) complexText {
+	return msgCatalog().render(locale, t, args...)
+}
+
+// replyMarkup tells the reply markup of the template in locale, nil if it has none
+func (t msgTemplate) replyMarkup(locale string) interface{} {
+	def, _ := msgCatalog().lookup(locale, t)
+	if def == nil || def.markup == nil {
+		return nil
+	}
+	return def.markup.build()
+}
+
+// buildMsg renders the template in locale along with its reply markup
+func (t msgTemplate) buildMsg(locale string, chatId int64, args ...templateArg) tgbotapi.MessageConfig {
+	def, tag := msgCatalog().lookup(locale, t)
+	if def == nil {
+		return complexText{newPlainText(string(t))}.buildMsg(chatId)
+	}
+	msg := def.render(pluralRuleOf(tag), args).buildMsg(chatId)
+	if def.markup != nil {
+		msg.ReplyMarkup = def.markup.build()
+	}
+	return msg
+}
+
+// buildMsgs renders the template in locale into messages within the length limit, the reply markup of the template
+// goes with the last one
+func (t msgTemplate) buildMsgs(locale string, chatId int64, args ...templateArg) sendables {
+	def, tag := msgCatalog().lookup(locale, t)
+	if def == nil {
+		return complexText{newPlainText(string(t))}.buildMsgs(chatId)
+	}
+	msgs := def.render(pluralRuleOf(tag), args).buildMsgs(chatId)
+	if def.markup != nil {
+		msgs = msgs.withReplyMarkup(def.markup.build())
+	}
+	return msgs
+}
+
+// templateArg is a parameter interpolated into a template, the parameter named count picks the plural form as well
+type templateArg struct {
+	name  string
+	value string
+	count int
+}
+
+func arg(name string, value string) templateArg {
+	return templateArg{name: name, value: value}
+}
+
+func countArg(n int) templateArg {
+	return templateArg{name: templateParamCount, value: strconv.Itoa(n), count: n}
+}
+
+const templateParamCount = "count"
+
+type pluralForm = string
+
+const (
+	pluralZero  pluralForm = "zero"
+	pluralOne   pluralForm = "one"
+	pluralTwo   pluralForm = "two"
+	pluralFew   pluralForm = "few"
+	pluralMany  pluralForm = "many"
+	pluralOther pluralForm = "other"
+)
+
+// pluralRules picks the plural form of a count by language, as in CLDR for integers. Languages not listed follow
+// English.
+var pluralRules = map[string]func(n int) pluralForm{
+	"en": pluralRuleOneOther,
+	"zh": pluralRuleOther,
+	"ja": pluralRuleOther,
+	"ko": pluralRuleOther,
+	"fr": func(n int) pluralForm {
+		if n == 0 || n == 1 {
+			return pluralOne
+		}
+		return pluralOther
+	},
+	"ru": func(n int) pluralForm {
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return pluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return pluralFew
+		default:
+			return pluralMany
+		}
+	},
+}
+
+func pluralRuleOneOther(n int) pluralForm {
+	if n == 1 {
+		return pluralOne
+	}
+	return pluralOther
+}
+
+func pluralRuleOther(int) pluralForm {
+	return pluralOther
+}
+
+func pluralRuleOf(locale string) func(n int) pluralForm {
+	language, _, _ := strings.Cut(locale, "-")
+	if rule, ok := pluralRules[language]; ok {
+		return rule
+	}
+	return pluralRuleOneOther
+}
+
+type segmentKind int
+
+const (
+	segmentPlain segmentKind = iota
+	segmentParam
+	segmentCommand
+)
+
+type templateSegment struct {
+	kind   segmentKind
+	text   string          // text is the plain text, the parameter name or the command
+	entity *templateEntity // entity covers the segment, nil for none
+}
+
+func (segment templateSegment) value(args []templateArg) string {
+	if segment.kind != segmentParam {
+		return segment.text
+	}
+	for _, a := range args {
+		if a.name == segment.text {
+			return a.value
+		}
+	}
+	// a missing parameter is left as is, so that it's noticed rather than silently dropped
+	return "{" + segment.text + "}"
+}
+
+// templateEntity is an entity of a template text. Offset and length are in UTF-16 code units of the text as written,
+// placeholders included, and the entity covers parameters in it after interpolation.
+type templateEntity struct {
+	Type          entityType `yaml:"type"`
+	Offset        int        `yaml:"offset"`
+	Length        int        `yaml:"length"`
+	Url           string     `yaml:"url"`             // Url is for text_link only
+	Language      string     `yaml:"language"`        // Language is for pre only, optional
+	CustomEmojiId string     `yaml:"custom_emoji_id"` // CustomEmojiId is for custom_emoji only
+}
+
+func (e *templateEntity) end() int {
+	return e.Offset + e.Length
+}
+
+func (e *templateEntity) validate() error {
+	switch e.Type {
+	case entityTypeBotCommand, entityTypeBold, entityTypeItalic, entityTypeCode, entityTypePre, entityTypeSpoiler:
+	case entityTypeTextLink:
+		if len(e.Url) == 0 {
+			return fmt.Errorf("url is required by %s", e.Type)
+		}
+	case entityTypeCustomEmoji:
+		if len(e.CustomEmojiId) == 0 {
+			return fmt.Errorf("custom_emoji_id is required by %s", e.Type)
+		}
+	case entityTypeTextMention:
+		return fmt.Errorf("%s refers to a user, which a template can't", e.Type)
+	default:
+		return fmt.Errorf("unknown entity type %q", e.Type)
+	}
+	if e.Offset < 0 || e.Length <= 0 {
+		return fmt.Errorf("%s entity at %d of length %d is empty or negative", e.Type, e.Offset, e.Length)
+	}
+	return nil
+}
+
+func (e *templateEntity) component(text string) iTextComponent {
+	return &textComponentEntity{
+		text:          text,
+		entityType:    e.Type,
+		url:           e.Url,
+		language:      e.Language,
+		customEmojiId: e.CustomEmojiId,
+	}
+}
+
+// parseTemplateText splits text into plain text, {param} and {/command}, {{ and }} are literal braces. Segments are
+// split at boundaries of entities as well, an entity must fit in the text, must not overlap another, and must not cut
+// through a placeholder or cover a command, as a command is an entity itself.
+func parseTemplateText(text string, entities []templateEntity) ([]templateSegment, error) {
+	entities = append([]templateEntity(nil), entities...)
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Offset < entities[j].Offset
+	})
+	textLen := utf16Len(text)
+	for i := range entities {
+		err := entities[i].validate()
+		if err != nil {
+			return nil, err
+		}
+		if entities[i].end() > textLen {
+			return nil, fmt.Errorf("%s entity at %d of length %d exceeds text length %d", entities[i].Type,
+				entities[i].Offset, entities[i].Length, textLen)
+		}
+		if i > 0 && entities[i].Offset < entities[i-1].end() {
+			return nil, fmt.Errorf("%s entity at %d overlaps %s entity at %d", entities[i].Type, entities[i].Offset,
+				entities[i-1].Type, entities[i-1].Offset)
+		}
+	}
+
+	var (
+		segments []templateSegment
+		plain    strings.Builder
+		current  *templateEntity
+		pos      int // pos is the offset in UTF-16 code units
+		next     int // next is the index of the next entity to start
+	)
+
+	flushPlain := func() {
+		if plain.Len() > 0 {
+			segments = append(segments, templateSegment{kind: segmentPlain, text: plain.String(), entity: current})
+			plain.Reset()
+		}
+	}
+	// enter updates the entity covering pos
+	enter := func() {
+		if current != nil && pos >= current.end() {
+			flushPlain()
+			current = nil
+		}
+		if next < len(entities) && pos == entities[next].Offset {
+			flushPlain()
+			current = &entities[next]
+			next++
+		}
+	}
+	// cut tells whether a boundary of an entity falls strictly inside (from, to)
+	cut := func(from int, to int) bool {
+		for i := range entities {
+			if entities[i].Offset > from && entities[i].Offset < to || entities[i].end() > from && entities[i].end() < to {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(text); {
+		enter()
+		c := text[i]
+		switch {
+		case (c == '{' || c == '}') && i+1 < len(text) && text[i+1] == c:
+			if cut(pos, pos+2) {
+				return nil, fmt.Errorf("entity cuts %c%c at %d", c, c, pos)
+			}
+			plain.WriteByte(c)
+			i += 2
+			pos += 2
+		case c == '}':
+			return nil, fmt.Errorf("unmatched } at %d", pos)
+		case c == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed { at %d", pos)
+			}
+			raw := text[i : i+end+1]
+			name := raw[1 : len(raw)-1]
+			segment := templateSegment{kind: segmentParam, text: name, entity: current}
+			if strings.HasPrefix(name, "/") {
+				segment.kind = segmentCommand
+				name = name[1:]
+			}
+			if !isTemplateName(name) {
+				return nil, fmt.Errorf("invalid placeholder %s at %d", raw, pos)
+			}
+			rawLen := utf16Len(raw)
+			if cut(pos, pos+rawLen) {
+				return nil, fmt.Errorf("entity cuts placeholder %s at %d", raw, pos)
+			}
+			if segment.kind == segmentCommand && current != nil {
+				return nil, fmt.Errorf("%s entity at %d covers command %s", current.Type, current.Offset, raw)
+			}
+			flushPlain()
+			segments = append(segments, segment)
+			i += len(raw)
+			pos += rawLen
+		default:
+			_, size := utf8.DecodeRuneInString(text[i:])
+			runeLen := utf16Len(text[i : i+size])
+			if cut(pos, pos+runeLen) {
+				return nil, fmt.Errorf("entity cuts a character at %d", pos)
+			}
+			plain.WriteString(text[i : i+size])
+			i += size
+			pos += runeLen
+		}
+	}
+	flushPlain()
+	return segments, nil
+}
+
+func isTemplateName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// templateMarkup is the reply markup of a template, one of a reply keyboard, an inline keyboard of url buttons, or
+// removing the reply keyboard. Buttons with callback data are built by the bot, as their data depends on the session.
+type templateMarkup struct {
+	Keyboard        [][]templateButton `yaml:"keyboard"`
+	ResizeKeyboard  bool               `yaml:"resize_keyboard"`
+	OneTimeKeyboard bool               `yaml:"one_time_keyboard"`
+	InlineKeyboard  [][]templateButton `yaml:"inline_keyboard"`
+	RemoveKeyboard  bool               `yaml:"remove_keyboard"`
+}
+
+type templateButton struct {
+	Text            string `yaml:"text"`
+	RequestContact  bool   `yaml:"request_contact"`
+	RequestLocation bool   `yaml:"request_location"`
+	Url             string `yaml:"url"` // Url is for inline keyboard only, and required by it
+}
+
+func (m *templateMarkup) validate() error {
+	kinds := 0
+	for _, given := range []bool{len(m.Keyboard) > 0, len(m.InlineKeyboard) > 0, m.RemoveKeyboard} {
+		if given {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("reply_markup must be one of keyboard, inline_keyboard and remove_keyboard")
+	}
+
+	for _, row := range append(append([][]templateButton(nil), m.Keyboard...), m.InlineKeyboard...) {
+		if len(row) == 0 {
+			return fmt.Errorf("reply_markup has an empty row")
+		}
+		for _, button := range row {
+			if len(button.Text) == 0 {
+				return fmt.Errorf("reply_markup has a button without text")
+			}
+		}
+	}
+	for _, row := range m.Keyboard {
+		for _, button := range row {
+			if len(button.Url) > 0 {
+				return fmt.Errorf("button %s of keyboard can't have url", button.Text)
+			}
+		}
+	}
+	for _, row := range m.InlineKeyboard {
+		for _, button := range row {
+			if len(button.Url) == 0 || button.RequestContact || button.RequestLocation {
+				return fmt.Errorf("button %s of inline_keyboard must have url only", button.Text)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *templateMarkup) build() interface{} {
+	switch {
+	case m.RemoveKeyboard:
+		return tgbotapi.ReplyKeyboardRemove{RemoveKeyboard: true}
+	case len(m.InlineKeyboard) > 0:
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for _, row := range m.InlineKeyboard {
+			var buttons []tgbotapi.InlineKeyboardButton
+			for _, button := range row {
+				buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonURL(button.Text, button.Url))
+			}
+			rows = append(rows, buttons)
+		}
+		return tgbotapi.NewInlineKeyboardMarkup(rows...)
+	default:
+		var rows [][]tgbotapi.KeyboardButton
+		for _, row := range m.Keyboard {
+			var buttons []tgbotapi.KeyboardButton
+			for _, button := range row {
+				buttons = append(buttons, tgbotapi.KeyboardButton{
+					Text:            button.Text,
+					RequestContact:  button.RequestContact,
+					RequestLocation: button.RequestLocation,
+				})
+			}
+			rows = append(rows, buttons)
+		}
+		return tgbotapi.ReplyKeyboardMarkup{
+			Keyboard:        rows,
+			ResizeKeyboard:  m.ResizeKeyboard,
+			OneTimeKeyboard: m.OneTimeKeyboard,
+		}
+	}
+}
+
+// templateDef is a template in a locale. In the bundle it's a text, texts by plural form, or a mapping of text,
+// entities and reply_markup, where text may be by plural form and entities are by plural form then.
+type templateDef struct {
+	forms  map[pluralForm][]templateSegment
+	markup *templateMarkup
+}
+
+func (d *templateDef) UnmarshalYAML(node *yaml.Node) error {
+	var (
+		textNode     = node
+		entitiesNode *yaml.Node
+	)
+	if node.Kind == yaml.MappingNode && hasYamlKey(node, "text") {
+		var full struct {
+			Text        yaml.Node       `yaml:"text"`
+			Entities    yaml.Node       `yaml:"entities"`
+			ReplyMarkup *templateMarkup `yaml:"reply_markup"`
+		}
+		err := node.Decode(&full)
+		if err != nil {
+			return err
+		}
+		textNode, entitiesNode, d.markup = &full.Text, &full.Entities, full.ReplyMarkup
+		if d.markup != nil {
+			err = d.markup.validate()
+			if err != nil {
+				return fmt.Errorf("line %d: %w", node.Line, err)
+			}
+		}
+	}
+
+	texts := map[pluralForm]string{}
+	switch textNode.Kind {
+	case yaml.ScalarNode:
+		texts[pluralOther] = textNode.Value
+	case yaml.MappingNode:
+		err := textNode.Decode(&texts)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: template should be a text or texts by plural form", textNode.Line)
+	}
+	if _, ok := texts[pluralOther]; !ok {
+		return fmt.Errorf("line %d: plural form %s is required", textNode.Line, pluralOther)
+	}
+
+	entities := map[pluralForm][]templateEntity{}
+	if entitiesNode != nil {
+		switch {
+		case entitiesNode.Kind == 0:
+		case entitiesNode.Kind == yaml.SequenceNode && textNode.Kind == yaml.ScalarNode:
+			var list []templateEntity
+			err := entitiesNode.Decode(&list)
+			if err != nil {
+				return err
+			}
+			entities[pluralOther] = list
+		case entitiesNode.Kind == yaml.MappingNode && textNode.Kind == yaml.MappingNode:
+			err := entitiesNode.Decode(&entities)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: entities should be by plural form as the text is", entitiesNode.Line)
+		}
+	}
+	for form := range entities {
+		if _, ok := texts[form]; !ok {
+			return fmt.Errorf("line %d: entities of plural form %s without text", entitiesNode.Line, form)
+		}
+	}
+
+	d.forms = map[pluralForm][]templateSegment{}
+	for form, text := range texts {
+		switch form {
+		case pluralZero, pluralOne, pluralTwo, pluralFew, pluralMany, pluralOther:
+		default:
+			return fmt.Errorf("line %d: unknown plural form %s", textNode.Line, form)
+		}
+		segments, err := parseTemplateText(text, entities[form])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", textNode.Line, err)
+		}
+		d.forms[form] = segments
+	}
+	return nil
+}
+
+func hasYamlKey(node *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// params tells parameters used by any plural form
+func (d *templateDef) params() map[string]bool {
+	params := map[string]bool{}
+	for _, segments := range d.forms {
+		for _, segment := range segments {
+			if segment.kind == segmentParam {
+				params[segment.text] = true
+			}
+		}
+	}
+	return params
+}
+
+// commands lists commands referred by {/command} and bot_command entities
+func (d *templateDef) commands() []string {
+	var commands []string
+	for _, segments := range d.forms {
+		var entityText strings.Builder
+		for i, segment := range segments {
+			if segment.kind == segmentCommand {
+				commands = append(commands, segment.text)
+			}
+			if segment.entity == nil || segment.entity.Type != entityTypeBotCommand {
+				continue
+			}
+			entityText.WriteString(segment.value(nil))
+			if i+1 == len(segments) || segments[i+1].entity != segment.entity {
+				commands = append(commands, entityText.String())
+				entityText.Reset()
+			}
+		}
+	}
+	return commands
+}
+
+func (d *templateDef) render(pluralRule func(n int) pluralForm, args []templateArg) complexText {
+	form := pluralOther
+	for _, a := range args {
+		if a.name == templateParamCount {
+			form = pluralRule(a.count)
+		}
+	}
+	segments, ok := d.forms[form]
+	if !ok {
+		segments = d.forms[pluralOther]
+	}
+
+	ct := make(complexText, 0, len(segments))
+	for i := 0; i < len(segments); {
+		segment := segments[i]
+		switch {
+		case segment.entity != nil:
+			// segments of an entity make one text of the entity
+			var entityText strings.Builder
+			for ; i < len(segments) && segments[i].entity == segment.entity; i++ {
+				entityText.WriteString(segments[i].value(args))
+			}
+			ct = append(ct, segment.entity.component(entityText.String()))
+			continue
+		case segment.kind == segmentCommand:
+			ct = append(ct, newEntityText(segment.text, entityTypeBotCommand))
+		default:
+			ct = append(ct, newPlainText(segment.value(args)))
+		}
+		i++
+	}
+	return ct
+}
+
+type templateLocale struct {
+	Locale    string                       `yaml:"locale"`
+	Name      string                       `yaml:"name"`     // Name is shown to users picking a language
+	Fallback  string                       `yaml:"fallback"` // Fallback is tried after parents of the locale, optional
+	Templates map[msgTemplate]*templateDef `yaml:"templates"`
+}
+
+// templateCatalog holds templates by locale. A template missing in a locale is looked up along the fallback chain:
+// the locale, its parents by dropping subtags, such as zh-hant-tw, zh-hant, zh, the declared fallback of each, and
+// the default locale at last.
+type templateCatalog struct {
+	locales map[string]*templateLocale
+}
+
+// loadTemplateCatalog loads a template bundle, each *.yaml, *.yml or *.json of fsys is a locale. Commands referred
+// by templates must be in commands.
+func loadTemplateCatalog(fsys fs.FS, commands map[string]bool) (*templateCatalog, error) {
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	catalog := &templateCatalog{locales: map[string]*templateLocale{}}
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		locale := &templateLocale{}
+		// json is parsed as yaml, which it's a subset of
+		err = yaml.Unmarshal(content, locale)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s fail: %w", file, err)
+		}
+		locale.Locale = normalizeLocale(locale.Locale)
+		locale.Fallback = normalizeLocale(locale.Fallback)
+		if len(locale.Locale) == 0 {
+			return nil, fmt.Errorf("%s: locale is required", file)
+		}
+		if _, ok := catalog.locales[locale.Locale]; ok {
+			return nil, fmt.Errorf("%s: locale %s is duplicated", file, locale.Locale)
+		}
+		catalog.locales[locale.Locale] = locale
+	}
+
+	return catalog, catalog.validate(commands)
+}
+
+// validate checks the default locale has all templates, and others have known templates with known parameters.
+// Commands referred must be known.
+func (c *templateCatalog) validate(commands map[string]bool) error {
+	defaults, ok := c.locales[defaultLocale]
+	if !ok {
+		return fmt.Errorf("default locale %s is missing", defaultLocale)
+	}
+	for _, t := range allMsgTemplates {
+		if _, ok := defaults.Templates[t]; !ok {
+			return fmt.Errorf("template %s is missing in default locale %s", t, defaultLocale)
+		}
+	}
+
+	for _, locale := range c.locales {
+		if len(locale.Fallback) > 0 {
+			if _, ok := c.locales[locale.Fallback]; !ok {
+				return fmt.Errorf("fallback %s of locale %s is missing", locale.Fallback, locale.Locale)
+			}
+		}
+		for t, def := range locale.Templates {
+			defaultDef, ok := defaults.Templates[t]
+			if !ok {
+				return fmt.Errorf("unknown template %s in locale %s", t, locale.Locale)
+			}
+			defaultParams := defaultDef.params()
+			for param := range def.params() {
+				if !defaultParams[param] {
+					return fmt.Errorf("unknown parameter %s of template %s in locale %s", param, t, locale.Locale)
+				}
+			}
+			for _, command := range def.commands() {
+				if !commands[command] {
+					return fmt.Errorf("unknown command %s in template %s of locale %s", command, t, locale.Locale)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeLocale turns a language tag as telegram's language_code into lower case with hyphens, such as zh-hans
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+func (c *templateCatalog) chain(locale string) []string {
+	var (
+		chain []string
+		seen  = map[string]bool{}
+		visit func(tag string)
+	)
+
+	visit = func(tag string) {
+		for len(tag) > 0 {
+			if l, ok := c.locales[tag]; ok && !seen[tag] {
+				seen[tag] = true
+				chain = append(chain, tag)
+				visit(l.Fallback)
+			}
+			cut := strings.LastIndexByte(tag, '-')
+			if cut < 0 {
+				break
+			}
+			tag = tag[:cut]
+		}
+	}
+	visit(normalizeLocale(locale))
+	visit(defaultLocale)
+	return chain
+}
+
+// resolveLocale tells the supported locale serving a language tag
+func (c *templateCatalog) resolveLocale(locale string) string {
+	return c.chain(locale)[0]
+}
+
+// hasLocale tells whether a locale is supported as is
+func (c *templateCatalog) hasLocale(locale string) bool {
+	_, ok := c.locales[normalizeLocale(locale)]
+	return ok
+}
+
+// sortedLocales lists supported locales by locale
+func (c *templateCatalog) sortedLocales() []*templateLocale {
+	locales := make([]*templateLocale, 0, len(c.locales))
+	for _, l := range c.locales {
+		locales = append(locales, l)
+	}
+	sort.Slice(locales, func(i, j int) bool {
+		return locales[i].Locale < locales[j].Locale
+	})
+	return locales
+}
+
+// lookup finds the template along the fallback chain of locale, it tells the locale found in as well
+func (c *templateCatalog) lookup(locale string, t msgTemplate) (*templateDef, string) {
+	for _, tag := range c.chain(locale) {
+		if def, ok := c.locales[tag].Templates[t]; ok {
+			return def, tag
+		}
+	}
+	return nil, ""
+}
+
+func (c *templateCatalog) render(locale string, t msgTemplate, args ...templateArg) complexText {
+	def, tag := c.lookup(locale, t)
+	if def == nil {
+		// not reachable as the default locale is validated to have all templates
+		return complexText{newPlainText(string(t))}
+	}
+	return def.render(pluralRuleOf(tag), args)
+}
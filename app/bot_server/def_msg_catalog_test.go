@@ -0,0 +1,300 @@
+package bot_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_MsgCatalog_Embedded(t *testing.T) {
+	// translations are complete, so that no user sees a mix of languages
+	for _, l := range msgCatalog().sortedLocales() {
+		assert.NotEmpty(t, l.Name, l.Locale)
+		for _, tmpl := range allMsgTemplates {
+			_, ok := l.Templates[tmpl]
+			assert.True(t, ok, "template %s missing in locale %s", tmpl, l.Locale)
+		}
+	}
+}
+
+func Test_UnitTest_MsgCatalog_Render(t *testing.T) {
+	testCases := []struct {
+		name     string
+		locale   string
+		tmpl     msgTemplate
+		args     []templateArg
+		wantText string
+	}{
+		{"default locale", "", cancelCommentTemplate, nil, "Your unfinished comment has been discarded."},
+		{"exact locale", "zh", cancelCommentTemplate, nil, "未完成的评价已放弃。"},
+		{"parent locale", "zh_Hans-CN", cancelCommentTemplate, nil, "未完成的评价已放弃。"},
+		{"unsupported locale", "pt-br", cancelCommentTemplate, nil, "Your unfinished comment has been discarded."},
+		{"param", "en", orderPickedTemplate, []templateArg{arg("order", "Drum {1}")}, "You are commenting on order: Drum {1}"},
+		{"missing param", "en", orderPickedTemplate, nil, "You are commenting on order: {order}"},
+		{"plural one", "en", draftReminderTemplate, []templateArg{countArg(1)},
+			"You have an unfinished review, use /finish to submit it or /cancel to discard it. It will be discarded if left unfinished in 1 hour."},
+		{"plural other", "en", draftReminderTemplate, []templateArg{countArg(2)},
+			"You have an unfinished review, use /finish to submit it or /cancel to discard it. It will be discarded if left unfinished in 2 hours."},
+		{"plural of language without forms", "zh", draftReminderTemplate, []templateArg{countArg(1)},
+			"您有一条未完成的评价，使用 /finish 提交或 /cancel 放弃。1 小时内未完成将被自动放弃。"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			text, _ := tc.tmpl.render(tc.locale, tc.args...).build()
+			assert.Equal(t, tc.wantText, text)
+		})
+	}
+
+	// commands are entities, offsets are counted in UTF-16 after CJK text
+	msg := finishEmptyCommentTemplate.render("zh").buildMsg(1)
+	assert.Equal(t, []tgbotapi.MessageEntity{{Type: entityTypeBotCommand, Offset: 12, Length: 8}}, msg.Entities)
+}
+
+func Test_UnitTest_MsgCatalog_Chain(t *testing.T) {
+	catalog, err := loadTemplateCatalog(fstest.MapFS{
+		"en.yaml":      {Data: []byte(testDefaultLocaleYaml())},
+		"zh.yaml":      {Data: []byte("locale: zh\ntemplates:\n  help: 帮助")},
+		"zh-hant.yaml": {Data: []byte("locale: zh_Hant\nfallback: zh-hk\ntemplates:\n  help: 幫助")},
+		"zh-hk.yaml":   {Data: []byte("locale: zh-HK\nfallback: zh-hant\ntemplates:\n  rate: 評分")},
+	}, reviewSessionMachine.commands())
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"zh-hant", "zh-hk", "zh", "en"}, catalog.chain("zh-Hant-TW"))
+	assert.Equal(t, []string{"zh-hk", "zh-hant", "zh", "en"}, catalog.chain("zh-hk"))
+	assert.Equal(t, []string{"en"}, catalog.chain("ja"))
+	assert.Equal(t, "zh", catalog.resolveLocale("zh-CN"))
+	assert.Equal(t, "en", catalog.resolveLocale(""))
+	assert.True(t, catalog.hasLocale("zh_HK"))
+	assert.False(t, catalog.hasLocale("zh-cn"))
+
+	// a template missing in a locale falls back along the chain
+	text, _ := catalog.render("zh-hant", rateTemplate).build()
+	assert.Equal(t, "評分", text)
+	text, _ = catalog.render("zh-hant", cancelCommentTemplate).build()
+	assert.Equal(t, "cancel", text)
+}
+
+func Test_UnitTest_MsgCatalog_Invalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		files   fstest.MapFS
+		wantErr string
+	}{
+		{"no default locale", fstest.MapFS{"zh.yaml": {Data: []byte("locale: zh")}}, "default locale en is missing"},
+		{"template missing in default locale", fstest.MapFS{"en.yaml": {Data: []byte("locale: en\ntemplates:\n  help: hi")}},
+			"is missing in default locale"},
+		{"no locale", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "x.yaml": {Data: []byte("name: x")}},
+			"x.yaml: locale is required"},
+		{"duplicated locale", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "x.yaml": {Data: []byte("locale: EN")}},
+			"locale en is duplicated"},
+		{"unknown fallback", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\nfallback: ja")}},
+			"fallback ja of locale zh is missing"},
+		{"unknown template", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  hepl: 帮助")}},
+			"unknown template hepl in locale zh"},
+		{"unknown param", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  order_picked: 订单 {title}")}},
+			"unknown parameter title of template order_picked in locale zh"},
+		{"unclosed brace", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help: \"{/comment\"")}},
+			"unclosed { at 0"},
+		{"unknown command", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help: \"{/help}\"")}},
+			"unknown command /help in template help of locale zh"},
+		{"unmatched brace", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help: \"a}\"")}},
+			"unmatched } at 1"},
+		{"invalid placeholder", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help: \"{Order}\"")}},
+			"invalid placeholder {Order}"},
+		{"unknown plural form", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help:\n    other: a\n    single: b")}},
+			"unknown plural form single"},
+		{"no other form", fstest.MapFS{"en.yaml": {Data: []byte(testDefaultLocaleYaml())}, "zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help:\n    one: a")}},
+			"plural form other is required"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadTemplateCatalog(tc.files, reviewSessionMachine.commands())
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func Test_UnitTest_PluralRules(t *testing.T) {
+	ru := pluralRuleOf("ru-RU")
+	assert.Equal(t, pluralOne, ru(21))
+	assert.Equal(t, pluralFew, ru(3))
+	assert.Equal(t, pluralMany, ru(12))
+	assert.Equal(t, pluralMany, ru(5))
+	assert.Equal(t, pluralOne, pluralRuleOf("fr")(0))
+	assert.Equal(t, pluralOther, pluralRuleOf("zh-hant")(1))
+	assert.Equal(t, pluralOne, pluralRuleOf("de")(1))
+	assert.Equal(t, pluralOther, pluralRuleOf("de")(0))
+}
+
+// testDefaultLocaleYaml has every template, each is its own name with all parameters of the embedded default locale
+func testDefaultLocaleYaml() string {
+	content := "locale: en\ntemplates:\n"
+	for _, tmpl := range allMsgTemplates {
+		text := string(tmpl)
+		if tmpl == cancelCommentTemplate {
+			text = "cancel"
+		}
+		for param := range msgCatalog().locales[defaultLocale].Templates[tmpl].params() {
+			text += " {" + param + "}"
+		}
+		content += "  " + string(tmpl) + ": \"" + text + "\"\n"
+	}
+	return content
+}
+
+func Test_UnitTest_MsgCatalog_Bundle(t *testing.T) {
+	zhYaml := `locale: zh
+templates:
+  order_picked:
+    text: "🎸订单：{order}！"
+    entities:
+      - {type: bold, offset: 2, length: 10}
+  draft_reminder:
+    text:
+      one: "剩 {count} 小时"
+      other: "剩 {count} 小时，{/finish}"
+    entities:
+      other: [{type: text_link, offset: 0, length: 1, url: "https://example.com"}]
+  request_phone:
+    text: "{{手机}}"
+    entities:
+      - {type: spoiler, offset: 0, length: 6}
+    reply_markup:
+      inline_keyboard:
+        - - {text: 官网, url: "https://example.com"}
+  rate:
+    text: "/rate 评分"
+    entities:
+      - {type: bot_command, offset: 0, length: 5}
+`
+	jaJson := `{"locale": "ja", "templates": {"rate": {"text": "評価", "entities": [{"type": "italic", "offset": 0, "length": 2}],
+"reply_markup": {"keyboard": [[{"text": "位置", "request_location": true}]], "resize_keyboard": true}}}}`
+	catalog, err := loadTemplateCatalog(fstest.MapFS{
+		"en.yaml": {Data: []byte(testDefaultLocaleYaml())},
+		"zh.yaml": {Data: []byte(zhYaml)},
+		"ja.json": {Data: []byte(jaJson)},
+	}, reviewSessionMachine.commands())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the entity covers the parameter after interpolation, offsets of the result are in UTF-16
+	text, entities := catalog.render("zh", orderPickedTemplate, arg("order", "鼓 🥁")).build()
+	assert.Equal(t, "🎸订单：鼓 🥁！", text)
+	assert.Equal(t, []textEntity{{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeBold, Offset: 2, Length: 7}}}, entities)
+
+	// chinese has no plural forms but other
+	text, entities = catalog.render("zh", draftReminderTemplate, countArg(1)).build()
+	assert.Equal(t, "剩 1 小时，/finish", text)
+	assert.Equal(t, []textEntity{
+		{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeTextLink, Offset: 0, Length: 1, URL: "https://example.com"}},
+		{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeBotCommand, Offset: 7, Length: 7}},
+	}, entities)
+
+	text, entities = catalog.render("zh", requestPhoneTemplate).build()
+	assert.Equal(t, "{手机}", text)
+	assert.Equal(t, []textEntity{{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeSpoiler, Offset: 0, Length: 4}}}, entities)
+
+	def, _ := catalog.lookup("zh", requestPhoneTemplate)
+	assert.Equal(t, tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL("官网", "https://example.com")),
+	), def.markup.build())
+
+	def, tag := catalog.lookup("ja", rateTemplate)
+	assert.Equal(t, "ja", tag)
+	assert.Equal(t, tgbotapi.ReplyKeyboardMarkup{
+		Keyboard:       [][]tgbotapi.KeyboardButton{{tgbotapi.NewKeyboardButtonLocation("位置")}},
+		ResizeKeyboard: true,
+	}, def.markup.build())
+}
+
+func Test_UnitTest_MsgCatalog_InvalidBundle(t *testing.T) {
+	testCases := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{"entity exceeds text", "{text: 评价, entities: [{type: bold, offset: 1, length: 2}]}",
+			"bold entity at 1 of length 2 exceeds text length 2"},
+		{"empty entity", "{text: 评价, entities: [{type: bold, offset: 1, length: 0}]}",
+			"bold entity at 1 of length 0 is empty or negative"},
+		{"overlapped entities", "{text: 评价好, entities: [{type: bold, offset: 1, length: 2}, {type: italic, offset: 0, length: 2}]}",
+			"bold entity at 1 overlaps italic entity at 0"},
+		{"entity cuts placeholder", "{text: \"a {review_id}\", entities: [{type: code, offset: 0, length: 4}]}",
+			"entity cuts placeholder {review_id} at 2"},
+		{"entity cuts astral character", "{text: \"🎸a\", entities: [{type: code, offset: 1, length: 2}]}",
+			"entity cuts a character at 0"},
+		{"entity covers command", "{text: \"use {/finish}\", entities: [{type: bold, offset: 0, length: 13}]}",
+			"bold entity at 0 covers command {/finish}"},
+		{"unknown bot command entity", "{text: \"/help\", entities: [{type: bot_command, offset: 0, length: 5}]}",
+			"unknown command /help"},
+		{"unknown entity type", "{text: a, entities: [{type: blink, offset: 0, length: 1}]}",
+			"unknown entity type \"blink\""},
+		{"text mention", "{text: a, entities: [{type: text_mention, offset: 0, length: 1}]}",
+			"text_mention refers to a user"},
+		{"text link without url", "{text: a, entities: [{type: text_link, offset: 0, length: 1}]}",
+			"url is required by text_link"},
+		{"custom emoji without id", "{text: a, entities: [{type: custom_emoji, offset: 0, length: 1}]}",
+			"custom_emoji_id is required by custom_emoji"},
+		{"entities not by form", "{text: {one: a, other: b}, entities: [{type: bold, offset: 0, length: 1}]}",
+			"entities should be by plural form as the text is"},
+		{"entities of unknown form", "{text: {other: b}, entities: {one: [{type: bold, offset: 0, length: 1}]}}",
+			"entities of plural form one without text"},
+		{"no markup", "{text: a, reply_markup: {resize_keyboard: true}}",
+			"reply_markup must be one of keyboard, inline_keyboard and remove_keyboard"},
+		{"two markups", "{text: a, reply_markup: {remove_keyboard: true, keyboard: [[{text: b}]]}}",
+			"reply_markup must be one of keyboard, inline_keyboard and remove_keyboard"},
+		{"empty row", "{text: a, reply_markup: {keyboard: [[]]}}", "reply_markup has an empty row"},
+		{"button without text", "{text: a, reply_markup: {keyboard: [[{request_contact: true}]]}}",
+			"reply_markup has a button without text"},
+		{"inline button without url", "{text: a, reply_markup: {inline_keyboard: [[{text: b}]]}}",
+			"button b of inline_keyboard must have url only"},
+		{"keyboard button with url", "{text: a, reply_markup: {keyboard: [[{text: b, url: \"https://example.com\"}]]}}",
+			"button b of keyboard can't have url"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadTemplateCatalog(fstest.MapFS{
+				"en.yaml": {Data: []byte(testDefaultLocaleYaml())},
+				"zh.yaml": {Data: []byte("locale: zh\ntemplates:\n  help: " + tc.template)},
+			}, reviewSessionMachine.commands())
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tc.wantErr)
+			}
+		})
+	}
+}
+
+func Test_UnitTest_LoadTemplates(t *testing.T) {
+	embedded := msgCatalog()
+	t.Cleanup(func() {
+		currentCatalog.Store(embedded)
+	})
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "en.yaml"), []byte(testDefaultLocaleYaml()), 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, CheckTemplates(dir))
+	assert.Same(t, embedded, msgCatalog())
+
+	assert.Nil(t, LoadTemplates(dir))
+	text, _ := cancelCommentTemplate.render("zh").build()
+	assert.Equal(t, "cancel", text)
+
+	// an invalid bundle keeps the templates in use
+	err = os.WriteFile(filepath.Join(dir, "zh.yaml"), []byte("locale: zh\ntemplates:\n  help: \"{\""), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, CheckTemplates(dir))
+	assert.NotNil(t, LoadTemplates(dir))
+	text, _ = cancelCommentTemplate.render("zh").build()
+	assert.Equal(t, "cancel", text)
+}
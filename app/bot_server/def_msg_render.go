@@ -0,0 +1,242 @@
+package bot_server
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxMessageLength is the most telegram takes in a message, in UTF-16 code units of the text after entities parsing
+const maxMessageLength = 4096
+
+// sendables are messages to send one by one in order, such as a long text split into chunks
+type sendables []tgbotapi.Chattable
+
+// withReplyMarkup puts the markup on the last message, which is the one read when the buttons are needed
+func (s sendables) withReplyMarkup(markup interface{}) sendables {
+	if len(s) == 0 || markup == nil {
+		return s
+	}
+	if msg, ok := s[len(s)-1].(tgbotapi.MessageConfig); ok {
+		msg.ReplyMarkup = markup
+		s[len(s)-1] = msg
+	}
+	return s
+}
+
+// buildMsgs builds the text into messages within maxMessageLength, entities by offset as buildMsg does
+func (ct complexText) buildMsgs(chatId int64) sendables {
+	var msgs sendables
+	for _, chunk := range ct.split(maxMessageLength) {
+		msg := chunk.buildMsg(chatId)
+		if len(strings.TrimSpace(msg.Text)) == 0 {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// buildFormattedMsgs builds the text into messages within maxMessageLength in parse mode tgbotapi.ModeMarkdownV2 or
+// tgbotapi.ModeHTML. Text is escaped, so parameters given by users can't break or inject formatting.
+func (ct complexText) buildFormattedMsgs(chatId int64, parseMode string) sendables {
+	var msgs sendables
+	for _, chunk := range ct.split(maxMessageLength) {
+		text, _ := chunk.build()
+		if len(strings.TrimSpace(text)) == 0 {
+			continue
+		}
+		msg := tgbotapi.NewMessage(chatId, chunk.format(parseMode))
+		msg.ParseMode = parseMode
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// split cuts the text into chunks of at most limit UTF-16 code units. A chunk ends at a component boundary if the
+// next component doesn't fit in, a component longer than a chunk is cut at a line break, then a space, then anywhere
+// between characters, and every piece keeps the entity of the component, so entities stay valid in every chunk.
+func (ct complexText) split(limit int) []complexText {
+	var (
+		chunks []complexText
+		chunk  complexText
+		length int
+	)
+	flush := func() {
+		if len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+		}
+		chunk, length = nil, 0
+	}
+
+	for _, component := range ct {
+		text := component.Text()
+		n := utf16Len(text)
+		if length+n <= limit {
+			chunk = append(chunk, component)
+			length += n
+			continue
+		}
+
+		flush()
+		for n > limit {
+			var head string
+			head, text = cutText(text, limit)
+			chunks = append(chunks, complexText{component.withText(head)})
+			n = utf16Len(text)
+		}
+		if n > 0 {
+			chunk = append(chunk, component.withText(text))
+			length = n
+		}
+	}
+	flush()
+	return chunks
+}
+
+// cutText cuts off a head of at most limit UTF-16 code units from text, at the last line break or else the last
+// space in it, which is dropped. The head takes a character at least, so that cutting always makes progress.
+func cutText(text string, limit int) (string, string) {
+	var (
+		length    int
+		end       int // end is the byte offset where the head reaches limit
+		lastBreak = -1
+		lastSpace = -1
+	)
+	for i, r := range text {
+		size := 1
+		if r >= 0x10000 {
+			size = 2
+		}
+		if length+size > limit && i > 0 {
+			break
+		}
+		if r == '\n' && i > 0 {
+			lastBreak = i
+		} else if r == ' ' && i > 0 {
+			lastSpace = i
+		}
+		length += size
+		end = i + utf8.RuneLen(r)
+	}
+
+	switch {
+	case lastBreak > 0:
+		return text[:lastBreak], text[lastBreak+1:]
+	case lastSpace > 0:
+		return text[:lastSpace], text[lastSpace+1:]
+	default:
+		return text[:end], text[end:]
+	}
+}
+
+// format renders the text in parse mode tgbotapi.ModeMarkdownV2 or tgbotapi.ModeHTML, entities become markup
+func (ct complexText) format(parseMode string) string {
+	builder := strings.Builder{}
+	for _, component := range ct {
+		entityText, ok := component.(*textComponentEntity)
+		if !ok {
+			builder.WriteString(escapeText(parseMode, component.Text()))
+			continue
+		}
+		if parseMode == tgbotapi.ModeHTML {
+			builder.WriteString(entityText.html())
+		} else {
+			builder.WriteString(entityText.markdownV2())
+		}
+	}
+	return builder.String()
+}
+
+func (entityText *textComponentEntity) markdownV2() string {
+	text := escapeMarkdownV2(entityText.text)
+	switch entityText.entityType {
+	case entityTypeBold:
+		return "*" + text + "*"
+	case entityTypeItalic:
+		// \r is ignored by telegram, it keeps the closing _ from reading as __ of underline with an adjacent italic
+		return "_" + text + "_\r"
+	case entityTypeCode:
+		return "`" + escapeMarkdownV2Code(entityText.text) + "`"
+	case entityTypePre:
+		return "```" + entityText.language + "\n" + escapeMarkdownV2Code(entityText.text) + "\n```"
+	case entityTypeTextLink:
+		return "[" + text + "](" + escapeMarkdownV2Link(entityText.url) + ")"
+	case entityTypeTextMention:
+		return "[" + text + "](tg://user?id=" + strconv.FormatInt(entityText.user.ID, 10) + ")"
+	case entityTypeSpoiler:
+		return "||" + text + "||"
+	case entityTypeCustomEmoji:
+		return "![" + text + "](tg://emoji?id=" + escapeMarkdownV2Link(entityText.customEmojiId) + ")"
+	default:
+		// bot commands are recognized by telegram in any parse mode
+		return text
+	}
+}
+
+func (entityText *textComponentEntity) html() string {
+	text := escapeHTML(entityText.text)
+	switch entityText.entityType {
+	case entityTypeBold:
+		return "<b>" + text + "</b>"
+	case entityTypeItalic:
+		return "<i>" + text + "</i>"
+	case entityTypeCode:
+		return "<code>" + text + "</code>"
+	case entityTypePre:
+		if len(entityText.language) == 0 {
+			return "<pre>" + text + "</pre>"
+		}
+		return `<pre><code class="language-` + escapeHTML(entityText.language) + `">` + text + "</code></pre>"
+	case entityTypeTextLink:
+		return `<a href="` + escapeHTML(entityText.url) + `">` + text + "</a>"
+	case entityTypeTextMention:
+		return `<a href="tg://user?id=` + strconv.FormatInt(entityText.user.ID, 10) + `">` + text + "</a>"
+	case entityTypeSpoiler:
+		return "<tg-spoiler>" + text + "</tg-spoiler>"
+	case entityTypeCustomEmoji:
+		return `<tg-emoji emoji-id="` + escapeHTML(entityText.customEmojiId) + `">` + text + "</tg-emoji>"
+	default:
+		return text
+	}
+}
+
+// escapeText escapes text given by users to be sent in parse mode tgbotapi.ModeMarkdownV2 or tgbotapi.ModeHTML
+func escapeText(parseMode string, text string) string {
+	if parseMode == tgbotapi.ModeHTML {
+		return escapeHTML(text)
+	}
+	return escapeMarkdownV2(text)
+}
+
+var (
+	// markdownV2Replacer escapes every character reserved by MarkdownV2, tgbotapi.EscapeText misses the backslash
+	markdownV2Replacer = strings.NewReplacer(
+		`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "`", "\\`",
+		">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+	)
+	// markdownV2CodeReplacer escapes text inside code and pre, where only ` and \ are reserved
+	markdownV2CodeReplacer = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+	// markdownV2LinkReplacer escapes the url of an inline link, where only ) and \ are reserved
+	markdownV2LinkReplacer = strings.NewReplacer(`\`, `\\`, ")", `\)`)
+	// htmlReplacer escapes text and attribute values, quotes included
+	htmlReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func escapeMarkdownV2(text string) string {
+	return markdownV2Replacer.Replace(text)
+}
+
+func escapeMarkdownV2Code(text string) string {
+	return markdownV2CodeReplacer.Replace(text)
+}
+
+func escapeMarkdownV2Link(url string) string {
+	return markdownV2LinkReplacer.Replace(url)
+}
+
+func escapeHTML(text string) string {
+	return htmlReplacer.Replace(text)
+}
@@ -0,0 +1,115 @@
+package bot_server
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_Msg_Split(t *testing.T) {
+	testCases := []struct {
+		name   string
+		text   complexText
+		limit  int
+		chunks []string
+	}{
+		{"fits", complexText{newPlainText("hello "), newEntityText("world", entityTypeBold)}, 11,
+			[]string{"hello world"}},
+		{"at component boundary", complexText{newPlainText("hello "), newEntityText("world", entityTypeBold)}, 8,
+			[]string{"hello ", "world"}},
+		{"at line break", complexText{newPlainText("a b\nc d\ne")}, 6, []string{"a b", "c d\ne"}},
+		{"at space", complexText{newPlainText("ab cd ef")}, 6, []string{"ab cd", "ef"}},
+		{"anywhere", complexText{newPlainText("abcdefg")}, 3, []string{"abc", "def", "g"}},
+		{"between surrogates", complexText{newPlainText("a🎸🎸")}, 2, []string{"a", "🎸", "🎸"}},
+		{"wide character at limit", complexText{newPlainText("🎸")}, 1, []string{"🎸"}},
+		{"rest joins next component", complexText{newPlainText("abcd"), newPlainText("e")}, 3,
+			[]string{"abc", "de"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var chunks []string
+			for _, chunk := range tc.text.split(tc.limit) {
+				text, _ := chunk.build()
+				chunks = append(chunks, text)
+			}
+			assert.Equal(t, tc.chunks, chunks)
+		})
+	}
+}
+
+func Test_UnitTest_Msg_BuildMsgs(t *testing.T) {
+	long := strings.Repeat("🎸", maxMessageLength/2-2)
+	markup := tgbotapi.NewRemoveKeyboard(true)
+
+	t.Run("short", func(t *testing.T) {
+		text := complexText{newPlainText("send "), newEntityText("/hello", entityTypeBotCommand)}
+		msg := text.buildMsg(testChatId)
+		msg.ReplyMarkup = markup
+		assert.Equal(t, sendables{msg}, text.buildMsgs(testChatId).withReplyMarkup(markup))
+	})
+
+	t.Run("entity across chunks", func(t *testing.T) {
+		bold := strings.Repeat("b", maxMessageLength+5)
+		text := complexText{newPlainText("see "), newEntityText(bold, entityTypeBold), newPlainText("!")}
+		msgs := text.buildMsgs(testChatId).withReplyMarkup(markup)
+		if !assert.Len(t, msgs, 3) {
+			return
+		}
+
+		first := msgs[0].(tgbotapi.MessageConfig)
+		assert.Equal(t, "see ", first.Text)
+		assert.Nil(t, first.Entities)
+
+		second := msgs[1].(tgbotapi.MessageConfig)
+		assert.Equal(t, bold[:maxMessageLength], second.Text)
+		assert.Equal(t, []tgbotapi.MessageEntity{{Type: entityTypeBold, Offset: 0, Length: maxMessageLength}}, second.Entities)
+		assert.Nil(t, second.ReplyMarkup)
+
+		third := msgs[2].(tgbotapi.MessageConfig)
+		assert.Equal(t, "bbbbb!", third.Text)
+		assert.Equal(t, []tgbotapi.MessageEntity{{Type: entityTypeBold, Offset: 0, Length: 5}}, third.Entities)
+		assert.Equal(t, markup, third.ReplyMarkup)
+	})
+
+	t.Run("blank chunk", func(t *testing.T) {
+		text := complexText{newPlainText(long), newPlainText("\n\n\n\n\n")}
+		msgs := text.buildMsgs(testChatId)
+		assert.Len(t, msgs, 1)
+	})
+}
+
+func Test_UnitTest_Msg_Format(t *testing.T) {
+	user := &tgbotapi.User{ID: testUserId, FirstName: "Rock"}
+	text := complexText{
+		newPlainText("1+1=2. <a> & \\ "),
+		newEntityText("*b*", entityTypeBold),
+		newEntityText("i_i", entityTypeItalic),
+		newEntityText("`c`", entityTypeCode),
+		newPreText("x <- y\\", "go"),
+		newTextLink("[l]", "https://example.com/(a)?b=\"c\""),
+		newTextMention("Rock", user),
+		newEntityText("s|s", entityTypeSpoiler),
+		newCustomEmoji("🎸", "42"),
+		newPlainText(" "),
+		newEntityText("/help", entityTypeBotCommand),
+	}
+
+	assert.Equal(t, "1\\+1\\=2\\. <a\\> & \\\\ *\\*b\\**_i\\_i_\r`\\`c\\``"+
+		"```go\nx <- y\\\\\n```[\\[l\\]](https://example.com/(a\\)?b=\"c\")[Rock](tg://user?id=3678)||s\\|s||"+
+		"![🎸](tg://emoji?id=42) /help", text.format(tgbotapi.ModeMarkdownV2))
+	assert.Equal(t, "1+1=2. &lt;a&gt; &amp; \\ <b>*b*</b><i>i_i</i><code>`c`</code>"+
+		"<pre><code class=\"language-go\">x &lt;- y\\</code></pre><a href=\"https://example.com/(a)?b=&quot;c&quot;\">[l]</a>"+
+		"<a href=\"tg://user?id=3678\">Rock</a><tg-spoiler>s|s</tg-spoiler><tg-emoji emoji-id=\"42\">🎸</tg-emoji> /help",
+		text.format(tgbotapi.ModeHTML))
+
+	msgs := text.buildFormattedMsgs(testChatId, tgbotapi.ModeHTML)
+	if assert.Len(t, msgs, 1) {
+		msg := msgs[0].(tgbotapi.MessageConfig)
+		assert.Equal(t, tgbotapi.ModeHTML, msg.ParseMode)
+		assert.Equal(t, text.format(tgbotapi.ModeHTML), msg.Text)
+		assert.Nil(t, msg.Entities)
+	}
+}
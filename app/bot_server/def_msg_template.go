@@ -1,6 +1,7 @@
 package bot_server
 
 import (
+	"strconv"
 	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -9,36 +10,103 @@ import (
 type entityType = string
 
 const (
-	entityTypeBotCommand entityType = "bot_command"
+	entityTypeBotCommand  entityType = "bot_command"
+	entityTypeBold        entityType = "bold"
+	entityTypeItalic      entityType = "italic"
+	entityTypeCode        entityType = "code"
+	entityTypePre         entityType = "pre"
+	entityTypeTextLink    entityType = "text_link"
+	entityTypeTextMention entityType = "text_mention"
+	entityTypeSpoiler     entityType = "spoiler"
+	entityTypeCustomEmoji entityType = "custom_emoji"
 )
 
+// textEntity is a message entity in UTF-16 code units as telegram counts, it's tgbotapi.MessageEntity plus fields
+// the vendored tgbotapi doesn't know yet
+type textEntity struct {
+	tgbotapi.MessageEntity
+	CustomEmojiId string `json:"custom_emoji_id,omitempty"`
+}
+
 type complexText []iTextComponent
 
-func (ct complexText) buildMsg(chatId int64) tgbotapi.MessageConfig {
+// build joins the components, offsets and lengths of entities are in UTF-16 code units rather than bytes, so that
+// text with CJK characters or emoji before an entity is highlighted right
+func (ct complexText) build() (string, []textEntity) {
 	var (
 		builder  = strings.Builder{}
-		entities []tgbotapi.MessageEntity
+		offset   int
+		entities []textEntity
 	)
 
 	for _, component := range ct {
-		offset := builder.Len()
-		builder.WriteString(component.Text())
+		text := component.Text()
+		builder.WriteString(text)
+		length := utf16Len(text)
 		if entityText, ok := component.(*textComponentEntity); ok {
-			entities = append(entities, tgbotapi.MessageEntity{
-				Type:   entityText.entityType,
-				Offset: offset,
-				Length: len(entityText.Text()),
-			})
+			entities = append(entities, entityText.entity(offset, length))
 		}
+		offset += length
 	}
+	return builder.String(), entities
+}
 
-	msg := tgbotapi.NewMessage(chatId, builder.String())
-	msg.Entities = entities
+// buildMsg builds the text with entities, or in parse mode tgbotapi.ModeHTML if it has custom emoji, as tgbotapi
+// v5.5.1 can't send custom_emoji_id of entities, while <tg-emoji> of HTML carries it
+func (ct complexText) buildMsg(chatId int64) tgbotapi.MessageConfig {
+	text, entities := ct.build()
+	for _, entity := range entities {
+		if entity.Type == entityTypeCustomEmoji {
+			msg := tgbotapi.NewMessage(chatId, ct.format(tgbotapi.ModeHTML))
+			msg.ParseMode = tgbotapi.ModeHTML
+			return msg
+		}
+	}
+	msg := tgbotapi.NewMessage(chatId, text)
+	msg.Entities = messageEntities(entities)
 	return msg
 }
 
+func (ct complexText) buildEditMsg(chatId int64, messageId int) tgbotapi.EditMessageTextConfig {
+	msg := ct.buildMsg(chatId)
+	editMsg := tgbotapi.NewEditMessageText(chatId, messageId, msg.Text)
+	editMsg.Entities = msg.Entities
+	editMsg.ParseMode = msg.ParseMode
+	return editMsg
+}
+
+// with returns a new complexText followed by components, the template itself is left untouched
+func (ct complexText) with(components ...iTextComponent) complexText {
+	newCt := make(complexText, 0, len(ct)+len(components))
+	newCt = append(newCt, ct...)
+	return append(newCt, components...)
+}
+
+// messageEntities converts entities for tgbotapi, custom emoji are not among them as buildMsg sends them in HTML
+func messageEntities(entities []textEntity) []tgbotapi.MessageEntity {
+	var messageEntities []tgbotapi.MessageEntity
+	for _, entity := range entities {
+		messageEntities = append(messageEntities, entity.MessageEntity)
+	}
+	return messageEntities
+}
+
+// utf16Len tells the length of s in UTF-16 code units, runes out of the basic multilingual plane take 2
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n++
+		if r >= 0x10000 {
+			n++
+		}
+	}
+	return n
+}
+
 type iTextComponent interface {
 	Text() string
+	// withText copies the component with a part of the text, which split uses to cut a long component
+	withText(text string) iTextComponent
 }
 
 type textComponentPlainText struct {
@@ -53,6 +121,11 @@ func (plainText *textComponentPlainText) Text() string {
 	return plainText.text
 }
 
+func (plainText *textComponentPlainText) withText(text string) iTextComponent {
+	return &textComponentPlainText{text: text}
+}
+
+// newEntityText makes text of an entity without extra fields, such as bot_command, bold, italic, code and spoiler
 func newEntityText(text string, entityType string) iTextComponent {
 	return &textComponentEntity{
 		text:       text,
@@ -60,41 +133,197 @@ func newEntityText(text string, entityType string) iTextComponent {
 	}
 }
 
+func newPreText(text string, language string) iTextComponent {
+	return &textComponentEntity{text: text, entityType: entityTypePre, language: language}
+}
+
+func newTextLink(text string, url string) iTextComponent {
+	return &textComponentEntity{text: text, entityType: entityTypeTextLink, url: url}
+}
+
+// newTextMention mentions a user without username
+func newTextMention(text string, user *tgbotapi.User) iTextComponent {
+	return &textComponentEntity{text: text, entityType: entityTypeTextMention, user: user}
+}
+
+// newCustomEmoji shows the custom emoji, or emoji as the fallback
+func newCustomEmoji(emoji string, customEmojiId string) iTextComponent {
+	return &textComponentEntity{text: emoji, entityType: entityTypeCustomEmoji, customEmojiId: customEmojiId}
+}
+
 type textComponentEntity struct {
-	text       string
-	entityType string
+	text          string
+	entityType    string
+	url           string         // url is for text_link only
+	user          *tgbotapi.User // user is for text_mention only
+	language      string         // language is for pre only, optional
+	customEmojiId string         // customEmojiId is for custom_emoji only
 }
 
 func (entityText *textComponentEntity) Text() string {
 	return entityText.text
 }
 
-var (
-	helpMsgTemplate = complexText{newPlainText("Pleased to serve you.\n\n"),
-		newEntityText("/comment", entityTypeBotCommand), newPlainText(" - start to comment\n"),
-		//newEntityText("/comment_transaction", entityTypeBotCommand), newPlainText(" - comment on specific transaction\n"),
-		newEntityText("/finish", entityTypeBotCommand), newPlainText(" - finish a comment"),
+func (entityText *textComponentEntity) withText(text string) iTextComponent {
+	c := *entityText
+	c.text = text
+	return &c
+}
+
+func (entityText *textComponentEntity) entity(offset int, length int) textEntity {
+	return textEntity{
+		MessageEntity: tgbotapi.MessageEntity{
+			Type:     entityText.entityType,
+			Offset:   offset,
+			Length:   length,
+			URL:      entityText.url,
+			User:     entityText.user,
+			Language: entityText.language,
+		},
+		CustomEmojiId: entityText.customEmojiId,
 	}
+}
 
-	helpMsgRequestPhoneTemplate = append(helpMsgTemplate, newPlainText("\n\nTo help us serve you better, you may provide you phone number to bind your RockShop account with telegram account."))
+const (
+	helpMsgTemplate                msgTemplate = "help"
+	requestPhoneTemplate           msgTemplate = "request_phone" // requestPhoneTemplate has a keyboard to share contact
+	phoneBindSuccessTemplate       msgTemplate = "phone_bind_success"
+	phoneBindUseOwnContactTemplate msgTemplate = "phone_bind_use_own_contact"
 
-	requestPhoneMarkup = tgbotapi.ReplyKeyboardMarkup{
-		Keyboard: [][]tgbotapi.KeyboardButton{
-			{tgbotapi.NewKeyboardButtonContact("Provide phone number for better service")},
-		},
-		ResizeKeyboard:  true,
-		OneTimeKeyboard: true,
+	unknownCommandTemplate msgTemplate = "unknown_command"
+
+	startCommentTemplate       msgTemplate = "start_comment"
+	resumeCommentTemplate      msgTemplate = "resume_comment"
+	sendValidCommentTemplate   msgTemplate = "send_valid_comment"
+	finishCommentTemplate      msgTemplate = "finish_comment" // finishCommentTemplate takes review_id
+	finishEmptyCommentTemplate msgTemplate = "finish_empty_comment"
+	cancelCommentTemplate      msgTemplate = "cancel_comment"
+
+	draftReminderTemplate msgTemplate = "draft_reminder" // draftReminderTemplate takes count of hours left
+	draftExpiredTemplate  msgTemplate = "draft_expired"
+
+	orderRequirePhoneTemplate msgTemplate = "order_require_phone"
+	noRecentOrderTemplate     msgTemplate = "no_recent_order"
+	pickOrderTemplate         msgTemplate = "pick_order"
+	orderNotFoundTemplate     msgTemplate = "order_not_found"
+	orderPickedTemplate       msgTemplate = "order_picked" // orderPickedTemplate takes order
+
+	rateTemplate             msgTemplate = "rate"
+	ratedTemplate            msgTemplate = "rated" // ratedTemplate takes stars
+	ratingSkipButtonTemplate msgTemplate = "rating_skip_button"
+	ratingSkippedTemplate    msgTemplate = "rating_skipped"
+	rateFinalizedTemplate    msgTemplate = "rate_finalized"
+
+	pickLanguageTemplate    msgTemplate = "pick_language"
+	languagePickedTemplate  msgTemplate = "language_picked"
+	languageUnknownTemplate msgTemplate = "language_unknown" // languageUnknownTemplate takes language
+
+	callbackExpiredTemplate msgTemplate = "callback_expired"
+
+	adminReviewTemplate         msgTemplate = "admin_review" // adminReviewTemplate takes review_id, customer, phone, order, stars and text
+	adminNoneTemplate           msgTemplate = "admin_none"   // adminNoneTemplate stands for a field of the review not given
+	adminAckButtonTemplate      msgTemplate = "admin_ack_button"
+	adminEscalateButtonTemplate msgTemplate = "admin_escalate_button"
+	adminReplyButtonTemplate    msgTemplate = "admin_reply_button"
+	adminAckedTemplate          msgTemplate = "admin_acked"         // adminAckedTemplate takes admin
+	adminEscalatedTemplate      msgTemplate = "admin_escalated"     // adminEscalatedTemplate takes admin
+	adminReplyPromptTemplate    msgTemplate = "admin_reply_prompt"  // adminReplyPromptTemplate takes review_id
+	adminReplySentTemplate      msgTemplate = "admin_reply_sent"    // adminReplySentTemplate takes review_id
+	adminReplyFailedTemplate    msgTemplate = "admin_reply_failed"  // adminReplyFailedTemplate takes review_id
+	adminReplyBlockedTemplate   msgTemplate = "admin_reply_blocked" // adminReplyBlockedTemplate takes review_id
+	adminReplyTextOnlyTemplate  msgTemplate = "admin_reply_text_only"
+	adminOnlyTemplate           msgTemplate = "admin_only"
+	adminReplyTemplate          msgTemplate = "admin_reply" // adminReplyTemplate is sent to the customer, takes review_id and text
+
+	errRetryTemplate msgTemplate = "err_retry"
+)
+
+// allMsgTemplates must all be in the default locale
+var allMsgTemplates = []msgTemplate{
+	helpMsgTemplate, requestPhoneTemplate, phoneBindSuccessTemplate,
+	phoneBindUseOwnContactTemplate,
+	unknownCommandTemplate,
+	startCommentTemplate, resumeCommentTemplate, sendValidCommentTemplate, finishCommentTemplate,
+	finishEmptyCommentTemplate, cancelCommentTemplate,
+	draftReminderTemplate, draftExpiredTemplate,
+	orderRequirePhoneTemplate, noRecentOrderTemplate, pickOrderTemplate, orderNotFoundTemplate, orderPickedTemplate,
+	rateTemplate, ratedTemplate, ratingSkipButtonTemplate, ratingSkippedTemplate, rateFinalizedTemplate,
+	pickLanguageTemplate, languagePickedTemplate, languageUnknownTemplate,
+	callbackExpiredTemplate,
+	adminReviewTemplate, adminNoneTemplate, adminAckButtonTemplate, adminEscalateButtonTemplate,
+	adminReplyButtonTemplate, adminAckedTemplate, adminEscalatedTemplate, adminReplyPromptTemplate,
+	adminReplySentTemplate, adminReplyFailedTemplate, adminReplyBlockedTemplate, adminReplyTextOnlyTemplate,
+	adminOnlyTemplate, adminReplyTemplate,
+	errRetryTemplate,
+}
+
+func newRatingMarkup(locale string, reviewId string) tgbotapi.InlineKeyboardMarkup {
+	var (
+		stars []tgbotapi.InlineKeyboardButton
+	)
+	for rating := 1; rating <= maxRating; rating++ {
+		stars = append(stars, tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(rating)+"★",
+			newCallbackPayload(callbackActionRate, reviewId+callbackDataSeparator+strconv.Itoa(rating)).encode()))
 	}
-	phoneBindSuccessTemplate       = complexText{newPlainText("Success! This telegram account is linked to your RockShop account.")}
-	phoneBindUseOwnContactTemplate = complexText{newPlainText("Provide your contact to update your phone_number, not other's")}
+	skipLabel, _ := ratingSkipButtonTemplate.render(locale).build()
+	skip := tgbotapi.NewInlineKeyboardButtonData(skipLabel,
+		newCallbackPayload(callbackActionRate, reviewId+callbackDataSeparator+"0").encode())
+	return tgbotapi.NewInlineKeyboardMarkup(stars, tgbotapi.NewInlineKeyboardRow(skip))
+}
+
+func ratingStars(rating int) string {
+	return strings.Repeat("★", rating) + strings.Repeat("☆", maxRating-rating)
+}
+
+func newPickOrderMarkup(orders []RockShopOrder) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, order := range orders {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(order.Title+" · "+order.Amount,
+				newCallbackPayload(callbackActionPickOrder, orderCallbackArg(order.OrderId)).encode()),
+		))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
 
-	unknownCommandTemplate = complexText{newPlainText("Unrecognized command. Say what?")}
+// newLanguageMarkup lists supported languages, the current one is checked
+func newLanguageMarkup(current string) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, l := range msgCatalog().sortedLocales() {
+		label := l.Name
+		if l.Locale == current {
+			label = "✓ " + label
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, newCallbackPayload(callbackActionLanguage, l.Locale).encode()),
+		))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
 
-	startCommentTemplate  = complexText{newPlainText("Please send your comment, you can send text, image, video, audio or voice.")}
-	resumeCommentTemplate = complexText{newPlainText("Your comment has been accepted, you can continue to add more, or use "),
-		newEntityText("/finish", entityTypeBotCommand), newPlainText(" to finish your comment")}
-	sendValidCommentTemplate = complexText{newPlainText("Please send text, image, video, audio or voice")}
-	finishCommentTemplate    = complexText{newPlainText("Thanks for your reply, happy to serve you.")}
+type adminReviewStatus int
 
-	errRetryTemplate = complexText{newPlainText("Unknown error occurred, please retry later")}
+const (
+	adminReviewNew adminReviewStatus = iota
+	adminReviewEscalated
+	adminReviewAcked
 )
+
+// newAdminReviewMarkup has buttons of what admins can do to a review in status, a review acknowledged can still be
+// replied
+func newAdminReviewMarkup(locale string, reviewId string, status adminReviewStatus) tgbotapi.InlineKeyboardMarkup {
+	button := func(t msgTemplate, action callbackAction) tgbotapi.InlineKeyboardButton {
+		label, _ := t.render(locale).build()
+		return tgbotapi.NewInlineKeyboardButtonData(label, newCallbackPayload(action, reviewId).encode())
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	if status != adminReviewAcked {
+		row = append(row, button(adminAckButtonTemplate, callbackActionAdminAck))
+	}
+	if status == adminReviewNew {
+		row = append(row, button(adminEscalateButtonTemplate, callbackActionAdminEscalate))
+	}
+	row = append(row, button(adminReplyButtonTemplate, callbackActionAdminReply))
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
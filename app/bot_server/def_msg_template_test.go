@@ -3,6 +3,7 @@ package bot_server
 import (
 	"rock_review/util/goutil"
 	"testing"
+	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/stretchr/testify/assert"
@@ -72,3 +73,89 @@ func Test_UnitTest_Msg_Template(t *testing.T) {
 		assert.Equal(t, goutil.JsonString(results[i].Entities), goutil.JsonString(msg.Entities))
 	}
 }
+
+func Test_UnitTest_Msg_Template_UTF16(t *testing.T) {
+	user := &tgbotapi.User{ID: testUserId, FirstName: "Rock"}
+	testCases := []struct {
+		name         string
+		template     complexText
+		wantText     string
+		wantEntities []textEntity
+		wantHTML     string // wantHTML is the text sent in HTML, as custom emoji can't be sent by entities
+	}{
+		{
+			name:     "cjk before command",
+			template: complexText{newPlainText("发送 "), newEntityText("/comment", entityTypeBotCommand), newPlainText(" 开始评价")},
+			wantText: "发送 /comment 开始评价",
+			wantEntities: []textEntity{
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeBotCommand, Offset: 3, Length: 8}},
+			},
+		},
+		{
+			name:     "astral emoji before and inside entities",
+			template: complexText{newPlainText("🎸 "), newEntityText("rock 🤘", entityTypeBold), newEntityText("é", entityTypeItalic)},
+			wantText: "🎸 rock 🤘é",
+			wantEntities: []textEntity{
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeBold, Offset: 3, Length: 7}},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeItalic, Offset: 10, Length: 1}},
+			},
+		},
+		{
+			name: "entities with fields",
+			template: complexText{newTextLink("链接", "https://example.com"), newPlainText("\n"),
+				newTextMention("Rock", user), newPlainText("\n"),
+				newPreText("fmt.Println(\"👋\")", "go"), newEntityText("`x`", entityTypeCode),
+				newEntityText("秘密", entityTypeSpoiler)},
+			wantText: "链接\nRock\nfmt.Println(\"👋\")`x`秘密",
+			wantEntities: []textEntity{
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeTextLink, Offset: 0, Length: 2, URL: "https://example.com"}},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeTextMention, Offset: 3, Length: 4, User: user}},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypePre, Offset: 8, Length: 17, Language: "go"}},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeCode, Offset: 25, Length: 3}},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeSpoiler, Offset: 28, Length: 2}},
+			},
+		},
+		{
+			name:     "custom emoji",
+			template: complexText{newPlainText("好评 "), newCustomEmoji("⭐", "5368324170671202286"), newEntityText("/finish", entityTypeBotCommand)},
+			wantText: "好评 ⭐/finish",
+			wantEntities: []textEntity{
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeCustomEmoji, Offset: 3, Length: 1}, CustomEmojiId: "5368324170671202286"},
+				{MessageEntity: tgbotapi.MessageEntity{Type: entityTypeBotCommand, Offset: 4, Length: 7}},
+			},
+			wantHTML: `好评 <tg-emoji emoji-id="5368324170671202286">⭐</tg-emoji>/finish`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			text, entities := tc.template.build()
+			assert.Equal(t, tc.wantText, text)
+			assert.Equal(t, tc.wantEntities, entities)
+
+			msg := tc.template.buildMsg(1)
+			if len(tc.wantHTML) > 0 {
+				assert.Equal(t, tc.wantHTML, msg.Text)
+				assert.Equal(t, tgbotapi.ModeHTML, msg.ParseMode)
+				assert.Nil(t, msg.Entities)
+				editMsg := tc.template.buildEditMsg(1, testMessageId)
+				assert.Equal(t, tc.wantHTML, editMsg.Text)
+				assert.Equal(t, tgbotapi.ModeHTML, editMsg.ParseMode)
+				return
+			}
+			assert.Equal(t, tc.wantText, msg.Text)
+			assert.Empty(t, msg.ParseMode)
+			assert.Equal(t, messageEntities(tc.wantEntities), msg.Entities)
+		})
+	}
+}
+
+func Test_UnitTest_Utf16Len(t *testing.T) {
+	assert.Equal(t, 0, utf16Len(""))
+	assert.Equal(t, 5, utf16Len("hello"))
+	assert.Equal(t, 2, utf16Len("评价"))
+	assert.Equal(t, 2, utf16Len("🎸"))
+	// a flag is two regional indicators out of the basic multilingual plane
+	assert.Equal(t, 4, utf16Len("🇸🇬"))
+	assert.Equal(t, len(utf16.Encode([]rune("★☆👍🏻 ok"))), utf16Len("★☆👍🏻 ok"))
+}
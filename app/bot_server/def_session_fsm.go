@@ -0,0 +1,40 @@
+package bot_server
+
+import "time"
+
+const (
+	// commentTimeout discards a draft left alone for so long, so that a later unrelated message doesn't become a review
+	commentTimeout      = 24 * time.Hour
+	draftReminderBefore = 2 * time.Hour
+)
+
+// reviewSessionMachine is the conversation of commenting, a user is idle in init and writes a review in comment.
+// Commands, contacts and callbacks are accepted in any state, text and media are taken as the comment in comment.
+var reviewSessionMachine = newSessionMachine("review_session").
+	state(stateDef{state: sessionStateInit, name: "init", onEntry: (*UserSession).dropDraft}).
+	state(stateDef{state: sessionStateComment, name: "comment", onEntry: (*UserSession).enterComment,
+		timeout: commentTimeout, remindBefore: draftReminderBefore}).
+	on(stateAny, sessionInputCommand, "/start", stateKeep, (*UserSession).replyHelp).
+	on(stateAny, sessionInputCommand, "/comment", sessionStateComment, nil).
+	on(stateAny, sessionInputCommand, "/rate", stateKeep, (*UserSession).replyRate).
+	on(stateAny, sessionInputCommand, "/comment_transaction", stateKeep, (*UserSession).listRecentOrders).
+	on(stateAny, sessionInputCommand, "/finish", sessionStateInit, (*UserSession).finishComment).
+	on(stateAny, sessionInputCommand, "/cancel", sessionStateInit, (*UserSession).cancelComment).
+	on(stateAny, sessionInputCommand, "/language", stateKeep, (*UserSession).pickLanguage).
+	on(stateAny, sessionInputContact, "", stateKeep, (*UserSession).bindPhone).
+	on(sessionStateComment, sessionInputText, "", stateKeep, (*UserSession).appendComment).
+	on(sessionStateComment, sessionInputMedia, "", stateKeep, (*UserSession).appendComment).
+	on(stateAny, sessionInputCallback, callbackActionPickOrder, sessionStateComment, (*UserSession).pickOrder).
+	on(stateAny, sessionInputCallback, callbackActionRate, stateKeep, (*UserSession).rateDraft).
+	on(stateAny, sessionInputCallback, callbackActionLanguage, stateKeep, (*UserSession).setLanguage).
+	on(sessionStateComment, sessionInputReminder, "", stateKeep, (*UserSession).remindDraft).
+	on(sessionStateComment, sessionInputTimeout, "", sessionStateInit, (*UserSession).expireDraft).
+	otherwise(sessionInputCommand, (*UserSession).replyUnknownCommand).
+	otherwise(sessionInputText, (*UserSession).replyHelp).
+	otherwise(sessionInputMedia, (*UserSession).replyHelp).
+	otherwise(sessionInputCallback, (*UserSession).expireCallback)
+
+// SessionGraphDot renders the conversation in DOT, such as for `dot -Tsvg`
+func SessionGraphDot() string {
+	return reviewSessionMachine.dot()
+}
@@ -0,0 +1,151 @@
+package bot_server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_ReviewSessionTransitions(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		commentData = userSessionData{
+			UserId:      testUserId,
+			State:       sessionStateComment,
+			PhoneNumber: testPhoneNumber,
+			Draft:       &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			// StateExpireAt is in the reminder window
+			StateExpireAt: testNow.Add(time.Hour).Unix(),
+		}
+		expiredData = userSessionData{
+			UserId:        testUserId,
+			State:         sessionStateComment,
+			Draft:         &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			StateExpireAt: testNow.Unix(),
+		}
+		initData = userSessionData{
+			UserId:      testUserId,
+			State:       sessionStateInit,
+			PhoneNumber: testPhoneNumber,
+		}
+	)
+
+	text := func(text string) *sessionEvent {
+		return newMessageEvent(newMockMessage().SetText(text).message)
+	}
+	callback := func(data string) *sessionEvent {
+		u := newMockUpdate()
+		u.SetCallbackQuery(data)
+		payload, _ := decodeCallbackPayload(data)
+		return newCallbackEvent(u.update.CallbackQuery, payload)
+	}
+	contact := func() *sessionEvent {
+		return newMessageEvent(newMockMessage().SetContact(&tgbotapi.Contact{UserID: testUserId, PhoneNumber: testPhoneNumber}).message)
+	}
+	photo := func() *sessionEvent {
+		return newMessageEvent(newMockMessage().SetPhoto("nice", tgbotapi.PhotoSize{FileID: "p", FileUniqueID: "u_p"}).message)
+	}
+	timer := func(input sessionInput) *sessionEvent {
+		return &sessionEvent{input: input}
+	}
+	rateData := newCallbackPayload(callbackActionRate, testReviewId+callbackDataSeparator+"3").encode()
+
+	testCases := []struct {
+		name      string
+		data      userSessionData
+		event     *sessionEvent
+		wantState sessionState
+		wantDraft bool
+	}{
+		{"init: /start", initData, text("/start"), sessionStateInit, false},
+		{"init: /comment", initData, text("/comment"), sessionStateComment, true},
+		{"init: /rate", initData, text("/rate"), sessionStateInit, false},
+		{"init: /comment_transaction", initData, text("/comment_transaction"), sessionStateInit, false},
+		{"init: /finish", initData, text("/finish"), sessionStateInit, false},
+		{"init: /cancel", initData, text("/cancel"), sessionStateInit, false},
+		{"init: unknown command", initData, text("/some_cmd"), sessionStateInit, false},
+		{"init: /language", initData, text("/language"), sessionStateInit, false},
+		{"init: contact", initData, contact(), sessionStateInit, false},
+		{"init: text", initData, text("hi"), sessionStateInit, false},
+		{"init: media", initData, photo(), sessionStateInit, false},
+		{"init: pick order", initData, callback("order:o1"), sessionStateComment, true},
+		{"init: rate", initData, callback(rateData), sessionStateInit, false},
+		{"init: pick language", initData, callback("lang:zh"), sessionStateInit, false},
+		{"init: unknown callback", initData, callback("some_action:x"), sessionStateInit, false},
+		{"comment: /start", commentData, text("/start"), sessionStateComment, true},
+		{"comment: /comment", commentData, text("/comment"), sessionStateComment, true},
+		{"comment: /rate", commentData, text("/rate"), sessionStateComment, true},
+		{"comment: /comment_transaction", commentData, text("/comment_transaction"), sessionStateComment, true},
+		{"comment: /finish", commentData, text("/finish"), sessionStateInit, false},
+		{"comment: /cancel", commentData, text("/cancel"), sessionStateInit, false},
+		{"comment: unknown command", commentData, text("/some_cmd"), sessionStateComment, true},
+		{"comment: /language zh", commentData, text("/language zh"), sessionStateComment, true},
+		{"comment: contact", commentData, contact(), sessionStateComment, true},
+		{"comment: text", commentData, text("there"), sessionStateComment, true},
+		{"comment: media", commentData, photo(), sessionStateComment, true},
+		{"comment: pick order", commentData, callback("order:o2"), sessionStateComment, true},
+		{"comment: rate", commentData, callback(rateData), sessionStateComment, true},
+		{"comment: pick language", commentData, callback("lang:en"), sessionStateComment, true},
+		{"comment: unknown callback", commentData, callback("some_action:x"), sessionStateComment, true},
+		{"comment: reminder", commentData, timer(sessionInputReminder), sessionStateComment, true},
+		{"comment: timeout", commentData, timer(sessionInputTimeout), sessionStateInit, false},
+		{"init: reminder", initData, timer(sessionInputReminder), sessionStateInit, false},
+		{"init: timeout", initData, timer(sessionInputTimeout), sessionStateInit, false},
+		{"expired comment: text", expiredData, text("hi"), sessionStateInit, false},
+		{"expired comment: /comment", expiredData, text("/comment"), sessionStateComment, true},
+	}
+
+	covered := map[int]bool{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dep := mockDependency(t)
+			data := tc.data
+			if data.Draft != nil {
+				draft := *data.Draft
+				data.Draft = &draft
+			}
+			session := NewUserSession(data, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl,
+				dep.rockShopCtrl)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, gomock.Any()).AnyTimes()
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, gomock.Any()).AnyTimes()
+			dep.reviewBotSvcCtrl.EXPECT().ArchiveFile(ctx, gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, gomock.Any()).AnyTimes()
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).AnyTimes()
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(testOrders, nil).AnyTimes()
+
+			for i, transition := range reviewSessionMachine.transitions {
+				matched, ok := reviewSessionMachine.match(tc.data.State, tc.event)
+				if ok && matched.from == transition.from && matched.label() == transition.label() && matched.to == transition.to {
+					covered[i] = true
+				}
+			}
+
+			assert.Nil(t, reviewSessionMachine.fire(session, ctx, tc.event))
+			assert.Equal(t, tc.wantState, session.State)
+			assert.Equal(t, tc.wantDraft, session.Draft != nil)
+			if session.State == sessionStateInit {
+				assert.Zero(t, session.StateExpireAt)
+			} else {
+				assert.True(t, session.StateExpireAt > testNow.Unix())
+			}
+		})
+	}
+
+	for i, transition := range reviewSessionMachine.transitions {
+		assert.True(t, covered[i], "transition not tested: %s", transition.label())
+	}
+}
+
+func Test_UnitTest_SessionGraphDot(t *testing.T) {
+	dot := SessionGraphDot()
+	assert.True(t, strings.HasPrefix(dot, "digraph review_session {\n"))
+	assert.Contains(t, dot, `"init" -> "comment" [label="command /comment"];`)
+	assert.Contains(t, dot, `"comment" -> "init" [label="command /finish"];`)
+	assert.Contains(t, dot, `"comment" -> "comment" [label="text", style=dashed];`)
+	assert.NotContains(t, dot, `"init" -> "init" [label="text", style=dashed];`)
+}
@@ -9,13 +9,56 @@ import (
 
 type IReviewBotSvc interface {
 	Send(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error)
-	GetFileUrl(ctx context.Context, fileId string) (string, error)
+	// Request is for methods not returning a message, such as answerCallbackQuery
+	Request(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	// ArchiveFile copies a telegram file to oss as <bucket>/<pathPrefix><ext>, the returned url is free of bot token
+	ArchiveFile(ctx context.Context, fileId string, bucket string, pathPrefix string) (string, error)
 }
 
 type IReviewRepo interface {
-	StoreReview(ctx context.Context, userId int64, content ReviewContent) error
+	StoreReview(ctx context.Context, review Review) error
+	GetReview(ctx context.Context, reviewId string) (Review, error)
 }
 
 type ISessionRepo interface {
+	// GetUserSessionData creates init session data if the user has none
+	GetUserSessionData(ctx context.Context, userId int64) (userSessionData, error)
 	SetUserSessionData(ctx context.Context, sessionData userSessionData) error
+	ListDueSessions(ctx context.Context, expireAt int64, remindAt int64, limit int) ([]userSessionData, error)
+}
+
+type IRockShopSvc interface {
+	ListRecentOrders(ctx context.Context, phoneNumber string, limit int) ([]RockShopOrder, error)
+}
+
+// IUpdateDedupeRepo remembers update ids with the outcome of handling them, as telegram redelivers an update until
+// it's acknowledged
+type IUpdateDedupeRepo interface {
+	// Claim returns true if the update is new or its previous claim is stale, otherwise the recorded outcome
+	Claim(ctx context.Context, updateId int) (updateOutcome, bool, error)
+	// Finish records the outcome of a claimed update
+	Finish(ctx context.Context, updateId int, outcome updateOutcome) error
+	// Release forgets a claimed update whose handling should be retried on redelivery
+	Release(ctx context.Context, updateId int) error
+}
+
+type IPollingOffsetRepo interface {
+	GetPollingOffset(ctx context.Context, botId int64) (int, error)
+	SetPollingOffset(ctx context.Context, botId int64, offset int) error
+}
+
+// IUpdateSpillRepo keeps updates overflowing the update channel of a session
+type IUpdateSpillRepo interface {
+	Spill(ctx context.Context, userId int64, chatId int64, update tgbotapi.Update) error
+	LoadSpilled(ctx context.Context, userId int64, afterId int64, limit int) ([]spilledUpdate, error)
+	DeleteSpilled(ctx context.Context, userId int64, maxId int64) error
+	CountSpilled(ctx context.Context, userId int64) (int, error)
+	ListSpilledUsers(ctx context.Context) ([]spilledUpdate, error)
+}
+
+// IUpdateJournalRepo keeps the update journal, see JournalEntry
+type IUpdateJournalRepo interface {
+	AppendJournal(ctx context.Context, entry JournalEntry) error
+	// ListJournal lists entries matching filter in the order appended
+	ListJournal(ctx context.Context, filter JournalFilter) ([]JournalEntry, error)
 }
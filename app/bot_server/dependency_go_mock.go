@@ -35,19 +35,34 @@ func (m *MockIReviewBotSvc) EXPECT() *MockIReviewBotSvcMockRecorder {
 	return m.recorder
 }
 
-// GetFileUrl mocks base method.
-func (m *MockIReviewBotSvc) GetFileUrl(ctx context.Context, fileId string) (string, error) {
+// ArchiveFile mocks base method.
+func (m *MockIReviewBotSvc) ArchiveFile(ctx context.Context, fileId string, bucket string, pathPrefix string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetFileUrl", ctx, fileId)
+	ret := m.ctrl.Call(m, "ArchiveFile", ctx, fileId, bucket, pathPrefix)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetFileUrl indicates an expected call of GetFileUrl.
-func (mr *MockIReviewBotSvcMockRecorder) GetFileUrl(ctx, fileId interface{}) *gomock.Call {
+// ArchiveFile indicates an expected call of ArchiveFile.
+func (mr *MockIReviewBotSvcMockRecorder) ArchiveFile(ctx, fileId, bucket, pathPrefix interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileUrl", reflect.TypeOf((*MockIReviewBotSvc)(nil).GetFileUrl), ctx, fileId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ArchiveFile", reflect.TypeOf((*MockIReviewBotSvc)(nil).ArchiveFile), ctx, fileId, bucket, pathPrefix)
+}
+
+// Request mocks base method.
+func (m *MockIReviewBotSvc) Request(ctx context.Context, c v5.Chattable) (*v5.APIResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Request", ctx, c)
+	ret0, _ := ret[0].(*v5.APIResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Request indicates an expected call of Request.
+func (mr *MockIReviewBotSvcMockRecorder) Request(ctx, c interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Request", reflect.TypeOf((*MockIReviewBotSvc)(nil).Request), ctx, c)
 }
 
 // Send mocks base method.
@@ -88,18 +103,33 @@ func (m *MockIReviewRepo) EXPECT() *MockIReviewRepoMockRecorder {
 	return m.recorder
 }
 
+// GetReview mocks base method.
+func (m *MockIReviewRepo) GetReview(ctx context.Context, reviewId string) (Review, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReview", ctx, reviewId)
+	ret0, _ := ret[0].(Review)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReview indicates an expected call of GetReview.
+func (mr *MockIReviewRepoMockRecorder) GetReview(ctx, reviewId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReview", reflect.TypeOf((*MockIReviewRepo)(nil).GetReview), ctx, reviewId)
+}
+
 // StoreReview mocks base method.
-func (m *MockIReviewRepo) StoreReview(ctx context.Context, userId int64, content ReviewContent) error {
+func (m *MockIReviewRepo) StoreReview(ctx context.Context, review Review) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "StoreReview", ctx, userId, content)
+	ret := m.ctrl.Call(m, "StoreReview", ctx, review)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // StoreReview indicates an expected call of StoreReview.
-func (mr *MockIReviewRepoMockRecorder) StoreReview(ctx, userId, content interface{}) *gomock.Call {
+func (mr *MockIReviewRepoMockRecorder) StoreReview(ctx, review interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreReview", reflect.TypeOf((*MockIReviewRepo)(nil).StoreReview), ctx, userId, content)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreReview", reflect.TypeOf((*MockIReviewRepo)(nil).StoreReview), ctx, review)
 }
 
 // MockISessionRepo is a mock of ISessionRepo interface.
@@ -125,6 +155,36 @@ func (m *MockISessionRepo) EXPECT() *MockISessionRepoMockRecorder {
 	return m.recorder
 }
 
+// GetUserSessionData mocks base method.
+func (m *MockISessionRepo) GetUserSessionData(ctx context.Context, userId int64) (userSessionData, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserSessionData", ctx, userId)
+	ret0, _ := ret[0].(userSessionData)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserSessionData indicates an expected call of GetUserSessionData.
+func (mr *MockISessionRepoMockRecorder) GetUserSessionData(ctx, userId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserSessionData", reflect.TypeOf((*MockISessionRepo)(nil).GetUserSessionData), ctx, userId)
+}
+
+// ListDueSessions mocks base method.
+func (m *MockISessionRepo) ListDueSessions(ctx context.Context, expireAt int64, remindAt int64, limit int) ([]userSessionData, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListDueSessions", ctx, expireAt, remindAt, limit)
+	ret0, _ := ret[0].([]userSessionData)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListDueSessions indicates an expected call of ListDueSessions.
+func (mr *MockISessionRepoMockRecorder) ListDueSessions(ctx, expireAt, remindAt, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListDueSessions", reflect.TypeOf((*MockISessionRepo)(nil).ListDueSessions), ctx, expireAt, remindAt, limit)
+}
+
 // SetUserSessionData mocks base method.
 func (m *MockISessionRepo) SetUserSessionData(ctx context.Context, sessionData userSessionData) error {
 	m.ctrl.T.Helper()
@@ -138,3 +198,308 @@ func (mr *MockISessionRepoMockRecorder) SetUserSessionData(ctx, sessionData inte
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserSessionData", reflect.TypeOf((*MockISessionRepo)(nil).SetUserSessionData), ctx, sessionData)
 }
+
+// MockIRockShopSvc is a mock of IRockShopSvc interface.
+type MockIRockShopSvc struct {
+	ctrl     *gomock.Controller
+	recorder *MockIRockShopSvcMockRecorder
+}
+
+// MockIRockShopSvcMockRecorder is the mock recorder for MockIRockShopSvc.
+type MockIRockShopSvcMockRecorder struct {
+	mock *MockIRockShopSvc
+}
+
+// NewMockIRockShopSvc creates a new mock instance.
+func NewMockIRockShopSvc(ctrl *gomock.Controller) *MockIRockShopSvc {
+	mock := &MockIRockShopSvc{ctrl: ctrl}
+	mock.recorder = &MockIRockShopSvcMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIRockShopSvc) EXPECT() *MockIRockShopSvcMockRecorder {
+	return m.recorder
+}
+
+// ListRecentOrders mocks base method.
+func (m *MockIRockShopSvc) ListRecentOrders(ctx context.Context, phoneNumber string, limit int) ([]RockShopOrder, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRecentOrders", ctx, phoneNumber, limit)
+	ret0, _ := ret[0].([]RockShopOrder)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRecentOrders indicates an expected call of ListRecentOrders.
+func (mr *MockIRockShopSvcMockRecorder) ListRecentOrders(ctx, phoneNumber, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRecentOrders", reflect.TypeOf((*MockIRockShopSvc)(nil).ListRecentOrders), ctx, phoneNumber, limit)
+}
+
+// MockIUpdateDedupeRepo is a mock of IUpdateDedupeRepo interface.
+type MockIUpdateDedupeRepo struct {
+	ctrl     *gomock.Controller
+	recorder *MockIUpdateDedupeRepoMockRecorder
+}
+
+// MockIUpdateDedupeRepoMockRecorder is the mock recorder for MockIUpdateDedupeRepo.
+type MockIUpdateDedupeRepoMockRecorder struct {
+	mock *MockIUpdateDedupeRepo
+}
+
+// NewMockIUpdateDedupeRepo creates a new mock instance.
+func NewMockIUpdateDedupeRepo(ctrl *gomock.Controller) *MockIUpdateDedupeRepo {
+	mock := &MockIUpdateDedupeRepo{ctrl: ctrl}
+	mock.recorder = &MockIUpdateDedupeRepoMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIUpdateDedupeRepo) EXPECT() *MockIUpdateDedupeRepoMockRecorder {
+	return m.recorder
+}
+
+// Claim mocks base method.
+func (m *MockIUpdateDedupeRepo) Claim(ctx context.Context, updateId int) (updateOutcome, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Claim", ctx, updateId)
+	ret0, _ := ret[0].(updateOutcome)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Claim indicates an expected call of Claim.
+func (mr *MockIUpdateDedupeRepoMockRecorder) Claim(ctx, updateId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Claim", reflect.TypeOf((*MockIUpdateDedupeRepo)(nil).Claim), ctx, updateId)
+}
+
+// Finish mocks base method.
+func (m *MockIUpdateDedupeRepo) Finish(ctx context.Context, updateId int, outcome updateOutcome) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Finish", ctx, updateId, outcome)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Finish indicates an expected call of Finish.
+func (mr *MockIUpdateDedupeRepoMockRecorder) Finish(ctx, updateId, outcome interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Finish", reflect.TypeOf((*MockIUpdateDedupeRepo)(nil).Finish), ctx, updateId, outcome)
+}
+
+// Release mocks base method.
+func (m *MockIUpdateDedupeRepo) Release(ctx context.Context, updateId int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Release", ctx, updateId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Release indicates an expected call of Release.
+func (mr *MockIUpdateDedupeRepoMockRecorder) Release(ctx, updateId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Release", reflect.TypeOf((*MockIUpdateDedupeRepo)(nil).Release), ctx, updateId)
+}
+
+// MockIPollingOffsetRepo is a mock of IPollingOffsetRepo interface.
+type MockIPollingOffsetRepo struct {
+	ctrl     *gomock.Controller
+	recorder *MockIPollingOffsetRepoMockRecorder
+}
+
+// MockIPollingOffsetRepoMockRecorder is the mock recorder for MockIPollingOffsetRepo.
+type MockIPollingOffsetRepoMockRecorder struct {
+	mock *MockIPollingOffsetRepo
+}
+
+// NewMockIPollingOffsetRepo creates a new mock instance.
+func NewMockIPollingOffsetRepo(ctrl *gomock.Controller) *MockIPollingOffsetRepo {
+	mock := &MockIPollingOffsetRepo{ctrl: ctrl}
+	mock.recorder = &MockIPollingOffsetRepoMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIPollingOffsetRepo) EXPECT() *MockIPollingOffsetRepoMockRecorder {
+	return m.recorder
+}
+
+// GetPollingOffset mocks base method.
+func (m *MockIPollingOffsetRepo) GetPollingOffset(ctx context.Context, botId int64) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPollingOffset", ctx, botId)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPollingOffset indicates an expected call of GetPollingOffset.
+func (mr *MockIPollingOffsetRepoMockRecorder) GetPollingOffset(ctx, botId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPollingOffset", reflect.TypeOf((*MockIPollingOffsetRepo)(nil).GetPollingOffset), ctx, botId)
+}
+
+// SetPollingOffset mocks base method.
+func (m *MockIPollingOffsetRepo) SetPollingOffset(ctx context.Context, botId int64, offset int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPollingOffset", ctx, botId, offset)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPollingOffset indicates an expected call of SetPollingOffset.
+func (mr *MockIPollingOffsetRepoMockRecorder) SetPollingOffset(ctx, botId, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPollingOffset", reflect.TypeOf((*MockIPollingOffsetRepo)(nil).SetPollingOffset), ctx, botId, offset)
+}
+
+// MockIUpdateSpillRepo is a mock of IUpdateSpillRepo interface.
+type MockIUpdateSpillRepo struct {
+	ctrl     *gomock.Controller
+	recorder *MockIUpdateSpillRepoMockRecorder
+}
+
+// MockIUpdateSpillRepoMockRecorder is the mock recorder for MockIUpdateSpillRepo.
+type MockIUpdateSpillRepoMockRecorder struct {
+	mock *MockIUpdateSpillRepo
+}
+
+// NewMockIUpdateSpillRepo creates a new mock instance.
+func NewMockIUpdateSpillRepo(ctrl *gomock.Controller) *MockIUpdateSpillRepo {
+	mock := &MockIUpdateSpillRepo{ctrl: ctrl}
+	mock.recorder = &MockIUpdateSpillRepoMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIUpdateSpillRepo) EXPECT() *MockIUpdateSpillRepoMockRecorder {
+	return m.recorder
+}
+
+// CountSpilled mocks base method.
+func (m *MockIUpdateSpillRepo) CountSpilled(ctx context.Context, userId int64) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountSpilled", ctx, userId)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountSpilled indicates an expected call of CountSpilled.
+func (mr *MockIUpdateSpillRepoMockRecorder) CountSpilled(ctx, userId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountSpilled", reflect.TypeOf((*MockIUpdateSpillRepo)(nil).CountSpilled), ctx, userId)
+}
+
+// DeleteSpilled mocks base method.
+func (m *MockIUpdateSpillRepo) DeleteSpilled(ctx context.Context, userId int64, maxId int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteSpilled", ctx, userId, maxId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteSpilled indicates an expected call of DeleteSpilled.
+func (mr *MockIUpdateSpillRepoMockRecorder) DeleteSpilled(ctx, userId, maxId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSpilled", reflect.TypeOf((*MockIUpdateSpillRepo)(nil).DeleteSpilled), ctx, userId, maxId)
+}
+
+// ListSpilledUsers mocks base method.
+func (m *MockIUpdateSpillRepo) ListSpilledUsers(ctx context.Context) ([]spilledUpdate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListSpilledUsers", ctx)
+	ret0, _ := ret[0].([]spilledUpdate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListSpilledUsers indicates an expected call of ListSpilledUsers.
+func (mr *MockIUpdateSpillRepoMockRecorder) ListSpilledUsers(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListSpilledUsers", reflect.TypeOf((*MockIUpdateSpillRepo)(nil).ListSpilledUsers), ctx)
+}
+
+// LoadSpilled mocks base method.
+func (m *MockIUpdateSpillRepo) LoadSpilled(ctx context.Context, userId int64, afterId int64, limit int) ([]spilledUpdate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoadSpilled", ctx, userId, afterId, limit)
+	ret0, _ := ret[0].([]spilledUpdate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoadSpilled indicates an expected call of LoadSpilled.
+func (mr *MockIUpdateSpillRepoMockRecorder) LoadSpilled(ctx, userId, afterId, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadSpilled", reflect.TypeOf((*MockIUpdateSpillRepo)(nil).LoadSpilled), ctx, userId, afterId, limit)
+}
+
+// Spill mocks base method.
+func (m *MockIUpdateSpillRepo) Spill(ctx context.Context, userId int64, chatId int64, update v5.Update) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Spill", ctx, userId, chatId, update)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Spill indicates an expected call of Spill.
+func (mr *MockIUpdateSpillRepoMockRecorder) Spill(ctx, userId, chatId, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Spill", reflect.TypeOf((*MockIUpdateSpillRepo)(nil).Spill), ctx, userId, chatId, update)
+}
+
+// MockIUpdateJournalRepo is a mock of IUpdateJournalRepo interface.
+type MockIUpdateJournalRepo struct {
+	ctrl     *gomock.Controller
+	recorder *MockIUpdateJournalRepoMockRecorder
+}
+
+// MockIUpdateJournalRepoMockRecorder is the mock recorder for MockIUpdateJournalRepo.
+type MockIUpdateJournalRepoMockRecorder struct {
+	mock *MockIUpdateJournalRepo
+}
+
+// NewMockIUpdateJournalRepo creates a new mock instance.
+func NewMockIUpdateJournalRepo(ctrl *gomock.Controller) *MockIUpdateJournalRepo {
+	mock := &MockIUpdateJournalRepo{ctrl: ctrl}
+	mock.recorder = &MockIUpdateJournalRepoMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIUpdateJournalRepo) EXPECT() *MockIUpdateJournalRepoMockRecorder {
+	return m.recorder
+}
+
+// AppendJournal mocks base method.
+func (m *MockIUpdateJournalRepo) AppendJournal(ctx context.Context, entry JournalEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AppendJournal", ctx, entry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendJournal indicates an expected call of AppendJournal.
+func (mr *MockIUpdateJournalRepoMockRecorder) AppendJournal(ctx, entry interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendJournal", reflect.TypeOf((*MockIUpdateJournalRepo)(nil).AppendJournal), ctx, entry)
+}
+
+// ListJournal mocks base method.
+func (m *MockIUpdateJournalRepo) ListJournal(ctx context.Context, filter JournalFilter) ([]JournalEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListJournal", ctx, filter)
+	ret0, _ := ret[0].([]JournalEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListJournal indicates an expected call of ListJournal.
+func (mr *MockIUpdateJournalRepoMockRecorder) ListJournal(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListJournal", reflect.TypeOf((*MockIUpdateJournalRepo)(nil).ListJournal), ctx, filter)
+}
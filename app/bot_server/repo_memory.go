@@ -0,0 +1,276 @@
+package bot_server
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The in-memory repos keep data in the process, so that bot_server runs without mysql for local development, and
+// tests run end to end without external services. Data is lost on exit, and not shared between processes.
+
+var (
+	_ IReviewRepo        = (*MemReviewRepo)(nil)
+	_ ISessionRepo       = (*MemUserSessionRepo)(nil)
+	_ IPollingOffsetRepo = (*MemPollingOffsetRepo)(nil)
+	_ IUpdateSpillRepo   = (*MemUpdateSpillRepo)(nil)
+	_ IUpdateJournalRepo = (*MemUpdateJournalRepo)(nil)
+)
+
+type MemReviewRepo struct {
+	m       sync.Mutex
+	reviews []Review
+}
+
+func NewMemReviewRepo() *MemReviewRepo {
+	return &MemReviewRepo{}
+}
+
+// StoreReview stores a finished review, the same review_id is replaced by a session version not older as ReviewRepo
+// does
+func (repo *MemReviewRepo) StoreReview(ctx context.Context, review Review) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	for i, stored := range repo.reviews {
+		if stored.ReviewId == review.ReviewId {
+			if review.SessionVersion >= stored.SessionVersion {
+				repo.reviews[i] = review
+			}
+			return nil
+		}
+	}
+	repo.reviews = append(repo.reviews, review)
+	return nil
+}
+
+func (repo *MemReviewRepo) GetReview(ctx context.Context, reviewId string) (Review, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	for _, stored := range repo.reviews {
+		if stored.ReviewId == reviewId {
+			return stored, nil
+		}
+	}
+	return Review{}, errReviewNotFound
+}
+
+// ListReviews lists reviews in the order stored
+func (repo *MemReviewRepo) ListReviews() []Review {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	return append([]Review(nil), repo.reviews...)
+}
+
+type MemUserSessionRepo struct {
+	m        sync.Mutex
+	sessions map[int64]userSessionData
+}
+
+func NewMemUserSessionRepo() *MemUserSessionRepo {
+	return &MemUserSessionRepo{sessions: map[int64]userSessionData{}}
+}
+
+func (repo *MemUserSessionRepo) GetUserSessionData(ctx context.Context, userId int64) (userSessionData, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	sessionData, ok := repo.sessions[userId]
+	if !ok {
+		sessionData = newInitSessionData(userId)
+		sessionData.Version = 1
+		repo.sessions[userId] = sessionData
+	}
+	return copySessionData(sessionData), nil
+}
+
+// SetUserSessionData checks and bumps the version as UserSessionRepo does
+func (repo *MemUserSessionRepo) SetUserSessionData(ctx context.Context, sessionData userSessionData) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	stored, ok := repo.sessions[sessionData.UserId]
+	if ok != (sessionData.Version > 0) || stored.Version != sessionData.Version {
+		return errSessionConflict
+	}
+	sessionData.Version++
+	repo.sessions[sessionData.UserId] = copySessionData(sessionData)
+	return nil
+}
+
+// copySessionData copies the draft, which a session changes in place, as if the data went through the database
+func copySessionData(sessionData userSessionData) userSessionData {
+	sessionData.Draft = sessionData.Draft.clone()
+	return sessionData
+}
+
+func (repo *MemUserSessionRepo) ListDueSessions(ctx context.Context, expireAt int64, remindAt int64, limit int) ([]userSessionData, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	var sessions []userSessionData
+	for _, sessionData := range repo.sessions {
+		if sessionData.StateExpireAt > 0 && (sessionData.StateExpireAt <= expireAt ||
+			(sessionData.StateExpireAt <= remindAt && !sessionData.ReminderSent)) {
+			sessions = append(sessions, copySessionData(sessionData))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StateExpireAt < sessions[j].StateExpireAt
+	})
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+type MemPollingOffsetRepo struct {
+	m       sync.Mutex
+	offsets map[int64]int
+}
+
+func NewMemPollingOffsetRepo() *MemPollingOffsetRepo {
+	return &MemPollingOffsetRepo{offsets: map[int64]int{}}
+}
+
+func (repo *MemPollingOffsetRepo) GetPollingOffset(ctx context.Context, botId int64) (int, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	return repo.offsets[botId], nil
+}
+
+func (repo *MemPollingOffsetRepo) SetPollingOffset(ctx context.Context, botId int64, offset int) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	repo.offsets[botId] = offset
+	return nil
+}
+
+type MemUpdateSpillRepo struct {
+	m       sync.Mutex
+	lastId  int64
+	updates []spilledUpdate // updates are in the order of id
+}
+
+func NewMemUpdateSpillRepo() *MemUpdateSpillRepo {
+	return &MemUpdateSpillRepo{}
+}
+
+func (repo *MemUpdateSpillRepo) Spill(ctx context.Context, userId int64, chatId int64, update tgbotapi.Update) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	repo.lastId++
+	repo.updates = append(repo.updates, spilledUpdate{Id: repo.lastId, UserId: userId, ChatId: chatId, Update: update})
+	return nil
+}
+
+func (repo *MemUpdateSpillRepo) LoadSpilled(ctx context.Context, userId int64, afterId int64, limit int) ([]spilledUpdate, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	var spilledUpdates []spilledUpdate
+	for _, spilled := range repo.updates {
+		if len(spilledUpdates) == limit {
+			break
+		}
+		if spilled.UserId == userId && spilled.Id > afterId {
+			spilledUpdates = append(spilledUpdates, spilled)
+		}
+	}
+	return spilledUpdates, nil
+}
+
+func (repo *MemUpdateSpillRepo) DeleteSpilled(ctx context.Context, userId int64, maxId int64) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	kept := repo.updates[:0]
+	for _, spilled := range repo.updates {
+		if spilled.UserId != userId || spilled.Id > maxId {
+			kept = append(kept, spilled)
+		}
+	}
+	repo.updates = kept
+	return nil
+}
+
+func (repo *MemUpdateSpillRepo) CountSpilled(ctx context.Context, userId int64) (int, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	count := 0
+	for _, spilled := range repo.updates {
+		if spilled.UserId == userId {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (repo *MemUpdateSpillRepo) ListSpilledUsers(ctx context.Context) ([]spilledUpdate, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	var (
+		spilledUsers []spilledUpdate
+		index        = map[int64]int{}
+	)
+	for _, spilled := range repo.updates {
+		i, ok := index[spilled.UserId]
+		if !ok {
+			index[spilled.UserId] = len(spilledUsers)
+			spilledUsers = append(spilledUsers, spilledUpdate{UserId: spilled.UserId, ChatId: spilled.ChatId})
+			continue
+		}
+		if spilled.ChatId > spilledUsers[i].ChatId {
+			spilledUsers[i].ChatId = spilled.ChatId
+		}
+	}
+	return spilledUsers, nil
+}
+
+type MemUpdateJournalRepo struct {
+	m       sync.Mutex
+	entries []JournalEntry
+}
+
+func NewMemUpdateJournalRepo() *MemUpdateJournalRepo {
+	return &MemUpdateJournalRepo{}
+}
+
+func (repo *MemUpdateJournalRepo) AppendJournal(ctx context.Context, entry JournalEntry) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	entry.Id = int64(len(repo.entries)) + 1
+	repo.entries = append(repo.entries, entry)
+	return nil
+}
+
+func (repo *MemUpdateJournalRepo) ListJournal(ctx context.Context, filter JournalFilter) ([]JournalEntry, error) {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultJournalLimit
+	}
+	var entries []JournalEntry
+	for _, entry := range repo.entries {
+		if len(entries) == limit {
+			break
+		}
+		if (filter.ChatId == 0 || entry.ChatId == filter.ChatId) &&
+			(filter.Since == 0 || entry.CreatedAt >= filter.Since) && (filter.Until == 0 || entry.CreatedAt <= filter.Until) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,108 @@
+package bot_server
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_MemUserSessionRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemUserSessionRepo()
+
+	sessionData, err := repo.GetUserSessionData(ctx, testUserId)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), sessionData.Version)
+
+	// a stale save is refused
+	sessionData.StateExpireAt = 100
+	assert.Nil(t, repo.SetUserSessionData(ctx, sessionData))
+	assert.ErrorIs(t, repo.SetUserSessionData(ctx, sessionData), errSessionConflict)
+	assert.ErrorIs(t, repo.SetUserSessionData(ctx, newInitSessionData(testUserId)), errSessionConflict)
+	assert.ErrorIs(t, repo.SetUserSessionData(ctx, userSessionData{UserId: 1, Version: 1}), errSessionConflict)
+
+	reminded := userSessionData{UserId: 2, StateExpireAt: 50, ReminderSent: true}
+	assert.Nil(t, repo.SetUserSessionData(ctx, reminded))
+	assert.Nil(t, repo.SetUserSessionData(ctx, userSessionData{UserId: 3, StateExpireAt: 300}))
+
+	due, _ := repo.ListDueSessions(ctx, 60, 200, 10)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, int64(2), due[0].UserId)
+		assert.Equal(t, testUserId, due[1].UserId)
+	}
+	due, _ = repo.ListDueSessions(ctx, 60, 200, 1)
+	assert.Len(t, due, 1)
+
+	// drafts changed in place don't leak into the stored data
+	sessionData, _ = repo.GetUserSessionData(ctx, 3)
+	sessionData.Draft = &reviewDraft{ReviewId: testReviewId,
+		Content: ReviewContent{Text: "stored", Medias: []ReviewMedia{{FileId: "p1"}}}}
+	assert.Nil(t, repo.SetUserSessionData(ctx, sessionData))
+	sessionData.Draft.Content.Text = "changed after set"
+	loaded, _ := repo.GetUserSessionData(ctx, 3)
+	assert.Equal(t, "stored", loaded.Draft.Content.Text)
+	loaded.Draft.Content.Medias[0].FileId = "p2"
+	loaded, _ = repo.GetUserSessionData(ctx, 3)
+	assert.Equal(t, "p1", loaded.Draft.Content.Medias[0].FileId)
+}
+
+func Test_UnitTest_MemReviewRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemReviewRepo()
+
+	store := func(text string, sessionVersion int64) {
+		assert.Nil(t, repo.StoreReview(ctx, Review{ReviewId: testReviewId, TgUserId: testUserId,
+			ReviewContent: &ReviewContent{Text: text}, SessionVersion: sessionVersion}))
+	}
+	store("stale", 1)
+	store("retried", 2)
+	store("stale again", 1)
+	reviews := repo.ListReviews()
+	if assert.Len(t, reviews, 1) {
+		assert.Equal(t, "retried", reviews[0].ReviewContent.Text)
+		assert.Equal(t, int64(2), reviews[0].SessionVersion)
+	}
+}
+
+func Test_UnitTest_MemUpdateSpillRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemUpdateSpillRepo()
+
+	for i := 1; i <= 3; i++ {
+		_ = repo.Spill(ctx, testUserId, testChatId, tgbotapi.Update{UpdateID: i})
+	}
+	_ = repo.Spill(ctx, 1, 2, tgbotapi.Update{UpdateID: 4})
+
+	spilled, _ := repo.LoadSpilled(ctx, testUserId, 1, 1)
+	if assert.Len(t, spilled, 1) {
+		assert.Equal(t, int64(2), spilled[0].Id)
+		assert.Equal(t, 2, spilled[0].Update.UpdateID)
+	}
+
+	_ = repo.DeleteSpilled(ctx, testUserId, 2)
+	count, _ := repo.CountSpilled(ctx, testUserId)
+	assert.Equal(t, 1, count)
+
+	users, _ := repo.ListSpilledUsers(ctx)
+	assert.Equal(t, []spilledUpdate{{UserId: testUserId, ChatId: testChatId}, {UserId: 1, ChatId: 2}}, users)
+}
+
+func Test_UnitTest_MemUpdateJournalRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemUpdateJournalRepo()
+
+	_ = repo.AppendJournal(ctx, JournalEntry{Kind: JournalKindUpdate, UpdateId: 1, ChatId: testChatId, CreatedAt: 100})
+	_ = repo.AppendJournal(ctx, JournalEntry{Kind: JournalKindOutbound, UpdateId: 1, ChatId: testChatId, CreatedAt: 101})
+	_ = repo.AppendJournal(ctx, JournalEntry{Kind: JournalKindUpdate, UpdateId: 2, ChatId: 1, CreatedAt: 102})
+	_ = repo.AppendJournal(ctx, JournalEntry{Kind: JournalKindUpdate, UpdateId: 3, ChatId: testChatId, CreatedAt: 200})
+
+	entries, _ := repo.ListJournal(ctx, JournalFilter{ChatId: testChatId, Since: 101, Until: 200})
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, int64(2), entries[0].Id)
+		assert.Equal(t, 3, entries[1].UpdateId)
+	}
+	entries, _ = repo.ListJournal(ctx, JournalFilter{Limit: 3})
+	assert.Len(t, entries, 3)
+}
@@ -0,0 +1,42 @@
+package bot_server
+
+import (
+	"context"
+	"database/sql"
+	"rock_review/util/persist"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PollingOffsetRepo keeps the offset of getUpdates per bot in table tg_polling_offset. Telegram takes updates
+// below the offset of a poll as confirmed, so the offset persisted on shutdown confirms the last dispatched updates on
+// the first poll after restart, and updates fetched but not dispatched are delivered again.
+type PollingOffsetRepo struct {
+	db      *sqlx.DB
+	dialect persist.Dialect
+}
+
+func NewPollingOffsetRepo(db *sqlx.DB) *PollingOffsetRepo {
+	return &PollingOffsetRepo{
+		db:      db,
+		dialect: persist.DialectOf(db.DriverName()),
+	}
+}
+
+// GetPollingOffset returns 0 if no offset is persisted, which polls from the earliest unconfirmed update
+func (repo *PollingOffsetRepo) GetPollingOffset(ctx context.Context, botId int64) (int, error) {
+	var offset int
+
+	err := repo.db.GetContext(ctx, &offset, "select update_offset from tg_polling_offset where bot_id = ?", botId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return offset, err
+}
+
+func (repo *PollingOffsetRepo) SetPollingOffset(ctx context.Context, botId int64, offset int) error {
+	_, err := repo.db.ExecContext(ctx,
+		repo.dialect.Upsert("tg_polling_offset", []string{"bot_id", "update_offset"}, []string{"bot_id"}, []string{"update_offset"}),
+		botId, offset)
+	return err
+}
@@ -2,24 +2,108 @@ package bot_server
 
 import (
 	"context"
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"path/filepath"
-	"rock_review/util/oss"
+	"rock_review/util/persist"
 
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/jmoiron/sqlx"
 	uuid "github.com/satori/go.uuid"
 )
 
+var errReviewNotFound = errors.New("review not found")
+
 type Review struct {
+	ReviewId      string         `db:"review_id"`
 	TgUserId      int64          `db:"tg_user_id"`
+	OrderId       string         `db:"order_id"`
+	Rating        int            `db:"rating"` // Rating ranges 1-5, 0 means not rated
 	ReviewContent *ReviewContent `db:"review_content"`
+	// SessionVersion is the version of the session committing the review. A commit retried after a session conflict
+	// carries a newer version, and replaces what the stale attempt stored.
+	SessionVersion int64 `db:"session_version"`
 }
 
 type ReviewContent struct {
-	Text      string   `json:"text"`
-	MediaUrls []string `json:"media_urls"`
+	Text   string        `json:"text"`
+	Medias []ReviewMedia `json:"medias"`
+}
+
+type mediaType = string
+
+const (
+	mediaTypePhoto mediaType = "photo"
+	mediaTypeVideo mediaType = "video"
+	mediaTypeAudio mediaType = "audio"
+	mediaTypeVoice mediaType = "voice"
+)
+
+// ReviewMedia refers to a telegram file by file_id instead of download url, as the url embeds the bot token and
+// expires in an hour. The file is resolved by the bot when archiving it to oss.
+type ReviewMedia struct {
+	Type         mediaType `json:"type"`
+	FileId       string    `json:"file_id"`
+	FileUniqueId string    `json:"file_unique_id"`
+	FileSize     int       `json:"file_size,omitempty"`
+	MimeType     string    `json:"mime_type,omitempty"`
+	Duration     int       `json:"duration,omitempty"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	ObjectUrl    string    `json:"object_url,omitempty"` // ObjectUrl is the durable copy in oss, empty if not archived
+}
+
+// newReviewMedias extracts medias of a message, only the largest size of a photo is kept
+func newReviewMedias(message *tgbotapi.Message) []ReviewMedia {
+	var medias []ReviewMedia
+
+	if len(message.Photo) > 0 {
+		photo := message.Photo[len(message.Photo)-1]
+		medias = append(medias, ReviewMedia{
+			Type:         mediaTypePhoto,
+			FileId:       photo.FileID,
+			FileUniqueId: photo.FileUniqueID,
+			FileSize:     photo.FileSize,
+			MimeType:     "image/jpeg",
+			Width:        photo.Width,
+			Height:       photo.Height,
+		})
+	}
+	if message.Video != nil {
+		medias = append(medias, ReviewMedia{
+			Type:         mediaTypeVideo,
+			FileId:       message.Video.FileID,
+			FileUniqueId: message.Video.FileUniqueID,
+			FileSize:     message.Video.FileSize,
+			MimeType:     message.Video.MimeType,
+			Duration:     message.Video.Duration,
+			Width:        message.Video.Width,
+			Height:       message.Video.Height,
+		})
+	}
+	if message.Audio != nil {
+		medias = append(medias, ReviewMedia{
+			Type:         mediaTypeAudio,
+			FileId:       message.Audio.FileID,
+			FileUniqueId: message.Audio.FileUniqueID,
+			FileSize:     message.Audio.FileSize,
+			MimeType:     message.Audio.MimeType,
+			Duration:     message.Audio.Duration,
+		})
+	}
+	if message.Voice != nil {
+		medias = append(medias, ReviewMedia{
+			Type:         mediaTypeVoice,
+			FileId:       message.Voice.FileID,
+			FileUniqueId: message.Voice.FileUniqueID,
+			FileSize:     message.Voice.FileSize,
+			MimeType:     message.Voice.MimeType,
+			Duration:     message.Voice.Duration,
+		})
+	}
+	return medias
 }
 
 func (f *ReviewContent) Value() (driver.Value, error) {
@@ -45,34 +129,114 @@ func (f *ReviewContent) Scan(src any) error {
 	return json.Unmarshal(bs, f)
 }
 
-type ReviewRepo struct {
-	db *sqlx.DB
+func (f *ReviewContent) isEmpty() bool {
+	return len(f.Text) == 0 && len(f.Medias) == 0
 }
 
-func NewReviewRepo(db *sqlx.DB) *ReviewRepo {
-	return &ReviewRepo{db: db}
+// merge appends text and media of another message to the content
+func (f *ReviewContent) merge(text string, medias []ReviewMedia) {
+	if len(text) > 0 {
+		if len(f.Text) > 0 {
+			f.Text += "\n"
+		}
+		f.Text += text
+	}
+	f.Medias = append(f.Medias, medias...)
 }
 
-func (repo *ReviewRepo) StoreReview(ctx context.Context, userId int64, content ReviewContent) error {
-	var (
-		err     error
-		newUrls []string
-	)
+// newReviewId generates the id of a review, it's assigned when the draft is created and kept after committed
+var newReviewId = func() string {
+	return uuid.NewV4().String()
+}
 
-	for _, mediaUrl := range content.MediaUrls {
-		newUrl, err := oss.Upload(ctx, oss.BucketRockReview, uuid.NewV4().String()+filepath.Ext(mediaUrl), mediaUrl)
-		if err != nil {
-			return err
-		}
-		newUrls = append(newUrls, newUrl)
-	}
+// reviewDraft accumulates a review across messages until it's committed by /finish or discarded by /cancel
+type reviewDraft struct {
+	ReviewId string        `json:"review_id"`
+	OrderId  string        `json:"order_id,omitempty"` // OrderId is the RockShop order picked by /comment_transaction
+	Rating   int           `json:"rating,omitempty"`
+	Content  ReviewContent `json:"content"`
+}
 
-	content.MediaUrls = newUrls
+func newReviewDraft() *reviewDraft {
+	return &reviewDraft{ReviewId: newReviewId()}
+}
 
-	review := &Review{
+// clone copies the draft along with its medias, so that changes of the copy don't leak
+func (d *reviewDraft) clone() *reviewDraft {
+	if d == nil {
+		return nil
+	}
+	draft := *d
+	draft.Content.Medias = append([]ReviewMedia(nil), d.Content.Medias...)
+	return &draft
+}
+
+func (d *reviewDraft) toReview(userId int64) Review {
+	content := d.Content
+	content.Medias = append([]ReviewMedia(nil), d.Content.Medias...)
+	return Review{
+		ReviewId:      d.ReviewId,
 		TgUserId:      userId,
+		OrderId:       d.OrderId,
+		Rating:        d.Rating,
 		ReviewContent: &content,
 	}
-	_, err = repo.db.NamedExecContext(ctx, "insert into review (tg_user_id, review_content) values (:tg_user_id, :review_content)", review)
+}
+
+func (d *reviewDraft) Value() (driver.Value, error) {
+	if d == nil {
+		return nil, nil
+	}
+
+	bs, err := json.Marshal(d)
+	return bs, err
+}
+
+func (d *reviewDraft) Scan(src any) error {
+	var bs []byte
+	switch convertedV := src.(type) {
+	case string:
+		bs = []byte(convertedV)
+	case []byte:
+		bs = convertedV
+	default:
+		return fmt.Errorf("type err")
+	}
+
+	return json.Unmarshal(bs, d)
+}
+
+type ReviewRepo struct {
+	db      *sqlx.DB
+	dialect persist.Dialect
+}
+
+func NewReviewRepo(db *sqlx.DB) *ReviewRepo {
+	return &ReviewRepo{db: db, dialect: persist.DialectOf(db.DriverName())}
+}
+
+// StoreReview stores a finished review, storing the same review_id again replaces it only if the session version is not
+// older, so that a retried commit won't duplicate, and a commit from stale session data doesn't win
+func (repo *ReviewRepo) StoreReview(ctx context.Context, review Review) error {
+	var (
+		err error
+	)
+
+	_, err = repo.db.ExecContext(ctx,
+		repo.dialect.UpsertNewer("review",
+			[]string{"review_id", "tg_user_id", "order_id", "rating", "review_content", "session_version"},
+			[]string{"review_id"}, []string{"order_id", "rating", "review_content"}, "session_version"),
+		review.ReviewId, review.TgUserId, review.OrderId, review.Rating, review.ReviewContent, review.SessionVersion)
 	return err
 }
+
+// GetReview returns errReviewNotFound if no review has the id
+func (repo *ReviewRepo) GetReview(ctx context.Context, reviewId string) (Review, error) {
+	var review Review
+	err := repo.db.GetContext(ctx, &review,
+		"select review_id, tg_user_id, order_id, rating, review_content from review where review_id = ?", reviewId)
+	if err == sql.ErrNoRows {
+		return review, errReviewNotFound
+	}
+	return review, err
+}
@@ -0,0 +1,227 @@
+package bot_server
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"rock_review/util/persist"
+	"rock_review/util/xlogger"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type updateStatus = int
+
+const (
+	updateStatusProcessing updateStatus = 0
+	updateStatusDone       updateStatus = 1
+	updateStatusFailed     updateStatus = 2
+)
+
+const (
+	defaultDedupeCapacity = 10000
+
+	// staleClaimSeconds is how long a claim stays processing before the handler is presumed dead, e.g. the lambda
+	// instance crashed, then a redelivered update can claim it again
+	staleClaimSeconds = 60
+
+	// dedupeRetentionSeconds is how long rows of tg_update_dedupe are kept, telegram stops redelivering after a day
+	dedupeRetentionSeconds = 2 * 24 * 3600
+	// dedupePurgeIntervalSeconds is how often an instance purges rows past retention, a batch of dedupePurgeLimit
+	// rows at a time so that a claim isn't held up for long
+	dedupePurgeIntervalSeconds = 3600
+	dedupePurgeLimit           = 1000
+)
+
+// errUpdateInFlight is returned for a redelivered update whose first delivery is still being handled. It's retryable,
+// by the next delivery the first one is finished, or its claim is stale and taken over if the handler died.
+var errUpdateInFlight = errors.New("update in flight")
+
+// updateOutcome is recorded per update_id, a redelivered update gets the outcome of its first delivery
+type updateOutcome struct {
+	Status updateStatus `db:"status"`
+	Err    string       `db:"err"`
+}
+
+func newUpdateOutcome(err error) updateOutcome {
+	if err != nil {
+		return updateOutcome{Status: updateStatusFailed, Err: err.Error()}
+	}
+	return updateOutcome{Status: updateStatusDone}
+}
+
+// err returns the error of the first delivery, or errUpdateInFlight if it's still processing
+func (o updateOutcome) err() error {
+	switch o.Status {
+	case updateStatusProcessing:
+		return errUpdateInFlight
+	case updateStatusFailed:
+		return errors.New(o.Err)
+	}
+	return nil
+}
+
+// LruUpdateDedupeRepo keeps recent update ids in memory, it's for bot_server where all updates arrive at one process
+type LruUpdateDedupeRepo struct {
+	capacity int
+
+	m       sync.Mutex
+	order   *list.List // order holds update ids, the least recently claimed at the back
+	entries map[int]*list.Element
+}
+
+type lruDedupeEntry struct {
+	updateId  int
+	outcome   updateOutcome
+	claimedAt int64
+}
+
+func NewLruUpdateDedupeRepo(capacity int) *LruUpdateDedupeRepo {
+	if capacity <= 0 {
+		capacity = defaultDedupeCapacity
+	}
+	return &LruUpdateDedupeRepo{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[int]*list.Element{},
+	}
+}
+
+func (repo *LruUpdateDedupeRepo) Claim(ctx context.Context, updateId int) (updateOutcome, bool, error) {
+	now := time.Now().Unix()
+
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	if elem, ok := repo.entries[updateId]; ok {
+		repo.order.MoveToFront(elem)
+		entry := elem.Value.(*lruDedupeEntry)
+		if entry.outcome.Status == updateStatusProcessing && entry.claimedAt < now-staleClaimSeconds {
+			entry.claimedAt = now
+			return updateOutcome{}, true, nil
+		}
+		return entry.outcome, false, nil
+	}
+
+	repo.entries[updateId] = repo.order.PushFront(&lruDedupeEntry{updateId: updateId, claimedAt: now})
+	for repo.order.Len() > repo.capacity {
+		oldest := repo.order.Back()
+		repo.order.Remove(oldest)
+		delete(repo.entries, oldest.Value.(*lruDedupeEntry).updateId)
+	}
+	return updateOutcome{}, true, nil
+}
+
+func (repo *LruUpdateDedupeRepo) Finish(ctx context.Context, updateId int, outcome updateOutcome) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	if elem, ok := repo.entries[updateId]; ok {
+		elem.Value.(*lruDedupeEntry).outcome = outcome
+	}
+	return nil
+}
+
+func (repo *LruUpdateDedupeRepo) Release(ctx context.Context, updateId int) error {
+	repo.m.Lock()
+	defer repo.m.Unlock()
+
+	if elem, ok := repo.entries[updateId]; ok && elem.Value.(*lruDedupeEntry).outcome.Status == updateStatusProcessing {
+		repo.order.Remove(elem)
+		delete(repo.entries, updateId)
+	}
+	return nil
+}
+
+// UpdateDedupeRepo keeps update ids in table tg_update_dedupe, it's for bot_lambda where a redelivered update
+// may reach another instance. Rows past retention are purged by claims once in a while.
+type UpdateDedupeRepo struct {
+	db      *sqlx.DB
+	dialect persist.Dialect
+	status  string // status is the quoted column, as status is a keyword
+
+	lastPurgeAt int64 // lastPurgeAt is the unix time of the last purge, accessed atomically
+}
+
+func NewUpdateDedupeRepo(db *sqlx.DB) *UpdateDedupeRepo {
+	dialect := persist.DialectOf(db.DriverName())
+	return &UpdateDedupeRepo{
+		db:      db,
+		dialect: dialect,
+		status:  dialect.Quote("status"),
+	}
+}
+
+func (repo *UpdateDedupeRepo) Claim(ctx context.Context, updateId int) (updateOutcome, bool, error) {
+	var (
+		outcome updateOutcome
+		now     = time.Now().Unix()
+	)
+
+	if repo.purgeDue(now) {
+		repo.purge(ctx, now)
+	}
+
+	result, err := repo.db.ExecContext(ctx,
+		repo.dialect.InsertIgnore("tg_update_dedupe", []string{"update_id", "status", "err", "claimed_at"}, []string{"update_id"}),
+		updateId, updateStatusProcessing, "", now)
+	if err != nil {
+		return updateOutcome{}, false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 1 {
+		return updateOutcome{}, true, nil
+	}
+
+	// take over a stale claim
+	result, err = repo.db.ExecContext(ctx,
+		"update tg_update_dedupe set claimed_at = ? where update_id = ? and "+repo.status+" = ? and claimed_at < ?",
+		now, updateId, updateStatusProcessing, now-staleClaimSeconds)
+	if err != nil {
+		return updateOutcome{}, false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 1 {
+		return updateOutcome{}, true, nil
+	}
+
+	err = repo.db.GetContext(ctx, &outcome, "select "+repo.status+", err from tg_update_dedupe where update_id = ?", updateId)
+	if err == sql.ErrNoRows {
+		// released in between, let the caller handle it
+		return updateOutcome{}, true, nil
+	}
+	return outcome, false, err
+}
+
+// purgeDue tells whether the purge interval passed since the last purge of this instance, only one caller gets true
+func (repo *UpdateDedupeRepo) purgeDue(now int64) bool {
+	lastPurgeAt := atomic.LoadInt64(&repo.lastPurgeAt)
+	return now-lastPurgeAt >= dedupePurgeIntervalSeconds && atomic.CompareAndSwapInt64(&repo.lastPurgeAt, lastPurgeAt, now)
+}
+
+// purge deletes rows past retention, a failure is left to the next purge
+func (repo *UpdateDedupeRepo) purge(ctx context.Context, now int64) {
+	result, err := repo.db.ExecContext(ctx, "delete from tg_update_dedupe where claimed_at < ? limit ?",
+		now-dedupeRetentionSeconds, dedupePurgeLimit)
+	if err != nil {
+		xlogger.ErrorF(ctx, "purge tg_update_dedupe fail: %v", err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		xlogger.InfoF(ctx, "purged %d rows of tg_update_dedupe", affected)
+	}
+}
+
+func (repo *UpdateDedupeRepo) Finish(ctx context.Context, updateId int, outcome updateOutcome) error {
+	_, err := repo.db.ExecContext(ctx, "update tg_update_dedupe set "+repo.status+" = ?, err = ? where update_id = ?",
+		outcome.Status, outcome.Err, updateId)
+	return err
+}
+
+func (repo *UpdateDedupeRepo) Release(ctx context.Context, updateId int) error {
+	_, err := repo.db.ExecContext(ctx, "delete from tg_update_dedupe where update_id = ? and "+repo.status+" = ?",
+		updateId, updateStatusProcessing)
+	return err
+}
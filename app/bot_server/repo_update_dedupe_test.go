@@ -0,0 +1,61 @@
+package bot_server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_LruUpdateDedupeRepo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewLruUpdateDedupeRepo(2)
+
+	_, claimed, err := repo.Claim(ctx, 1)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+
+	// in flight
+	outcome, claimed, _ := repo.Claim(ctx, 1)
+	assert.False(t, claimed)
+	assert.Equal(t, updateStatusProcessing, outcome.Status)
+	assert.ErrorIs(t, outcome.err(), errUpdateInFlight)
+	assert.True(t, IsRetryableErr(outcome.err()))
+
+	_ = repo.Finish(ctx, 1, updateOutcome{Status: updateStatusFailed, Err: "sent_from or from_chat cannot be nil"})
+	outcome, claimed, _ = repo.Claim(ctx, 1)
+	assert.False(t, claimed)
+	assert.EqualError(t, outcome.err(), "sent_from or from_chat cannot be nil")
+
+	// released update is claimed again, finished one is not released
+	_, claimed, _ = repo.Claim(ctx, 2)
+	assert.True(t, claimed)
+	_ = repo.Release(ctx, 2)
+	_, claimed, _ = repo.Claim(ctx, 2)
+	assert.True(t, claimed)
+	_ = repo.Release(ctx, 1)
+	_, claimed, _ = repo.Claim(ctx, 1)
+	assert.False(t, claimed)
+
+	// stale claim is taken over
+	repo.entries[2].Value.(*lruDedupeEntry).claimedAt -= staleClaimSeconds + 1
+	_, claimed, _ = repo.Claim(ctx, 2)
+	assert.True(t, claimed)
+
+	// least recently claimed is evicted
+	_, claimed, _ = repo.Claim(ctx, 3)
+	assert.True(t, claimed)
+	assert.Len(t, repo.entries, 2)
+	_, claimed, _ = repo.Claim(ctx, 1)
+	assert.True(t, claimed)
+}
+
+func Test_UnitTest_UpdateDedupePurgeDue(t *testing.T) {
+	repo := &UpdateDedupeRepo{}
+	now := int64(1700000000)
+
+	assert.True(t, repo.purgeDue(now))
+	assert.False(t, repo.purgeDue(now+dedupePurgeIntervalSeconds-1))
+	assert.True(t, repo.purgeDue(now+dedupePurgeIntervalSeconds))
+	assert.False(t, repo.purgeDue(now+dedupePurgeIntervalSeconds))
+}
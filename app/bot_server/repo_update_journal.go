@@ -0,0 +1,61 @@
+package bot_server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// defaultJournalLimit caps the entries listed if the filter has no limit
+const defaultJournalLimit = 10000
+
+// UpdateJournalRepo keeps the update journal in table tg_update_journal
+type UpdateJournalRepo struct {
+	db *sqlx.DB
+}
+
+func NewUpdateJournalRepo(db *sqlx.DB) *UpdateJournalRepo {
+	return &UpdateJournalRepo{
+		db: db,
+	}
+}
+
+func (repo *UpdateJournalRepo) AppendJournal(ctx context.Context, entry JournalEntry) error {
+	_, err := repo.db.ExecContext(ctx,
+		"insert into tg_update_journal (kind, update_id, chat_id, payload, created_at) values (?,?,?,?,?)",
+		entry.Kind, entry.UpdateId, entry.ChatId, []byte(entry.Payload), entry.CreatedAt)
+	return err
+}
+
+func (repo *UpdateJournalRepo) ListJournal(ctx context.Context, filter JournalFilter) ([]JournalEntry, error) {
+	var (
+		conditions []string
+		args       []interface{}
+		entries    []JournalEntry
+	)
+	if filter.ChatId != 0 {
+		conditions = append(conditions, "chat_id = ?")
+		args = append(args, filter.ChatId)
+	}
+	if filter.Since > 0 {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if filter.Until > 0 {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.Until)
+	}
+	query := "select id, kind, update_id, chat_id, payload, created_at from tg_update_journal"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultJournalLimit
+	}
+	args = append(args, limit)
+
+	err := repo.db.SelectContext(ctx, &entries, query+" order by id limit ?", args...)
+	return entries, err
+}
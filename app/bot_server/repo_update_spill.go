@@ -0,0 +1,80 @@
+package bot_server
+
+import (
+	"context"
+	"encoding/json"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// spilledUpdate is an update overflowing the update channel of a session, ordered by id per user
+type spilledUpdate struct {
+	Id     int64           `db:"id"`
+	UserId int64           `db:"tg_user_id"`
+	ChatId int64           `db:"chat_id"`
+	Update tgbotapi.Update `db:"-"`
+
+	UpdateContent []byte `db:"update_content"`
+}
+
+// UpdateSpillRepo persists overflowing updates in table tg_update_spill, so that they survive restart
+type UpdateSpillRepo struct {
+	db *sqlx.DB
+}
+
+func NewUpdateSpillRepo(db *sqlx.DB) *UpdateSpillRepo {
+	return &UpdateSpillRepo{
+		db: db,
+	}
+}
+
+func (repo *UpdateSpillRepo) Spill(ctx context.Context, userId int64, chatId int64, update tgbotapi.Update) error {
+	content, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	_, err = repo.db.ExecContext(ctx,
+		"insert into tg_update_spill (tg_user_id, chat_id, update_content) values (?,?,?)", userId, chatId, content)
+	return err
+}
+
+// LoadSpilled loads at most limit updates of the user after id afterId in order
+func (repo *UpdateSpillRepo) LoadSpilled(ctx context.Context, userId int64, afterId int64, limit int) ([]spilledUpdate, error) {
+	var spilledUpdates []spilledUpdate
+
+	err := repo.db.SelectContext(ctx, &spilledUpdates,
+		"select id, tg_user_id, chat_id, update_content from tg_update_spill where tg_user_id = ? and id > ? order by id limit ?",
+		userId, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range spilledUpdates {
+		err = json.Unmarshal(spilledUpdates[i].UpdateContent, &spilledUpdates[i].Update)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return spilledUpdates, nil
+}
+
+// DeleteSpilled deletes handled updates of the user up to id maxId
+func (repo *UpdateSpillRepo) DeleteSpilled(ctx context.Context, userId int64, maxId int64) error {
+	_, err := repo.db.ExecContext(ctx, "delete from tg_update_spill where tg_user_id = ? and id <= ?", userId, maxId)
+	return err
+}
+
+func (repo *UpdateSpillRepo) CountSpilled(ctx context.Context, userId int64) (int, error) {
+	var count int
+	err := repo.db.GetContext(ctx, &count, "select count(*) from tg_update_spill where tg_user_id = ?", userId)
+	return count, err
+}
+
+// ListSpilledUsers lists users having spilled updates along with their chat, sessions of them are to be recovered on
+// start
+func (repo *UpdateSpillRepo) ListSpilledUsers(ctx context.Context) ([]spilledUpdate, error) {
+	var spilledUsers []spilledUpdate
+	err := repo.db.SelectContext(ctx, &spilledUsers,
+		"select tg_user_id, max(chat_id) as chat_id from tg_update_spill group by tg_user_id")
+	return spilledUsers, err
+}
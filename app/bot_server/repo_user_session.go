@@ -3,24 +3,54 @@ package bot_server
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"rock_review/util/persist"
+	"rock_review/util/xlogger"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/jmoiron/sqlx"
 )
 
+// errSessionConflict tells the session data was changed by others since it's loaded
+var errSessionConflict = errors.New("user session conflict")
+
 type userSessionData struct {
-	UserId      int64        `db:"tg_user_id"`
-	State       sessionState `db:"state"`
-	PhoneNumber string       `db:"phone_number"`
+	UserId      int64        `db:"tg_user_id" json:"tg_user_id"`
+	State       sessionState `db:"state" json:"state"`
+	PhoneNumber string       `db:"phone_number" json:"phone_number"`
+	Draft       *reviewDraft `db:"review_draft" json:"review_draft"`
+	// Version is bumped on each save, so that a save based on stale data is refused. 0 is data not stored yet.
+	Version int64 `db:"version" json:"version"`
+	// ChatId is the chat to reply when the session expires or an admin replies, as there's no update to reply to
+	ChatId        int64 `db:"chat_id" json:"chat_id"`
+	StateExpireAt int64 `db:"state_expire_at" json:"state_expire_at"` // StateExpireAt is the unix time the state times out, 0 never
+	ReminderSent  bool  `db:"reminder_sent" json:"reminder_sent"`
+	// Locale is the language picked by /language or detected from the telegram client, empty is the default locale
+	Locale string `db:"locale" json:"locale"`
+}
+
+func newInitSessionData(userId int64) userSessionData {
+	return userSessionData{
+		UserId: userId,
+		State:  sessionStateInit,
+	}
 }
 
 type UserSessionRepo struct {
-	//redisCli *redis.Client
-	db *sqlx.DB
+	db      *sqlx.DB
+	dialect persist.Dialect
+	state   string // state is the quoted column, as state is a keyword
 }
 
 func NewUserSessionRepo(db *sqlx.DB) *UserSessionRepo {
+	dialect := persist.DialectOf(db.DriverName())
 	repo := &UserSessionRepo{
-		db: db,
+		db:      db,
+		dialect: dialect,
+		state:   dialect.Quote("state"),
 	}
 	return repo
 }
@@ -33,32 +63,144 @@ func (repo *UserSessionRepo) GetUserSessionData(ctx context.Context, userId int6
 
 	err = repo.db.GetContext(ctx, &sessionData, "select * from review_user_session where tg_user_id = ?", userId)
 	if err == sql.ErrNoRows {
-		sessionData = repo.newInitSessionData(userId)
+		sessionData = newInitSessionData(userId)
 		err = repo.SetUserSessionData(ctx, sessionData)
+		if errors.Is(err, errSessionConflict) {
+			// created by others in between
+			err = repo.db.GetContext(ctx, &sessionData, "select * from review_user_session where tg_user_id = ?", userId)
+			return sessionData, err
+		}
 		if err != nil {
 			return userSessionData{}, err
 		}
+		sessionData.Version = 1
 		return sessionData, nil
 	}
 
 	return sessionData, err
 }
 
-func (repo *UserSessionRepo) newInitSessionData(userId int64) userSessionData {
-	return userSessionData{
-		UserId: userId,
-		State:  sessionStateInit,
-	}
-}
-
+// SetUserSessionData stores the session data if the stored version is still the version of the data, the stored
+// version is bumped by 1. errSessionConflict is returned if the data was changed by others since it's loaded.
 func (repo *UserSessionRepo) SetUserSessionData(ctx context.Context, sessionData userSessionData) error {
 	var (
-		err error
+		result sql.Result
+		err    error
 	)
 
-	_, err = repo.db.ExecContext(ctx,
-		"insert into review_user_session (tg_user_id, phone_number, `state`) values (?,?,?) "+
-			"on duplicate key update phone_number = ?, `state` = ?",
-		sessionData.UserId, sessionData.PhoneNumber, sessionData.State, sessionData.PhoneNumber, sessionData.State)
-	return err
+	if sessionData.Version == 0 {
+		result, err = repo.db.ExecContext(ctx,
+			repo.dialect.InsertIgnore("review_user_session", []string{"tg_user_id", "phone_number", "state", "review_draft",
+				"chat_id", "state_expire_at", "reminder_sent", "locale", "version"}, []string{"tg_user_id"}),
+			sessionData.UserId, sessionData.PhoneNumber, sessionData.State, sessionData.Draft, sessionData.ChatId,
+			sessionData.StateExpireAt, sessionData.ReminderSent, sessionData.Locale, 1)
+	} else {
+		result, err = repo.db.ExecContext(ctx,
+			"update review_user_session set phone_number = ?, "+repo.state+" = ?, review_draft = ?, chat_id = ?, state_expire_at = ?, "+
+				"reminder_sent = ?, locale = ?, version = version + 1 where tg_user_id = ? and version = ?",
+			sessionData.PhoneNumber, sessionData.State, sessionData.Draft, sessionData.ChatId, sessionData.StateExpireAt,
+			sessionData.ReminderSent, sessionData.Locale, sessionData.UserId, sessionData.Version)
+	}
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 {
+		return fmt.Errorf("%w, tg_user_id: %d, version: %d", errSessionConflict, sessionData.UserId, sessionData.Version)
+	}
+	return nil
+}
+
+// ListDueSessions lists sessions timed out by expireAt, or to be reminded by remindAt and not reminded yet
+func (repo *UserSessionRepo) ListDueSessions(ctx context.Context, expireAt int64, remindAt int64, limit int) ([]userSessionData, error) {
+	var sessions []userSessionData
+
+	err := repo.db.SelectContext(ctx, &sessions,
+		"select * from review_user_session where state_expire_at > 0 and "+
+			"(state_expire_at <= ? or (state_expire_at <= ? and reminder_sent = 0)) order by state_expire_at limit ?",
+		expireAt, remindAt, limit)
+	return sessions, err
+}
+
+const sessionCacheKeyFormat = "rock_review:user_session:%d"
+
+// CachedUserSessionRepo caches session data in redis over a repo of mysql. Reads go through the cache, writes go to
+// mysql first then refresh the cache, so mysql stays the source of truth. Entries expire after ttl, sessions of users
+// coming back after a long time are loaded from mysql again.
+type CachedUserSessionRepo struct {
+	redisCli *redis.Client
+	repo     ISessionRepo
+	ttl      time.Duration
+}
+
+func NewCachedUserSessionRepo(redisCli *redis.Client, repo ISessionRepo, ttl time.Duration) *CachedUserSessionRepo {
+	return &CachedUserSessionRepo{
+		redisCli: redisCli,
+		repo:     repo,
+		ttl:      ttl,
+	}
+}
+
+func (repo *CachedUserSessionRepo) GetUserSessionData(ctx context.Context, userId int64) (userSessionData, error) {
+	var sessionData userSessionData
+
+	cacheKey := fmt.Sprintf(sessionCacheKeyFormat, userId)
+	cached, err := repo.redisCli.WithContext(ctx).Get(cacheKey).Bytes()
+	if err == nil {
+		err = json.Unmarshal(cached, &sessionData)
+		if err == nil {
+			return sessionData, nil
+		}
+		xlogger.ErrorF(ctx, "decode cached session fail, user: %d, err: %v", userId, err)
+	} else if err != redis.Nil {
+		xlogger.ErrorF(ctx, "get cached session fail, user: %d, err: %v", userId, err)
+	}
+
+	sessionData, err = repo.repo.GetUserSessionData(ctx, userId)
+	if err != nil {
+		return userSessionData{}, err
+	}
+	repo.setCache(ctx, sessionData)
+	return sessionData, nil
+}
+
+// SetUserSessionData caches the data with the bumped version, the cache is evicted on conflict so that the data is
+// reloaded from mysql
+func (repo *CachedUserSessionRepo) SetUserSessionData(ctx context.Context, sessionData userSessionData) error {
+	err := repo.repo.SetUserSessionData(ctx, sessionData)
+	if errors.Is(err, errSessionConflict) {
+		repo.evictCache(ctx, sessionData.UserId)
+	}
+	if err != nil {
+		return err
+	}
+	sessionData.Version++
+	repo.setCache(ctx, sessionData)
+	return nil
+}
+
+// ListDueSessions lists from mysql, as the cache may miss sessions
+func (repo *CachedUserSessionRepo) ListDueSessions(ctx context.Context, expireAt int64, remindAt int64, limit int) ([]userSessionData, error) {
+	return repo.repo.ListDueSessions(ctx, expireAt, remindAt, limit)
+}
+
+// setCache refreshes the cache, or evicts it on failure so that no stale data is read
+func (repo *CachedUserSessionRepo) setCache(ctx context.Context, sessionData userSessionData) {
+	cacheKey := fmt.Sprintf(sessionCacheKeyFormat, sessionData.UserId)
+	content, err := json.Marshal(sessionData)
+	if err == nil {
+		err = repo.redisCli.WithContext(ctx).Set(cacheKey, content, repo.ttl).Err()
+	}
+	if err == nil {
+		return
+	}
+
+	xlogger.ErrorF(ctx, "set cached session fail, user: %d, err: %v", sessionData.UserId, err)
+	repo.evictCache(ctx, sessionData.UserId)
+}
+
+func (repo *CachedUserSessionRepo) evictCache(ctx context.Context, userId int64) {
+	err := repo.redisCli.WithContext(ctx).Del(fmt.Sprintf(sessionCacheKeyFormat, userId)).Err()
+	if err != nil {
+		xlogger.ErrorF(ctx, "evict cached session fail, user: %d, err: %v", userId, err)
+	}
 }
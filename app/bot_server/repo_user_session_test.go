@@ -0,0 +1,256 @@
+package bot_server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedisServer is an in-process stand-in of redis speaking RESP, it supports PING, GET, SET with EX or PX and DEL
+type fakeRedisServer struct {
+	listener net.Listener
+
+	m        sync.Mutex
+	values   map[string]string
+	expireAt map[string]time.Time
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := &fakeRedisServer{
+		listener: listener,
+		values:   map[string]string{},
+		expireAt: map[string]time.Time{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakeRedisServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedisServer) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRespArray(reader)
+		if err != nil {
+			return
+		}
+		_, err = io.WriteString(conn, s.exec(args))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) exec(args []string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "get":
+		value, ok := s.values[args[1]]
+		if !ok || (!s.expireAt[args[1]].IsZero() && time.Now().After(s.expireAt[args[1]])) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "set":
+		s.values[args[1]] = args[2]
+		delete(s.expireAt, args[1])
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			unit := time.Second
+			if strings.ToLower(args[3]) == "px" {
+				unit = time.Millisecond
+			}
+			s.expireAt[args[1]] = time.Now().Add(time.Duration(n) * unit)
+		}
+		return "+OK\r\n"
+	case "del":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				deleted++
+			}
+			delete(s.values, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func readRespArray(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line: %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func newTestRedisClient(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:        addr,
+		DialTimeout: 100 * time.Millisecond,
+		MaxRetries:  0,
+	})
+}
+
+func Test_UnitTest_CachedUserSessionRepo(t *testing.T) {
+	ctx := context.Background()
+	dep := mockDependency(t)
+	redisServer := newFakeRedisServer(t)
+	repo := NewCachedUserSessionRepo(newTestRedisClient(redisServer.Addr()), dep.sessionRepoCtrl, time.Hour)
+
+	sessionData := userSessionData{
+		UserId:      testUserId,
+		State:       sessionStateComment,
+		PhoneNumber: testPhoneNumber,
+		Draft:       &reviewDraft{ReviewId: testReviewId, Rating: 4, Content: ReviewContent{Text: "good"}},
+	}
+
+	t.Run("read through", func(t *testing.T) {
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(gomock.Any(), int64(testUserId)).Return(sessionData, nil)
+
+		got, err := repo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, sessionData, got)
+
+		// cached
+		got, err = repo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, sessionData, got)
+	})
+
+	t.Run("write through", func(t *testing.T) {
+		newData := sessionData
+		newData.State = sessionStateInit
+		newData.Draft = nil
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), newData).Return(nil)
+
+		assert.Nil(t, repo.SetUserSessionData(ctx, newData))
+		got, err := repo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		newData.Version++
+		assert.Equal(t, newData, got)
+	})
+
+	t.Run("fail: mysql set fail keeps cache", func(t *testing.T) {
+		newData := sessionData
+		newData.PhoneNumber = "+10000"
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), newData).Return(errors.New("db down"))
+
+		assert.NotNil(t, repo.SetUserSessionData(ctx, newData))
+		got, _ := repo.GetUserSessionData(ctx, testUserId)
+		assert.Equal(t, sessionStateInit, got.State)
+		assert.Equal(t, testPhoneNumber, got.PhoneNumber)
+	})
+
+	t.Run("fail: conflict evicts cache", func(t *testing.T) {
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), sessionData).Return(nil)
+		assert.Nil(t, repo.SetUserSessionData(ctx, sessionData))
+
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), sessionData).Return(errSessionConflict)
+		assert.ErrorIs(t, repo.SetUserSessionData(ctx, sessionData), errSessionConflict)
+
+		storedData := sessionData
+		storedData.Version = 2
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(gomock.Any(), int64(testUserId)).Return(storedData, nil)
+		got, err := repo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, storedData, got)
+	})
+
+	t.Run("expired by ttl", func(t *testing.T) {
+		ttlRepo := NewCachedUserSessionRepo(newTestRedisClient(redisServer.Addr()), dep.sessionRepoCtrl, 20*time.Millisecond)
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), sessionData).Return(nil)
+		assert.Nil(t, ttlRepo.SetUserSessionData(ctx, sessionData))
+
+		time.Sleep(30 * time.Millisecond)
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(gomock.Any(), int64(testUserId)).Return(sessionData, nil)
+		got, err := ttlRepo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, sessionData, got)
+	})
+
+	t.Run("corrupted cache falls back to mysql", func(t *testing.T) {
+		redisServer.m.Lock()
+		redisServer.values[fmt.Sprintf(sessionCacheKeyFormat, testUserId)] = "{"
+		redisServer.m.Unlock()
+
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(gomock.Any(), int64(testUserId)).Return(sessionData, nil)
+		got, err := repo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, sessionData, got)
+	})
+
+	t.Run("redis down falls back to mysql", func(t *testing.T) {
+		downServer := newFakeRedisServer(t)
+		downRepo := NewCachedUserSessionRepo(newTestRedisClient(downServer.Addr()), dep.sessionRepoCtrl, time.Hour)
+		downServer.Close()
+
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(gomock.Any(), int64(testUserId)).Return(sessionData, nil)
+		got, err := downRepo.GetUserSessionData(ctx, testUserId)
+		assert.Nil(t, err)
+		assert.Equal(t, sessionData, got)
+
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), sessionData).Return(nil)
+		assert.Nil(t, downRepo.SetUserSessionData(ctx, sessionData))
+	})
+}
@@ -0,0 +1,450 @@
+package bot_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rock_review/app/config"
+	"rock_review/util/goutil"
+	"rock_review/util/xlogger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// maxMediaGroupSize is the most medias telegram takes in a media group
+	maxMediaGroupSize = 10
+
+	// adminCacheTtl is how long whether a user is an admin of the admin chat is remembered, getChatMember is paced as
+	// a message to the group otherwise
+	adminCacheTtl = time.Minute
+
+	// adminUpdateBufferSize is how many updates of the admin chat wait for the worker, more are refused as busy
+	adminUpdateBufferSize = 100
+)
+
+// AdminInbox posts finalized reviews to the admin group chat, where admins acknowledge, escalate or reply to them by
+// the buttons under the post. Everyone in the chat sees the posts, only admins of the chat can press the buttons.
+// Updates of the admin chat never go to user sessions.
+type AdminInbox struct {
+	chatId      int64
+	locale      string
+	bot         IReviewBotSvc
+	reviewRepo  IReviewRepo
+	sessionRepo ISessionRepo
+
+	m      sync.Mutex
+	admins map[int64]adminCacheEntry
+
+	updateCh      chan tgbotapi.Update
+	queueM        sync.Mutex // queueM guards queueing to updateCh
+	intakeStopped bool
+	cancelF       context.CancelFunc
+	done          chan struct{} // done is closed when the worker returns
+}
+
+type adminCacheEntry struct {
+	isAdmin  bool
+	expireAt time.Time
+}
+
+func NewAdminInbox(cfg config.AdminConfig, bot IReviewBotSvc, reviewRepo IReviewRepo, sessionRepo ISessionRepo) *AdminInbox {
+	return &AdminInbox{
+		chatId:      cfg.ChatId,
+		locale:      cfg.Locale,
+		bot:         bot,
+		reviewRepo:  reviewRepo,
+		sessionRepo: sessionRepo,
+		admins:      map[int64]adminCacheEntry{},
+		updateCh:    make(chan tgbotapi.Update, adminUpdateBufferSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// WithAdminInbox posts finalized reviews to the admin chat configured
+func (bot *ReviewBotSvc) WithAdminInbox(cfg config.AdminConfig) *ReviewBotSvc {
+	bot.adminInbox = NewAdminInbox(cfg, bot, bot.reviewRepo, bot.userSessionMgr.repo)
+	return bot
+}
+
+// owns tells whether the update belongs to the admin chat
+func (inbox *AdminInbox) owns(update tgbotapi.Update) bool {
+	chat := update.FromChat()
+	return chat != nil && chat.ID == inbox.chatId
+}
+
+// start runs the worker handling updates queued by enqueue one by one, so that admins waiting on telegram, such as
+// for getChatMember, don't hold up polling. The worker returns when the queue is drained after stopIntake, or when
+// drain gives up.
+func (inbox *AdminInbox) start() {
+	ctx, cancelF := context.WithCancel(context.Background())
+	inbox.cancelF = cancelF
+	goutil.SafeGo(ctx, func() {
+		defer close(inbox.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-inbox.updateCh:
+				if !ok {
+					return
+				}
+				inbox.handleUpdate(withJournalRef(ctx, update), update)
+			}
+		}
+	})
+}
+
+// enqueue queues the update to the worker, the update is refused with errSessionBusy when the queue is full or
+// intake is stopped
+func (inbox *AdminInbox) enqueue(update tgbotapi.Update) error {
+	inbox.queueM.Lock()
+	defer inbox.queueM.Unlock()
+
+	if inbox.intakeStopped {
+		return fmt.Errorf("%w, admin inbox stopped, update_id: %d", errSessionBusy, update.UpdateID)
+	}
+	select {
+	case inbox.updateCh <- update:
+		return nil
+	default:
+		return fmt.Errorf("%w, admin inbox full, update_id: %d", errSessionBusy, update.UpdateID)
+	}
+}
+
+// stopIntake closes the queue, the worker returns after handling updates left in it
+func (inbox *AdminInbox) stopIntake() {
+	inbox.queueM.Lock()
+	defer inbox.queueM.Unlock()
+
+	if !inbox.intakeStopped {
+		inbox.intakeStopped = true
+		close(inbox.updateCh)
+	}
+}
+
+// drain waits for the worker to handle updates left after stopIntake until ctx is done, updates still queued then
+// are dropped
+func (inbox *AdminInbox) drain(ctx context.Context) {
+	if inbox.cancelF == nil {
+		return
+	}
+	select {
+	case <-inbox.done:
+	case <-ctx.Done():
+		xlogger.ErrorF(ctx, "admin inbox not drained on shutdown, pending updates: %d", len(inbox.updateCh))
+	}
+	inbox.cancelF()
+}
+
+// PostReview posts the review with its customer to the admin chat, the medias follow in reply to the post. Failures
+// are logged only, as the review is stored already.
+func (inbox *AdminInbox) PostReview(ctx context.Context, review Review, customer *tgbotapi.User, phoneNumber string) {
+	if customer == nil {
+		customer = &tgbotapi.User{ID: review.TgUserId}
+	}
+	none := inbox.text(adminNoneTemplate)
+	phone, order, stars := none, none, none
+	if len(phoneNumber) > 0 {
+		phone = phoneNumber
+	}
+	if len(review.OrderId) > 0 {
+		order = review.OrderId
+	}
+	if review.Rating > 0 {
+		stars = ratingStars(review.Rating)
+	}
+	content := review.ReviewContent
+	if content == nil {
+		content = &ReviewContent{}
+	}
+
+	msgs := adminReviewTemplate.buildMsgs(inbox.locale, inbox.chatId, arg("review_id", review.ReviewId),
+		arg("customer", userLabel(customer)), arg("phone", phone), arg("order", order), arg("stars", stars),
+		arg("text", content.Text)).
+		withReplyMarkup(newAdminReviewMarkup(inbox.locale, review.ReviewId, adminReviewNew))
+	var post tgbotapi.Message
+	for i, msg := range msgs {
+		sent, err := inbox.bot.Send(ctx, msg)
+		if err != nil {
+			xlogger.ErrorF(ctx, "post review %s to admin chat fail: %v", review.ReviewId, err)
+			return
+		}
+		if i == 0 {
+			post = sent
+		}
+	}
+
+	for _, medias := range groupMedias(content.Medias) {
+		_, err := inbox.bot.Request(ctx, inbox.mediaConfig(medias, post.MessageID))
+		if err != nil {
+			xlogger.ErrorF(ctx, "post medias of review %s to admin chat fail: %v", review.ReviewId, err)
+		}
+	}
+}
+
+// groupMedias groups medias to send together, photos and videos go in media groups, audios in their own as telegram
+// doesn't mix them, and voices one by one as they can't be grouped
+func groupMedias(medias []ReviewMedia) [][]ReviewMedia {
+	var visuals, audios, groups [][]ReviewMedia
+	for _, media := range medias {
+		switch media.Type {
+		case mediaTypePhoto, mediaTypeVideo:
+			visuals = appendMediaGroup(visuals, media)
+		case mediaTypeAudio:
+			audios = appendMediaGroup(audios, media)
+		default:
+			groups = append(groups, []ReviewMedia{media})
+		}
+	}
+	return append(append(visuals, audios...), groups...)
+}
+
+func appendMediaGroup(groups [][]ReviewMedia, media ReviewMedia) [][]ReviewMedia {
+	if len(groups) == 0 || len(groups[len(groups)-1]) >= maxMediaGroupSize {
+		return append(groups, []ReviewMedia{media})
+	}
+	groups[len(groups)-1] = append(groups[len(groups)-1], media)
+	return groups
+}
+
+// mediaConfig sends a group of medias, a single media is sent by itself as a media group takes 2 at least
+func (inbox *AdminInbox) mediaConfig(medias []ReviewMedia, replyTo int) tgbotapi.Chattable {
+	if len(medias) == 1 {
+		file := tgbotapi.FileID(medias[0].FileId)
+		switch medias[0].Type {
+		case mediaTypePhoto:
+			c := tgbotapi.NewPhoto(inbox.chatId, file)
+			c.ReplyToMessageID = replyTo
+			return c
+		case mediaTypeVideo:
+			c := tgbotapi.NewVideo(inbox.chatId, file)
+			c.ReplyToMessageID = replyTo
+			return c
+		case mediaTypeAudio:
+			c := tgbotapi.NewAudio(inbox.chatId, file)
+			c.ReplyToMessageID = replyTo
+			return c
+		default:
+			c := tgbotapi.NewVoice(inbox.chatId, file)
+			c.ReplyToMessageID = replyTo
+			return c
+		}
+	}
+
+	files := make([]interface{}, 0, len(medias))
+	for _, media := range medias {
+		file := tgbotapi.FileID(media.FileId)
+		switch media.Type {
+		case mediaTypePhoto:
+			files = append(files, tgbotapi.NewInputMediaPhoto(file))
+		case mediaTypeVideo:
+			files = append(files, tgbotapi.NewInputMediaVideo(file))
+		default:
+			files = append(files, tgbotapi.NewInputMediaAudio(file))
+		}
+	}
+	c := tgbotapi.NewMediaGroup(inbox.chatId, files)
+	c.ReplyToMessageID = replyTo
+	return c
+}
+
+// handleUpdate handles an update of the admin chat. Messages other than replies to the reply prompt are admins
+// talking, which are left alone.
+func (inbox *AdminInbox) handleUpdate(ctx context.Context, update tgbotapi.Update) {
+	switch {
+	case update.CallbackQuery != nil:
+		inbox.handleCallbackQuery(ctx, update.CallbackQuery)
+	case update.Message != nil && update.Message.ReplyToMessage != nil:
+		inbox.handleReply(ctx, update.Message)
+	}
+}
+
+// handleCallbackQuery handles buttons under a posted review, the query is always answered as user sessions do
+func (inbox *AdminInbox) handleCallbackQuery(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	payload, err := decodeCallbackPayload(query.Data)
+	if err != nil || query.Message == nil {
+		xlogger.WarnF(ctx, "unknown callback of admin chat: %s", query.Data)
+		inbox.answerCallback(ctx, query, inbox.text(callbackExpiredTemplate), false)
+		return
+	}
+	if !inbox.isAdmin(ctx, query.From.ID) {
+		inbox.answerCallback(ctx, query, inbox.text(adminOnlyTemplate), true)
+		return
+	}
+
+	post := query.Message
+	reviewId := payload.Arg
+	switch payload.Action {
+	case callbackActionAdminAck:
+		inbox.answerCallback(ctx, query, "", false)
+		inbox.editStatus(ctx, post, reviewId, adminReviewAcked)
+		// a review escalated has no escalate button, and is pinned
+		if !hasCallbackAction(post.ReplyMarkup, callbackActionAdminEscalate) {
+			_, _ = inbox.bot.Request(ctx, tgbotapi.UnpinChatMessageConfig{ChatID: inbox.chatId, MessageID: post.MessageID})
+		}
+		inbox.reply(ctx, post.MessageID, adminAckedTemplate, arg("admin", userLabel(query.From)))
+	case callbackActionAdminEscalate:
+		inbox.answerCallback(ctx, query, "", false)
+		inbox.editStatus(ctx, post, reviewId, adminReviewEscalated)
+		_, _ = inbox.bot.Request(ctx, tgbotapi.PinChatMessageConfig{ChatID: inbox.chatId, MessageID: post.MessageID})
+		inbox.reply(ctx, post.MessageID, adminEscalatedTemplate, arg("admin", userLabel(query.From)))
+	case callbackActionAdminReply:
+		inbox.answerCallback(ctx, query, "", false)
+		msg := adminReplyPromptTemplate.buildMsg(inbox.locale, inbox.chatId, arg("review_id", reviewId))
+		msg.ReplyToMessageID = post.MessageID
+		msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true}
+		_, _ = inbox.bot.Send(ctx, msg)
+	default:
+		xlogger.WarnF(ctx, "unknown callback action of admin chat: %s", payload.Action)
+		inbox.answerCallback(ctx, query, inbox.text(callbackExpiredTemplate), false)
+	}
+}
+
+// handleReply sends the text an admin replies to the reply prompt to the customer of the review. The prompt is told
+// by its text, which carries the review id.
+func (inbox *AdminInbox) handleReply(ctx context.Context, message *tgbotapi.Message) {
+	prompt := message.ReplyToMessage
+	reviewId := MintedIdPattern.FindString(prompt.Text)
+	if prompt.From == nil || !prompt.From.IsBot || len(reviewId) == 0 ||
+		prompt.Text != inbox.text(adminReplyPromptTemplate, arg("review_id", reviewId)) {
+		return
+	}
+	if message.From == nil || !inbox.isAdmin(ctx, message.From.ID) {
+		inbox.reply(ctx, message.MessageID, adminOnlyTemplate)
+		return
+	}
+	if len(message.Text) == 0 {
+		inbox.reply(ctx, message.MessageID, adminReplyTextOnlyTemplate)
+		return
+	}
+
+	review, err := inbox.reviewRepo.GetReview(ctx, reviewId)
+	if err != nil {
+		xlogger.ErrorF(ctx, "get review %s to reply fail: %v", reviewId, err)
+		inbox.reply(ctx, message.MessageID, adminReplyFailedTemplate, arg("review_id", reviewId))
+		return
+	}
+	// the customer is talked to in the chat and the language of the session, the private chat of the user in the
+	// default language if it's gone
+	locale, chatId := "", review.TgUserId
+	sessionData, err := inbox.sessionRepo.GetUserSessionData(ctx, review.TgUserId)
+	if err == nil {
+		locale = sessionData.Locale
+		if sessionData.ChatId != 0 {
+			chatId = sessionData.ChatId
+		}
+	}
+	msgs := adminReplyTemplate.buildMsgs(locale, chatId, arg("review_id", reviewId), arg("text", message.Text))
+	for _, msg := range msgs {
+		_, err = inbox.bot.Send(ctx, msg)
+		if isBlockedErr(err) {
+			inbox.reply(ctx, message.MessageID, adminReplyBlockedTemplate, arg("review_id", reviewId))
+			return
+		}
+		if err != nil {
+			xlogger.ErrorF(ctx, "send reply of review %s to customer fail: %v", reviewId, err)
+			inbox.reply(ctx, message.MessageID, adminReplyFailedTemplate, arg("review_id", reviewId))
+			return
+		}
+	}
+	inbox.reply(ctx, message.MessageID, adminReplySentTemplate, arg("review_id", reviewId))
+}
+
+// isAdmin tells whether the user is the creator or an administrator of the admin chat, a user is not if telegram
+// can't tell
+func (inbox *AdminInbox) isAdmin(ctx context.Context, userId int64) bool {
+	now := time.Now()
+	inbox.m.Lock()
+	entry, ok := inbox.admins[userId]
+	inbox.m.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		return entry.isAdmin
+	}
+
+	resp, err := inbox.bot.Request(ctx, tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: inbox.chatId, UserID: userId},
+	})
+	if err != nil {
+		return false
+	}
+	var member tgbotapi.ChatMember
+	err = json.Unmarshal(resp.Result, &member)
+	if err != nil {
+		xlogger.ErrorF(ctx, "decode chat member %d fail: %v", userId, err)
+		return false
+	}
+
+	entry = adminCacheEntry{isAdmin: member.IsCreator() || member.IsAdministrator(), expireAt: now.Add(adminCacheTtl)}
+	inbox.m.Lock()
+	inbox.admins[userId] = entry
+	inbox.m.Unlock()
+	return entry.isAdmin
+}
+
+// editStatus updates the buttons of the post to those of status
+func (inbox *AdminInbox) editStatus(ctx context.Context, post *tgbotapi.Message, reviewId string, status adminReviewStatus) {
+	_, _ = inbox.bot.Send(ctx, tgbotapi.NewEditMessageReplyMarkup(inbox.chatId, post.MessageID,
+		newAdminReviewMarkup(inbox.locale, reviewId, status)))
+}
+
+func (inbox *AdminInbox) reply(ctx context.Context, replyTo int, t msgTemplate, args ...templateArg) {
+	msg := t.buildMsg(inbox.locale, inbox.chatId, args...)
+	msg.ReplyToMessageID = replyTo
+	_, _ = inbox.bot.Send(ctx, msg)
+}
+
+func (inbox *AdminInbox) answerCallback(ctx context.Context, query *tgbotapi.CallbackQuery, notice string, alert bool) {
+	callback := tgbotapi.NewCallback(query.ID, notice)
+	callback.ShowAlert = alert
+	_, err := inbox.bot.Request(ctx, callback)
+	if err != nil {
+		xlogger.ErrorF(ctx, "answer callback query fail: %v", err)
+	}
+}
+
+// text renders the template in the locale of the admin chat
+func (inbox *AdminInbox) text(t msgTemplate, args ...templateArg) string {
+	text, _ := t.render(inbox.locale, args...).build()
+	return text
+}
+
+// isBlockedErr tells whether telegram refuses to send to the user, such as when the user blocked the bot or deleted
+// the account, which trying again doesn't help
+func isBlockedErr(err error) bool {
+	var apiErr *tgbotapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+func hasCallbackAction(markup *tgbotapi.InlineKeyboardMarkup, action callbackAction) bool {
+	if markup == nil {
+		return false
+	}
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData == nil {
+				continue
+			}
+			payload, err := decodeCallbackPayload(*button.CallbackData)
+			if err == nil && payload.Action == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userLabel tells who the user is in the admin chat, by name, username and id
+func userLabel(user *tgbotapi.User) string {
+	label := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if len(user.UserName) > 0 {
+		label += " @" + user.UserName
+	}
+	return strings.TrimSpace(label + " (" + strconv.FormatInt(user.ID, 10) + ")")
+}
@@ -0,0 +1,238 @@
+package bot_server
+
+import (
+	"context"
+	"encoding/json"
+	"rock_review/app/config"
+	"rock_review/util/telegramtest"
+	"strconv"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminChatId = -1001234
+
+func Test_UnitTest_AdminInbox(t *testing.T) {
+	ctx := context.Background()
+	bot, server, _ := newTestBot(t, config.BotModeWebhook)
+	bot.WithAdminInbox(config.AdminConfig{ChatId: testAdminChatId})
+	admin := tgbotapi.User{ID: 1111, FirstName: "Ada", UserName: "ada_admin"}
+	stranger := tgbotapi.User{ID: 2222, FirstName: "Sam"}
+	server.SetChatMember(testAdminChatId, tgbotapi.ChatMember{User: &admin, Status: "administrator"})
+	customer := tgbotapi.User{ID: testUserId, FirstName: "Rock", LastName: "Fan", UserName: "rock_fan"}
+
+	handle := func(update tgbotapi.Update) {
+		update.UpdateID = server.PushUpdate(update)
+		assert.Nil(t, bot.HandleUpdate(ctx, update))
+	}
+	text := func(t msgTemplate, args ...templateArg) string {
+		s, _ := t.render(defaultLocale, args...).build()
+		return s
+	}
+	adminCallback := func(from tgbotapi.User, post tgbotapi.Message, action callbackAction) tgbotapi.Update {
+		update := telegramtest.CallbackUpdate(from, testCallbackId, post.MessageID,
+			newCallbackPayload(action, testReviewId).encode())
+		update.CallbackQuery.Message = &post
+		return update
+	}
+
+	// the customer binds phone, rates and comments with medias
+	update := telegramtest.TextUpdate(customer, "")
+	update.Message.Contact = &tgbotapi.Contact{PhoneNumber: testPhoneNumber, UserID: testUserId}
+	handle(update)
+	handle(telegramtest.TextUpdate(customer, "/comment"))
+	handle(telegramtest.CallbackUpdate(customer, testCallbackId, testMessageId,
+		newCallbackPayload(callbackActionRate, testReviewId+callbackDataSeparator+"4").encode()))
+	handle(telegramtest.TextUpdate(customer, "Loud and clear"))
+	for _, fileId := range []string{"p1", "p2"} {
+		update = telegramtest.TextUpdate(customer, "")
+		update.Message.Photo = []tgbotapi.PhotoSize{{FileID: fileId, FileUniqueID: "u_" + fileId}}
+		handle(update)
+	}
+	update = telegramtest.TextUpdate(customer, "")
+	update.Message.Voice = &tgbotapi.Voice{FileID: "v1", FileUniqueID: "u_v1"}
+	handle(update)
+	server.TakeCalls()
+
+	handle(telegramtest.TextUpdate(customer, "/finish"))
+	calls := server.TakeCalls()
+	var posted []telegramtest.Call
+	for _, call := range calls {
+		if call.Params.Get("chat_id") == strconv.Itoa(testAdminChatId) {
+			posted = append(posted, call)
+		}
+	}
+	if !assert.Len(t, posted, 3) {
+		return
+	}
+	assert.Equal(t, "sendMessage", posted[0].Method)
+	assert.Equal(t, text(adminReviewTemplate, arg("review_id", testReviewId),
+		arg("customer", "Rock Fan @rock_fan (3678)"), arg("phone", testPhoneNumber), arg("order", "none"),
+		arg("stars", "★★★★☆"), arg("text", "Loud and clear")), posted[0].Params.Get("text"))
+	var markup tgbotapi.InlineKeyboardMarkup
+	assert.Nil(t, json.Unmarshal([]byte(posted[0].Params.Get("reply_markup")), &markup))
+	assert.Equal(t, newAdminReviewMarkup(defaultLocale, testReviewId, adminReviewNew), markup)
+	// medias follow in reply to the post, the voice can't be grouped
+	assert.Equal(t, "sendMediaGroup", posted[1].Method)
+	assert.Contains(t, posted[1].Params.Get("media"), `"media":"p2"`)
+	assert.Equal(t, "sendVoice", posted[2].Method)
+	postId, _ := strconv.Atoi(posted[1].Params.Get("reply_to_message_id"))
+	assert.NotZero(t, postId)
+	assert.Equal(t, posted[1].Params.Get("reply_to_message_id"), posted[2].Params.Get("reply_to_message_id"))
+	post := tgbotapi.Message{MessageID: postId, Chat: &tgbotapi.Chat{ID: testAdminChatId}, ReplyMarkup: &markup}
+
+	// only admins press buttons, others are told by an alert
+	handle(adminCallback(stranger, post, callbackActionAdminEscalate))
+	calls = server.TakeCalls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, "getChatMember", calls[0].Method)
+		assert.Equal(t, "answerCallbackQuery", calls[1].Method)
+		assert.Equal(t, text(adminOnlyTemplate), calls[1].Params.Get("text"))
+		assert.Equal(t, "true", calls[1].Params.Get("show_alert"))
+	}
+
+	handle(adminCallback(admin, post, callbackActionAdminEscalate))
+	calls = server.TakeCalls()
+	if assert.Len(t, calls, 5) {
+		assert.Equal(t, "getChatMember", calls[0].Method)
+		assert.Equal(t, "answerCallbackQuery", calls[1].Method)
+		assert.Equal(t, "editMessageReplyMarkup", calls[2].Method)
+		assert.NotContains(t, calls[2].Params.Get("reply_markup"), callbackActionAdminEscalate)
+		assert.Equal(t, "pinChatMessage", calls[3].Method)
+		assert.Equal(t, text(adminEscalatedTemplate, arg("admin", "Ada @ada_admin (1111)")), calls[4].Params.Get("text"))
+	}
+
+	// acknowledging an escalated review unpins it, whether one is admin is remembered for a while
+	escalated := newAdminReviewMarkup(defaultLocale, testReviewId, adminReviewEscalated)
+	post.ReplyMarkup = &escalated
+	handle(adminCallback(admin, post, callbackActionAdminAck))
+	var methods []string
+	for _, call := range server.TakeCalls() {
+		methods = append(methods, call.Method)
+	}
+	assert.Equal(t, []string{"answerCallbackQuery", "editMessageReplyMarkup", "unpinChatMessage", "sendMessage"}, methods)
+
+	// admins reply to the customer by replying to the prompt
+	handle(adminCallback(admin, post, callbackActionAdminReply))
+	calls = server.TakeCalls()
+	if !assert.Len(t, calls, 2) {
+		return
+	}
+	prompt := calls[1]
+	assert.Equal(t, text(adminReplyPromptTemplate, arg("review_id", testReviewId)), prompt.Params.Get("text"))
+	assert.Contains(t, prompt.Params.Get("reply_markup"), `"force_reply":true`)
+
+	replyTo := func(from tgbotapi.User, text string) tgbotapi.Update {
+		update := telegramtest.TextUpdate(from, text)
+		update.Message.Chat = &tgbotapi.Chat{ID: testAdminChatId, Type: "supergroup"}
+		update.Message.ReplyToMessage = &tgbotapi.Message{From: &server.Self, Text: prompt.Params.Get("text")}
+		return update
+	}
+	// the customer is replied in the chat stored with the session
+	sessionData, _ := bot.userSessionMgr.repo.GetUserSessionData(ctx, testUserId)
+	sessionData.ChatId = testChatId
+	assert.Nil(t, bot.userSessionMgr.repo.SetUserSessionData(ctx, sessionData))
+	handle(replyTo(admin, "Glad you like it!"))
+	calls = server.TakeCalls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, strconv.FormatInt(testChatId, 10), calls[0].Params.Get("chat_id"))
+		assert.Equal(t, text(adminReplyTemplate, arg("review_id", testReviewId), arg("text", "Glad you like it!")),
+			calls[0].Params.Get("text"))
+		assert.Equal(t, text(adminReplySentTemplate, arg("review_id", testReviewId)), calls[1].Params.Get("text"))
+	}
+
+	// admins are told when the customer blocked the bot, the reply is not tried again
+	server.BlockBot(testChatId)
+	handle(replyTo(admin, "Still there?"))
+	calls = server.TakeCalls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, strconv.FormatInt(testChatId, 10), calls[0].Params.Get("chat_id"))
+		assert.Equal(t, text(adminReplyBlockedTemplate, arg("review_id", testReviewId)), calls[1].Params.Get("text"))
+	}
+
+	handle(replyTo(stranger, "hi"))
+	calls = server.TakeCalls()
+	if assert.Len(t, calls, 1) {
+		assert.Equal(t, text(adminOnlyTemplate), calls[0].Params.Get("text"))
+	}
+
+	// admins talking in the chat are left alone, and get no session
+	handle(replyTo(admin, "")) // a sticker
+	assert.Equal(t, text(adminReplyTextOnlyTemplate), server.TakeCalls()[0].Params.Get("text"))
+	update = telegramtest.TextUpdate(admin, "/comment")
+	update.Message.Chat = &tgbotapi.Chat{ID: testAdminChatId, Type: "supergroup"}
+	handle(update)
+	assert.Nil(t, server.TakeCalls())
+	_, ok := bot.userSessionMgr.activeSessionMap[admin.ID]
+	assert.False(t, ok)
+}
+
+func Test_UnitTest_AdminInboxQueue(t *testing.T) {
+	ctx := context.Background()
+	bot, server, _ := newTestBot(t, config.BotModePolling)
+	bot.WithAdminInbox(config.AdminConfig{ChatId: testAdminChatId})
+	admin := tgbotapi.User{ID: 1111, FirstName: "Ada"}
+	adminUpdate := func(updateId int) tgbotapi.Update {
+		update := telegramtest.TextUpdate(admin, "morning")
+		update.UpdateID = updateId
+		update.Message.Chat = &tgbotapi.Chat{ID: testAdminChatId, Type: "supergroup"}
+		return update
+	}
+
+	// updates wait for the worker instead of being handled on the polling goroutine, a full queue is busy
+	for i := 1; i <= adminUpdateBufferSize; i++ {
+		assert.Nil(t, bot.dispatch(ctx, adminUpdate(i)))
+	}
+	err := bot.dispatch(ctx, adminUpdate(adminUpdateBufferSize+1))
+	assert.True(t, IsRetryableErr(err))
+
+	bot.adminInbox.start()
+	assert.Eventually(t, func() bool {
+		return bot.dispatch(ctx, adminUpdate(adminUpdateBufferSize+1)) == nil
+	}, time.Second, 10*time.Millisecond)
+
+	update := telegramtest.CallbackUpdate(admin, testCallbackId, testMessageId,
+		newCallbackPayload(callbackActionAdminAck, testReviewId).encode())
+	update.UpdateID = adminUpdateBufferSize + 2
+	update.CallbackQuery.Message = &tgbotapi.Message{MessageID: testMessageId, Chat: &tgbotapi.Chat{ID: testAdminChatId}}
+	assert.Nil(t, bot.dispatch(ctx, update))
+	var calls []telegramtest.Call
+	assert.Eventually(t, func() bool {
+		calls = append(calls, server.TakeCalls()...)
+		return len(calls) == 2
+	}, time.Second, 10*time.Millisecond)
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, "getChatMember", calls[0].Method)
+		assert.Equal(t, bot.adminInbox.text(adminOnlyTemplate), calls[1].Params.Get("text"))
+	}
+
+	// updates queued are handled on shutdown, later ones are busy
+	bot.adminInbox.stopIntake()
+	bot.adminInbox.drain(ctx)
+	assert.Len(t, bot.adminInbox.updateCh, 0)
+	err = bot.dispatch(ctx, adminUpdate(adminUpdateBufferSize+3))
+	assert.True(t, IsRetryableErr(err))
+}
+
+func Test_UnitTest_GroupMedias(t *testing.T) {
+	var medias []ReviewMedia
+	for i := 0; i < 12; i++ {
+		medias = append(medias, ReviewMedia{Type: mediaTypePhoto, FileId: "p" + strconv.Itoa(i)})
+	}
+	medias = append(medias, ReviewMedia{Type: mediaTypeVoice, FileId: "v1"}, ReviewMedia{Type: mediaTypeAudio, FileId: "a1"},
+		ReviewMedia{Type: mediaTypeVideo, FileId: "m1"})
+
+	groups := groupMedias(medias)
+	var sizes []int
+	for _, group := range groups {
+		sizes = append(sizes, len(group))
+	}
+	assert.Equal(t, []int{10, 3, 1, 1}, sizes)
+	assert.Equal(t, "m1", groups[1][2].FileId)
+	assert.Equal(t, "a1", groups[2][0].FileId)
+	assert.Equal(t, "v1", groups[3][0].FileId)
+	assert.Nil(t, groupMedias(nil))
+}
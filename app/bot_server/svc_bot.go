@@ -2,31 +2,112 @@ package bot_server
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
+	"rock_review/app/config"
 	"rock_review/util/goutil"
+	"rock_review/util/oss"
 	"rock_review/util/xlogger"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type ReviewBotSvc struct {
 	userSessionMgr *UserSessionMgr
-	reviewRepo     *ReviewRepo
+	reviewRepo     IReviewRepo
+	rockShop       IRockShopSvc
+	dedupeRepo     IUpdateDedupeRepo
+	offsetRepo     IPollingOffsetRepo
+	journalRepo    IUpdateJournalRepo // journalRepo is nil unless the update journal is on
+	adminInbox     *AdminInbox        // adminInbox is nil unless the admin chat is configured
+	sendScheduler  *sendScheduler
 
-	botToken string
-	botApi   *tgbotapi.BotAPI
+	botToken      string
+	mode          string
+	updateTimeout int
+	webhook       config.WebhookConfig
+	apiEndpoint   string
+	fileEndpoint  string
+	botApi        *tgbotapi.BotAPI
+
+	intakeDone    chan struct{} // intakeDone is closed when polling or webhook server stops
+	pollingOffset int64         // pollingOffset is the id next to the last dispatched update
+}
+
+const (
+	// secretTokenHeader carries secret_token registered by setWebhook in every webhook request
+	secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+	maxUpdateBodySize    = 1 << 20
+	sendStatsInterval    = time.Minute
+	pollingRetryInterval = 3 * time.Second
+	// dispatchRetryInterval is the first backoff of dispatching an update again, it doubles up to pollingRetryInterval
+	dispatchRetryInterval = 100 * time.Millisecond
+)
+
+var errSessionBusy = errors.New("user session busy")
+
+// IsRetryableErr tells whether the update failed for the moment only, such as a busy session, a session conflict
+// which outlasts retries or a redelivery while the first delivery is in flight, so that telegram is expected to
+// deliver it again
+func IsRetryableErr(err error) bool {
+	return errors.Is(err, errSessionBusy) || errors.Is(err, errSessionConflict) || errors.Is(err, errUpdateInFlight)
 }
 
-func NewReviewBotSvc(botToken string, userSessionMgr *UserSessionMgr, reviewRepo *ReviewRepo) *ReviewBotSvc {
+func NewReviewBotSvc(cfg config.BotConfig, userSessionMgr *UserSessionMgr, reviewRepo IReviewRepo, rockShop IRockShopSvc) *ReviewBotSvc {
 	return &ReviewBotSvc{
-		botToken:       botToken,
+		botToken:       cfg.Token.Value(),
+		mode:           cfg.Mode,
+		updateTimeout:  cfg.UpdateTimeout,
+		webhook:        cfg.Webhook,
+		apiEndpoint:    cfg.ApiEndpoint,
+		fileEndpoint:   cfg.FileEndpoint,
 		userSessionMgr: userSessionMgr,
 		reviewRepo:     reviewRepo,
+		rockShop:       rockShop,
+		dedupeRepo:     NewLruUpdateDedupeRepo(cfg.DedupeCapacity),
+		sendScheduler:  newSendScheduler(cfg.Send),
 	}
 }
 
+// WithDedupeRepo replaces the in-memory dedupe repo, which only works when all updates arrive at one process
+func (bot *ReviewBotSvc) WithDedupeRepo(repo IUpdateDedupeRepo) *ReviewBotSvc {
+	bot.dedupeRepo = repo
+	return bot
+}
+
+// WithPollingOffsetRepo persists the polling offset on shutdown, otherwise the last fetched updates are confirmed by
+// no one and delivered again after restart
+func (bot *ReviewBotSvc) WithPollingOffsetRepo(repo IPollingOffsetRepo) *ReviewBotSvc {
+	bot.offsetRepo = repo
+	return bot
+}
+
+// Run receives updates by long polling or by serving webhook as configured, both feed updates to user sessions by
+// dispatch. Intake stops when ctx is done, then Shutdown is to be called to drain sessions.
 func (bot *ReviewBotSvc) Run(ctx context.Context) {
+	bot.intakeDone = make(chan struct{})
+
+	goutil.SafeGo(ctx, func() {
+		bot.reportSendStats(ctx)
+	})
+	if bot.adminInbox != nil {
+		bot.adminInbox.start()
+	}
 	goutil.SafeGo(ctx, func() {
+		defer close(bot.intakeDone)
+		bot.userSessionMgr.RecoverSessions(ctx, bot)
+		if bot.mode == config.BotModeWebhook {
+			bot.serveWebhook(ctx)
+			return
+		}
 		bot.receiveUpdates(ctx)
 	})
 	return
@@ -34,61 +115,377 @@ func (bot *ReviewBotSvc) Run(ctx context.Context) {
 
 func (bot *ReviewBotSvc) Init() error {
 	var err error
-	bot.botApi, err = tgbotapi.NewBotAPI(bot.botToken)
-	return err
+	_ = tgbotapi.SetLogger(redactLogger{botToken: bot.botToken})
+	bot.botApi, err = tgbotapi.NewBotAPIWithAPIEndpoint(bot.botToken, bot.apiEndpoint)
+	return bot.redactErr(err)
 }
 
+// HandleUpdate handles the update synchronously, it's for lambda which returns after handling
 func (bot *ReviewBotSvc) HandleUpdate(ctx context.Context, update tgbotapi.Update) error {
+	return bot.HandleRawUpdate(ctx, update, nil)
+}
+
+// HandleRawUpdate handles the update as HandleUpdate does, raw is the update json as received, which is journaled
+// instead of the update, so that fields unknown to tgbotapi are kept
+func (bot *ReviewBotSvc) HandleRawUpdate(ctx context.Context, update tgbotapi.Update, raw []byte) error {
+	return bot.handleOnce(ctx, update, raw, func() error {
+		if update.SentFrom() == nil || update.FromChat() == nil {
+			return fmt.Errorf("sent_from or from_chat cannot be nil")
+		}
+		if bot.adminInbox != nil && bot.adminInbox.owns(update) {
+			bot.adminInbox.handleUpdate(withJournalRef(ctx, update), update)
+			return nil
+		}
+		// todo is chat_id unchanged for a certain user_id
+		userSession := bot.userSessionMgr.GetCurrentUserSession(ctx, update.SentFrom().ID, update.FromChat().ID, bot)
+
+		return userSession.handleUpdateWithRetry(withJournalRef(ctx, update), update)
+	})
+}
+
+// handleOnce handles an update unless it was delivered before, in which case the outcome of the first delivery is
+// returned. A retryable failure releases the update so that its redelivery is handled. Updates are handled anyway if
+// the dedupe repo fails, as losing them is worse than handling them twice. Updates are journaled once claimed, so that
+// redeliveries aren't replayed as updates of their own.
+func (bot *ReviewBotSvc) handleOnce(ctx context.Context, update tgbotapi.Update, raw []byte, handle func() error) error {
+	outcome, claimed, err := bot.dedupeRepo.Claim(ctx, update.UpdateID)
+	if err != nil {
+		xlogger.ErrorF(ctx, "claim update fail, update_id: %d, err: %v", update.UpdateID, err)
+		bot.journalUpdate(ctx, update, raw)
+		return handle()
+	}
+	if !claimed {
+		xlogger.InfoF(ctx, "duplicated update ignored, update_id: %d, status: %d", update.UpdateID, outcome.Status)
+		return outcome.err()
+	}
+
+	bot.journalUpdate(ctx, update, raw)
+	err = handle()
+	if IsRetryableErr(err) {
+		if releaseErr := bot.dedupeRepo.Release(ctx, update.UpdateID); releaseErr != nil {
+			xlogger.ErrorF(ctx, "release update fail, update_id: %d, err: %v", update.UpdateID, releaseErr)
+		}
+		return err
+	}
+	if finishErr := bot.dedupeRepo.Finish(ctx, update.UpdateID, newUpdateOutcome(err)); finishErr != nil {
+		xlogger.ErrorF(ctx, "finish update fail, update_id: %d, err: %v", update.UpdateID, finishErr)
+	}
+	return err
+}
+
+// dispatch queues the update to the session of its sender, it's the one path of updates from polling and webhook.
+// Updates not sent by a user, such as channel posts, are dropped. Updates of the admin chat, which has no session,
+// are queued to the worker of the admin inbox.
+func (bot *ReviewBotSvc) dispatch(ctx context.Context, update tgbotapi.Update) error {
 	if update.SentFrom() == nil || update.FromChat() == nil {
-		return fmt.Errorf("sent_from or from_chat cannot be nil")
+		return nil
+	}
+	if bot.adminInbox != nil && bot.adminInbox.owns(update) {
+		return bot.handleOnce(ctx, update, nil, func() error {
+			return bot.adminInbox.enqueue(update)
+		})
+	}
+
+	return bot.handleOnce(ctx, update, nil, func() error {
+		// todo is chat_id unchanged for a certain user_id
+		userSession := bot.userSessionMgr.GetCurrentUserSession(ctx, update.SentFrom().ID, update.FromChat().ID, bot)
+		return userSession.enqueue(ctx, update)
+	})
+}
+
+// Shutdown is called after ctx of Run is done. It waits for intake to stop, persists the polling offset, and drains
+// sessions and the admin inbox until ctx is done.
+func (bot *ReviewBotSvc) Shutdown(ctx context.Context) DrainReport {
+	if bot.intakeDone != nil {
+		select {
+		case <-bot.intakeDone:
+		case <-ctx.Done():
+			xlogger.ErrorF(ctx, "intake not stopped before shutdown deadline")
+		}
+	}
+
+	offset := atomic.LoadInt64(&bot.pollingOffset)
+	if bot.mode != config.BotModeWebhook && bot.offsetRepo != nil && offset > 0 {
+		err := bot.offsetRepo.SetPollingOffset(ctx, bot.botApi.Self.ID, int(offset))
+		if err != nil {
+			xlogger.ErrorF(ctx, "persist polling offset %d fail: %v", offset, err)
+		}
 	}
-	// todo is chat_id unchanged for a certain user_id
-	userSession := bot.userSessionMgr.GetCurrentUserSession(ctx, update.SentFrom().ID, update.FromChat().ID, bot)
 
-	userSession.handleUpdate(ctx, update)
-	return nil
+	if bot.adminInbox != nil {
+		bot.adminInbox.stopIntake()
+	}
+	report := bot.userSessionMgr.Shutdown(ctx)
+	if bot.adminInbox != nil {
+		bot.adminInbox.drain(ctx)
+	}
+	if len(report.Abandoned) > 0 || len(report.FlushFailed) > 0 {
+		xlogger.ErrorF(ctx, "sessions not drained on shutdown: %s", goutil.JsonString(report))
+	} else {
+		xlogger.InfoF(ctx, "sessions drained on shutdown: %s", goutil.JsonString(report))
+	}
+	return report
 }
 
+// receiveUpdates polls updates from the persisted offset, an update is confirmed to telegram by the offset of the
+// next poll only after it's dispatched
 func (bot *ReviewBotSvc) receiveUpdates(ctx context.Context) {
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := bot.botApi.GetUpdatesChan(u)
+	var offset int
+	if bot.offsetRepo != nil {
+		var err error
+		offset, err = bot.offsetRepo.GetPollingOffset(ctx, bot.botApi.Self.ID)
+		if err != nil {
+			xlogger.ErrorF(ctx, "get polling offset fail, polling from unconfirmed updates: %v", err)
+		}
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			bot.botApi.StopReceivingUpdates()
-		case update := <-updates:
-			if update.SentFrom() == nil || update.FromChat() == nil {
+		updates, err := bot.getUpdates(ctx, offset)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			xlogger.ErrorF(ctx, "get updates fail, retrying in %v: %v", pollingRetryInterval, err)
+			_ = sleepCtx(ctx, pollingRetryInterval)
+			continue
+		}
+
+		for _, update := range updates {
+			// updates not dispatched yet are left to the next run
+			if ctx.Err() != nil {
+				return
+			}
+			if update.UpdateID < offset {
 				continue
 			}
-			// todo is chat_id unchanged for a certain user_id
-			userSession := bot.userSessionMgr.GetCurrentUserSession(ctx, update.SentFrom().ID, update.FromChat().ID, bot)
-
-			select {
-			// todo gracefully wait all session done, then close
-			case userSession.updateCh <- update:
-			default:
-				xlogger.ErrorF(ctx, "userSession channel full, ignoring update, tg_user_id: %d", update.SentFrom().ID)
+			err = bot.dispatchWithRetry(ctx, update)
+			if IsRetryableErr(err) {
+				// retries stop on shutdown only, the update is left to the next run
+				return
+			}
+			if err != nil {
+				xlogger.ErrorF(ctx, "dispatch update fail, ignoring update: %v", err)
 			}
+			offset = update.UpdateID + 1
+			atomic.StoreInt64(&bot.pollingOffset, int64(offset))
+		}
+	}
+}
 
+// dispatchWithRetry dispatches the update again while it fails for the moment, such as a busy session, as the offset
+// can't move past it without losing it. Later updates wait meanwhile, as they are confirmed by the offset as well.
+func (bot *ReviewBotSvc) dispatchWithRetry(ctx context.Context, update tgbotapi.Update) error {
+	backoff := dispatchRetryInterval
+	for {
+		err := bot.dispatch(ctx, update)
+		if !IsRetryableErr(err) {
+			return err
 		}
+		xlogger.WarnF(ctx, "dispatch update fail, retrying in %v: %v", backoff, err)
+		if sleepCtx(ctx, backoff) != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > pollingRetryInterval {
+			backoff = pollingRetryInterval
+		}
+	}
+}
+
+// getUpdates long polls in another goroutine, so that shutdown doesn't wait for the poll. Updates of an abandoned poll
+// are not confirmed, as confirmation is made by the offset of the next poll.
+func (bot *ReviewBotSvc) getUpdates(ctx context.Context, offset int) ([]tgbotapi.Update, error) {
+	type pollResult struct {
+		updates []tgbotapi.Update
+		err     error
+	}
+
+	u := tgbotapi.NewUpdate(offset)
+	u.Timeout = bot.updateTimeout
+	resultCh := make(chan pollResult, 1)
+	goutil.SafeGo(ctx, func() {
+		updates, err := bot.botApi.GetUpdates(u)
+		resultCh <- pollResult{updates: updates, err: bot.redactErr(err)}
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-resultCh:
+		return result.updates, result.err
+	}
+}
+
+// VerifySecretToken checks header X-Telegram-Bot-Api-Secret-Token of a webhook request, any token passes if no
+// secret token is configured
+func (bot *ReviewBotSvc) VerifySecretToken(token string) bool {
+	secretToken := bot.webhook.SecretToken.Value()
+	if len(secretToken) == 0 {
+		return true
 	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secretToken)) == 1
+}
+
+// WebhookHandler serves updates pushed by telegram until ctx is done. A retryable failure, such as a busy session or
+// shutting down, is answered with 503 so that telegram delivers the update again later, other failures are answered
+// with 4xx.
+func (bot *ReviewBotSvc) WebhookHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ctx.Err() != nil {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !bot.VerifySecretToken(r.Header.Get(secretTokenHeader)) {
+			xlogger.WarnF(ctx, "webhook secret token mismatch, remote: %s", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateBodySize)).Decode(&update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = bot.dispatch(ctx, update)
+		if IsRetryableErr(err) {
+			xlogger.WarnF(ctx, "dispatch update fail, telegram will retry: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
 }
 
+// serveWebhook serves WebhookHandler at the configured path, on tls if cert and key are given, or on plain http
+// behind a reverse proxy
+func (bot *ReviewBotSvc) serveWebhook(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle(bot.webhook.Path, bot.WebhookHandler(ctx))
+	server := &http.Server{
+		Addr:              bot.webhook.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// intake stops when requests in flight are done, which dispatch without blocking
+	shutdownDone := make(chan struct{})
+	goutil.SafeGo(ctx, func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	})
+
+	var err error
+	xlogger.InfoF(ctx, "webhook server listening on %s%s", bot.webhook.ListenAddr, bot.webhook.Path)
+	if len(bot.webhook.TlsCertFile) > 0 {
+		err = server.ListenAndServeTLS(bot.webhook.TlsCertFile, bot.webhook.TlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		xlogger.ErrorF(ctx, "webhook server failed: %v", err)
+		return
+	}
+	<-shutdownDone
+}
+
+// Send waits for its turn under the rate limits, and retries on flood control and transient failures, messages are
+// not sent again on failures which may have sent them
 func (bot *ReviewBotSvc) Send(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
-	msg, err := bot.botApi.Send(c)
+	var msg tgbotapi.Message
+	err := bot.sendScheduler.do(ctx, chatIdOf(c), idempotentOf(c), func() error {
+		var err error
+		msg, err = bot.botApi.Send(c)
+		return err
+	})
+	err = bot.redactErr(err)
 	if err != nil {
 		xlogger.ErrorF(ctx, "send msg failed: %v", err)
+		return msg, err
+	}
+	bot.journalOutbound(ctx, c)
+	return msg, nil
+}
+
+func (bot *ReviewBotSvc) Request(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := bot.sendScheduler.do(ctx, chatIdOf(c), idempotentOf(c), func() error {
+		var err error
+		resp, err = bot.botApi.Request(c)
+		return err
+	})
+	err = bot.redactErr(err)
+	if err != nil {
+		xlogger.ErrorF(ctx, "request failed: %v", err)
+		return resp, err
 	}
-	return msg, err
+	bot.journalOutbound(ctx, c)
+	return resp, nil
+}
+
+func (bot *ReviewBotSvc) SendStats() SendStats {
+	return bot.sendScheduler.Stats()
 }
 
-func (bot *ReviewBotSvc) GetFileUrl(ctx context.Context, fileId string) (string, error) {
+// reportSendStats logs send stats periodically when there's anything new
+func (bot *ReviewBotSvc) reportSendStats(ctx context.Context) {
+	var lastStats SendStats
+
+	ticker := time.NewTicker(sendStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := bot.SendStats()
+			if stats != lastStats {
+				xlogger.InfoF(ctx, "send stats: %s", goutil.JsonString(stats))
+				lastStats = stats
+			}
+		}
+	}
+}
+
+// ArchiveFile downloads the file from telegram and stores it to oss, the download url embedding bot token never
+// leaves this method
+func (bot *ReviewBotSvc) ArchiveFile(ctx context.Context, fileId string, bucket string, pathPrefix string) (string, error) {
 	file, err := bot.botApi.GetFile(tgbotapi.FileConfig{FileID: fileId})
 	if err != nil {
-		return "", err
+		return "", bot.redactErr(err)
+	}
+	objectUrl, err := oss.Upload(ctx, bucket, pathPrefix+path.Ext(file.FilePath), fmt.Sprintf(bot.fileEndpoint, bot.botToken, file.FilePath))
+	if err != nil {
+		return "", bot.redactErr(err)
 	}
-	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", bot.botToken, file.FilePath)
-	return url, nil
+	return objectUrl, nil
+}
+
+// redactErr removes bot token from err, errors of http requests to telegram carry the request url embedding the token
+func (bot *ReviewBotSvc) redactErr(err error) error {
+	if err == nil || len(bot.botToken) == 0 || !strings.Contains(err.Error(), bot.botToken) {
+		return err
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), bot.botToken, redactedToken))
+}
+
+const redactedToken = "<redacted>"
+
+// redactLogger is the logger of telegram bot api lib, which logs errors of getUpdates without redacting bot token
+type redactLogger struct {
+	botToken string
+}
+
+func (l redactLogger) Println(v ...interface{}) {
+	xlogger.ErrorF(context.TODO(), "%s", strings.ReplaceAll(fmt.Sprint(v...), l.botToken, redactedToken))
+}
+
+func (l redactLogger) Printf(format string, v ...interface{}) {
+	xlogger.ErrorF(context.TODO(), "%s", strings.ReplaceAll(fmt.Sprintf(format, v...), l.botToken, redactedToken))
 }
@@ -0,0 +1,230 @@
+package bot_server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"rock_review/app/config"
+	"rock_review/util/oss"
+	"rock_review/util/telegramtest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBotToken = "123:secret"
+
+var testUser = tgbotapi.User{ID: testUserId, FirstName: "Rock"}
+
+// newTestBot runs the bot against a fake bot api and in-memory repos, nothing external is needed
+func newTestBot(t *testing.T, mode string) (*ReviewBotSvc, *telegramtest.Server, *MemReviewRepo) {
+	server := telegramtest.NewServer(testBotToken)
+	t.Cleanup(server.Close)
+
+	reviewRepo := NewMemReviewRepo()
+	sessionMgr := NewUserSessionMgr(NewMemUserSessionRepo(), config.SessionConfig{InactiveSeconds: 300, UpdateBufferSize: 10})
+	bot := NewReviewBotSvc(config.BotConfig{
+		Token:          testBotToken,
+		Mode:           mode,
+		UpdateTimeout:  1,
+		DedupeCapacity: 100,
+		ApiEndpoint:    server.APIEndpoint(),
+		FileEndpoint:   server.FileEndpoint(),
+	}, sessionMgr, reviewRepo, nil).WithPollingOffsetRepo(NewMemPollingOffsetRepo())
+	if !assert.Nil(t, bot.Init()) {
+		t.FailNow()
+	}
+	assert.Equal(t, server.Self, bot.botApi.Self)
+	server.TakeCalls()
+	return bot, server, reviewRepo
+}
+
+func Test_UnitTest_BotEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	bot, server, reviewRepo := newTestBot(t, config.BotModeWebhook)
+
+	handle := func(update tgbotapi.Update) {
+		update.UpdateID = server.PushUpdate(update)
+		assert.Nil(t, bot.HandleUpdate(ctx, update))
+	}
+	sentTexts := func() []string {
+		var texts []string
+		for _, call := range server.TakeCalls() {
+			assert.Equal(t, strconv.FormatInt(testChatId, 10), call.Params.Get("chat_id"), call.Method)
+			texts = append(texts, call.Method+": "+call.Params.Get("text"))
+		}
+		return texts
+	}
+	text := func(t msgTemplate, args ...templateArg) string {
+		s, _ := t.render(defaultLocale, args...).build()
+		return s
+	}
+	sendText := func(text string) {
+		update := telegramtest.TextUpdate(testUser, text)
+		update.Message.Chat.ID = testChatId
+		handle(update)
+	}
+
+	sendText("/comment")
+	assert.Equal(t, []string{"sendMessage: " + text(startCommentTemplate)}, sentTexts())
+
+	update := telegramtest.CallbackUpdate(testUser, testCallbackId, testMessageId,
+		newCallbackPayload(callbackActionRate, testReviewId+callbackDataSeparator+"5").encode())
+	update.CallbackQuery.Message.Chat.ID = testChatId
+	handle(update)
+	calls := server.TakeCalls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, "answerCallbackQuery", calls[0].Method)
+		assert.Equal(t, testCallbackId, calls[0].Params.Get("callback_query_id"))
+		assert.Equal(t, "editMessageText", calls[1].Method)
+		assert.Equal(t, strconv.Itoa(testMessageId), calls[1].Params.Get("message_id"))
+	}
+
+	sendText("Plays like a dream")
+	assert.Equal(t, []string{"sendMessage: " + text(resumeCommentTemplate)}, sentTexts())
+
+	sendText("/finish")
+	assert.Equal(t, []string{"sendMessage: " + text(finishCommentTemplate, arg("review_id", testReviewId))}, sentTexts())
+
+	assert.Equal(t, []Review{{
+		ReviewId:       testReviewId,
+		TgUserId:       testUserId,
+		Rating:         5,
+		ReviewContent:  &ReviewContent{Text: "Plays like a dream"},
+		SessionVersion: 4,
+	}}, reviewRepo.ListReviews())
+	sessionData, _ := bot.userSessionMgr.repo.GetUserSessionData(ctx, testUserId)
+	assert.Equal(t, sessionStateInit, sessionData.State)
+	assert.Nil(t, sessionData.Draft)
+
+	// a redelivered update is not handled again
+	update = telegramtest.TextUpdate(testUser, "/finish")
+	update.UpdateID = server.PushUpdate(update) - 1
+	assert.Nil(t, bot.HandleUpdate(ctx, update))
+	assert.Nil(t, server.TakeCalls())
+}
+
+// Test_UnitTest_BotHandleConcurrently hands updates of a user to HandleUpdate at once as lambda instances do, run it
+// with -race
+func Test_UnitTest_BotHandleConcurrently(t *testing.T) {
+	ctx := context.Background()
+	bot, server, _ := newTestBot(t, config.BotModeWebhook)
+
+	newText := func(text string) tgbotapi.Update {
+		update := telegramtest.TextUpdate(testUser, text)
+		update.Message.Chat.ID = testChatId
+		update.UpdateID = server.PushUpdate(update)
+		return update
+	}
+	assert.Nil(t, bot.HandleUpdate(ctx, newText("/comment")))
+
+	const n = 8
+	updates := make([]tgbotapi.Update, 0, n)
+	for i := 0; i < n; i++ {
+		updates = append(updates, newText("line "+strconv.Itoa(i)))
+	}
+	var wg sync.WaitGroup
+	for _, update := range updates {
+		wg.Add(1)
+		go func(update tgbotapi.Update) {
+			defer wg.Done()
+			assert.Nil(t, bot.HandleUpdate(ctx, update))
+		}(update)
+	}
+	wg.Wait()
+
+	sessionData, _ := bot.userSessionMgr.repo.GetUserSessionData(ctx, testUserId)
+	if assert.NotNil(t, sessionData.Draft) {
+		assert.Len(t, strings.Split(sessionData.Draft.Content.Text, "\n"), n)
+	}
+	assert.Equal(t, int64(n+2), sessionData.Version)
+}
+
+func Test_UnitTest_BotPolling(t *testing.T) {
+	bot, server, _ := newTestBot(t, config.BotModePolling)
+	ctx, cancelF := context.WithCancel(context.Background())
+
+	server.PushUpdate(telegramtest.TextUpdate(testUser, "/help"))
+	bot.Run(ctx)
+
+	sent := server.WaitCalls("sendMessage", 1, 5*time.Second)
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, strconv.FormatInt(testUserId, 10), sent[0].Params.Get("chat_id"))
+	}
+	lastUpdateId := server.PushUpdate(telegramtest.TextUpdate(testUser, "/cancel"))
+	server.WaitCalls("sendMessage", 2, 5*time.Second)
+
+	cancelF()
+	shutdownCtx, shutdownCancelF := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancelF()
+	report := bot.Shutdown(shutdownCtx)
+	assert.Empty(t, report.Abandoned)
+	assert.Empty(t, report.FlushFailed)
+
+	// updates not confirmed to telegram yet are confirmed by the persisted offset on the first poll after restart
+	offset, _ := bot.offsetRepo.GetPollingOffset(context.Background(), server.Self.ID)
+	assert.Equal(t, lastUpdateId+1, offset)
+}
+
+func Test_UnitTest_BotPollingBusySession(t *testing.T) {
+	bot, server, _ := newTestBot(t, config.BotModePolling)
+	ctx, cancelF := context.WithCancel(context.Background())
+	defer cancelF()
+
+	// the session refuses updates until intake resumes
+	session := NewUserSession(newInitSessionData(testUserId), testUserId, bot, bot.reviewRepo,
+		bot.userSessionMgr.repo, bot.rockShop)
+	session.intakeStopped = true
+	bot.userSessionMgr.activeSessionMap[testUserId] = session
+	updateId := server.PushUpdate(telegramtest.TextUpdate(testUser, "/help"))
+	bot.Run(ctx)
+
+	assert.Empty(t, server.WaitCalls("sendMessage", 1, 500*time.Millisecond))
+	assert.Zero(t, atomic.LoadInt64(&bot.pollingOffset))
+
+	session.queueM.Lock()
+	session.intakeStopped = false
+	session.queueM.Unlock()
+	go session.Run(ctx)
+	assert.Len(t, server.WaitCalls("sendMessage", 1, 5*time.Second), 1)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&bot.pollingOffset) == int64(updateId+1)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_UnitTest_BotArchiveFile(t *testing.T) {
+	ctx := context.Background()
+	bot, server, _ := newTestBot(t, config.BotModeWebhook)
+	rootDir := t.TempDir()
+	storage, err := oss.NewLocalStorage(rootDir, "http://oss.local")
+	assert.Nil(t, err)
+	oss.Init(storage)
+	t.Cleanup(func() {
+		oss.Init(nil)
+	})
+
+	server.AddFile("f1", "photos/file_1.jpg", []byte("jpeg"))
+	objectUrl, err := bot.ArchiveFile(ctx, "f1", oss.BucketRockReview, "r1/u_f1")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://oss.local/"+oss.BucketRockReview+"/r1/u_f1.jpg", objectUrl)
+	content, err := os.ReadFile(filepath.Join(rootDir, oss.BucketRockReview, "r1", "u_f1.jpg"))
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", string(content))
+
+	_, err = bot.ArchiveFile(ctx, "missing", oss.BucketRockReview, "r1/u_missing")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid file_id")
+		assert.NotContains(t, err.Error(), testBotToken)
+	}
+
+	_, err = bot.Send(ctx, tgbotapi.NewMessage(testChatId, "hello"))
+	assert.Nil(t, err)
+	calls := server.Calls("getFile", "sendMessage")
+	assert.Len(t, calls, 3)
+}
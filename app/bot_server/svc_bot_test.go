@@ -0,0 +1,172 @@
+package bot_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rock_review/app/config"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_RedactErr(t *testing.T) {
+	bot := NewReviewBotSvc(config.BotConfig{Token: "123:secret"}, nil, nil, nil)
+
+	err := bot.redactErr(fmt.Errorf(`Post "https://api.telegram.org/bot123:secret/getFile": dial tcp: i/o timeout`))
+	assert.Equal(t, `Post "https://api.telegram.org/bot<redacted>/getFile": dial tcp: i/o timeout`, err.Error())
+
+	plainErr := fmt.Errorf("Bad Request: chat not found")
+	assert.Equal(t, plainErr, bot.redactErr(plainErr))
+	assert.Nil(t, bot.redactErr(nil))
+}
+
+func Test_UnitTest_WebhookHandler(t *testing.T) {
+	session := NewUserSession(userSessionData{UserId: testUserId}, testChatId, nil, nil, nil, nil).withUpdateBuffer(1)
+	sessionMgr := &UserSessionMgr{activeSessionMap: map[int64]*UserSession{testUserId: session}}
+	bot := NewReviewBotSvc(config.BotConfig{
+		Token:   "123:secret",
+		Mode:    config.BotModeWebhook,
+		Webhook: config.WebhookConfig{SecretToken: "webhook_secret"},
+	}, sessionMgr, nil, nil)
+	handler := bot.WebhookHandler(context.Background())
+
+	serve := func(method string, secretToken string, body string) int {
+		req := httptest.NewRequest(method, "/telegram/webhook", strings.NewReader(body))
+		if len(secretToken) > 0 {
+			req.Header.Set(secretTokenHeader, secretToken)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	userUpdate := fmt.Sprintf(`{"update_id":1,"message":{"message_id":1,"from":{"id":%d},"chat":{"id":%d},"text":"/start"}}`,
+		testUserId, testChatId)
+
+	t.Run("fail: secret token mismatch", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "", userUpdate))
+		assert.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "webhook_secreT", userUpdate))
+		assert.Empty(t, session.updateCh)
+	})
+
+	t.Run("fail: method not allowed", func(t *testing.T) {
+		assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodGet, "webhook_secret", ""))
+	})
+
+	t.Run("fail: malformed body", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "webhook_secret", "{"))
+	})
+
+	t.Run("update not from user is dropped", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(http.MethodPost, "webhook_secret", `{"update_id":2,"channel_post":{"message_id":1,"chat":{"id":1}}}`))
+		assert.Empty(t, session.updateCh)
+	})
+
+	t.Run("update dispatched to session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(http.MethodPost, "webhook_secret", userUpdate))
+		assert.Len(t, session.updateCh, 1)
+
+		// redelivered update is acknowledged without dispatching
+		assert.Equal(t, http.StatusOK, serve(http.MethodPost, "webhook_secret", userUpdate))
+		assert.Len(t, session.updateCh, 1)
+
+		// session busy, telegram should retry
+		busyUpdate := strings.Replace(userUpdate, `"update_id":1`, `"update_id":3`, 1)
+		assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodPost, "webhook_secret", busyUpdate))
+
+		update := <-session.updateCh
+		assert.Equal(t, 1, update.UpdateID)
+		assert.Equal(t, "/start", update.Message.Text)
+
+		// retried after busy
+		assert.Equal(t, http.StatusOK, serve(http.MethodPost, "webhook_secret", busyUpdate))
+		update = <-session.updateCh
+		assert.Equal(t, 3, update.UpdateID)
+	})
+}
+
+func Test_UnitTest_HandleUpdateOnce(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	ctx := context.Background()
+	dedupeRepo := NewMockIUpdateDedupeRepo(ctrl)
+	bot := NewReviewBotSvc(config.BotConfig{Token: "123:secret"}, nil, nil, nil).WithDedupeRepo(dedupeRepo)
+	update := tgbotapi.Update{UpdateID: 7}
+
+	t.Run("first delivery records outcome", func(t *testing.T) {
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{}, true, nil)
+		dedupeRepo.EXPECT().Finish(gomock.Any(), 7, updateOutcome{Status: updateStatusFailed, Err: "sent_from or from_chat cannot be nil"})
+		assert.EqualError(t, bot.HandleUpdate(ctx, update), "sent_from or from_chat cannot be nil")
+	})
+
+	t.Run("redelivery returns original outcome", func(t *testing.T) {
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{Status: updateStatusFailed, Err: "original"}, false, nil)
+		assert.EqualError(t, bot.HandleUpdate(ctx, update), "original")
+
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{Status: updateStatusDone}, false, nil)
+		assert.Nil(t, bot.HandleUpdate(ctx, update))
+	})
+
+	t.Run("redelivery in flight is delivered again", func(t *testing.T) {
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{Status: updateStatusProcessing}, false, nil)
+		err := bot.HandleUpdate(ctx, update)
+		assert.ErrorIs(t, err, errUpdateInFlight)
+		assert.True(t, IsRetryableErr(err))
+	})
+
+	t.Run("conflict releases update for redelivery", func(t *testing.T) {
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{}, true, nil)
+		dedupeRepo.EXPECT().Release(gomock.Any(), 7)
+		err := bot.handleOnce(ctx, update, nil, func() error {
+			return errSessionConflict
+		})
+		assert.True(t, IsRetryableErr(err))
+	})
+
+	t.Run("handled anyway if dedupe repo fails", func(t *testing.T) {
+		dedupeRepo.EXPECT().Claim(gomock.Any(), 7).Return(updateOutcome{}, false, fmt.Errorf("db down"))
+		assert.EqualError(t, bot.HandleUpdate(ctx, update), "sent_from or from_chat cannot be nil")
+	})
+}
+
+func Test_UnitTest_VerifySecretToken(t *testing.T) {
+	bot := NewReviewBotSvc(config.BotConfig{Token: "123:secret"}, nil, nil, nil)
+	assert.True(t, bot.VerifySecretToken(""))
+	assert.True(t, bot.VerifySecretToken("any"))
+
+	bot = NewReviewBotSvc(config.BotConfig{Token: "123:secret", Webhook: config.WebhookConfig{SecretToken: "s"}}, nil, nil, nil)
+	assert.True(t, bot.VerifySecretToken("s"))
+	assert.False(t, bot.VerifySecretToken(""))
+}
+
+func Test_UnitTest_BotShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	offsetRepo := NewMockIPollingOffsetRepo(ctrl)
+	newBot := func(mode string) *ReviewBotSvc {
+		sessionMgr := NewUserSessionMgr(nil, config.SessionConfig{InactiveSeconds: 300, UpdateBufferSize: 10})
+		bot := NewReviewBotSvc(config.BotConfig{Token: "123:secret", Mode: mode}, sessionMgr, nil, nil).
+			WithPollingOffsetRepo(offsetRepo)
+		bot.botApi = &tgbotapi.BotAPI{Self: tgbotapi.User{ID: 123}}
+		bot.intakeDone = make(chan struct{})
+		close(bot.intakeDone)
+		bot.pollingOffset = 101
+		return bot
+	}
+
+	t.Run("polling offset persisted", func(t *testing.T) {
+		offsetRepo.EXPECT().SetPollingOffset(gomock.Any(), int64(123), 101).Return(nil)
+		report := newBot(config.BotModePolling).Shutdown(context.Background())
+		assert.Equal(t, DrainReport{}, report)
+	})
+
+	t.Run("no offset for webhook", func(t *testing.T) {
+		newBot(config.BotModeWebhook).Shutdown(context.Background())
+	})
+}
@@ -0,0 +1,97 @@
+package bot_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type RockShopOrder struct {
+	OrderId   string `json:"order_id"`
+	Title     string `json:"title"`
+	Amount    string `json:"amount"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type rockShopResp struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		Orders []RockShopOrder `json:"orders"`
+	} `json:"data"`
+}
+
+// RockShopSvc queries RockShop open api, orders are looked up by the phone number bound to the telegram account
+type RockShopSvc struct {
+	baseUrl string
+	httpCli *http.Client
+}
+
+func NewRockShopSvc(baseUrl string) *RockShopSvc {
+	return &RockShopSvc{
+		baseUrl: baseUrl,
+		httpCli: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (svc *RockShopSvc) ListRecentOrders(ctx context.Context, phoneNumber string, limit int) ([]RockShopOrder, error) {
+	query := url.Values{}
+	query.Set("phone_number", phoneNumber)
+	query.Set("limit", strconv.Itoa(limit))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, svc.baseUrl+"/api/orders?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := svc.httpCli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rock shop list orders fail, http status: %d", resp.StatusCode)
+	}
+
+	var shopResp rockShopResp
+	err = json.NewDecoder(resp.Body).Decode(&shopResp)
+	if err != nil {
+		return nil, err
+	}
+	if shopResp.Code != 0 {
+		return nil, fmt.Errorf("rock shop list orders fail, code: %d, msg: %s", shopResp.Code, shopResp.Msg)
+	}
+
+	return shopResp.Data.Orders, nil
+}
+
+// NewRockShopStubHandler serves the RockShop order api from a fixed phone_number -> orders map, orders are expected
+// to be sorted from newest to oldest. It's a local stand-in for testing and developing without RockShop.
+func NewRockShopStubHandler(ordersByPhone map[string][]RockShopOrder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/orders", func(w http.ResponseWriter, r *http.Request) {
+		var resp rockShopResp
+
+		phoneNumber := r.URL.Query().Get("phone_number")
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if len(phoneNumber) == 0 || err != nil {
+			resp.Code = 400
+			resp.Msg = "invalid phone_number or limit"
+		} else {
+			orders := ordersByPhone[phoneNumber]
+			if limit > 0 && len(orders) > limit {
+				orders = orders[:limit]
+			}
+			resp.Data.Orders = orders
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	return mux
+}
@@ -0,0 +1,46 @@
+package bot_server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_RockShopListRecentOrders(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		orders = []RockShopOrder{
+			{OrderId: "o1", Title: "Guitar", Amount: "$100", CreatedAt: 1700000200},
+			{OrderId: "o2", Title: "Drum", Amount: "$200", CreatedAt: 1700000100},
+		}
+	)
+
+	server := httptest.NewServer(NewRockShopStubHandler(map[string][]RockShopOrder{testPhoneNumber: orders}))
+	defer server.Close()
+	svc := NewRockShopSvc(server.URL)
+
+	t.Run("limited", func(t *testing.T) {
+		result, err := svc.ListRecentOrders(ctx, testPhoneNumber, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, orders[:1], result)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		result, err := svc.ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit)
+		assert.Nil(t, err)
+		assert.Equal(t, orders, result)
+	})
+
+	t.Run("unknown phone number", func(t *testing.T) {
+		result, err := svc.ListRecentOrders(ctx, "10000", recentOrderLimit)
+		assert.Nil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("fail: bad request", func(t *testing.T) {
+		_, err := svc.ListRecentOrders(ctx, "", recentOrderLimit)
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,270 @@
+package bot_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"rock_review/app/config"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	defaultRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 10 * time.Second
+
+	// chatScheduleCleanSize is the size of chat schedules to drop elapsed ones, idle chats need no schedule
+	chatScheduleCleanSize = 1024
+)
+
+var errSendQueueFull = errors.New("send queue full, message dropped")
+
+// SendStats is a snapshot of the send scheduler for monitoring
+type SendStats struct {
+	QueueDepth int64 `json:"queue_depth"` // QueueDepth is sends waiting for their turn or retry at the moment
+	Sent       int64 `json:"sent"`
+	Retried    int64 `json:"retried"`
+	Dropped    int64 `json:"dropped"` // Dropped is sends given up due to full queue, canceled context or running out of retries
+	Failed     int64 `json:"failed"`  // Failed is sends rejected by telegram for good, such as a blocked chat
+}
+
+// sendScheduler paces requests to telegram under the global limit and the limit of each chat. Senders wait for
+// their turn in their own goroutine, so that messages of a chat keep the order they're sent, while a busy chat
+// doesn't hold others back. Flood control (429) and failures before the request is sent are retried with backoff,
+// other transient failures are retried for idempotent requests only, as a message may be sent despite the failure.
+type sendScheduler struct {
+	globalInterval time.Duration
+	chatInterval   time.Duration
+	groupInterval  time.Duration
+	maxQueueDepth  int64
+	maxRetries     int
+	retryAfterUnit time.Duration // retryAfterUnit is the unit of retry_after, which is seconds, tests shorten it
+	retryBackoff   time.Duration
+
+	m          sync.Mutex
+	globalNext time.Time
+	chatNext   map[int64]time.Time
+
+	queueDepth int64
+	sent       int64
+	retried    int64
+	dropped    int64
+	failed     int64
+}
+
+func newSendScheduler(cfg config.SendConfig) *sendScheduler {
+	return &sendScheduler{
+		globalInterval: perSecond(cfg.GlobalPerSecond, 1),
+		chatInterval:   perSecond(cfg.ChatPerMinute, 60),
+		groupInterval:  perSecond(cfg.GroupPerMinute, 60),
+		maxQueueDepth:  int64(cfg.MaxQueueDepth),
+		maxRetries:     cfg.MaxRetries,
+		retryAfterUnit: time.Second,
+		retryBackoff:   defaultRetryBackoff,
+		chatNext:       map[int64]time.Time{},
+	}
+}
+
+// perSecond converts a rate of count per seconds to the interval between two sends, a non-positive count is unlimited
+func perSecond(count int, seconds int) time.Duration {
+	if count <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second / time.Duration(count)
+}
+
+func (s *sendScheduler) Stats() SendStats {
+	return SendStats{
+		QueueDepth: atomic.LoadInt64(&s.queueDepth),
+		Sent:       atomic.LoadInt64(&s.sent),
+		Retried:    atomic.LoadInt64(&s.retried),
+		Dropped:    atomic.LoadInt64(&s.dropped),
+		Failed:     atomic.LoadInt64(&s.failed),
+	}
+}
+
+// do calls send when chat and global limits allow, chat 0 is subject to the global limit only. It gives up when the
+// queue is full, ctx is done or retries run out. idempotent tells whether send can be retried on ambiguous failures.
+func (s *sendScheduler) do(ctx context.Context, chatId int64, idempotent bool, send func() error) error {
+	depth := atomic.AddInt64(&s.queueDepth, 1)
+	defer atomic.AddInt64(&s.queueDepth, -1)
+	if s.maxQueueDepth > 0 && depth > s.maxQueueDepth {
+		atomic.AddInt64(&s.dropped, 1)
+		return errSendQueueFull
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := sleepCtx(ctx, s.reserveChat(chatId))
+		if err == nil {
+			err = sleepCtx(ctx, s.reserveGlobal(chatId))
+		}
+		if err != nil {
+			atomic.AddInt64(&s.dropped, 1)
+			return err
+		}
+
+		err = send()
+		if err == nil {
+			atomic.AddInt64(&s.sent, 1)
+			return nil
+		}
+
+		retryAfter, retryable := s.retryDelay(err, attempt, idempotent)
+		if !retryable {
+			atomic.AddInt64(&s.failed, 1)
+			return err
+		}
+		if attempt >= s.maxRetries {
+			atomic.AddInt64(&s.dropped, 1)
+			return err
+		}
+
+		atomic.AddInt64(&s.retried, 1)
+		s.delay(chatId, retryAfter)
+	}
+}
+
+// reserveChat takes the next turn of the chat and returns how long to wait for it, chat 0 needs no turn
+func (s *sendScheduler) reserveChat(chatId int64) time.Duration {
+	if chatId == 0 {
+		return 0
+	}
+	now := time.Now()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if len(s.chatNext) >= chatScheduleCleanSize {
+		for id, next := range s.chatNext {
+			if next.Before(now) {
+				delete(s.chatNext, id)
+			}
+		}
+	}
+	turn := now
+	if next := s.chatNext[chatId]; next.After(turn) {
+		turn = next
+	}
+	s.chatNext[chatId] = turn.Add(s.chatIntervalOf(chatId))
+	return turn.Sub(now)
+}
+
+// reserveGlobal takes the next global turn, it's taken after the chat turn is due, so that a chat waiting for its
+// turn doesn't hold global turns back from other chats. The chat turn is pushed back if the global turn is late.
+func (s *sendScheduler) reserveGlobal(chatId int64) time.Duration {
+	now := time.Now()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	turn := now
+	if s.globalNext.After(turn) {
+		turn = s.globalNext
+	}
+	s.globalNext = turn.Add(s.globalInterval)
+	if chatId != 0 {
+		if chatNext := turn.Add(s.chatIntervalOf(chatId)); chatNext.After(s.chatNext[chatId]) {
+			s.chatNext[chatId] = chatNext
+		}
+	}
+	return turn.Sub(now)
+}
+
+// delay holds the chat back for d, flood control of chat 0 holds all chats back
+func (s *sendScheduler) delay(chatId int64, d time.Duration) {
+	next := time.Now().Add(d)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if chatId == 0 {
+		if next.After(s.globalNext) {
+			s.globalNext = next
+		}
+		return
+	}
+	if next.After(s.chatNext[chatId]) {
+		s.chatNext[chatId] = next
+	}
+}
+
+// chatIntervalOf tells interval of a chat, ids of groups and channels are negative, they're limited more strictly
+func (s *sendScheduler) chatIntervalOf(chatId int64) time.Duration {
+	if chatId < 0 {
+		return s.groupInterval
+	}
+	return s.chatInterval
+}
+
+// retryDelay tells whether err is worth a retry and how long to wait. Flood control tells the wait by retry_after, a
+// request refused by flood control is not carried out. Failing to connect backs off exponentially, as nothing is sent.
+// Server errors and other network errors back off exponentially as well, but only for idempotent requests, as the
+// request may have been carried out. Other errors of telegram are final.
+func (s *sendScheduler) retryDelay(err error, attempt int, idempotent bool) (time.Duration, bool) {
+	var (
+		apiErr *tgbotapi.Error
+		opErr  *net.OpError
+	)
+	switch {
+	case errors.As(err, &apiErr) && apiErr.RetryAfter > 0:
+		return time.Duration(apiErr.RetryAfter) * s.retryAfterUnit, true
+	case apiErr != nil && (apiErr.Code < 500 || !idempotent):
+		return 0, false
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return 0, false
+	case !idempotent && !(errors.As(err, &opErr) && opErr.Op == "dial"):
+		return 0, false
+	}
+
+	backoff := s.retryBackoff << attempt
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	return backoff, true
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// idempotentOf tells whether a request can be carried out twice without harm. Requests sending messages are not, a
+// retry after an ambiguous failure may send the message twice.
+func idempotentOf(c tgbotapi.Chattable) bool {
+	switch reflect.Indirect(reflect.ValueOf(c)).Interface().(type) {
+	case tgbotapi.MessageConfig, tgbotapi.PhotoConfig, tgbotapi.VideoConfig, tgbotapi.AudioConfig,
+		tgbotapi.VoiceConfig, tgbotapi.DocumentConfig, tgbotapi.AnimationConfig, tgbotapi.StickerConfig,
+		tgbotapi.VideoNoteConfig, tgbotapi.ContactConfig, tgbotapi.LocationConfig, tgbotapi.VenueConfig,
+		tgbotapi.GameConfig, tgbotapi.DiceConfig, tgbotapi.ForwardConfig, tgbotapi.CopyMessageConfig,
+		tgbotapi.MediaGroupConfig, tgbotapi.InvoiceConfig:
+		return false
+	}
+	return true
+}
+
+// chatIdOf finds the chat a request is sent to, requests not bound to a chat such as answerCallbackQuery get 0.
+// Configs of telegram bot api embed the chat id as ChatID of BaseChat or BaseEdit.
+func chatIdOf(c tgbotapi.Chattable) int64 {
+	v := reflect.Indirect(reflect.ValueOf(c))
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+	field := v.FieldByName("ChatID")
+	if !field.IsValid() || field.Kind() != reflect.Int64 {
+		return 0
+	}
+	return field.Int()
+}
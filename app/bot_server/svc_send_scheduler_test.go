@@ -0,0 +1,167 @@
+package bot_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"rock_review/app/config"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSendScheduler(cfg config.SendConfig) *sendScheduler {
+	s := newSendScheduler(cfg)
+	s.retryAfterUnit = time.Millisecond
+	s.retryBackoff = time.Millisecond
+	return s
+}
+
+func Test_UnitTest_SendSchedulerReserve(t *testing.T) {
+	s := newTestSendScheduler(config.SendConfig{GlobalPerSecond: 10, ChatPerMinute: 60, GroupPerMinute: 20})
+	delta := float64(10 * time.Millisecond)
+
+	// first send of each chat is due at once, then spaced by the global limit
+	assert.LessOrEqual(t, s.reserveChat(testChatId), time.Duration(0))
+	assert.LessOrEqual(t, s.reserveGlobal(testChatId), time.Duration(0))
+	assert.LessOrEqual(t, s.reserveChat(testChatId+1), time.Duration(0))
+	assert.InDelta(t, 100*time.Millisecond, s.reserveGlobal(testChatId+1), delta)
+
+	// next send of a chat waits a second, a group waits 3 seconds
+	assert.InDelta(t, time.Second, s.reserveChat(testChatId), delta)
+	assert.LessOrEqual(t, s.reserveChat(-testChatId), time.Duration(0))
+	assert.InDelta(t, 3*time.Second, s.reserveChat(-testChatId), delta)
+
+	// waiting chats don't hold the global turn back, chat 0 is only globally limited
+	assert.LessOrEqual(t, s.reserveChat(0), time.Duration(0))
+	assert.InDelta(t, 200*time.Millisecond, s.reserveGlobal(0), delta)
+
+	// chat turn is pushed back by a late global turn
+	assert.LessOrEqual(t, s.reserveChat(testChatId+2), time.Duration(0))
+	assert.InDelta(t, 300*time.Millisecond, s.reserveGlobal(testChatId+2), delta)
+	assert.InDelta(t, 1300*time.Millisecond, s.reserveChat(testChatId+2), delta)
+}
+
+func Test_UnitTest_SendSchedulerDo(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("idempotent requests retry on flood control, server and network errors", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{MaxRetries: 3})
+		errs := []error{
+			&tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}},
+			&tgbotapi.Error{Code: 502, Message: "Bad Gateway"},
+			fmt.Errorf("dial tcp: i/o timeout"),
+		}
+		calls := 0
+		start := time.Now()
+		err := s.do(ctx, testChatId, true, func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 4, calls)
+		assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+		assert.Equal(t, SendStats{Sent: 1, Retried: 3}, s.Stats())
+	})
+
+	t.Run("sends are retried only on failures before sending", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{MaxRetries: 3})
+		errs := []error{
+			&tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 1", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}},
+			&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			&tgbotapi.Error{Code: 502, Message: "Bad Gateway"},
+		}
+		calls := 0
+		err := s.do(ctx, testChatId, false, func() error {
+			calls++
+			return errs[calls-1]
+		})
+		assert.EqualError(t, err, "Bad Gateway")
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, SendStats{Retried: 2, Failed: 1}, s.Stats())
+
+		calls = 0
+		err = s.do(ctx, testChatId, false, func() error {
+			calls++
+			return &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("fail: retries run out", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{MaxRetries: 1})
+		calls := 0
+		err := s.do(ctx, testChatId, true, func() error {
+			calls++
+			return &tgbotapi.Error{Code: 500, Message: "Internal Server Error"}
+		})
+		assert.EqualError(t, err, "Internal Server Error")
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, SendStats{Retried: 1, Dropped: 1}, s.Stats())
+	})
+
+	t.Run("fail: rejected for good", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{MaxRetries: 3})
+		calls := 0
+		err := s.do(ctx, testChatId, true, func() error {
+			calls++
+			return &tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}
+		})
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, SendStats{Failed: 1}, s.Stats())
+	})
+
+	t.Run("fail: queue full", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{MaxQueueDepth: 1})
+		blocked, release := make(chan struct{}), make(chan struct{})
+		go func() {
+			_ = s.do(ctx, testChatId, true, func() error {
+				close(blocked)
+				<-release
+				return nil
+			})
+		}()
+		<-blocked
+
+		assert.Equal(t, int64(1), s.Stats().QueueDepth)
+		assert.Equal(t, errSendQueueFull, s.do(ctx, testChatId+1, true, func() error { return nil }))
+		assert.Equal(t, int64(1), s.Stats().Dropped)
+		close(release)
+	})
+
+	t.Run("fail: canceled while waiting", func(t *testing.T) {
+		s := newTestSendScheduler(config.SendConfig{ChatPerMinute: 1})
+		_ = s.do(ctx, testChatId, true, func() error { return nil })
+
+		cancelCtx, cancelF := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancelF()
+		err := s.do(cancelCtx, testChatId, true, func() error { return nil })
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, SendStats{Sent: 1, Dropped: 1}, s.Stats())
+	})
+}
+
+func Test_UnitTest_IdempotentOf(t *testing.T) {
+	assert.False(t, idempotentOf(tgbotapi.NewMessage(testChatId, "hi")))
+	assert.False(t, idempotentOf(tgbotapi.NewMediaGroup(testChatId, nil)))
+	assert.False(t, idempotentOf(&tgbotapi.VoiceConfig{}))
+	assert.True(t, idempotentOf(tgbotapi.NewEditMessageText(testChatId, testMessageId, "hi")))
+	assert.True(t, idempotentOf(tgbotapi.NewCallback(testCallbackId, "")))
+	assert.True(t, idempotentOf(tgbotapi.PinChatMessageConfig{ChatID: testChatId, MessageID: testMessageId}))
+}
+
+func Test_UnitTest_ChatIdOf(t *testing.T) {
+	assert.Equal(t, int64(testChatId), chatIdOf(tgbotapi.NewMessage(testChatId, "hi")))
+	assert.Equal(t, int64(testChatId), chatIdOf(tgbotapi.NewEditMessageText(testChatId, testMessageId, "hi")))
+	assert.Equal(t, int64(testChatId), chatIdOf(tgbotapi.NewMediaGroup(testChatId, nil)))
+	assert.Equal(t, int64(0), chatIdOf(tgbotapi.NewCallback(testCallbackId, "")))
+}
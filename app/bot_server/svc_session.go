@@ -2,7 +2,11 @@ package bot_server
 
 import (
 	"context"
+	"errors"
+	"rock_review/util/oss"
 	"rock_review/util/xlogger"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +18,17 @@ const (
 	sessionStateComment sessionState = 1
 )
 
+const (
+	defaultUpdateBufferSize = 10
+
+	recentOrderLimit = 5
+	maxRating        = 5
+
+	// maxConflictRetries is how many times an update is handled again on a session conflict, which happens when
+	// lambda instances handle updates of a user at the same time
+	maxConflictRetries = 3
+)
+
 type sessionState = int
 
 type UserSession struct {
@@ -24,28 +39,67 @@ type UserSession struct {
 	updateCh       chan tgbotapi.Update
 	once           sync.Once
 	cancelF        context.CancelFunc
+	done           chan struct{} // done is closed when Run returns
+	unsaved        bool          // unsaved tells the last save failed, the session data is to be flushed on shutdown
+	conflicted     bool          // conflicted tells the session data was changed by others while handling the update
+	dirty          bool          // dirty tells the session data is changed by the event being handled
+	replies        []tgbotapi.Chattable
+	afterSaves     []func(ctx context.Context)
+	// handleM serializes handling of updates, which Run does by itself, but HandleUpdate of lambda calls from the
+	// goroutines of requests
+	handleM sync.Mutex
+
+	queueM        sync.Mutex // queueM guards queueing to updateCh and spillRepo
+	intakeStopped bool
+	spilled       int // spilled is the count of spilled updates not handled yet
+	maxSpilled    int
+	lastSpillId   int64
+	spillNotify   chan struct{}
+	spillRepo     IUpdateSpillRepo
+	handleBudget  chan struct{}
 
 	reviewBot       IReviewBotSvc
 	reviewRepo      IReviewRepo
 	userSessionRepo ISessionRepo
+	rockShop        IRockShopSvc
+	adminInbox      *AdminInbox // adminInbox is nil unless the admin chat is configured
 }
 
-func NewUserSession(data userSessionData, chatId int64, botSvc IReviewBotSvc, reviewRepo IReviewRepo, sessionRepo ISessionRepo) *UserSession {
+func NewUserSession(data userSessionData, chatId int64, botSvc IReviewBotSvc, reviewRepo IReviewRepo, sessionRepo ISessionRepo, rockShop IRockShopSvc) *UserSession {
+	data.ChatId = chatId
 	userSession := &UserSession{
 		userSessionData: data,
 		chatId:          chatId,
 		lastActiveUnix:  time.Now().Unix(),
-		updateCh:        make(chan tgbotapi.Update, 10),
+		updateCh:        make(chan tgbotapi.Update, defaultUpdateBufferSize),
+		done:            make(chan struct{}),
+		spillNotify:     make(chan struct{}, 1),
 		reviewBot:       botSvc,
 		reviewRepo:      reviewRepo,
 		userSessionRepo: sessionRepo,
+		rockShop:        rockShop,
 	}
 
 	return userSession
 }
 
+// withUpdateBuffer resizes the update channel, it must be called before the session runs
+func (session *UserSession) withUpdateBuffer(size int) *UserSession {
+	session.updateCh = make(chan tgbotapi.Update, size)
+	return session
+}
+
+// withAdminInbox posts reviews finalized to the admin chat
+func (session *UserSession) withAdminInbox(inbox *AdminInbox) *UserSession {
+	session.adminInbox = inbox
+	return session
+}
+
+// Run handles updates one by one until ctx is done or the update channel is closed and drained. Updates in the
+// channel are older than spilled ones, spilled ones are handled when the channel is empty.
 func (session *UserSession) Run(ctx context.Context) {
 	session.once.Do(func() {
+		defer close(session.done)
 		newCtx, cancelF := context.WithCancel(ctx)
 		session.cancelF = cancelF
 
@@ -58,7 +112,25 @@ func (session *UserSession) Run(ctx context.Context) {
 				if !ok {
 					return
 				}
-				session.handleUpdate(newCtx, update)
+				session.handleWithBudget(newCtx, update)
+				continue
+			default:
+			}
+
+			if session.spilledCount() > 0 {
+				session.handleSpilled(newCtx)
+				continue
+			}
+
+			select {
+			case <-newCtx.Done():
+				return
+			case update, ok := <-session.updateCh:
+				if !ok {
+					return
+				}
+				session.handleWithBudget(newCtx, update)
+			case <-session.spillNotify:
 			}
 		}
 	})
@@ -70,143 +142,392 @@ func (session *UserSession) Close() {
 	}
 }
 
+// Save stores the session data if no one else changed it since it's loaded, otherwise errSessionConflict is returned
+// and the update is to be handled again on reloaded data
 func (session *UserSession) Save(ctx context.Context) error {
-	return session.userSessionRepo.SetUserSessionData(ctx, session.userSessionData)
+	err := session.userSessionRepo.SetUserSessionData(ctx, session.userSessionData)
+	if err == nil {
+		session.Version++
+	}
+	if errors.Is(err, errSessionConflict) {
+		session.conflicted = true
+	}
+	session.unsaved = err != nil && !session.conflicted
+	return err
+}
+
+// reload replaces the session data with the stored one
+func (session *UserSession) reload(ctx context.Context) error {
+	sessionData, err := session.userSessionRepo.GetUserSessionData(ctx, session.UserId)
+	if err != nil {
+		return err
+	}
+	sessionData.ChatId = session.chatId
+	session.userSessionData = sessionData
+	return nil
 }
 
-func (session *UserSession) handleUpdate(ctx context.Context, update tgbotapi.Update) {
+// handleUpdateWithRetry handles the update again on reloaded session data when the session data was changed by
+// others. Replies are sent after saving, so the update is replied once. errSessionConflict is returned when retries
+// run out.
+func (session *UserSession) handleUpdateWithRetry(ctx context.Context, update tgbotapi.Update) error {
+	session.handleM.Lock()
+	defer session.handleM.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		err := session.handleUpdate(ctx, update)
+		if err == nil || attempt >= maxConflictRetries {
+			return err
+		}
+
+		xlogger.WarnF(ctx, "session conflict, handle again, user: %d, update_id: %d", session.UserId, update.UpdateID)
+		err = session.reload(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleUpdate returns errSessionConflict if the session data was changed by others, other errors are replied to the
+// user
+func (session *UserSession) handleUpdate(ctx context.Context, update tgbotapi.Update) error {
+	session.conflicted = false
+
 	switch {
 	case update.Message != nil:
 		session.handleUserMsg(ctx, update.Message)
+	case update.CallbackQuery != nil:
+		session.handleCallbackQuery(ctx, update.CallbackQuery)
+	}
+
+	if session.conflicted {
+		return errSessionConflict
+	}
+	return nil
+}
+
+// sendErrRetry asks the user to retry, unless the update is to be handled again due to a session conflict
+func (session *UserSession) sendErrRetry(ctx context.Context) {
+	if session.conflicted {
+		return
 	}
+	_, _ = session.reviewBot.Send(ctx, session.msg(errRetryTemplate))
 }
 
 func (session *UserSession) handleUserMsg(ctx context.Context, message *tgbotapi.Message) {
-	var (
-		err error
-	)
 	xlogger.InfoF(ctx, "%s wrote %s", message.From.FirstName, message.Text)
 
-	if len(message.Text) > 0 && message.Text[0] == '/' {
-		err = session.handleCommand(ctx, message)
-		if err != nil {
-			xlogger.ErrorF(ctx, "handle user command %s fail: %v", message.Text, err)
-			_, _ = session.reviewBot.Send(ctx, errRetryTemplate.buildMsg(session.chatId))
-		}
-		return
+	event := newMessageEvent(message)
+	err := reviewSessionMachine.fire(session, ctx, event)
+	if err != nil {
+		xlogger.ErrorF(ctx, "handle %s %s fail: %v", event.input, event.name, err)
+		session.sendErrRetry(ctx)
 	}
+}
 
-	if message.Contact != nil {
-		if message.Contact.UserID != message.From.ID {
-			_, _ = session.reviewBot.Send(ctx, phoneBindUseOwnContactTemplate.buildMsg(session.chatId))
-			return
-		}
-		session.PhoneNumber = message.Contact.PhoneNumber
-		err = session.Save(ctx)
-		if err != nil {
-			xlogger.ErrorF(ctx, "save phone number fail:%v", err)
-			_, _ = session.reviewBot.Send(ctx, errRetryTemplate.buildMsg(session.chatId))
-			return
-		}
-		successMsg := phoneBindSuccessTemplate.buildMsg(session.chatId)
-		successMsg.ReplyMarkup = tgbotapi.ReplyKeyboardRemove{RemoveKeyboard: true}
-		_, _ = session.reviewBot.Send(ctx, successMsg)
-		return
-	}
+// markDirty tells the state machine to save the session data after the event
+func (session *UserSession) markDirty() {
+	session.dirty = true
+}
 
-	if session.State == sessionStateComment {
-		err = session.handleUserComment(ctx, message)
-		if err != nil {
-			xlogger.ErrorF(ctx, "handle user comment fail: %v", err)
-			_, _ = session.reviewBot.Send(ctx, errRetryTemplate.buildMsg(session.chatId))
-		}
+// reply queues messages to send in order after the session data is saved
+func (session *UserSession) reply(cs ...tgbotapi.Chattable) {
+	session.replies = append(session.replies, cs...)
+}
+
+// afterSave queues f to run after the session data is saved and replies are sent, so that f runs once for an event
+// even if the event is handled again on a session conflict
+func (session *UserSession) afterSave(f func(ctx context.Context)) {
+	session.afterSaves = append(session.afterSaves, f)
+}
+
+// text renders the template in the locale of the user
+func (session *UserSession) text(t msgTemplate, args ...templateArg) complexText {
+	return t.render(session.Locale, args...)
+}
+
+// msg builds the message of the template in the locale of the user, with the reply markup of the template if any
+func (session *UserSession) msg(t msgTemplate, args ...templateArg) tgbotapi.MessageConfig {
+	return t.buildMsg(session.Locale, session.chatId, args...)
+}
+
+// msgs builds the template as msg does, split into messages if the text is longer than telegram takes
+func (session *UserSession) msgs(t msgTemplate, args ...templateArg) sendables {
+	return t.buildMsgs(session.Locale, session.chatId, args...)
+}
+
+// detectLocale remembers the language of the user's telegram client, so that messages without an update, such as
+// reminders, are in the language as well. A locale picked by /language is kept.
+func (session *UserSession) detectLocale(event *sessionEvent) {
+	if len(session.Locale) > 0 || len(event.languageCode) == 0 {
 		return
 	}
+	session.Locale = msgCatalog().resolveLocale(event.languageCode)
+	session.markDirty()
+}
 
-	session.sendHelpMsg(ctx)
+// dropDraft enters init, where no draft is kept
+func (session *UserSession) dropDraft() {
+	session.Draft = nil
 }
 
-func (session *UserSession) sendHelpMsg(ctx context.Context) {
-	msg := helpMsgTemplate.buildMsg(session.chatId)
+// enterComment asks for rating along with the comment, rating is optional so user can skip to text directly
+func (session *UserSession) enterComment() {
+	if session.Draft == nil {
+		session.Draft = newReviewDraft()
+	}
+	msg := session.msg(startCommentTemplate)
+	msg.ReplyMarkup = newRatingMarkup(session.Locale, session.Draft.ReviewId)
+	session.reply(msg)
+}
+
+func (session *UserSession) replyHelp(ctx context.Context, event *sessionEvent) (bool, error) {
+	msgs := session.msgs(helpMsgTemplate)
 	if len(session.PhoneNumber) == 0 { // todo do not always pop if user refuse to provide phone number
-		msg = helpMsgRequestPhoneTemplate.buildMsg(session.chatId)
-		msg.ReplyMarkup = requestPhoneMarkup
+		msgs = session.text(helpMsgTemplate).with(session.text(requestPhoneTemplate)...).buildMsgs(session.chatId).
+			withReplyMarkup(requestPhoneTemplate.replyMarkup(session.Locale))
 	}
-	_, _ = session.reviewBot.Send(ctx, msg)
+	session.reply(msgs...)
+	return true, nil
 }
 
-func (session *UserSession) handleUserComment(ctx context.Context, message *tgbotapi.Message) (err error) {
-	if len(message.Text) == 0 && len(message.Photo) == 0 && message.Video == nil && message.Audio == nil && message.Voice == nil {
-		_, _ = session.reviewBot.Send(ctx, sendValidCommentTemplate.buildMsg(session.chatId))
-		return
+func (session *UserSession) replyUnknownCommand(ctx context.Context, event *sessionEvent) (bool, error) {
+	session.reply(session.msg(unknownCommandTemplate))
+	return true, nil
+}
+
+func (session *UserSession) bindPhone(ctx context.Context, event *sessionEvent) (bool, error) {
+	contact := event.message.Contact
+	if contact.UserID != event.message.From.ID {
+		session.reply(session.msg(phoneBindUseOwnContactTemplate))
+		return false, nil
+	}
+	session.PhoneNumber = contact.PhoneNumber
+	session.markDirty()
+
+	session.reply(session.msg(phoneBindSuccessTemplate))
+	return true, nil
+}
+
+func (session *UserSession) appendComment(ctx context.Context, event *sessionEvent) (bool, error) {
+	message := event.message
+	if len(message.Text) == 0 && event.input != sessionInputMedia {
+		session.reply(session.msg(sendValidCommentTemplate))
+		return false, nil
 	}
 
 	var (
-		mediaUrls []string
-		fileIds   []string
-		text      string
+		text string
 	)
 
-	if len(message.Photo) > 0 {
-		fileIds = append(fileIds, message.Photo[len(message.Photo)-1].FileID)
+	text = message.Text
+	if len(message.Caption) != 0 {
+		text = message.Caption
 	}
-	if message.Video != nil {
-		fileIds = append(fileIds, message.Video.FileID)
+
+	if session.Draft == nil {
+		session.Draft = newReviewDraft()
 	}
-	if message.Audio != nil {
-		fileIds = append(fileIds, message.Audio.FileID)
+	session.Draft.Content.merge(text, newReviewMedias(message))
+	session.markDirty()
+	session.reply(session.msg(resumeCommentTemplate))
+	return true, nil
+}
+
+func (session *UserSession) replyRate(ctx context.Context, event *sessionEvent) (bool, error) {
+	if session.Draft == nil {
+		session.reply(session.msg(finishEmptyCommentTemplate))
+		return false, nil
 	}
-	if message.Voice != nil {
-		fileIds = append(fileIds, message.Voice.FileID)
+	msg := session.msg(rateTemplate)
+	msg.ReplyMarkup = newRatingMarkup(session.Locale, session.Draft.ReviewId)
+	session.reply(msg)
+	return true, nil
+}
+
+// listRecentOrders lets user pick one of the recent RockShop orders to comment on
+func (session *UserSession) listRecentOrders(ctx context.Context, event *sessionEvent) (bool, error) {
+	if len(session.PhoneNumber) == 0 {
+		session.reply(session.msg(orderRequirePhoneTemplate))
+		return false, nil
 	}
 
-	for _, fileId := range fileIds {
-		mediaUrl, err := session.reviewBot.GetFileUrl(ctx, fileId)
-		if err != nil {
-			return err
-		}
-		mediaUrls = append(mediaUrls, mediaUrl)
+	orders, err := session.rockShop.ListRecentOrders(ctx, session.PhoneNumber, recentOrderLimit)
+	if err != nil {
+		return false, err
+	}
+	if len(orders) == 0 {
+		session.reply(session.msg(noRecentOrderTemplate))
+		return false, nil
 	}
 
-	text = message.Text
-	if len(message.Caption) != 0 {
-		text = message.Caption
+	msg := session.msg(pickOrderTemplate)
+	msg.ReplyMarkup = newPickOrderMarkup(orders)
+	session.reply(msg)
+	return true, nil
+}
+
+// pickOrder starts to comment on the order, the order is checked against user's recent orders as callback data
+// is sent by the client and can't be trusted
+func (session *UserSession) pickOrder(ctx context.Context, event *sessionEvent) (bool, error) {
+	if len(session.PhoneNumber) == 0 {
+		event.result = callbackResult{editText: session.text(orderNotFoundTemplate)}
+		return false, nil
 	}
 
-	err = session.reviewRepo.StoreReview(ctx, session.UserId, ReviewContent{
-		Text:      text,
-		MediaUrls: mediaUrls,
-	})
+	orders, err := session.rockShop.ListRecentOrders(ctx, session.PhoneNumber, recentOrderLimit)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	var pickedOrder *RockShopOrder
+	for i := range orders {
+		if orderCallbackArg(orders[i].OrderId) == event.payload.Arg {
+			pickedOrder = &orders[i]
+			break
+		}
+	}
+	if pickedOrder == nil {
+		event.result = callbackResult{editText: session.text(orderNotFoundTemplate)}
+		return false, nil
+	}
+
+	if session.Draft == nil {
+		session.Draft = newReviewDraft()
 	}
-	_, _ = session.reviewBot.Send(ctx, resumeCommentTemplate.buildMsg(session.chatId))
-	return
+	session.Draft.OrderId = pickedOrder.OrderId
+	event.result = callbackResult{editText: session.text(orderPickedTemplate, arg("order", pickedOrder.Title))}
+	return true, nil
 }
 
-func (session *UserSession) handleCommand(ctx context.Context, message *tgbotapi.Message) (err error) {
+// rateDraft sets rating of the draft, the rating keyboard is kept so that rating can be changed until the review is
+// finalized, a rating of 0 skips rating
+func (session *UserSession) rateDraft(ctx context.Context, event *sessionEvent) (bool, error) {
+	reviewId, ratingStr, _ := strings.Cut(event.payload.Arg, callbackDataSeparator)
+	rating, err := strconv.Atoi(ratingStr)
+	if err != nil || rating < 0 || rating > maxRating {
+		event.result = callbackResult{notice: session.msg(callbackExpiredTemplate).Text}
+		return false, nil
+	}
+	if session.Draft == nil || session.Draft.ReviewId != reviewId {
+		event.result = callbackResult{notice: session.msg(rateFinalizedTemplate).Text}
+		return false, nil
+	}
 
-	switch message.Text {
-	case "/start":
-		session.sendHelpMsg(ctx)
-	case "/comment":
-		session.State = sessionStateComment
-		err = session.Save(ctx)
-		if err != nil {
-			return err
+	session.Draft.Rating = rating
+	session.markDirty()
+
+	markup := newRatingMarkup(session.Locale, reviewId)
+	event.result = callbackResult{editText: session.text(ratingSkippedTemplate), editMarkup: &markup}
+	if rating > 0 {
+		event.result.editText = session.text(ratedTemplate, arg("stars", ratingStars(rating)))
+	}
+	return true, nil
+}
+
+// expireCallback answers buttons no longer handled, such as those of an old version
+func (session *UserSession) expireCallback(ctx context.Context, event *sessionEvent) (bool, error) {
+	xlogger.WarnF(ctx, "unknown callback action: %s", event.payload.Action)
+	event.result = callbackResult{notice: session.msg(callbackExpiredTemplate).Text}
+	return true, nil
+}
+
+// archiveMedias copies medias of the review to oss, a media failed to archive is still referred by file_id
+func (session *UserSession) archiveMedias(ctx context.Context, review Review) {
+	for i := range review.ReviewContent.Medias {
+		media := &review.ReviewContent.Medias[i]
+		if len(media.ObjectUrl) > 0 {
+			continue
 		}
-		_, _ = session.reviewBot.Send(ctx, startCommentTemplate.buildMsg(session.chatId))
-	//case "/comment_transaction":
-	//	_, _ = session.reviewBot.Send(ctx, complexText{newPlainText("you used /comment_transaction")}.buildMsg(session.chatId))
-	case "/finish":
-		session.State = sessionStateInit
-		err = session.Save(ctx)
+		objectUrl, err := session.reviewBot.ArchiveFile(ctx, media.FileId, oss.BucketRockReview, review.ReviewId+"/"+media.FileUniqueId)
 		if err != nil {
-			return err
+			xlogger.ErrorF(ctx, "archive media %s of review %s fail: %v", media.FileUniqueId, review.ReviewId, err)
+			continue
 		}
-		_, _ = session.reviewBot.Send(ctx, finishCommentTemplate.buildMsg(session.chatId))
-	default:
-		_, _ = session.reviewBot.Send(ctx, unknownCommandTemplate.buildMsg(session.chatId))
+		media.ObjectUrl = objectUrl
 	}
-	return nil
+}
+
+// finishComment commits the draft as a review, the draft is kept if commit fails so that user can retry /finish
+func (session *UserSession) finishComment(ctx context.Context, event *sessionEvent) (bool, error) {
+	draft := session.Draft
+	if draft == nil || draft.Content.isEmpty() {
+		session.reply(session.msg(finishEmptyCommentTemplate))
+		return true, nil
+	}
+
+	// stored before the session is saved, so that a review isn't lost once the draft is gone. A stale attempt is
+	// replaced by the retry after the conflict, which carries a newer version.
+	review := draft.toReview(session.UserId)
+	review.SessionVersion = session.Version
+	session.archiveMedias(ctx, review)
+	err := session.reviewRepo.StoreReview(ctx, review)
+	if err != nil {
+		return false, err
+	}
+
+	session.reply(session.msg(finishCommentTemplate, arg("review_id", draft.ReviewId)))
+	if inbox := session.adminInbox; inbox != nil {
+		var customer *tgbotapi.User
+		if event.message != nil {
+			customer = event.message.From
+		}
+		phoneNumber := session.PhoneNumber
+		session.afterSave(func(ctx context.Context) {
+			inbox.PostReview(ctx, review, customer, phoneNumber)
+		})
+	}
+	return true, nil
+}
+
+func (session *UserSession) remindDraft(ctx context.Context, event *sessionEvent) (bool, error) {
+	session.ReminderSent = true
+	session.markDirty()
+	hoursLeft := int((time.Unix(session.StateExpireAt, 0).Sub(timeNow()) + time.Hour - 1) / time.Hour)
+	if hoursLeft < 1 {
+		hoursLeft = 1
+	}
+	session.reply(session.msg(draftReminderTemplate, countArg(hoursLeft)))
+	return true, nil
+}
+
+func (session *UserSession) expireDraft(ctx context.Context, event *sessionEvent) (bool, error) {
+	session.reply(session.msg(draftExpiredTemplate))
+	return true, nil
+}
+
+func (session *UserSession) cancelComment(ctx context.Context, event *sessionEvent) (bool, error) {
+	session.reply(session.msg(cancelCommentTemplate))
+	return true, nil
+}
+
+// pickLanguage switches to the language given after the command, such as "/language zh", or lists languages to pick
+func (session *UserSession) pickLanguage(ctx context.Context, event *sessionEvent) (bool, error) {
+	locale := normalizeLocale(event.arg)
+	if len(locale) > 0 && msgCatalog().hasLocale(locale) {
+		session.Locale = locale
+		session.markDirty()
+		session.reply(session.msg(languagePickedTemplate))
+		return true, nil
+	}
+
+	msg := session.msg(pickLanguageTemplate)
+	if len(locale) > 0 {
+		msg = session.msg(languageUnknownTemplate, arg("language", event.arg))
+	}
+	msg.ReplyMarkup = newLanguageMarkup(session.Locale)
+	session.reply(msg)
+	return true, nil
+}
+
+// setLanguage switches to the language of the button
+func (session *UserSession) setLanguage(ctx context.Context, event *sessionEvent) (bool, error) {
+	if !msgCatalog().hasLocale(event.payload.Arg) {
+		event.result = callbackResult{notice: session.msg(callbackExpiredTemplate).Text}
+		return false, nil
+	}
+	session.Locale = normalizeLocale(event.payload.Arg)
+	session.markDirty()
+	event.result = callbackResult{editText: session.text(languagePickedTemplate)}
+	return true, nil
 }
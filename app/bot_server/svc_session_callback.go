@@ -0,0 +1,113 @@
+package bot_server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"rock_review/util/xlogger"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type callbackAction = string
+
+const (
+	callbackActionPickOrder callbackAction = "order"
+	callbackActionRate      callbackAction = "rate"
+	callbackActionLanguage  callbackAction = "lang"
+
+	// buttons under reviews posted to the admin chat, handled by AdminInbox rather than user sessions
+	callbackActionAdminAck      callbackAction = "adm_ack"
+	callbackActionAdminEscalate callbackAction = "adm_esc"
+	callbackActionAdminReply    callbackAction = "adm_reply"
+)
+
+const (
+	callbackDataSeparator = ":"
+	callbackDataMaxLen    = 64 // telegram limits callback_data to 1-64 bytes
+
+	// orderHashPrefix marks the arg of an order picked by the hash of its id, as the id is too long for callback data
+	orderHashPrefix = "#"
+)
+
+// callbackPayload is the typed content of inline keyboard callback data, it's encoded as "<action>:<arg>"
+type callbackPayload struct {
+	Action callbackAction
+	Arg    string
+}
+
+func newCallbackPayload(action callbackAction, arg string) callbackPayload {
+	return callbackPayload{Action: action, Arg: arg}
+}
+
+func (p callbackPayload) encode() string {
+	return p.Action + callbackDataSeparator + p.Arg
+}
+
+// orderCallbackArg is the order id, or a short hash of it if the id doesn't fit in callback data, which pickOrder maps
+// back among recent orders
+func orderCallbackArg(orderId string) string {
+	if len(newCallbackPayload(callbackActionPickOrder, orderId).encode()) <= callbackDataMaxLen {
+		return orderId
+	}
+	sum := sha256.Sum256([]byte(orderId))
+	return orderHashPrefix + hex.EncodeToString(sum[:8])
+}
+
+func decodeCallbackPayload(data string) (callbackPayload, error) {
+	if len(data) > callbackDataMaxLen {
+		return callbackPayload{}, fmt.Errorf("callback data too long: %d", len(data))
+	}
+	action, arg, found := strings.Cut(data, callbackDataSeparator)
+	if !found || len(action) == 0 {
+		return callbackPayload{}, fmt.Errorf("malformed callback data: %s", data)
+	}
+	return callbackPayload{Action: action, Arg: arg}, nil
+}
+
+// callbackResult tells how to respond to a button press
+type callbackResult struct {
+	notice string // notice pops up as a toast on the client, empty notice just stops the loading animation
+
+	editText   complexText                    // editText replaces the text of the message carrying the button when not nil
+	editMarkup *tgbotapi.InlineKeyboardMarkup // editMarkup is kept along with editText, nil removes the inline keyboard
+}
+
+// handleCallbackQuery feeds a button press to the state machine, the query is always answered, otherwise the client
+// keeps showing the loading animation on the button
+func (session *UserSession) handleCallbackQuery(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	payload, err := decodeCallbackPayload(query.Data)
+	if err != nil {
+		xlogger.WarnF(ctx, "decode callback data fail: %v", err)
+		session.answerCallback(ctx, query, session.msg(callbackExpiredTemplate).Text)
+		return
+	}
+
+	event := newCallbackEvent(query, payload)
+	err = reviewSessionMachine.fire(session, ctx, event)
+	if err != nil {
+		xlogger.ErrorF(ctx, "handle callback %s fail: %v", query.Data, err)
+		// the query is answered when the update is handled again
+		if !session.conflicted {
+			session.answerCallback(ctx, query, session.msg(errRetryTemplate).Text)
+		}
+		return
+	}
+
+	result := event.result
+	session.answerCallback(ctx, query, result.notice)
+	if result.editText != nil && query.Message != nil {
+		editMsg := result.editText.buildEditMsg(query.Message.Chat.ID, query.Message.MessageID)
+		editMsg.ReplyMarkup = result.editMarkup
+		_, _ = session.reviewBot.Send(ctx, editMsg)
+	}
+}
+
+func (session *UserSession) answerCallback(ctx context.Context, query *tgbotapi.CallbackQuery, notice string) {
+	_, err := session.reviewBot.Request(ctx, tgbotapi.NewCallback(query.ID, notice))
+	if err != nil {
+		xlogger.ErrorF(ctx, "answer callback query fail: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package bot_server
+
+import (
+	"context"
+	"errors"
+	"rock_review/util/goutil"
+	"rock_review/util/xlogger"
+)
+
+const expiryBatchSize = 100
+
+// ExpiryReport tells what a scan of due sessions did
+type ExpiryReport struct {
+	Expired    int `json:"expired"`
+	Reminded   int `json:"reminded"`
+	Conflicted int `json:"conflicted"` // Conflicted is sessions changed by users meanwhile, they're checked in the next scan
+	Failed     int `json:"failed"`
+}
+
+// SessionExpiryScheduler times out sessions left alone in a state, and reminds them before. It scans the session repo
+// rather than sessions in memory, so that sessions of all instances are covered. Due sessions are handled on their
+// stored data, a session changed by an update at the same time wins the save and is checked again in the next scan.
+type SessionExpiryScheduler struct {
+	bot        IReviewBotSvc
+	reviewRepo IReviewRepo
+	rockShop   IRockShopSvc
+	repo       ISessionRepo
+	machine    *sessionMachine
+}
+
+func NewSessionExpiryScheduler(bot *ReviewBotSvc, repo ISessionRepo) *SessionExpiryScheduler {
+	return &SessionExpiryScheduler{
+		bot:        bot,
+		reviewRepo: bot.reviewRepo,
+		rockShop:   bot.rockShop,
+		repo:       repo,
+		machine:    reviewSessionMachine,
+	}
+}
+
+// RunOnce handles sessions due by now. It's called periodically by UserSessionMgr.RunRoutine in bot_server, and by
+// a timer trigger in bot_lambda.
+func (s *SessionExpiryScheduler) RunOnce(ctx context.Context) ExpiryReport {
+	var report ExpiryReport
+
+	for ctx.Err() == nil {
+		now := timeNow()
+		dueSessions, err := s.repo.ListDueSessions(ctx, now.Unix(), now.Add(s.machine.maxRemindBefore()).Unix(), expiryBatchSize)
+		if err != nil {
+			xlogger.ErrorF(ctx, "list due sessions fail: %v", err)
+			break
+		}
+
+		handled := 0
+		for _, sessionData := range dueSessions {
+			if s.handleDue(ctx, sessionData, &report) {
+				handled++
+			}
+		}
+		// sessions left due are listed again, stop if none of the batch is handled
+		if len(dueSessions) < expiryBatchSize || handled == 0 {
+			break
+		}
+	}
+
+	if report != (ExpiryReport{}) {
+		xlogger.InfoF(ctx, "session expiry: %s", goutil.JsonString(report))
+	}
+	return report
+}
+
+// handleDue fires the timeout or the reminder of the session, it tells whether the session is no longer due
+func (s *SessionExpiryScheduler) handleDue(ctx context.Context, sessionData userSessionData, report *ExpiryReport) bool {
+	chatId := sessionData.ChatId
+	if chatId == 0 {
+		// sessions saved before chat_id is stored, the id of a private chat is the id of the user
+		chatId = sessionData.UserId
+	}
+	session := NewUserSession(sessionData, chatId, s.bot, s.reviewRepo, s.repo, s.rockShop)
+
+	now := timeNow()
+	event := &sessionEvent{}
+	switch {
+	case s.machine.expired(session, now):
+		event.input = sessionInputTimeout
+	case s.machine.remindDue(session, now):
+		event.input = sessionInputReminder
+	default:
+		// in the reminder window of another state
+		return false
+	}
+
+	err := s.machine.fire(session, ctx, event)
+	switch {
+	case errors.Is(err, errSessionConflict):
+		report.Conflicted++
+		return true
+	case err != nil:
+		xlogger.ErrorF(ctx, "fire %s of session fail, user: %d, err: %v", event.input, session.UserId, err)
+		report.Failed++
+		return false
+	case !session.dirty:
+		xlogger.WarnF(ctx, "no transition for %s of state %d, user: %d", event.input, session.State, session.UserId)
+		return false
+	case event.input == sessionInputTimeout:
+		report.Expired++
+	default:
+		report.Reminded++
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package bot_server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_SessionExpiryScheduler(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		expireAt = testNow.Unix()
+		remindAt = testNow.Add(draftReminderBefore).Unix()
+		draft    = &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}}
+	)
+
+	newScheduler := func(dep *sessionDependency) *SessionExpiryScheduler {
+		return &SessionExpiryScheduler{
+			bot:        dep.reviewBotSvcCtrl,
+			reviewRepo: dep.reviewRepoCtrl,
+			rockShop:   dep.rockShopCtrl,
+			repo:       dep.sessionRepoCtrl,
+			machine:    reviewSessionMachine,
+		}
+	}
+
+	t.Run("expire and remind", func(t *testing.T) {
+		dep := mockDependency(t)
+		expired := userSessionData{UserId: testUserId, ChatId: testChatId, State: sessionStateComment, Draft: draft,
+			StateExpireAt: expireAt, Version: 3}
+		reminded := userSessionData{UserId: testUserId + 1, State: sessionStateComment, Draft: draft,
+			StateExpireAt: expireAt + 60, Version: 5}
+		dep.sessionRepoCtrl.EXPECT().ListDueSessions(ctx, expireAt, remindAt, expiryBatchSize).
+			Return([]userSessionData{expired, reminded}, nil)
+
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{UserId: testUserId, ChatId: testChatId,
+			State: sessionStateInit, Version: 3})
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, draftExpiredTemplate.render(defaultLocale).buildMsg(testChatId))
+		// chat_id not stored yet falls back to the user id
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{UserId: testUserId + 1, ChatId: testUserId + 1,
+			State: sessionStateComment, Draft: draft, StateExpireAt: expireAt + 60, ReminderSent: true, Version: 5})
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, draftReminderTemplate.render(defaultLocale, countArg(1)).buildMsg(testUserId+1))
+
+		report := newScheduler(dep).RunOnce(ctx)
+		assert.Equal(t, ExpiryReport{Expired: 1, Reminded: 1}, report)
+	})
+
+	t.Run("conflict is left to next scan", func(t *testing.T) {
+		dep := mockDependency(t)
+		expired := userSessionData{UserId: testUserId, ChatId: testChatId, State: sessionStateComment, Draft: draft,
+			StateExpireAt: expireAt, Version: 3}
+		dep.sessionRepoCtrl.EXPECT().ListDueSessions(ctx, expireAt, remindAt, expiryBatchSize).
+			Return([]userSessionData{expired}, nil)
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).Return(errSessionConflict)
+
+		report := newScheduler(dep).RunOnce(ctx)
+		assert.Equal(t, ExpiryReport{Conflicted: 1}, report)
+	})
+
+	t.Run("fail: save err", func(t *testing.T) {
+		dep := mockDependency(t)
+		expired := userSessionData{UserId: testUserId, ChatId: testChatId, State: sessionStateComment, Draft: draft,
+			StateExpireAt: expireAt, Version: 3}
+		dep.sessionRepoCtrl.EXPECT().ListDueSessions(ctx, expireAt, remindAt, expiryBatchSize).
+			Return([]userSessionData{expired}, nil)
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).Return(fmt.Errorf("db down"))
+
+		report := newScheduler(dep).RunOnce(ctx)
+		assert.Equal(t, ExpiryReport{Failed: 1}, report)
+	})
+
+	t.Run("fail: list err", func(t *testing.T) {
+		dep := mockDependency(t)
+		dep.sessionRepoCtrl.EXPECT().ListDueSessions(ctx, expireAt, remindAt, expiryBatchSize).
+			Return(nil, fmt.Errorf("db down"))
+
+		report := newScheduler(dep).RunOnce(ctx)
+		assert.Equal(t, ExpiryReport{}, report)
+	})
+
+	t.Run("full batch of undue sessions stops", func(t *testing.T) {
+		dep := mockDependency(t)
+		// a state without timeout transition, such as one removed in a later version
+		undue := make([]userSessionData, expiryBatchSize)
+		for i := range undue {
+			undue[i] = userSessionData{UserId: int64(i + 1), State: sessionStateInit, StateExpireAt: expireAt}
+		}
+		dep.sessionRepoCtrl.EXPECT().ListDueSessions(ctx, expireAt, remindAt, expiryBatchSize).Return(undue, nil)
+
+		report := newScheduler(dep).RunOnce(ctx)
+		assert.Equal(t, ExpiryReport{}, report)
+	})
+}
+
+func Test_UnitTest_SessionExpiryRefresh(t *testing.T) {
+	ctx := context.Background()
+	dep := mockDependency(t)
+	session := NewUserSession(userSessionData{
+		UserId:        testUserId,
+		State:         sessionStateComment,
+		Draft:         &reviewDraft{ReviewId: testReviewId},
+		StateExpireAt: testNow.Add(time.Hour).Unix(),
+		ReminderSent:  true,
+	}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+	// the timeout restarts on any change of the user
+	dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any())
+	dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+	u := newMockUpdate()
+	u.SetMessage(newMockMessage().SetText("more").message)
+	assert.Nil(t, session.handleUpdate(ctx, u.update))
+	assert.Equal(t, testNow.Add(commentTimeout).Unix(), session.StateExpireAt)
+	assert.False(t, session.ReminderSent)
+}
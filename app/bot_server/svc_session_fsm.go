@@ -0,0 +1,342 @@
+package bot_server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// sessionInput is the kind of input a session reacts to
+type sessionInput int
+
+const (
+	sessionInputCommand sessionInput = iota + 1
+	sessionInputText
+	sessionInputMedia
+	sessionInputContact
+	sessionInputCallback
+	sessionInputTimeout  // sessionInputTimeout is fired when the session stays in a state longer than its timeout
+	sessionInputReminder // sessionInputReminder is fired a while before the timeout
+)
+
+var sessionInputNames = map[sessionInput]string{
+	sessionInputCommand:  "command",
+	sessionInputText:     "text",
+	sessionInputMedia:    "media",
+	sessionInputContact:  "contact",
+	sessionInputCallback: "callback",
+	sessionInputTimeout:  "timeout",
+	sessionInputReminder: "reminder",
+}
+
+func (input sessionInput) String() string {
+	if name, ok := sessionInputNames[input]; ok {
+		return name
+	}
+	return fmt.Sprintf("input(%d)", int(input))
+}
+
+// timeNow tells the time of events, tests fix it
+var timeNow = time.Now
+
+const (
+	// stateAny matches any state as the source of a transition
+	stateAny sessionState = -1
+	// stateKeep as the target keeps the current state, exit and entry hooks don't run
+	stateKeep sessionState = -2
+)
+
+// sessionEvent is an input fed to the state machine
+type sessionEvent struct {
+	input   sessionInput
+	name    string // name is the command or the callback action, empty for other inputs
+	arg     string // arg is the text after the command, such as "zh" of "/language zh"
+	message *tgbotapi.Message
+	query   *tgbotapi.CallbackQuery
+	payload callbackPayload
+	result  callbackResult // result is set by actions of callbacks to respond to the button press
+
+	languageCode string // languageCode is the language of the user's telegram client, optional
+}
+
+// newMessageEvent tells the input of a message, a message with neither text nor media, such as a sticker, is an empty
+// text. A command is matched by its name, "/start@RockReviewBot payload" is /start with arg payload.
+func newMessageEvent(message *tgbotapi.Message) *sessionEvent {
+	event := &sessionEvent{message: message}
+	if message.From != nil {
+		event.languageCode = message.From.LanguageCode
+	}
+	switch {
+	case len(message.Text) > 0 && message.Text[0] == '/':
+		event.input = sessionInputCommand
+		name, arg, _ := strings.Cut(message.Text, " ")
+		event.name, _, _ = strings.Cut(name, "@")
+		event.arg = strings.TrimSpace(arg)
+	case message.Contact != nil:
+		event.input = sessionInputContact
+	case len(message.Photo) > 0 || message.Video != nil || message.Audio != nil || message.Voice != nil:
+		event.input = sessionInputMedia
+	default:
+		event.input = sessionInputText
+	}
+	return event
+}
+
+func newCallbackEvent(query *tgbotapi.CallbackQuery, payload callbackPayload) *sessionEvent {
+	event := &sessionEvent{
+		input:   sessionInputCallback,
+		name:    payload.Action,
+		query:   query,
+		payload: payload,
+	}
+	if query.From != nil {
+		event.languageCode = query.From.LanguageCode
+	}
+	return event
+}
+
+// sessionAction handles the event of a transition, it returns false to stay in the current state, such as when the
+// input turns out invalid. Data changed is to be marked by markDirty, replies are to be queued by reply.
+type sessionAction func(session *UserSession, ctx context.Context, event *sessionEvent) (bool, error)
+
+// sessionHook runs on entering or leaving a state, it changes session data and queues replies only
+type sessionHook func(session *UserSession)
+
+type stateDef struct {
+	state   sessionState
+	name    string
+	onEntry sessionHook
+	onExit  sessionHook
+	timeout time.Duration // timeout fires sessionInputTimeout after the session stays in the state for so long, 0 never
+	// remindBefore fires sessionInputReminder so long before the timeout, 0 never
+	remindBefore time.Duration
+}
+
+type transitionDef struct {
+	from   sessionState
+	input  sessionInput
+	name   string // name is the command or the callback action to match, empty matches any
+	to     sessionState
+	action sessionAction
+}
+
+func (t transitionDef) label() string {
+	if len(t.name) == 0 {
+		return t.input.String()
+	}
+	return t.input.String() + " " + t.name
+}
+
+// sessionMachine declares states of a conversation and transitions between them. Transitions from a certain state
+// take precedence over those from stateAny, and the first one registered wins among them. Inputs matching no
+// transition go to the fallback action of the input, if any, without changing state.
+type sessionMachine struct {
+	name        string
+	states      map[sessionState]stateDef
+	stateOrder  []sessionState
+	transitions []transitionDef
+	fallbacks   map[sessionInput]sessionAction
+}
+
+func newSessionMachine(name string) *sessionMachine {
+	return &sessionMachine{
+		name:      name,
+		states:    map[sessionState]stateDef{},
+		fallbacks: map[sessionInput]sessionAction{},
+	}
+}
+
+func (m *sessionMachine) state(def stateDef) *sessionMachine {
+	if _, ok := m.states[def.state]; !ok {
+		m.stateOrder = append(m.stateOrder, def.state)
+	}
+	m.states[def.state] = def
+	return m
+}
+
+// on registers a transition, action may be nil if entering the target state is all to do
+func (m *sessionMachine) on(from sessionState, input sessionInput, name string, to sessionState, action sessionAction) *sessionMachine {
+	m.transitions = append(m.transitions, transitionDef{from: from, input: input, name: name, to: to, action: action})
+	return m
+}
+
+func (m *sessionMachine) otherwise(input sessionInput, action sessionAction) *sessionMachine {
+	m.fallbacks[input] = action
+	return m
+}
+
+func (m *sessionMachine) match(state sessionState, event *sessionEvent) (transitionDef, bool) {
+	for _, from := range []sessionState{state, stateAny} {
+		for _, t := range m.transitions {
+			if t.from == from && t.input == event.input && (len(t.name) == 0 || t.name == event.name) {
+				return t, true
+			}
+		}
+	}
+	return transitionDef{}, false
+}
+
+// commands tells commands of transitions
+func (m *sessionMachine) commands() map[string]bool {
+	commands := map[string]bool{}
+	for _, t := range m.transitions {
+		if t.input == sessionInputCommand && len(t.name) > 0 {
+			commands[t.name] = true
+		}
+	}
+	return commands
+}
+
+// timeoutOf tells how long the session may stay in the state, 0 is forever
+func (m *sessionMachine) timeoutOf(state sessionState) time.Duration {
+	return m.states[state].timeout
+}
+
+// maxRemindBefore tells the earliest a reminder is due before the timeout among all states
+func (m *sessionMachine) maxRemindBefore() time.Duration {
+	var remindBefore time.Duration
+	for _, def := range m.states {
+		if def.remindBefore > remindBefore {
+			remindBefore = def.remindBefore
+		}
+	}
+	return remindBefore
+}
+
+func (m *sessionMachine) expired(session *UserSession, now time.Time) bool {
+	return session.StateExpireAt > 0 && session.StateExpireAt <= now.Unix()
+}
+
+func (m *sessionMachine) remindDue(session *UserSession, now time.Time) bool {
+	remindBefore := m.states[session.State].remindBefore
+	return remindBefore > 0 && !session.ReminderSent && session.StateExpireAt > 0 &&
+		session.StateExpireAt <= now.Add(remindBefore).Unix()
+}
+
+// fire runs the transition matching the event. A timeout due but not fired yet, as the scheduler runs periodically,
+// is fired before the event, so that the event isn't taken by a stale state. The session is saved if its data
+// changed, then queued replies are sent and queued afterSave funcs run, so that nothing is replied for an event which
+// fails or conflicts.
+func (m *sessionMachine) fire(session *UserSession, ctx context.Context, event *sessionEvent) error {
+	session.dirty = false
+	session.replies = nil
+	session.afterSaves = nil
+	defer func() {
+		session.replies = nil
+		session.afterSaves = nil
+	}()
+	session.detectLocale(event)
+
+	now := timeNow()
+	if event.input != sessionInputTimeout && m.expired(session, now) {
+		err := m.step(session, ctx, &sessionEvent{input: sessionInputTimeout}, now)
+		if err != nil {
+			return err
+		}
+	}
+	err := m.step(session, ctx, event, now)
+	if err != nil {
+		return err
+	}
+
+	if session.dirty {
+		err = session.Save(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range session.replies {
+		_, _ = session.reviewBot.Send(ctx, c)
+	}
+	for _, f := range session.afterSaves {
+		f(ctx)
+	}
+	return nil
+}
+
+func (m *sessionMachine) step(session *UserSession, ctx context.Context, event *sessionEvent, now time.Time) error {
+	to, action := stateKeep, m.fallbacks[event.input]
+	if t, ok := m.match(session.State, event); ok {
+		to, action = t.to, t.action
+	}
+
+	proceed := true
+	if action != nil {
+		var err error
+		proceed, err = action(session, ctx, event)
+		if err != nil {
+			return err
+		}
+	}
+	if proceed && to != stateKeep {
+		m.transit(session, to)
+	}
+	// the timeout counts from the last change, a reminder changes nothing of the user
+	if session.dirty && event.input != sessionInputReminder {
+		m.refreshExpiry(session, now)
+	}
+	return nil
+}
+
+func (m *sessionMachine) refreshExpiry(session *UserSession, now time.Time) {
+	session.StateExpireAt = 0
+	if timeout := m.timeoutOf(session.State); timeout > 0 {
+		session.StateExpireAt = now.Add(timeout).Unix()
+	}
+	session.ReminderSent = false
+}
+
+// transit leaves the current state and enters state to, a transition to the current state runs both hooks as well
+func (m *sessionMachine) transit(session *UserSession, to sessionState) {
+	if hook := m.states[session.State].onExit; hook != nil {
+		hook(session)
+	}
+	session.State = to
+	session.markDirty()
+	if hook := m.states[to].onEntry; hook != nil {
+		hook(session)
+	}
+}
+
+func (m *sessionMachine) stateName(state sessionState) string {
+	if def, ok := m.states[state]; ok && len(def.name) > 0 {
+		return def.name
+	}
+	return fmt.Sprintf("state(%d)", state)
+}
+
+// dot renders the graph in DOT, transitions from stateAny are drawn from every state and transitions keeping the
+// state are drawn as dashed loops
+func (m *sessionMachine) dot() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "digraph %s {\n", m.name)
+	for _, state := range m.stateOrder {
+		label := m.stateName(state)
+		if timeout := m.timeoutOf(state); timeout > 0 {
+			label += fmt.Sprintf("\ntimeout %s", timeout)
+		}
+		if remindBefore := m.states[state].remindBefore; remindBefore > 0 {
+			label += fmt.Sprintf("\nreminder %s before", remindBefore)
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q];\n", m.stateName(state), label)
+	}
+	for _, t := range m.transitions {
+		froms := []sessionState{t.from}
+		if t.from == stateAny {
+			froms = m.stateOrder
+		}
+		for _, from := range froms {
+			to, style := t.to, ""
+			if to == stateKeep {
+				to, style = from, ", style=dashed"
+			}
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q%s];\n", m.stateName(from), m.stateName(to), t.label(), style)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
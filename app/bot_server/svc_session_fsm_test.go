@@ -0,0 +1,155 @@
+package bot_server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_SessionMachine(t *testing.T) {
+	const (
+		stateIdle sessionState = 10
+		stateBusy sessionState = 11
+	)
+
+	var (
+		ctx   = context.Background()
+		trace []string
+	)
+
+	record := func(step string, proceed bool, err error) sessionAction {
+		return func(session *UserSession, ctx context.Context, event *sessionEvent) (bool, error) {
+			trace = append(trace, step)
+			return proceed, err
+		}
+	}
+	hook := func(step string) sessionHook {
+		return func(session *UserSession) {
+			trace = append(trace, step)
+		}
+	}
+	machine := newSessionMachine("test").
+		state(stateDef{state: stateIdle, name: "idle", onEntry: hook("enter idle"), onExit: hook("exit idle")}).
+		state(stateDef{state: stateBusy, name: "busy", onEntry: hook("enter busy"), onExit: hook("exit busy"), timeout: time.Hour}).
+		on(stateIdle, sessionInputCommand, "/go", stateBusy, record("go", true, nil)).
+		on(stateIdle, sessionInputCommand, "/try", stateBusy, record("try", false, nil)).
+		on(stateIdle, sessionInputCommand, "/fail", stateBusy, record("fail", true, errors.New("fail"))).
+		on(stateBusy, sessionInputTimeout, "", stateIdle, record("timeout", true, nil)).
+		on(stateBusy, sessionInputCommand, "/go", stateBusy, nil).
+		on(stateAny, sessionInputCommand, "/go", stateIdle, record("go any", true, nil)).
+		on(stateAny, sessionInputText, "", stateKeep, record("text", true, nil)).
+		otherwise(sessionInputCommand, record("unknown", true, nil))
+
+	testCases := []struct {
+		name      string
+		from      sessionState
+		event     *sessionEvent
+		wantState sessionState
+		wantTrace []string
+		wantSave  bool
+		wantErr   bool
+	}{
+		{"transit", stateIdle, &sessionEvent{input: sessionInputCommand, name: "/go"}, stateBusy,
+			[]string{"go", "exit idle", "enter busy"}, true, false},
+		{"action stays", stateIdle, &sessionEvent{input: sessionInputCommand, name: "/try"}, stateIdle,
+			[]string{"try"}, false, false},
+		{"action fails", stateIdle, &sessionEvent{input: sessionInputCommand, name: "/fail"}, stateIdle,
+			[]string{"fail"}, false, true},
+		{"timeout", stateBusy, &sessionEvent{input: sessionInputTimeout}, stateIdle,
+			[]string{"timeout", "exit busy", "enter idle"}, true, false},
+		{"self transition runs hooks", stateBusy, &sessionEvent{input: sessionInputCommand, name: "/go"}, stateBusy,
+			[]string{"exit busy", "enter busy"}, true, false},
+		{"keep runs no hook", stateBusy, &sessionEvent{input: sessionInputText}, stateBusy,
+			[]string{"text"}, false, false},
+		{"fallback", stateBusy, &sessionEvent{input: sessionInputCommand, name: "/what"}, stateBusy,
+			[]string{"unknown"}, false, false},
+		{"no fallback", stateBusy, &sessionEvent{input: sessionInputCallback, name: "what"}, stateBusy,
+			nil, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{UserId: testUserId, State: tc.from}, testChatId,
+				dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+			if tc.wantSave {
+				dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any())
+			}
+			trace = nil
+
+			err := machine.fire(session, ctx, tc.event)
+			assert.Equal(t, tc.wantErr, err != nil)
+			assert.Equal(t, tc.wantState, session.State)
+			assert.Equal(t, tc.wantTrace, trace)
+		})
+	}
+
+	t.Run("replies after save", func(t *testing.T) {
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{UserId: testUserId, State: stateIdle}, testChatId,
+			dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+		replyMachine := newSessionMachine("reply").
+			on(stateAny, sessionInputText, "", stateKeep,
+				func(session *UserSession, ctx context.Context, event *sessionEvent) (bool, error) {
+					session.markDirty()
+					session.reply(tgbotapi.NewMessage(testChatId, "saved"))
+					return true, nil
+				})
+
+		gomock.InOrder(
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).Return(errors.New("save fail")),
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()),
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, tgbotapi.NewMessage(testChatId, "saved")),
+		)
+		assert.NotNil(t, replyMachine.fire(session, ctx, &sessionEvent{input: sessionInputText}))
+		assert.Nil(t, replyMachine.fire(session, ctx, &sessionEvent{input: sessionInputText}))
+	})
+
+	t.Run("dot", func(t *testing.T) {
+		assert.Equal(t, time.Hour, machine.timeoutOf(stateBusy))
+		assert.Equal(t, time.Duration(0), machine.timeoutOf(stateIdle))
+		assert.Equal(t, `digraph test {
+	"idle" [label="idle"];
+	"busy" [label="busy\ntimeout 1h0m0s"];
+	"idle" -> "busy" [label="command /go"];
+	"idle" -> "busy" [label="command /try"];
+	"idle" -> "busy" [label="command /fail"];
+	"busy" -> "idle" [label="timeout"];
+	"busy" -> "busy" [label="command /go"];
+	"idle" -> "idle" [label="command /go"];
+	"busy" -> "idle" [label="command /go"];
+	"idle" -> "idle" [label="text", style=dashed];
+	"busy" -> "busy" [label="text", style=dashed];
+}
+`, machine.dot())
+	})
+}
+
+func Test_UnitTest_NewMessageEvent(t *testing.T) {
+	testCases := []struct {
+		name      string
+		message   *tgbotapi.Message
+		wantInput sessionInput
+		wantName  string
+	}{
+		{"command", newMockMessage().SetText("/start").message, sessionInputCommand, "/start"},
+		{"text", newMockMessage().SetText("hi").message, sessionInputText, ""},
+		{"photo", newMockMessage().SetPhoto("nice", tgbotapi.PhotoSize{FileID: "p"}).message, sessionInputMedia, ""},
+		{"voice", &tgbotapi.Message{Voice: &tgbotapi.Voice{FileID: "v"}}, sessionInputMedia, ""},
+		{"contact", newMockMessage().SetContact(&tgbotapi.Contact{PhoneNumber: testPhoneNumber}).message, sessionInputContact, ""},
+		{"sticker", &tgbotapi.Message{Sticker: &tgbotapi.Sticker{FileID: "s"}}, sessionInputText, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			event := newMessageEvent(tc.message)
+			assert.Equal(t, tc.wantInput, event.input)
+			assert.Equal(t, tc.wantName, event.name)
+		})
+	}
+}
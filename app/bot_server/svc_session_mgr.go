@@ -2,35 +2,80 @@ package bot_server
 
 import (
 	"context"
+	"rock_review/app/config"
 	"rock_review/util/goutil"
 	"rock_review/util/xlogger"
 	"sync"
 	"time"
 )
 
+const defaultExpiryInterval = time.Minute
+
 type UserSessionMgr struct {
-	repo *UserSessionRepo
+	repo      ISessionRepo
+	spillRepo IUpdateSpillRepo
 
 	inactiveSeconds  int64
+	updateBufferSize int
+	maxSpilled       int
+	handleBudget     chan struct{} // handleBudget limits concurrent handling of all sessions
+	expiryInterval   time.Duration
 	m                sync.Mutex
 	activeSessionMap map[int64]*UserSession
+	expiry           *SessionExpiryScheduler // expiry is guarded by m, as it's set after the routine starts
+
+	// sessionCtx is the context sessions run in, it's independent of intake so that sessions can drain on shutdown
+	sessionCtx context.Context
+	cancelF    context.CancelFunc
+}
+
+// DrainReport tells how sessions ended on shutdown
+type DrainReport struct {
+	Drained     int                `json:"drained"`      // Drained is sessions handled all their updates
+	Flushed     int                `json:"flushed"`      // Flushed is drained sessions saved again as their last save failed
+	FlushFailed []int64            `json:"flush_failed"` // FlushFailed is users whose session data is lost
+	Abandoned   []AbandonedSession `json:"abandoned"`    // Abandoned is sessions still busy at the deadline
+	Spilled     int                `json:"spilled"`      // Spilled is spilled updates left to sessions after restart
+}
+
+type AbandonedSession struct {
+	UserId         int64 `json:"tg_user_id"`
+	PendingUpdates int   `json:"pending_updates"` // PendingUpdates is updates left in the channel, not counting the one being handled
 }
 
-func NewUserSessionMgr(repo *UserSessionRepo) *UserSessionMgr {
+func NewUserSessionMgr(repo ISessionRepo, cfg config.SessionConfig) *UserSessionMgr {
+	sessionCtx, cancelF := context.WithCancel(context.Background())
 	mgr := &UserSessionMgr{
 		repo:             repo,
-		inactiveSeconds:  300,
+		inactiveSeconds:  cfg.InactiveSeconds,
+		updateBufferSize: cfg.UpdateBufferSize,
+		maxSpilled:       cfg.MaxSpilledUpdates,
+		expiryInterval:   time.Duration(cfg.ExpiryScanSeconds) * time.Second,
 		m:                sync.Mutex{},
 		activeSessionMap: map[int64]*UserSession{},
+		sessionCtx:       sessionCtx,
+		cancelF:          cancelF,
+	}
+	if cfg.MaxConcurrentHandlers > 0 {
+		mgr.handleBudget = make(chan struct{}, cfg.MaxConcurrentHandlers)
+	}
+	if mgr.expiryInterval <= 0 {
+		mgr.expiryInterval = defaultExpiryInterval
 	}
 
-	goutil.SafeGo(context.TODO(), func() {
-		mgr.RunRoutine(context.TODO())
+	goutil.SafeGo(sessionCtx, func() {
+		mgr.RunRoutine(sessionCtx)
 	})
 
 	return mgr
 }
 
+// WithSpillRepo lets updates overflowing a session spill to repo, otherwise they're refused
+func (mgr *UserSessionMgr) WithSpillRepo(repo IUpdateSpillRepo) *UserSessionMgr {
+	mgr.spillRepo = repo
+	return mgr
+}
+
 func (mgr *UserSessionMgr) GetCurrentUserSession(ctx context.Context, userId int64, chatId int64, botSvc *ReviewBotSvc) *UserSession {
 	var (
 		now = time.Now()
@@ -50,11 +95,23 @@ func (mgr *UserSessionMgr) GetCurrentUserSession(ctx context.Context, userId int
 	sessionData, err := mgr.repo.GetUserSessionData(ctx, userId)
 	if err != nil {
 		xlogger.ErrorF(ctx, "get user session data fail: %v", err)
-		sessionData = mgr.repo.newInitSessionData(userId)
+		sessionData = newInitSessionData(userId)
 	}
 
 	// init session
-	userSession = NewUserSession(sessionData, chatId, botSvc, botSvc.reviewRepo, mgr.repo)
+	userSession = NewUserSession(sessionData, chatId, botSvc, botSvc.reviewRepo, mgr.repo, botSvc.rockShop).
+		withUpdateBuffer(mgr.updateBufferSize).
+		withHandleBudget(mgr.handleBudget).
+		withAdminInbox(botSvc.adminInbox)
+	if mgr.spillRepo != nil {
+		spilled, err := mgr.spillRepo.CountSpilled(ctx, userId)
+		if err != nil {
+			// assume there are, the session finds out by loading them
+			xlogger.ErrorF(ctx, "count spilled updates fail: %v", err)
+			spilled = 1
+		}
+		userSession.withSpill(mgr.spillRepo, spilled, mgr.maxSpilled)
+	}
 
 	// register session if not exist
 	mgr.m.Lock()
@@ -68,20 +125,56 @@ func (mgr *UserSessionMgr) GetCurrentUserSession(ctx context.Context, userId int
 
 	// run session
 	goutil.SafeGo(ctx, func() {
-		userSession.Run(ctx)
+		userSession.Run(mgr.sessionCtx)
 	})
 
 	return userSession
 }
 
+// WithExpiryScheduler lets the routine time out and remind sessions periodically
+func (mgr *UserSessionMgr) WithExpiryScheduler(scheduler *SessionExpiryScheduler) *UserSessionMgr {
+	mgr.m.Lock()
+	defer mgr.m.Unlock()
+	mgr.expiry = scheduler
+	return mgr
+}
+
+// RecoverSessions starts sessions of users having updates spilled before restart
+func (mgr *UserSessionMgr) RecoverSessions(ctx context.Context, botSvc *ReviewBotSvc) {
+	if mgr.spillRepo == nil {
+		return
+	}
+	spilledUsers, err := mgr.spillRepo.ListSpilledUsers(ctx)
+	if err != nil {
+		xlogger.ErrorF(ctx, "list users with spilled updates fail: %v", err)
+		return
+	}
+	for _, spilledUser := range spilledUsers {
+		mgr.GetCurrentUserSession(ctx, spilledUser.UserId, spilledUser.ChatId, botSvc)
+	}
+	if len(spilledUsers) > 0 {
+		xlogger.InfoF(ctx, "sessions recovered for spilled updates: %d", len(spilledUsers))
+	}
+}
+
 func (mgr *UserSessionMgr) RunRoutine(ctx context.Context) {
 	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	expiryTicker := time.NewTicker(mgr.expiryInterval)
+	defer expiryTicker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			mgr.purgeInactiveSession(ctx)
+		case <-expiryTicker.C:
+			mgr.m.Lock()
+			expiry := mgr.expiry
+			mgr.m.Unlock()
+			if expiry != nil {
+				expiry.RunOnce(ctx)
+			}
 		}
 	}
 }
@@ -96,7 +189,8 @@ func (mgr *UserSessionMgr) purgeInactiveSession(ctx context.Context) {
 		purged := false
 
 		mgr.m.Lock()
-		if session.lastActiveUnix < inactiveDeadline {
+		// a session with updates left is busy rather than inactive
+		if session.lastActiveUnix < inactiveDeadline && len(session.updateCh) == 0 && session.spilledCount() == 0 {
 			delete(mgr.activeSessionMap, userId)
 			purged = true
 		}
@@ -111,3 +205,55 @@ func (mgr *UserSessionMgr) purgeInactiveSession(ctx context.Context) {
 	}
 	mgr.m.Unlock()
 }
+
+// Shutdown lets every session handle updates left in its channel until ctx is done, and saves drained sessions whose
+// last save failed. Intake must be stopped before, as no update can be queued to a session afterwards. Sessions still
+// busy at the deadline are canceled and reported as abandoned.
+func (mgr *UserSessionMgr) Shutdown(ctx context.Context) DrainReport {
+	var report DrainReport
+
+	mgr.m.Lock()
+	sessions := make([]*UserSession, 0, len(mgr.activeSessionMap))
+	for _, session := range mgr.activeSessionMap {
+		sessions = append(sessions, session)
+	}
+	mgr.m.Unlock()
+
+	for _, session := range sessions {
+		session.stopIntake()
+	}
+
+	for _, session := range sessions {
+		select {
+		case <-session.done:
+		case <-ctx.Done():
+		}
+		// a session drained already counts even if ctx is done as well
+		select {
+		case <-session.done:
+		default:
+			report.Abandoned = append(report.Abandoned, AbandonedSession{
+				UserId:         session.UserId,
+				PendingUpdates: len(session.updateCh),
+			})
+			report.Spilled += session.spilledCount()
+			continue
+		}
+
+		report.Drained++
+		report.Spilled += session.spilledCount()
+		if !session.unsaved {
+			continue
+		}
+		err := session.Save(ctx)
+		if err != nil {
+			xlogger.ErrorF(ctx, "flush session fail, user: %d, err: %v", session.UserId, err)
+			report.FlushFailed = append(report.FlushFailed, session.UserId)
+			continue
+		}
+		report.Flushed++
+	}
+
+	mgr.cancelF()
+	return report
+}
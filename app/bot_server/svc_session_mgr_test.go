@@ -0,0 +1,63 @@
+package bot_server
+
+import (
+	"context"
+	"rock_review/app/config"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_SessionMgrShutdown(t *testing.T) {
+	dep := mockDependency(t)
+	mgr := NewUserSessionMgr(nil, config.SessionConfig{InactiveSeconds: 300, UpdateBufferSize: 10})
+	startSession := func(userId int64) *UserSession {
+		session := NewUserSession(userSessionData{UserId: userId}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl,
+			dep.sessionRepoCtrl, dep.rockShopCtrl)
+		mgr.activeSessionMap[userId] = session
+		go session.Run(mgr.sessionCtx)
+		return session
+	}
+	startCmd := tgbotapi.Update{Message: &tgbotapi.Message{From: &tgbotapi.User{ID: testUserId + 1}, Text: "/start"}}
+
+	// idle session with updates left and a failed save
+	idleSession := startSession(testUserId)
+	idleSession.unsaved = true
+	idleSession.updateCh <- tgbotapi.Update{}
+	idleSession.updateCh <- tgbotapi.Update{}
+	dep.sessionRepoCtrl.EXPECT().SetUserSessionData(gomock.Any(), userSessionData{UserId: testUserId, ChatId: testChatId}).Return(nil)
+
+	// busy session blocked on sending
+	handling, release := make(chan struct{}), make(chan struct{})
+	busySession := startSession(testUserId + 1)
+	dep.reviewBotSvcCtrl.EXPECT().Send(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+			handling <- struct{}{}
+			<-release
+			return tgbotapi.Message{}, nil
+		}).AnyTimes()
+	busySession.updateCh <- startCmd
+	busySession.updateCh <- startCmd
+	<-handling
+
+	ctx, cancelF := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelF()
+	report := mgr.Shutdown(ctx)
+
+	assert.Equal(t, 1, report.Drained)
+	assert.Equal(t, 1, report.Flushed)
+	assert.Empty(t, report.FlushFailed)
+	assert.Equal(t, []AbandonedSession{{UserId: testUserId + 1, PendingUpdates: 1}}, report.Abandoned)
+	assert.False(t, idleSession.unsaved)
+
+	// abandoned session is canceled
+	go func() {
+		for range handling {
+		}
+	}()
+	close(release)
+	<-busySession.done
+}
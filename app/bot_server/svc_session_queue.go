@@ -0,0 +1,146 @@
+package bot_server
+
+import (
+	"context"
+	"fmt"
+	"rock_review/util/xlogger"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	spillBatchSize     = 50
+	spillRetryInterval = time.Second
+)
+
+// withSpill lets updates overflowing the update channel spill to repo instead of being refused, spilled is the count
+// of updates spilled before, such as before restart. It must be called before the session runs.
+func (session *UserSession) withSpill(repo IUpdateSpillRepo, spilled int, maxSpilled int) *UserSession {
+	session.spillRepo = repo
+	session.spilled = spilled
+	session.maxSpilled = maxSpilled
+	return session
+}
+
+// withHandleBudget shares a global budget of concurrent handling among sessions, so that a flooding user takes a slot
+// per update like others instead of all slots
+func (session *UserSession) withHandleBudget(budget chan struct{}) *UserSession {
+	session.handleBudget = budget
+	return session
+}
+
+// enqueue queues the update in order. Once an update is spilled, later ones are spilled as well until the spilled
+// ones are handled, as updates in the channel are handled first. The update is refused with errSessionBusy when the
+// session stops intake, spilled updates reach the limit or spilling fails.
+func (session *UserSession) enqueue(ctx context.Context, update tgbotapi.Update) error {
+	session.queueM.Lock()
+	defer session.queueM.Unlock()
+
+	if session.intakeStopped {
+		return fmt.Errorf("%w, session stopped, tg_user_id: %d, update_id: %d", errSessionBusy, session.UserId, update.UpdateID)
+	}
+	if session.spilled == 0 {
+		select {
+		case session.updateCh <- update:
+			return nil
+		default:
+		}
+	}
+
+	if session.spillRepo == nil || session.spilled >= session.maxSpilled {
+		return fmt.Errorf("%w, tg_user_id: %d, update_id: %d", errSessionBusy, session.UserId, update.UpdateID)
+	}
+	err := session.spillRepo.Spill(ctx, session.UserId, session.chatId, update)
+	if err != nil {
+		return fmt.Errorf("%w, spill fail, tg_user_id: %d, update_id: %d, err: %v", errSessionBusy, session.UserId, update.UpdateID, err)
+	}
+	session.spilled++
+
+	select {
+	case session.spillNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// stopIntake closes the update channel, Run returns after handling updates left in the channel. Spilled updates are
+// left to the session after restart. No update can be queued afterwards.
+func (session *UserSession) stopIntake() {
+	session.queueM.Lock()
+	defer session.queueM.Unlock()
+
+	if !session.intakeStopped {
+		session.intakeStopped = true
+		close(session.updateCh)
+	}
+}
+
+func (session *UserSession) spilledCount() int {
+	session.queueM.Lock()
+	defer session.queueM.Unlock()
+	return session.spilled
+}
+
+// handleSpilled handles a batch of spilled updates and deletes them. An update is handled again after restart if
+// deleting fails, as is an update in the channel when the process crashes.
+func (session *UserSession) handleSpilled(ctx context.Context) {
+	spilledUpdates, err := session.spillRepo.LoadSpilled(ctx, session.UserId, session.lastSpillId, spillBatchSize)
+	if err != nil {
+		xlogger.ErrorF(ctx, "load spilled updates fail, user: %d, err: %v", session.UserId, err)
+		_ = sleepCtx(ctx, spillRetryInterval)
+		return
+	}
+
+	handled := 0
+	for _, spilled := range spilledUpdates {
+		if ctx.Err() != nil {
+			break
+		}
+		// an update not handled for ctx done stays spilled, for the session after restart
+		if !session.handleWithBudget(ctx, spilled.Update) {
+			break
+		}
+		session.lastSpillId = spilled.Id
+		handled++
+	}
+
+	session.queueM.Lock()
+	if len(spilledUpdates) < spillBatchSize && handled == len(spilledUpdates) {
+		// all spilled as of loading are handled, the count is only off if it's not known on start
+		session.spilled -= handled
+		if session.spilled < 0 || len(spilledUpdates) == 0 {
+			session.spilled = 0
+		}
+	} else {
+		session.spilled -= handled
+	}
+	session.queueM.Unlock()
+
+	if handled > 0 {
+		err = session.spillRepo.DeleteSpilled(ctx, session.UserId, session.lastSpillId)
+		if err != nil {
+			xlogger.ErrorF(ctx, "delete spilled updates fail, user: %d, err: %v", session.UserId, err)
+		}
+	}
+}
+
+// handleWithBudget handles the update when a slot of the global budget is free, it tells false if ctx is done before
+// a slot is free, the update is not handled then
+func (session *UserSession) handleWithBudget(ctx context.Context, update tgbotapi.Update) bool {
+	if session.handleBudget != nil {
+		select {
+		case session.handleBudget <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+		defer func() {
+			<-session.handleBudget
+		}()
+	}
+	err := session.handleUpdateWithRetry(withJournalRef(ctx, update), update)
+	if err != nil {
+		xlogger.ErrorF(ctx, "handle update fail, user: %d, update_id: %d, err: %v", session.UserId, update.UpdateID, err)
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package bot_server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueueSession(dep *sessionDependency, spillRepo IUpdateSpillRepo, spilled int) *UserSession {
+	return NewUserSession(userSessionData{UserId: testUserId}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl,
+		dep.sessionRepoCtrl, dep.rockShopCtrl).
+		withUpdateBuffer(1).
+		withSpill(spillRepo, spilled, 2)
+}
+
+func newTestCommandUpdate(updateId int) tgbotapi.Update {
+	return tgbotapi.Update{
+		UpdateID: updateId,
+		Message:  &tgbotapi.Message{From: &tgbotapi.User{ID: testUserId}, Text: "/some_cmd"},
+	}
+}
+
+func Test_UnitTest_SessionEnqueue(t *testing.T) {
+	ctx := context.Background()
+	dep := mockDependency(t)
+	spillRepo := NewMockIUpdateSpillRepo(gomock.NewController(t))
+
+	t.Run("spill in order", func(t *testing.T) {
+		session := newTestQueueSession(dep, spillRepo, 0)
+
+		assert.Nil(t, session.enqueue(ctx, newTestCommandUpdate(1)))
+		assert.Len(t, session.updateCh, 1)
+
+		spillRepo.EXPECT().Spill(gomock.Any(), int64(testUserId), int64(testChatId), newTestCommandUpdate(2)).Return(nil)
+		assert.Nil(t, session.enqueue(ctx, newTestCommandUpdate(2)))
+		assert.Equal(t, 1, session.spilledCount())
+
+		// channel has room, but the update is newer than the spilled one
+		<-session.updateCh
+		spillRepo.EXPECT().Spill(gomock.Any(), int64(testUserId), int64(testChatId), newTestCommandUpdate(3)).Return(nil)
+		assert.Nil(t, session.enqueue(ctx, newTestCommandUpdate(3)))
+		assert.Equal(t, 2, session.spilledCount())
+		assert.Empty(t, session.updateCh)
+
+		// spill limit reached
+		err := session.enqueue(ctx, newTestCommandUpdate(4))
+		assert.True(t, errors.Is(err, errSessionBusy))
+	})
+
+	t.Run("fail: spill fail", func(t *testing.T) {
+		session := newTestQueueSession(dep, spillRepo, 0)
+		session.updateCh <- tgbotapi.Update{}
+
+		spillRepo.EXPECT().Spill(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("db down"))
+		err := session.enqueue(ctx, newTestCommandUpdate(2))
+		assert.True(t, errors.Is(err, errSessionBusy))
+		assert.Equal(t, 0, session.spilledCount())
+	})
+
+	t.Run("fail: refused without spill repo", func(t *testing.T) {
+		session := newTestQueueSession(dep, nil, 0)
+		session.updateCh <- tgbotapi.Update{}
+		assert.True(t, errors.Is(session.enqueue(ctx, newTestCommandUpdate(2)), errSessionBusy))
+	})
+
+	t.Run("fail: intake stopped", func(t *testing.T) {
+		session := newTestQueueSession(dep, spillRepo, 0)
+		session.stopIntake()
+		session.stopIntake()
+		assert.True(t, errors.Is(session.enqueue(ctx, newTestCommandUpdate(1)), errSessionBusy))
+	})
+}
+
+func Test_UnitTest_SessionRunSpilled(t *testing.T) {
+	dep := mockDependency(t)
+	spillRepo := NewMockIUpdateSpillRepo(gomock.NewController(t))
+
+	// spilled before restart, updates in channel are handled first
+	session := newTestQueueSession(dep, spillRepo, 2).withHandleBudget(make(chan struct{}, 1))
+	session.updateCh <- newTestCommandUpdate(3)
+
+	deleted := make(chan struct{})
+	gomock.InOrder(
+		dep.reviewBotSvcCtrl.EXPECT().Send(gomock.Any(), gomock.Any()),
+		spillRepo.EXPECT().LoadSpilled(gomock.Any(), int64(testUserId), int64(0), spillBatchSize).Return([]spilledUpdate{
+			{Id: 11, Update: newTestCommandUpdate(4)},
+			{Id: 12, Update: newTestCommandUpdate(5)},
+		}, nil),
+		dep.reviewBotSvcCtrl.EXPECT().Send(gomock.Any(), gomock.Any()).Times(2),
+		spillRepo.EXPECT().DeleteSpilled(gomock.Any(), int64(testUserId), int64(12)).DoAndReturn(
+			func(ctx context.Context, userId int64, maxId int64) error {
+				close(deleted)
+				return nil
+			}),
+	)
+
+	go session.Run(context.Background())
+	<-deleted
+	session.stopIntake()
+	<-session.done
+
+	assert.Equal(t, 0, session.spilledCount())
+	assert.Equal(t, int64(12), session.lastSpillId)
+	assert.Empty(t, session.handleBudget)
+}
+
+func Test_UnitTest_SessionSpilledNotHandledOnShutdown(t *testing.T) {
+	ctx := context.Background()
+	dep := mockDependency(t)
+	spillRepo := NewMemUpdateSpillRepo()
+	_ = spillRepo.Spill(ctx, testUserId, testChatId, newTestCommandUpdate(4))
+
+	// the budget is taken by other sessions until ctx is done on shutdown
+	budget := make(chan struct{}, 1)
+	budget <- struct{}{}
+	session := newTestQueueSession(dep, spillRepo, 1).withHandleBudget(budget)
+	sessionCtx, cancelF := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancelF()
+	}()
+	session.handleSpilled(sessionCtx)
+
+	assert.Equal(t, 1, session.spilledCount())
+	assert.Equal(t, int64(0), session.lastSpillId)
+	spilled, _ := spillRepo.LoadSpilled(ctx, testUserId, 0, spillBatchSize)
+	if assert.Len(t, spilled, 1) {
+		assert.Equal(t, 4, spilled[0].Update.UpdateID)
+	}
+}
@@ -3,18 +3,52 @@ package bot_server
 import (
 	"context"
 	"fmt"
+	"rock_review/util/oss"
+	"strings"
 	"testing"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testPhotoMedia = ReviewMedia{
+		Type:         mediaTypePhoto,
+		FileId:       "large",
+		FileUniqueId: "u_large",
+		FileSize:     10000,
+		MimeType:     "image/jpeg",
+		Width:        900,
+		Height:       600,
+	}
+	testOrders = []RockShopOrder{
+		{OrderId: "o1", Title: "Guitar", Amount: "$100"},
+		{OrderId: "o2", Title: "Drum", Amount: "$200"},
+	}
 )
 
 const (
 	testChatId      int64 = 8989
 	testUserId      int64 = 3678
 	testPhoneNumber       = "86478901"
+	testReviewId          = "b7d4e0f2-5c1a-4f3e-9a55-2f1c8e6d9a10"
+	testCallbackId        = "cb_1"
+	testMessageId         = 1001
 )
 
+var testNow = time.Unix(1700000000, 0)
+
+func init() {
+	newReviewId = func() string {
+		return testReviewId
+	}
+	timeNow = func() time.Time {
+		return testNow
+	}
+}
+
 func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 
 	var (
@@ -28,15 +62,15 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
 			u.SetMessage(newMockMessage().SetText("/start").message)
 
 			// set up expectation
-			msg := helpMsgRequestPhoneTemplate.buildMsg(testChatId)
-			msg.ReplyMarkup = requestPhoneMarkup
+			msg := helpMsgTemplate.render(defaultLocale).with(requestPhoneTemplate.render(defaultLocale)...).buildMsg(testChatId)
+			msg.ReplyMarkup = testRequestPhoneMarkup
 			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
 
 			// do test
@@ -50,14 +84,14 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 				UserId:      testUserId,
 				State:       sessionStateInit,
 				PhoneNumber: testPhoneNumber,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
 			u.SetMessage(newMockMessage().SetText("/start").message)
 
 			// set up expectation
-			msg := helpMsgTemplate.buildMsg(testChatId)
+			msg := helpMsgTemplate.render(defaultLocale).buildMsg(testChatId)
 			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
 
 			// do test
@@ -73,7 +107,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -81,10 +115,15 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 
 			// set up expectation
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
-				UserId: testUserId,
-				State:  sessionStateComment,
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId},
 			})
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, startCommentTemplate.buildMsg(testChatId))
+			msg := startCommentTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = newRatingMarkup(defaultLocale, testReviewId)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -96,7 +135,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -104,10 +143,13 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 
 			// set up expectation
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
-				UserId: testUserId,
-				State:  sessionStateComment,
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId},
 			}).Return(fmt.Errorf("save fail"))
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.render(defaultLocale).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -121,30 +163,78 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateComment,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+				Draft:  &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
 			u.SetMessage(newMockMessage().SetText("/finish").message)
 
 			// set up expectation
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:      testReviewId,
+				TgUserId:      testUserId,
+				ReviewContent: &ReviewContent{Text: "hi"},
+			})
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
 				UserId: testUserId,
+				ChatId: testChatId,
 				State:  sessionStateInit,
 			})
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishCommentTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishCommentTemplate.render(defaultLocale, arg("review_id", testReviewId)).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
 		})
 
-		t.Run("fail", func(t *testing.T) {
+		t.Run("success: archive medias", func(t *testing.T) {
 			// init dependency
 			dep := mockDependency(t)
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateComment,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+				Draft: &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{
+					Medias: []ReviewMedia{testPhotoMedia, testPhotoMedia},
+				}},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/finish").message)
+
+			// set up expectation, media failed to archive is kept by file_id
+			archivedMedia := testPhotoMedia
+			archivedMedia.ObjectUrl = "https://oss.example.com/rock-review/" + testReviewId + "/u_large.jpg"
+			gomock.InOrder(
+				dep.reviewBotSvcCtrl.EXPECT().ArchiveFile(ctx, "large", oss.BucketRockReview, testReviewId+"/u_large").
+					Return(archivedMedia.ObjectUrl, nil),
+				dep.reviewBotSvcCtrl.EXPECT().ArchiveFile(ctx, "large", oss.BucketRockReview, testReviewId+"/u_large").
+					Return("", fmt.Errorf("archive fail")),
+			)
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:      testReviewId,
+				TgUserId:      testUserId,
+				ReviewContent: &ReviewContent{Medias: []ReviewMedia{archivedMedia, testPhotoMedia}},
+			})
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId: testUserId,
+				ChatId: testChatId,
+				State:  sessionStateInit,
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishCommentTemplate.render(defaultLocale, arg("review_id", testReviewId)).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("empty draft", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -153,9 +243,375 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			// set up expectation
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
 				UserId: testUserId,
+				ChatId: testChatId,
+				State:  sessionStateInit,
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishEmptyCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("fail: store err", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/finish").message)
+
+			// set up expectation
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:      testReviewId,
+				TgUserId:      testUserId,
+				ReviewContent: &ReviewContent{Text: "hi"},
+			}).Return(fmt.Errorf("store fail"))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+			assert.Equal(t, sessionStateComment, session.State)
+			assert.Equal(t, testReviewId, session.Draft.ReviewId)
+		})
+
+		t.Run("fail: save err", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/finish").message)
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId: testUserId,
+				ChatId: testChatId,
 				State:  sessionStateInit,
 			}).Return(fmt.Errorf("save fail"))
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.render(defaultLocale).buildMsg(testChatId))
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+	})
+
+	t.Run("input: /rate", func(t *testing.T) {
+		t.Run("have draft", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId, Rating: 3},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/rate").message)
+
+			// set up expectation
+			msg := rateTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = newRatingMarkup(defaultLocale, testReviewId)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("no draft", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/rate").message)
+
+			// set up expectation
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishEmptyCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+	})
+
+	t.Run("input: /cancel", func(t *testing.T) {
+		// init dependency
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId: testUserId,
+			State:  sessionStateComment,
+			Draft:  &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetMessage(newMockMessage().SetText("/cancel").message)
+
+		// set up expectation
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+			UserId: testUserId,
+			ChatId: testChatId,
+			State:  sessionStateInit,
+		})
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, cancelCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+		// do test
+		session.handleUpdate(ctx, u.update)
+	})
+
+	t.Run("input: /comment_transaction", func(t *testing.T) {
+		t.Run("no phone number", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/comment_transaction").message)
+
+			// set up expectation
+			msg := orderRequirePhoneTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = testRequestPhoneMarkup
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("list orders", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/comment_transaction").message)
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(testOrders, nil)
+			msg := pickOrderTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = newPickOrderMarkup(testOrders)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("no order", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/comment_transaction").message)
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, noRecentOrderTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("fail: rock shop err", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/comment_transaction").message)
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(nil, fmt.Errorf("rock shop fail"))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("finish with order", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateComment,
+				PhoneNumber: testPhoneNumber,
+				Draft:       &reviewDraft{ReviewId: testReviewId, OrderId: "o2", Rating: 4, Content: ReviewContent{Text: "hi"}},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/finish").message)
+
+			// set up expectation
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:      testReviewId,
+				TgUserId:      testUserId,
+				OrderId:       "o2",
+				Rating:        4,
+				ReviewContent: &ReviewContent{Text: "hi"},
+			})
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:      testUserId,
+				ChatId:      testChatId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishCommentTemplate.render(defaultLocale, arg("review_id", testReviewId)).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+	})
+
+	t.Run("input: /language", func(t *testing.T) {
+		t.Run("pick by arg", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+				Locale: "en",
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/language ZH").message)
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId: testUserId,
+				ChatId: testChatId,
+				State:  sessionStateInit,
+				Locale: "zh",
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, languagePickedTemplate.render("zh").buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("list languages", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+				Locale: "zh",
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/language").message)
+
+			// set up expectation
+			msg := pickLanguageTemplate.render("zh").buildMsg(testChatId)
+			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+				tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("English", "lang:en")),
+				tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("✓ 中文", "lang:zh")),
+			)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("unknown language", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+				Locale: "en",
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("/language klingon").message)
+
+			// set up expectation
+			msg := languageUnknownTemplate.render("en", arg("language", "klingon")).buildMsg(testChatId)
+			msg.ReplyMarkup = newLanguageMarkup("en")
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("detect from client", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			message := newMockMessage().SetText("/cancel").message
+			message.From.LanguageCode = "zh-hans"
+			u.SetMessage(message)
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId: testUserId,
+				ChatId: testChatId,
+				State:  sessionStateInit,
+				Locale: "zh",
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, cancelCommentTemplate.render("zh").buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("picked language kept", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+				Locale: "en",
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			message := newMockMessage().SetText("/some_cmd").message
+			message.From.LanguageCode = "zh"
+			u.SetMessage(message)
+
+			// set up expectation
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, unknownCommandTemplate.render("en").buildMsg(testChatId))
+
 			// do test
 			session.handleUpdate(ctx, u.update)
 		})
@@ -168,7 +624,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -180,10 +636,11 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			// set up expectation
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
 				UserId:      testUserId,
+				ChatId:      testChatId,
 				State:       sessionStateInit,
 				PhoneNumber: testPhoneNumber,
 			})
-			successMsg := phoneBindSuccessTemplate.buildMsg(testChatId)
+			successMsg := phoneBindSuccessTemplate.render(defaultLocale).buildMsg(testChatId)
 			successMsg.ReplyMarkup = tgbotapi.ReplyKeyboardRemove{RemoveKeyboard: true}
 			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, successMsg)
 
@@ -197,7 +654,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -207,7 +664,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			}).message)
 
 			// set up expectation
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, phoneBindUseOwnContactTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, phoneBindUseOwnContactTemplate.render(defaultLocale).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -219,7 +676,7 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateInit,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
@@ -231,10 +688,11 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			// set up expectation
 			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
 				UserId:      testUserId,
+				ChatId:      testChatId,
 				State:       sessionStateInit,
 				PhoneNumber: testPhoneNumber,
 			}).Return(fmt.Errorf("save fail"))
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, errRetryTemplate.render(defaultLocale).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -248,15 +706,15 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 				session := NewUserSession(userSessionData{
 					UserId: testUserId,
 					State:  sessionStateInit,
-				}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+				}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 				// set up parameters
 				u := newMockUpdate()
 				u.SetMessage(newMockMessage().SetText("hi").message)
 
 				// set up expectation
-				msg := helpMsgRequestPhoneTemplate.buildMsg(testChatId)
-				msg.ReplyMarkup = requestPhoneMarkup
+				msg := helpMsgTemplate.render(defaultLocale).with(requestPhoneTemplate.render(defaultLocale)...).buildMsg(testChatId)
+				msg.ReplyMarkup = testRequestPhoneMarkup
 				dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
 
 				// do test
@@ -269,14 +727,14 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 					UserId:      testUserId,
 					State:       sessionStateInit,
 					PhoneNumber: testPhoneNumber,
-				}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+				}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 				// set up parameters
 				u := newMockUpdate()
 				u.SetMessage(newMockMessage().SetText("hi").message)
 
 				// set up expectation
-				dep.reviewBotSvcCtrl.EXPECT().Send(ctx, helpMsgTemplate.buildMsg(testChatId))
+				dep.reviewBotSvcCtrl.EXPECT().Send(ctx, helpMsgTemplate.render(defaultLocale).buildMsg(testChatId))
 
 				// do test
 				session.handleUpdate(ctx, u.update)
@@ -287,15 +745,79 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateComment,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
 			u.SetMessage(newMockMessage().SetText("hi").message)
 
 			// set up expectation
-			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, testUserId, ReviewContent{Text: "hi"})
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.buildMsg(testChatId))
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("comment state: photo", func(t *testing.T) {
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetPhoto("nice",
+				tgbotapi.PhotoSize{FileID: "small", FileUniqueID: "u_small", Width: 90, Height: 60, FileSize: 100},
+				tgbotapi.PhotoSize{FileID: "large", FileUniqueID: "u_large", Width: 900, Height: 600, FileSize: 10000},
+			).message)
+
+			// set up expectation, no file url is resolved before the review is finished
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft: &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{
+					Text:   "nice",
+					Medias: []ReviewMedia{testPhotoMedia},
+				}},
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("comment state: append to draft", func(t *testing.T) {
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetMessage(newMockMessage().SetText("there").message)
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi\nthere"}},
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.render(defaultLocale).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -306,14 +828,14 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 			session := NewUserSession(userSessionData{
 				UserId: testUserId,
 				State:  sessionStateComment,
-			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl)
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
 
 			// set up parameters
 			u := newMockUpdate()
 			u.SetMessage(newMockMessage().SetText("/some_cmd").message)
 
 			// set up expectation
-			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, unknownCommandTemplate.buildMsg(testChatId))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, unknownCommandTemplate.render(defaultLocale).buildMsg(testChatId))
 
 			// do test
 			session.handleUpdate(ctx, u.update)
@@ -321,10 +843,441 @@ func Test_UnitTest_SessionHandleUpdate(t *testing.T) {
 	})
 }
 
+func Test_UnitTest_SessionConflict(t *testing.T) {
+
+	var (
+		ctx = context.Background()
+	)
+
+	t.Run("handled again on reloaded data", func(t *testing.T) {
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId:  testUserId,
+			State:   sessionStateComment,
+			Draft:   &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			Version: 1,
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetMessage(newMockMessage().SetText("there").message)
+
+		// set up expectation
+		gomock.InOrder(
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi\nthere"}},
+				Version:       1,
+			}).Return(errSessionConflict),
+			dep.sessionRepoCtrl.EXPECT().GetUserSessionData(ctx, testUserId).Return(userSessionData{
+				UserId:  testUserId,
+				State:   sessionStateComment,
+				Draft:   &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi\nagain"}},
+				Version: 2,
+			}, nil),
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi\nagain\nthere"}},
+				Version:       2,
+			}),
+		)
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, resumeCommentTemplate.render(defaultLocale).buildMsg(testChatId))
+
+		// do test
+		assert.Nil(t, session.handleUpdateWithRetry(ctx, u.update))
+		assert.Equal(t, int64(3), session.Version)
+		assert.False(t, session.unsaved)
+	})
+
+	t.Run("finish replaces the review stored from stale data", func(t *testing.T) {
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId:  testUserId,
+			State:   sessionStateComment,
+			Draft:   &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi"}},
+			Version: 1,
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetMessage(newMockMessage().SetText("/finish").message)
+
+		// set up expectation, the review of the retry carries the newer version
+		gomock.InOrder(
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:       testReviewId,
+				TgUserId:       testUserId,
+				ReviewContent:  &ReviewContent{Text: "hi"},
+				SessionVersion: 1,
+			}),
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).Return(errSessionConflict),
+			dep.sessionRepoCtrl.EXPECT().GetUserSessionData(ctx, testUserId).Return(userSessionData{
+				UserId:  testUserId,
+				State:   sessionStateComment,
+				Draft:   &reviewDraft{ReviewId: testReviewId, Content: ReviewContent{Text: "hi\nagain"}},
+				Version: 2,
+			}, nil),
+			dep.reviewRepoCtrl.EXPECT().StoreReview(ctx, Review{
+				ReviewId:       testReviewId,
+				TgUserId:       testUserId,
+				ReviewContent:  &ReviewContent{Text: "hi\nagain"},
+				SessionVersion: 2,
+			}),
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:  testUserId,
+				ChatId:  testChatId,
+				State:   sessionStateInit,
+				Version: 2,
+			}),
+		)
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, finishCommentTemplate.render(defaultLocale, arg("review_id", testReviewId)).buildMsg(testChatId))
+
+		// do test
+		assert.Nil(t, session.handleUpdateWithRetry(ctx, u.update))
+		assert.Nil(t, session.Draft)
+	})
+
+	t.Run("fail: retries run out", func(t *testing.T) {
+		dep := mockDependency(t)
+		sessionData := userSessionData{
+			UserId:  testUserId,
+			State:   sessionStateInit,
+			Version: 1,
+		}
+		session := NewUserSession(sessionData, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl,
+			dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetMessage(newMockMessage().SetText("/comment").message)
+
+		// set up expectation, no reply is sent
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, gomock.Any()).Return(errSessionConflict).Times(maxConflictRetries + 1)
+		dep.sessionRepoCtrl.EXPECT().GetUserSessionData(ctx, testUserId).Return(sessionData, nil).Times(maxConflictRetries)
+
+		// do test
+		assert.ErrorIs(t, session.handleUpdateWithRetry(ctx, u.update), errSessionConflict)
+		assert.False(t, session.unsaved)
+	})
+}
+
+func Test_UnitTest_SessionHandleCallback(t *testing.T) {
+
+	var (
+		ctx = context.Background()
+	)
+
+	t.Run("pick order", func(t *testing.T) {
+		t.Run("success", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionPickOrder, "o2").encode())
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(testOrders, nil)
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				PhoneNumber:   testPhoneNumber,
+				Draft:         &reviewDraft{ReviewId: testReviewId, OrderId: "o2"},
+			})
+			msg := startCommentTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = newRatingMarkup(defaultLocale, testReviewId)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, orderPickedTemplate.render(defaultLocale, arg("order", "Drum")).buildEditMsg(testChatId, testMessageId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("order id too long for callback data", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters, the button carries a hash of the id instead
+			orders := append([]RockShopOrder{{OrderId: strings.Repeat("9", callbackDataMaxLen), Title: "Amp", Amount: "$300"}},
+				testOrders...)
+			markup := newPickOrderMarkup(orders)
+			data := *markup.InlineKeyboard[0][0].CallbackData
+			assert.LessOrEqual(t, len(data), callbackDataMaxLen)
+			assert.Equal(t, newCallbackPayload(callbackActionPickOrder, "o1").encode(), *markup.InlineKeyboard[1][0].CallbackData)
+			u := newMockUpdate()
+			u.SetCallbackQuery(data)
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(orders, nil)
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				PhoneNumber:   testPhoneNumber,
+				Draft:         &reviewDraft{ReviewId: testReviewId, OrderId: orders[0].OrderId},
+			})
+			msg := startCommentTemplate.render(defaultLocale).buildMsg(testChatId)
+			msg.ReplyMarkup = newRatingMarkup(defaultLocale, testReviewId)
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, msg)
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, orderPickedTemplate.render(defaultLocale, arg("order", "Amp")).buildEditMsg(testChatId, testMessageId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("not user's order", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionPickOrder, "o3").encode())
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(testOrders, nil)
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, orderNotFoundTemplate.render(defaultLocale).buildEditMsg(testChatId, testMessageId))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("fail: rock shop err", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId:      testUserId,
+				State:       sessionStateInit,
+				PhoneNumber: testPhoneNumber,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionPickOrder, "o2").encode())
+
+			// set up expectation
+			dep.rockShopCtrl.EXPECT().ListRecentOrders(ctx, testPhoneNumber, recentOrderLimit).Return(nil, fmt.Errorf("rock shop fail"))
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, errRetryTemplate.render(defaultLocale).buildMsg(testChatId).Text))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		t.Run("success", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId, Rating: 2},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionRate, testReviewId+":4").encode())
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId, Rating: 4},
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+			markup := newRatingMarkup(defaultLocale, testReviewId)
+			editMsg := ratedTemplate.render(defaultLocale, arg("stars", "★★★★☆")).buildEditMsg(testChatId, testMessageId)
+			editMsg.ReplyMarkup = &markup
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, editMsg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("skip", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId, Rating: 2},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionRate, testReviewId+":0").encode())
+
+			// set up expectation
+			dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+				UserId:        testUserId,
+				ChatId:        testChatId,
+				StateExpireAt: testNow.Add(commentTimeout).Unix(),
+				State:         sessionStateComment,
+				Draft:         &reviewDraft{ReviewId: testReviewId},
+			})
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+			markup := newRatingMarkup(defaultLocale, testReviewId)
+			editMsg := ratingSkippedTemplate.render(defaultLocale).buildEditMsg(testChatId, testMessageId)
+			editMsg.ReplyMarkup = &markup
+			dep.reviewBotSvcCtrl.EXPECT().Send(ctx, editMsg)
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("finalized", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateInit,
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionRate, testReviewId+":4").encode())
+
+			// set up expectation
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, rateFinalizedTemplate.render(defaultLocale).buildMsg(testChatId).Text))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+
+		t.Run("invalid rating", func(t *testing.T) {
+			// init dependency
+			dep := mockDependency(t)
+			session := NewUserSession(userSessionData{
+				UserId: testUserId,
+				State:  sessionStateComment,
+				Draft:  &reviewDraft{ReviewId: testReviewId},
+			}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+			// set up parameters
+			u := newMockUpdate()
+			u.SetCallbackQuery(newCallbackPayload(callbackActionRate, testReviewId+":6").encode())
+
+			// set up expectation
+			dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, callbackExpiredTemplate.render(defaultLocale).buildMsg(testChatId).Text))
+
+			// do test
+			session.handleUpdate(ctx, u.update)
+		})
+	})
+
+	t.Run("pick language", func(t *testing.T) {
+		// init dependency
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId: testUserId,
+			State:  sessionStateInit,
+			Locale: "en",
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetCallbackQuery(newCallbackPayload(callbackActionLanguage, "zh").encode())
+
+		// set up expectation
+		dep.sessionRepoCtrl.EXPECT().SetUserSessionData(ctx, userSessionData{
+			UserId: testUserId,
+			ChatId: testChatId,
+			State:  sessionStateInit,
+			Locale: "zh",
+		})
+		dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, ""))
+		dep.reviewBotSvcCtrl.EXPECT().Send(ctx, languagePickedTemplate.render("zh").buildEditMsg(testChatId, testMessageId))
+
+		// do test
+		session.handleUpdate(ctx, u.update)
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		// init dependency
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId: testUserId,
+			State:  sessionStateInit,
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetCallbackQuery(newCallbackPayload("some_action", "1").encode())
+
+		// set up expectation
+		dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, callbackExpiredTemplate.render(defaultLocale).buildMsg(testChatId).Text))
+
+		// do test
+		session.handleUpdate(ctx, u.update)
+	})
+
+	t.Run("malformed data", func(t *testing.T) {
+		// init dependency
+		dep := mockDependency(t)
+		session := NewUserSession(userSessionData{
+			UserId: testUserId,
+			State:  sessionStateInit,
+		}, testChatId, dep.reviewBotSvcCtrl, dep.reviewRepoCtrl, dep.sessionRepoCtrl, dep.rockShopCtrl)
+
+		// set up parameters
+		u := newMockUpdate()
+		u.SetCallbackQuery("Next")
+
+		// set up expectation
+		dep.reviewBotSvcCtrl.EXPECT().Request(ctx, tgbotapi.NewCallback(testCallbackId, callbackExpiredTemplate.render(defaultLocale).buildMsg(testChatId).Text))
+
+		// do test
+		session.handleUpdate(ctx, u.update)
+	})
+}
+
+func Test_UnitTest_CallbackPayload(t *testing.T) {
+	payload := newCallbackPayload(callbackActionPickOrder, "o:1")
+	decoded, err := decodeCallbackPayload(payload.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, payload, decoded)
+
+	_, err = decodeCallbackPayload("no_separator")
+	assert.NotNil(t, err)
+	_, err = decodeCallbackPayload(":no_action")
+	assert.NotNil(t, err)
+	_, err = decodeCallbackPayload(newCallbackPayload(callbackActionPickOrder, strings.Repeat("1", callbackDataMaxLen)).encode())
+	assert.NotNil(t, err)
+}
+
 type sessionDependency struct {
 	reviewBotSvcCtrl *MockIReviewBotSvc
 	reviewRepoCtrl   *MockIReviewRepo
 	sessionRepoCtrl  *MockISessionRepo
+	rockShopCtrl     *MockIRockShopSvc
 }
 
 func mockDependency(tb testing.TB) *sessionDependency {
@@ -332,15 +1285,25 @@ func mockDependency(tb testing.TB) *sessionDependency {
 	reviewBotSvcMock := NewMockIReviewBotSvc(ctrl)
 	reviewRepoMock := NewMockIReviewRepo(ctrl)
 	sessionRepoMock := NewMockISessionRepo(ctrl)
+	rockShopMock := NewMockIRockShopSvc(ctrl)
 
 	dep := &sessionDependency{
 		reviewBotSvcCtrl: reviewBotSvcMock,
 		reviewRepoCtrl:   reviewRepoMock,
 		sessionRepoCtrl:  sessionRepoMock,
+		rockShopCtrl:     rockShopMock,
 	}
 	return dep
 }
 
+var testRequestPhoneMarkup = tgbotapi.ReplyKeyboardMarkup{
+	Keyboard: [][]tgbotapi.KeyboardButton{
+		{tgbotapi.NewKeyboardButtonContact("Provide phone number for better service")},
+	},
+	ResizeKeyboard:  true,
+	OneTimeKeyboard: true,
+}
+
 type mockUpdate struct {
 	update tgbotapi.Update
 }
@@ -349,6 +1312,15 @@ func (mu *mockUpdate) SetMessage(message *tgbotapi.Message) {
 	mu.update.Message = message
 }
 
+func (mu *mockUpdate) SetCallbackQuery(data string) {
+	mu.update.CallbackQuery = &tgbotapi.CallbackQuery{
+		ID:      testCallbackId,
+		From:    &tgbotapi.User{ID: testUserId},
+		Message: &tgbotapi.Message{MessageID: testMessageId, Chat: &tgbotapi.Chat{ID: testChatId}},
+		Data:    data,
+	}
+}
+
 type mockMessage struct {
 	message *tgbotapi.Message
 }
@@ -358,6 +1330,12 @@ func (mm *mockMessage) SetText(text string) *mockMessage {
 	return mm
 }
 
+func (mm *mockMessage) SetPhoto(caption string, photos ...tgbotapi.PhotoSize) *mockMessage {
+	mm.message.Caption = caption
+	mm.message.Photo = photos
+	return mm
+}
+
 func (mm *mockMessage) SetContact(contact *tgbotapi.Contact) *mockMessage {
 	mm.message.Contact = contact
 	return mm
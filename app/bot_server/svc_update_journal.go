@@ -0,0 +1,241 @@
+package bot_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"rock_review/util/xlogger"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The update journal records updates received and messages sent with personal data redacted, so that a reply a user
+// reports can be reproduced by replaying the updates of the chat, see package replay.
+
+const (
+	JournalKindUpdate   = "update"
+	JournalKindOutbound = "outbound"
+)
+
+// JournalEntry is an update received or a message sent. Payload of an update is the update json, of a message sent
+// is a JournalCall.
+type JournalEntry struct {
+	Id        int64           `db:"id" json:"id"`
+	Kind      string          `db:"kind" json:"kind"`
+	UpdateId  int             `db:"update_id" json:"update_id"` // UpdateId of a message sent is the update it replies to, 0 if none
+	ChatId    int64           `db:"chat_id" json:"chat_id"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	CreatedAt int64           `db:"created_at" json:"created_at"`
+}
+
+// JournalCall is a message sent, Type is the type of the config sent such as MessageConfig, Config is the config in
+// json
+type JournalCall struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+// JournalFilter selects journal entries, zero fields match all
+type JournalFilter struct {
+	ChatId int64
+	Since  int64 // Since and Until are unix time, both inclusive
+	Until  int64
+	Limit  int
+}
+
+// WithJournalRepo turns on the update journal
+func (bot *ReviewBotSvc) WithJournalRepo(repo IUpdateJournalRepo) *ReviewBotSvc {
+	bot.journalRepo = repo
+	return bot
+}
+
+// journalUpdate records the update, raw is the update json as received if any, so that fields unknown to tgbotapi are
+// kept. Failures are logged only, journaling never stops an update from being handled.
+func (bot *ReviewBotSvc) journalUpdate(ctx context.Context, update tgbotapi.Update, raw []byte) {
+	if bot.journalRepo == nil {
+		return
+	}
+	entry := JournalEntry{Kind: JournalKindUpdate, UpdateId: update.UpdateID}
+	if chat := update.FromChat(); chat != nil {
+		entry.ChatId = chat.ID
+	}
+	if bot.isAdminChat(entry.ChatId) {
+		return
+	}
+	if raw == nil {
+		var err error
+		raw, err = json.Marshal(update)
+		if err != nil {
+			xlogger.ErrorF(ctx, "journal update fail, update_id: %d, err: %v", update.UpdateID, err)
+			return
+		}
+	}
+	bot.appendJournal(ctx, entry, raw)
+}
+
+// journalOutbound records a message sent, along with the update being handled by ctx
+func (bot *ReviewBotSvc) journalOutbound(ctx context.Context, c tgbotapi.Chattable) {
+	if bot.journalRepo == nil {
+		return
+	}
+	ref := journalRefOf(ctx)
+	call := JournalCall{Type: strings.TrimPrefix(fmt.Sprintf("%T", c), "tgbotapi.")}
+	raw, err := json.Marshal(c)
+	if err == nil {
+		call.Config = raw
+		raw, err = json.Marshal(call)
+	}
+	if err != nil {
+		xlogger.ErrorF(ctx, "journal %s fail, update_id: %d, err: %v", call.Type, ref.updateId, err)
+		return
+	}
+	// configs such as CallbackConfig have no chat, they belong to the chat of the update
+	chatId := chatIdOf(c)
+	if chatId == 0 {
+		chatId = ref.chatId
+	}
+	if bot.isAdminChat(chatId) {
+		return
+	}
+	bot.appendJournal(ctx, JournalEntry{Kind: JournalKindOutbound, UpdateId: ref.updateId, ChatId: chatId}, raw)
+}
+
+// isAdminChat tells the admin chat, which is not journaled, as posts there carry names of customers in text, which
+// redaction by field names can't tell
+func (bot *ReviewBotSvc) isAdminChat(chatId int64) bool {
+	return bot.adminInbox != nil && chatId == bot.adminInbox.chatId
+}
+
+func (bot *ReviewBotSvc) appendJournal(ctx context.Context, entry JournalEntry, raw []byte) {
+	payload, err := redactJson(raw)
+	if err == nil {
+		entry.Payload = payload
+		entry.CreatedAt = time.Now().Unix()
+		err = bot.journalRepo.AppendJournal(ctx, entry)
+	}
+	if err != nil {
+		xlogger.ErrorF(ctx, "journal %s fail, update_id: %d, err: %v", entry.Kind, entry.UpdateId, err)
+	}
+}
+
+type journalRefKey struct{}
+
+// journalRef is the update being handled, messages sent while handling it are journaled as its replies
+type journalRef struct {
+	updateId int
+	chatId   int64
+}
+
+func withJournalRef(ctx context.Context, update tgbotapi.Update) context.Context {
+	ref := journalRef{updateId: update.UpdateID}
+	if chat := update.FromChat(); chat != nil {
+		ref.chatId = chat.ID
+	}
+	return context.WithValue(ctx, journalRefKey{}, ref)
+}
+
+func journalRefOf(ctx context.Context) journalRef {
+	ref, _ := ctx.Value(journalRefKey{}).(journalRef)
+	return ref
+}
+
+const redactedName = "<redacted>"
+
+var (
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d -]{5,}\d`)
+	// MintedIdPattern matches ids minted by the bot, such as review ids, which redaction keeps and replay maps
+	MintedIdPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+)
+
+// redactJson redacts personal data in json of an update or of a config sent by field names: names of users, phone
+// numbers, locations, and emails and phone numbers within text. Field names of updates are in snake case, those of
+// configs are in camel case. Masks keep the length of text, so that entity offsets hold.
+func redactJson(data []byte) ([]byte, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue("", v))
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			value[k] = redactValue(strings.ToLower(strings.ReplaceAll(k, "_", "")), field)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(key, item)
+		}
+	case string:
+		switch key {
+		case "firstname", "lastname", "username", "vcard":
+			if len(value) > 0 {
+				return redactedName
+			}
+		case "phonenumber":
+			return maskDigits(value)
+		case "text", "caption":
+			return redactText(value)
+		}
+	case json.Number:
+		if key == "latitude" || key == "longitude" {
+			return json.Number("0")
+		}
+	}
+	return v
+}
+
+// redactText masks emails and phone numbers in text, ids minted by the bot which look like phone numbers in part are
+// kept, as replay maps them
+func redactText(text string) string {
+	var (
+		redacted strings.Builder
+		last     int
+	)
+	for _, span := range MintedIdPattern.FindAllStringIndex(text, -1) {
+		redacted.WriteString(redactContacts(text[last:span[0]]))
+		redacted.WriteString(text[span[0]:span[1]])
+		last = span[1]
+	}
+	redacted.WriteString(redactContacts(text[last:]))
+	return redacted.String()
+}
+
+func redactContacts(text string) string {
+	text = emailPattern.ReplaceAllStringFunc(text, func(email string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '@' {
+				return r
+			}
+			return '*'
+		}, email)
+	})
+	return phonePattern.ReplaceAllStringFunc(text, maskDigits)
+}
+
+// maskDigits masks digits but the last 4, which is enough to tell phone numbers apart when investigating
+func maskDigits(s string) string {
+	keep := 4
+	rs := []rune(s)
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i] < '0' || rs[i] > '9' {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		rs[i] = '*'
+	}
+	return string(rs)
+}
@@ -0,0 +1,42 @@
+package bot_server
+
+import (
+	"encoding/json"
+	"rock_review/util/telegramtest"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_RedactJson(t *testing.T) {
+	update := telegramtest.TextUpdate(tgbotapi.User{ID: testUserId, FirstName: "Rock", UserName: "rock_fan"},
+		"mail rock.fan@example.com or call +65 9123 4567")
+	update.Message.Contact = &tgbotapi.Contact{PhoneNumber: "6591234567", FirstName: "Rock", UserID: testUserId}
+	update.Message.Location = &tgbotapi.Location{Latitude: 1.29, Longitude: 103.85}
+	raw, _ := json.Marshal(update)
+
+	redacted, err := redactJson(raw)
+	assert.Nil(t, err)
+	var got tgbotapi.Update
+	assert.Nil(t, json.Unmarshal(redacted, &got))
+	assert.Equal(t, testUserId, got.Message.From.ID)
+	assert.Equal(t, redactedName, got.Message.From.FirstName)
+	assert.Equal(t, redactedName, got.Message.From.UserName)
+	assert.Equal(t, "", got.Message.From.LastName)
+	assert.Equal(t, "mail ********@*********** or call +** **** 4567", got.Message.Text)
+	assert.Equal(t, update.Message.Entities, got.Message.Entities)
+	assert.Equal(t, "******4567", got.Message.Contact.PhoneNumber)
+	assert.Equal(t, tgbotapi.Location{}, *got.Message.Location)
+
+	// configs sent are in camel case
+	redacted, _ = redactJson([]byte(`{"ChatID":8989,"Text":"bound to 86478901","ReplyMarkup":null}`))
+	assert.JSONEq(t, `{"ChatID":8989,"Text":"bound to ****8901","ReplyMarkup":null}`, string(redacted))
+
+	// ids minted by the bot are kept for replay
+	assert.Equal(t, "review id: 00000000-0000-4000-8000-000000000001, call ****4567",
+		redactText("review id: 00000000-0000-4000-8000-000000000001, call 91234567"))
+
+	_, err = redactJson([]byte("{"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,481 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"rock_review/util/oss"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvConfigPath is the environment variable of config file path, used when no path is given by flag
+const EnvConfigPath = "ROCK_REVIEW_CONFIG"
+
+// secretFilePrefix marks a secret value as a file path, the secret is the trimmed content of the file
+const secretFilePrefix = "file:"
+
+// Secret is a sensitive string such as bot token or dsn with password, it can be given by "file:<path>" in yaml or
+// env, or by env <ENV>_FILE, so that it can be mounted from a secret store instead of written in plain text.
+type Secret string
+
+// String hides the secret from logs
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return "******"
+}
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+type Config struct {
+	Bot       BotConfig       `yaml:"bot"`
+	Mysql     MysqlConfig     `yaml:"mysql"`
+	Redis     RedisConfig     `yaml:"redis"`
+	Session   SessionConfig   `yaml:"session"`
+	RockShop  RockShopConfig  `yaml:"rock_shop"`
+	Oss       OssConfig       `yaml:"oss"`
+	Templates TemplatesConfig `yaml:"templates"`
+	Journal   JournalConfig   `yaml:"journal"`
+	Admin     AdminConfig     `yaml:"admin"`
+}
+
+const (
+	BotModePolling = "polling"
+	BotModeWebhook = "webhook"
+)
+
+type BotConfig struct {
+	Token          Secret        `yaml:"token" env:"ROCK_REVIEW_BOT_TOKEN"`
+	Mode           string        `yaml:"mode" env:"ROCK_REVIEW_BOT_MODE"`                       // Mode is how bot_server receives updates, polling or webhook
+	UpdateTimeout  int           `yaml:"update_timeout" env:"ROCK_REVIEW_BOT_UPDATE_TIMEOUT"`   // UpdateTimeout is long polling timeout in seconds
+	DedupeCapacity int           `yaml:"dedupe_capacity" env:"ROCK_REVIEW_BOT_DEDUPE_CAPACITY"` // DedupeCapacity is how many recent update ids bot_server remembers
+	DrainTimeout   int           `yaml:"drain_timeout" env:"ROCK_REVIEW_BOT_DRAIN_TIMEOUT"`     // DrainTimeout is how long bot_server drains sessions on shutdown in seconds
+	ApiEndpoint    string        `yaml:"api_endpoint" env:"ROCK_REVIEW_BOT_API_ENDPOINT"`       // ApiEndpoint is formatted by bot token and method, e.g. for a local bot api server
+	FileEndpoint   string        `yaml:"file_endpoint" env:"ROCK_REVIEW_BOT_FILE_ENDPOINT"`     // FileEndpoint is formatted by bot token and file path
+	Webhook        WebhookConfig `yaml:"webhook"`
+	Send           SendConfig    `yaml:"send"`
+}
+
+// SendConfig paces requests to telegram, telegram allows about 30 messages per second overall, a message per second
+// to a chat and 20 messages per minute to a group
+type SendConfig struct {
+	GlobalPerSecond int `yaml:"global_per_second" env:"ROCK_REVIEW_BOT_SEND_GLOBAL_PER_SECOND"`
+	ChatPerMinute   int `yaml:"chat_per_minute" env:"ROCK_REVIEW_BOT_SEND_CHAT_PER_MINUTE"`
+	GroupPerMinute  int `yaml:"group_per_minute" env:"ROCK_REVIEW_BOT_SEND_GROUP_PER_MINUTE"`
+	MaxQueueDepth   int `yaml:"max_queue_depth" env:"ROCK_REVIEW_BOT_SEND_MAX_QUEUE_DEPTH"` // MaxQueueDepth is how many sends can wait, more are dropped
+	MaxRetries      int `yaml:"max_retries" env:"ROCK_REVIEW_BOT_SEND_MAX_RETRIES"`         // MaxRetries is retries of flood control and transient failures
+}
+
+// WebhookConfig is shared by the webhook server of bot_server, bot_lambda and bot_config which registers the webhook.
+// Without tls cert and key, the server listens on plain http, expecting a reverse proxy to terminate tls.
+type WebhookConfig struct {
+	Url         string `yaml:"url" env:"ROCK_REVIEW_BOT_WEBHOOK_URL"` // Url is registered to telegram by bot_config
+	ListenAddr  string `yaml:"listen_addr" env:"ROCK_REVIEW_BOT_WEBHOOK_LISTEN_ADDR"`
+	Path        string `yaml:"path" env:"ROCK_REVIEW_BOT_WEBHOOK_PATH"`
+	SecretToken Secret `yaml:"secret_token" env:"ROCK_REVIEW_BOT_WEBHOOK_SECRET_TOKEN"` // SecretToken is sent back by telegram in header X-Telegram-Bot-Api-Secret-Token
+	TlsCertFile string `yaml:"tls_cert_file" env:"ROCK_REVIEW_BOT_WEBHOOK_TLS_CERT_FILE"`
+	TlsKeyFile  string `yaml:"tls_key_file" env:"ROCK_REVIEW_BOT_WEBHOOK_TLS_KEY_FILE"`
+}
+
+const (
+	MysqlDriverMysql  = "mysql"
+	MysqlDriverMemory = "memory" // MysqlDriverMemory keeps all data in memory of bot_server, for local development
+)
+
+type MysqlConfig struct {
+	Driver       string `yaml:"driver" env:"ROCK_REVIEW_MYSQL_DRIVER"`
+	Dsn          Secret `yaml:"dsn" env:"ROCK_REVIEW_MYSQL_DSN"`
+	MaxOpenConns int    `yaml:"max_open_conns" env:"ROCK_REVIEW_MYSQL_MAX_OPEN_CONNS"`
+	MaxIdleConns int    `yaml:"max_idle_conns" env:"ROCK_REVIEW_MYSQL_MAX_IDLE_CONNS"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr" env:"ROCK_REVIEW_REDIS_ADDR"`
+	Password Secret `yaml:"password" env:"ROCK_REVIEW_REDIS_PASSWORD"`
+}
+
+const (
+	SessionStoreMysql = "mysql"
+	SessionStoreRedis = "redis" // SessionStoreRedis caches sessions in redis over mysql
+)
+
+type SessionConfig struct {
+	Store                 string `yaml:"store" env:"ROCK_REVIEW_SESSION_STORE"`
+	CacheTtl              int    `yaml:"cache_ttl" env:"ROCK_REVIEW_SESSION_CACHE_TTL"`                             // CacheTtl is how long a session is cached in redis in seconds
+	InactiveSeconds       int64  `yaml:"inactive_seconds" env:"ROCK_REVIEW_SESSION_INACTIVE_SECONDS"`               // InactiveSeconds is how long an idle session stays in memory
+	UpdateBufferSize      int    `yaml:"update_buffer_size" env:"ROCK_REVIEW_SESSION_UPDATE_BUFFER_SIZE"`           // UpdateBufferSize is buffer size of update channel of a session
+	MaxSpilledUpdates     int    `yaml:"max_spilled_updates" env:"ROCK_REVIEW_SESSION_MAX_SPILLED_UPDATES"`         // MaxSpilledUpdates is how many updates overflowing the buffer of a user can spill to mysql
+	MaxConcurrentHandlers int    `yaml:"max_concurrent_handlers" env:"ROCK_REVIEW_SESSION_MAX_CONCURRENT_HANDLERS"` // MaxConcurrentHandlers is how many updates of all sessions can be handled at once
+	ExpiryScanSeconds     int64  `yaml:"expiry_scan_seconds" env:"ROCK_REVIEW_SESSION_EXPIRY_SCAN_SECONDS"`         // ExpiryScanSeconds is how often bot_server scans for sessions to time out or remind
+}
+
+// TemplatesConfig locates the message template bundle, bot_server reloads it on SIGHUP
+type TemplatesConfig struct {
+	Dir string `yaml:"dir" env:"ROCK_REVIEW_TEMPLATES_DIR"` // Dir holds a yaml or json file per locale, templates embedded in the binary are used if empty
+}
+
+// JournalConfig turns on the update journal, which records updates and messages sent with personal data redacted for
+// bot_server replay
+type JournalConfig struct {
+	Enabled bool `yaml:"enabled" env:"ROCK_REVIEW_JOURNAL_ENABLED"`
+}
+
+// AdminConfig is the admin group chat where finalized reviews are posted, reviews are posted nowhere if chat id is 0
+type AdminConfig struct {
+	ChatId int64  `yaml:"chat_id" env:"ROCK_REVIEW_ADMIN_CHAT_ID"` // ChatId is the id of a group or supergroup, which is negative
+	Locale string `yaml:"locale" env:"ROCK_REVIEW_ADMIN_LOCALE"`   // Locale of posts to the chat, the default locale if empty
+}
+
+type RockShopConfig struct {
+	BaseUrl string `yaml:"base_url" env:"ROCK_REVIEW_ROCK_SHOP_BASE_URL"`
+}
+
+const (
+	OssDriverLocal = "local"
+	OssDriverS3    = "s3"
+)
+
+type OssConfig struct {
+	Driver string         `yaml:"driver" env:"ROCK_REVIEW_OSS_DRIVER"`
+	Local  LocalOssConfig `yaml:"local"`
+	S3     S3OssConfig    `yaml:"s3"`
+}
+
+type LocalOssConfig struct {
+	RootDir string `yaml:"root_dir" env:"ROCK_REVIEW_OSS_LOCAL_ROOT_DIR"`
+	BaseUrl string `yaml:"base_url" env:"ROCK_REVIEW_OSS_LOCAL_BASE_URL"`
+}
+
+type S3OssConfig struct {
+	Endpoint        string `yaml:"endpoint" env:"ROCK_REVIEW_OSS_S3_ENDPOINT"`
+	Region          string `yaml:"region" env:"ROCK_REVIEW_OSS_S3_REGION"`
+	AccessKeyId     Secret `yaml:"access_key_id" env:"ROCK_REVIEW_OSS_S3_ACCESS_KEY_ID"`
+	SecretAccessKey Secret `yaml:"secret_access_key" env:"ROCK_REVIEW_OSS_S3_SECRET_ACCESS_KEY"`
+	PublicBaseUrl   string `yaml:"public_base_url" env:"ROCK_REVIEW_OSS_S3_PUBLIC_BASE_URL"`
+}
+
+func Default() *Config {
+	return &Config{
+		Bot: BotConfig{
+			Mode:           BotModePolling,
+			UpdateTimeout:  60,
+			DedupeCapacity: 10000,
+			DrainTimeout:   20,
+			ApiEndpoint:    "https://api.telegram.org/bot%s/%s",
+			FileEndpoint:   "https://api.telegram.org/file/bot%s/%s",
+			Webhook: WebhookConfig{
+				ListenAddr: ":8443",
+				Path:       "/telegram/webhook",
+			},
+			Send: SendConfig{
+				GlobalPerSecond: 30,
+				ChatPerMinute:   60,
+				GroupPerMinute:  20,
+				MaxQueueDepth:   1000,
+				MaxRetries:      3,
+			},
+		},
+		Mysql: MysqlConfig{
+			Driver:       MysqlDriverMysql,
+			MaxOpenConns: 500,
+			MaxIdleConns: 100,
+		},
+		Session: SessionConfig{
+			Store:                 SessionStoreMysql,
+			CacheTtl:              86400,
+			InactiveSeconds:       300,
+			UpdateBufferSize:      10,
+			MaxSpilledUpdates:     1000,
+			MaxConcurrentHandlers: 64,
+			ExpiryScanSeconds:     60,
+		},
+		Oss: OssConfig{
+			Driver: OssDriverLocal,
+			Local: LocalOssConfig{
+				RootDir: "data/oss",
+			},
+		},
+	}
+}
+
+// Load reads config from the yaml file at path on top of defaults, then applies environment variable overrides and
+// resolves secrets. An empty path loads from defaults and env only. The config is not validated, as tools only need
+// part of it.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if len(path) > 0 {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file fail: %w", err)
+		}
+		err = yaml.Unmarshal(bs, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("parse config file fail: %w", err)
+		}
+	}
+
+	err := applyEnv(reflect.ValueOf(cfg).Elem())
+	if err != nil {
+		return nil, err
+	}
+	err = resolveSecrets(reflect.ValueOf(cfg).Elem())
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// MustLoad loads and validates config for services, from the path or from EnvConfigPath if path is empty.
+// It panics on error, as a service can't start without a valid config.
+func MustLoad(path string) *Config {
+	if len(path) == 0 {
+		path = os.Getenv(EnvConfigPath)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		panic(err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+// ValidateBot validates the bot section only, which is all a telegram api tool needs
+func (cfg *Config) ValidateBot() error {
+	errs := cfg.validateBot(nil)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (cfg *Config) validateBot(errs []string) []string {
+	if len(cfg.Bot.Token) == 0 {
+		errs = append(errs, "bot.token is required")
+	}
+	if cfg.Bot.UpdateTimeout <= 0 {
+		errs = append(errs, "bot.update_timeout must be positive")
+	}
+	if cfg.Bot.DedupeCapacity <= 0 {
+		errs = append(errs, "bot.dedupe_capacity must be positive")
+	}
+	if cfg.Bot.DrainTimeout <= 0 {
+		errs = append(errs, "bot.drain_timeout must be positive")
+	}
+	if strings.Count(cfg.Bot.ApiEndpoint, "%s") != 2 || strings.Count(cfg.Bot.FileEndpoint, "%s") != 2 {
+		errs = append(errs, "bot.api_endpoint and file_endpoint must have %s for bot token and for method or file path")
+	}
+	if cfg.Bot.Send.GlobalPerSecond < 0 || cfg.Bot.Send.ChatPerMinute < 0 || cfg.Bot.Send.GroupPerMinute < 0 ||
+		cfg.Bot.Send.MaxQueueDepth < 0 || cfg.Bot.Send.MaxRetries < 0 {
+		errs = append(errs, "bot.send must not be negative")
+	}
+	if !isValidSecretToken(cfg.Bot.Webhook.SecretToken.Value()) {
+		errs = append(errs, "bot.webhook.secret_token must be at most 256 characters of A-Z, a-z, 0-9, _ and -")
+	}
+
+	switch cfg.Bot.Mode {
+	case BotModePolling:
+	case BotModeWebhook:
+		if len(cfg.Bot.Webhook.ListenAddr) == 0 {
+			errs = append(errs, "bot.webhook.listen_addr is required")
+		}
+		if !strings.HasPrefix(cfg.Bot.Webhook.Path, "/") {
+			errs = append(errs, "bot.webhook.path must start with /")
+		}
+		if len(cfg.Bot.Webhook.SecretToken) == 0 {
+			errs = append(errs, "bot.webhook.secret_token is required")
+		}
+		if (len(cfg.Bot.Webhook.TlsCertFile) == 0) != (len(cfg.Bot.Webhook.TlsKeyFile) == 0) {
+			errs = append(errs, "bot.webhook.tls_cert_file and tls_key_file must be given together")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("bot.mode must be %s or %s", BotModePolling, BotModeWebhook))
+	}
+	return errs
+}
+
+// isValidSecretToken checks the charset telegram accepts for secret_token of setWebhook, empty token is valid as it's
+// optional
+func isValidSecretToken(token string) bool {
+	if len(token) > 256 {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (cfg *Config) Validate() error {
+	var errs []string
+
+	errs = cfg.validateBot(errs)
+	switch cfg.Mysql.Driver {
+	case MysqlDriverMysql:
+		if len(cfg.Mysql.Dsn) == 0 {
+			errs = append(errs, "mysql.dsn is required")
+		}
+	case MysqlDriverMemory:
+	default:
+		errs = append(errs, fmt.Sprintf("mysql.driver must be %s or %s", MysqlDriverMysql, MysqlDriverMemory))
+	}
+	if cfg.Mysql.MaxOpenConns <= 0 {
+		errs = append(errs, "mysql.max_open_conns must be positive")
+	}
+	if cfg.Mysql.MaxIdleConns < 0 || cfg.Mysql.MaxIdleConns > cfg.Mysql.MaxOpenConns {
+		errs = append(errs, "mysql.max_idle_conns must be in [0, max_open_conns]")
+	}
+	if cfg.Session.InactiveSeconds <= 0 {
+		errs = append(errs, "session.inactive_seconds must be positive")
+	}
+	if cfg.Session.UpdateBufferSize <= 0 {
+		errs = append(errs, "session.update_buffer_size must be positive")
+	}
+	if cfg.Session.ExpiryScanSeconds <= 0 {
+		errs = append(errs, "session.expiry_scan_seconds must be positive")
+	}
+	switch cfg.Session.Store {
+	case SessionStoreMysql:
+	case SessionStoreRedis:
+		if len(cfg.Redis.Addr) == 0 {
+			errs = append(errs, "redis.addr is required by session.store redis")
+		}
+		if cfg.Session.CacheTtl <= 0 {
+			errs = append(errs, "session.cache_ttl must be positive")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("session.store must be %s or %s", SessionStoreMysql, SessionStoreRedis))
+	}
+	if cfg.Session.MaxSpilledUpdates < 0 || cfg.Session.MaxConcurrentHandlers < 0 {
+		errs = append(errs, "session.max_spilled_updates and max_concurrent_handlers must not be negative")
+	}
+	if len(cfg.RockShop.BaseUrl) == 0 {
+		errs = append(errs, "rock_shop.base_url is required")
+	}
+	if cfg.Admin.ChatId > 0 {
+		errs = append(errs, "admin.chat_id must be the negative id of a group chat")
+	}
+
+	switch cfg.Oss.Driver {
+	case OssDriverLocal:
+		if len(cfg.Oss.Local.RootDir) == 0 {
+			errs = append(errs, "oss.local.root_dir is required")
+		}
+	case OssDriverS3:
+		if len(cfg.Oss.S3.Endpoint) == 0 || len(cfg.Oss.S3.Region) == 0 ||
+			len(cfg.Oss.S3.AccessKeyId) == 0 || len(cfg.Oss.S3.SecretAccessKey) == 0 {
+			errs = append(errs, "oss.s3.endpoint, region, access_key_id and secret_access_key are required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("oss.driver must be %s or %s", OssDriverLocal, OssDriverS3))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewStorage creates the oss storage driver configured
+func (c OssConfig) NewStorage() (oss.IStorage, error) {
+	switch c.Driver {
+	case OssDriverS3:
+		return oss.NewS3Storage(oss.S3Option{
+			Endpoint:        c.S3.Endpoint,
+			Region:          c.S3.Region,
+			AccessKeyId:     c.S3.AccessKeyId.Value(),
+			SecretAccessKey: c.S3.SecretAccessKey.Value(),
+			PublicBaseUrl:   c.S3.PublicBaseUrl,
+		}), nil
+	case OssDriverLocal:
+		return oss.NewLocalStorage(c.Local.RootDir, c.Local.BaseUrl)
+	default:
+		return nil, fmt.Errorf("unknown oss driver: %s", c.Driver)
+	}
+}
+
+// applyEnv overrides fields tagged by env with non-empty environment variables, <ENV>_FILE is also read for secrets
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := v.Type().Field(i)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		envName := fieldType.Tag.Get("env")
+		if len(envName) == 0 {
+			continue
+		}
+		envValue := os.Getenv(envName)
+		if field.Type() == reflect.TypeOf(Secret("")) && len(envValue) == 0 {
+			if secretFile := os.Getenv(envName + "_FILE"); len(secretFile) > 0 {
+				envValue = secretFilePrefix + secretFile
+			}
+		}
+		if len(envValue) == 0 {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(envValue)
+		case reflect.Int, reflect.Int64:
+			intValue, err := strconv.ParseInt(envValue, 10, 64)
+			if err != nil {
+				return fmt.Errorf("env %s must be an integer: %w", envName, err)
+			}
+			field.SetInt(intValue)
+		case reflect.Bool:
+			boolValue, err := strconv.ParseBool(envValue)
+			if err != nil {
+				return fmt.Errorf("env %s must be a bool: %w", envName, err)
+			}
+			field.SetBool(boolValue)
+		default:
+			return fmt.Errorf("env %s of unsupported kind %s", envName, field.Kind())
+		}
+	}
+	return nil
+}
+
+// resolveSecrets replaces "file:<path>" secrets with the content of the file
+func resolveSecrets(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := resolveSecrets(field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.Type() != reflect.TypeOf(Secret("")) || !strings.HasPrefix(field.String(), secretFilePrefix) {
+			continue
+		}
+		secretPath := strings.TrimPrefix(field.String(), secretFilePrefix)
+		bs, err := os.ReadFile(secretPath)
+		if err != nil {
+			return fmt.Errorf("read secret %s fail: %w", v.Type().Field(i).Name, err)
+		}
+		field.SetString(strings.TrimSpace(string(bs)))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	assert.Nil(t, err)
+	return path
+}
+
+func Test_UnitTest_Load(t *testing.T) {
+	t.Run("yaml with defaults", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+bot:
+  token: "123:abc"
+mysql:
+  dsn: "user:pwd@tcp(localhost:3306)/rock_review"
+  max_open_conns: 50
+rock_shop:
+  base_url: http://localhost:8081
+`)
+		cfg, err := Load(path)
+		assert.Nil(t, err)
+		assert.Equal(t, "123:abc", cfg.Bot.Token.Value())
+		assert.Equal(t, 60, cfg.Bot.UpdateTimeout)
+		assert.Equal(t, 50, cfg.Mysql.MaxOpenConns)
+		assert.Equal(t, 100, cfg.Mysql.MaxIdleConns)
+		assert.Equal(t, int64(300), cfg.Session.InactiveSeconds)
+		assert.Equal(t, OssDriverLocal, cfg.Oss.Driver)
+
+		// max_idle_conns of default exceeds max_open_conns of yaml
+		assert.NotNil(t, cfg.Validate())
+	})
+
+	t.Run("env overrides and secret file", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+bot:
+  token: "123:abc"
+mysql:
+  dsn: "file:`+writeFile(t, "dsn", "user:pwd@tcp(db:3306)/rock_review\n")+`"
+rock_shop:
+  base_url: http://localhost:8081
+`)
+		t.Setenv("ROCK_REVIEW_BOT_TOKEN_FILE", writeFile(t, "token", "456:def\n"))
+		t.Setenv("ROCK_REVIEW_SESSION_INACTIVE_SECONDS", "60")
+		t.Setenv("ROCK_REVIEW_OSS_DRIVER", OssDriverS3)
+		t.Setenv("ROCK_REVIEW_OSS_S3_ENDPOINT", "http://localhost:9000")
+		t.Setenv("ROCK_REVIEW_OSS_S3_REGION", "us-east-1")
+		t.Setenv("ROCK_REVIEW_OSS_S3_ACCESS_KEY_ID", "ak")
+		t.Setenv("ROCK_REVIEW_OSS_S3_SECRET_ACCESS_KEY", "sk")
+
+		cfg, err := Load(path)
+		assert.Nil(t, err)
+		assert.Nil(t, cfg.Validate())
+		assert.Equal(t, "456:def", cfg.Bot.Token.Value())
+		assert.Equal(t, "user:pwd@tcp(db:3306)/rock_review", cfg.Mysql.Dsn.Value())
+		assert.Equal(t, int64(60), cfg.Session.InactiveSeconds)
+		assert.Equal(t, "sk", cfg.Oss.S3.SecretAccessKey.Value())
+	})
+
+	t.Run("secret is hidden from logs", func(t *testing.T) {
+		assert.Equal(t, "******", Secret("123:abc").String())
+	})
+
+	t.Run("fail: invalid env", func(t *testing.T) {
+		t.Setenv("ROCK_REVIEW_MYSQL_MAX_OPEN_CONNS", "many")
+		_, err := Load("")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("fail: secret file not found", func(t *testing.T) {
+		t.Setenv("ROCK_REVIEW_BOT_TOKEN", "file:/not/exist")
+		_, err := Load("")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("fail: validate", func(t *testing.T) {
+		cfg, err := Load("")
+		assert.Nil(t, err)
+		err = cfg.Validate()
+		assert.Contains(t, err.Error(), "bot.token is required")
+		assert.Contains(t, err.Error(), "mysql.dsn is required")
+		assert.Contains(t, err.Error(), "rock_shop.base_url is required")
+
+		cfg.Bot.Token = "123:abc"
+		assert.Nil(t, cfg.ValidateBot())
+
+		// no dsn is needed in memory
+		cfg.Mysql.Driver = MysqlDriverMemory
+		err = cfg.Validate()
+		assert.NotContains(t, err.Error(), "mysql.dsn is required")
+		cfg.Mysql.Driver = "sqlserver"
+		err = cfg.Validate()
+		assert.Contains(t, err.Error(), "mysql.driver must be mysql or memory")
+
+		// a private chat can't be the admin chat
+		cfg.Admin.ChatId = 3678
+		err = cfg.Validate()
+		assert.Contains(t, err.Error(), "admin.chat_id must be the negative id of a group chat")
+	})
+}
+
+func Test_UnitTest_ValidateWebhook(t *testing.T) {
+	cfg := Default()
+	cfg.Bot.Token = "123:abc"
+	cfg.Bot.Mode = BotModeWebhook
+
+	err := cfg.ValidateBot()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bot.webhook.secret_token is required")
+
+	cfg.Bot.Webhook.SecretToken = "not valid!"
+	err = cfg.ValidateBot()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bot.webhook.secret_token must be")
+
+	cfg.Bot.Webhook.SecretToken = "a-Valid_token0"
+	assert.Nil(t, cfg.ValidateBot())
+
+	cfg.Bot.Webhook.TlsCertFile = "cert.pem"
+	err = cfg.ValidateBot()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "tls_cert_file and tls_key_file must be given together")
+
+	cfg.Bot.Webhook.TlsKeyFile = "key.pem"
+	assert.Nil(t, cfg.ValidateBot())
+
+	cfg.Bot.Mode = "push"
+	assert.NotNil(t, cfg.ValidateBot())
+}
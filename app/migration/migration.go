@@ -0,0 +1,330 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// scriptFS holds a pair of scripts per version, named <version>_<name>.up.sql and <version>_<name>.down.sql, versions
+// start from 1 and go up by 1. A version without a down script is irreversible, like the baseline of tables made by
+// hand before migrations. Statements of a script end with ; at the end of a line, lines starting with -- are comments.
+//
+//go:embed scripts/*.sql
+var scriptFS embed.FS
+
+var (
+	// ErrSchemaTooNew is returned when the schema is migrated by a newer binary, which this one doesn't understand
+	ErrSchemaTooNew = errors.New("schema version is newer than known")
+	// ErrSchemaOutdated is returned when migrations are pending, run migrate up first
+	ErrSchemaOutdated = errors.New("schema version is outdated")
+	// ErrSchemaDirty is returned when a migration failed halfway, as mysql can't roll back ddl. Fix the schema by hand,
+	// then run migrate force with the version the schema is at.
+	ErrSchemaDirty = errors.New("schema is dirty")
+	// ErrIrreversible is returned when migrating down through a version without a down script, revert it by hand and
+	// run migrate force with the version below it.
+	ErrIrreversible = errors.New("migration is irreversible")
+)
+
+// mysql error number of a missing table, the schema version table is missing before the first migration
+const errNoSuchTable = 1146
+
+const createSchemaVersionTable = "create table if not exists schema_version (" +
+	"version int not null, " +
+	"dirty tinyint(1) not null default 0, " +
+	"applied_at timestamp not null default current_timestamp, " +
+	"primary key (version)" +
+	") engine = InnoDB default charset = utf8mb4"
+
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+var embeddedMigrations = mustLoadMigrations(scriptFS)
+
+// LatestVersion is the schema version this binary is written against
+func LatestVersion() int {
+	return len(embeddedMigrations)
+}
+
+func mustLoadMigrations(fsys fs.FS) []migration {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return migrations
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(fsys, "scripts/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, p := range paths {
+		base := path.Base(p)
+		var (
+			direction string
+			up        bool
+		)
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction, up = ".up.sql", true
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = ".down.sql"
+		default:
+			return nil, fmt.Errorf("script %s is neither up nor down", base)
+		}
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(base, direction), "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("script %s is not named <version>_<name>%s", base, direction)
+		}
+
+		bs, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		statements := splitStatements(string(bs))
+		if len(statements) == 0 {
+			return nil, fmt.Errorf("script %s has no statement", base)
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("scripts of version %d are named both %s and %s", version, m.name, name)
+		}
+		if up {
+			m.up = statements
+		} else {
+			m.down = statements
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("version %d is missing", i+1)
+		}
+		if len(m.up) == 0 {
+			return nil, fmt.Errorf("version %d needs an up script", m.version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements splits a script by ; at line ends, so that it runs without multiStatements of the mysql dsn
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		builder    strings.Builder
+	)
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		builder.WriteString(line)
+		builder.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(builder.String()), ";"))
+			builder.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(builder.String()); len(rest) > 0 {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// checkVersion tells whether a binary of latest understands the schema at version
+func checkVersion(version int, dirty bool, latest int) error {
+	switch {
+	case dirty:
+		return fmt.Errorf("%w at version %d", ErrSchemaDirty, version)
+	case version > latest:
+		return fmt.Errorf("%w, schema version: %d, known: %d", ErrSchemaTooNew, version, latest)
+	case version < latest:
+		return fmt.Errorf("%w, schema version: %d, known: %d", ErrSchemaOutdated, version, latest)
+	}
+	return nil
+}
+
+// planDown tells the migrations to revert, newest first, by steps from version. Nothing is reverted when any of them is
+// irreversible, so that the schema isn't left between versions.
+func planDown(migrations []migration, version int, steps int) ([]migration, error) {
+	var plan []migration
+	for ; steps > 0 && version > 0; steps-- {
+		mig := migrations[version-1]
+		if len(mig.down) == 0 {
+			return nil, fmt.Errorf("%w, %d_%s has no down script, revert it by hand then run migrate force %d",
+				ErrIrreversible, mig.version, mig.name, mig.version-1)
+		}
+		plan = append(plan, mig)
+		version--
+	}
+	return plan, nil
+}
+
+// Migrator migrates the mysql schema by the scripts embedded, versions applied are recorded in table schema_version
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []migration
+}
+
+func NewMigrator(db *sqlx.DB) *Migrator {
+	return &Migrator{db: db, migrations: embeddedMigrations}
+}
+
+// Version tells the version of the schema, 0 before any migration, and whether a migration failed halfway
+func (m *Migrator) Version(ctx context.Context) (int, bool, error) {
+	var row struct {
+		Version int  `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+	err := m.db.GetContext(ctx, &row, "select version, dirty from schema_version order by version desc limit 1")
+	var mysqlErr *mysql.MySQLError
+	if errors.Is(err, sql.ErrNoRows) || (errors.As(err, &mysqlErr) && mysqlErr.Number == errNoSuchTable) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("get schema version fail: %w", err)
+	}
+	return row.Version, row.Dirty, nil
+}
+
+// Check refuses a schema which this binary doesn't understand, services check it before start
+func (m *Migrator) Check(ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	return checkVersion(version, dirty, len(m.migrations))
+}
+
+// Up applies pending migrations in order, it returns the version migrated to
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	version, err := m.prepare(ctx)
+	if err != nil {
+		return version, err
+	}
+
+	for _, mig := range m.migrations[version:] {
+		_, err = m.db.ExecContext(ctx, "insert into schema_version (version, dirty) values (?, 1)", mig.version)
+		if err != nil {
+			return version, fmt.Errorf("record version %d fail: %w", mig.version, err)
+		}
+		err = m.exec(ctx, mig.up)
+		if err != nil {
+			return mig.version, fmt.Errorf("migrate up to %d_%s fail, schema is left dirty: %w", mig.version, mig.name, err)
+		}
+		_, err = m.db.ExecContext(ctx, "update schema_version set dirty = 0 where version = ?", mig.version)
+		if err != nil {
+			return mig.version, fmt.Errorf("record version %d fail: %w", mig.version, err)
+		}
+		version = mig.version
+	}
+	return version, nil
+}
+
+// Down reverts the last steps migrations, it returns the version migrated to
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	version, err := m.prepare(ctx)
+	if err != nil {
+		return version, err
+	}
+
+	plan, err := planDown(m.migrations, version, steps)
+	if err != nil {
+		return version, err
+	}
+	for _, mig := range plan {
+		_, err = m.db.ExecContext(ctx, "update schema_version set dirty = 1 where version = ?", mig.version)
+		if err != nil {
+			return version, fmt.Errorf("record version %d fail: %w", mig.version, err)
+		}
+		err = m.exec(ctx, mig.down)
+		if err != nil {
+			return version, fmt.Errorf("migrate down from %d_%s fail, schema is left dirty: %w", mig.version, mig.name, err)
+		}
+		_, err = m.db.ExecContext(ctx, "delete from schema_version where version = ?", mig.version)
+		if err != nil {
+			return version, fmt.Errorf("record version %d fail: %w", mig.version, err)
+		}
+		version--
+	}
+	return version, nil
+}
+
+// Force records the schema at version and clears the dirty flag without running any script, it's for recovery after
+// the schema is fixed by hand
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	if version < 0 || version > len(m.migrations) {
+		return fmt.Errorf("version %d is out of 0-%d", version, len(m.migrations))
+	}
+	_, err := m.db.ExecContext(ctx, createSchemaVersionTable)
+	if err != nil {
+		return fmt.Errorf("create schema_version fail: %w", err)
+	}
+	_, err = m.db.ExecContext(ctx, "delete from schema_version where version > ?", version)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	_, err = m.db.ExecContext(ctx,
+		"insert into schema_version (version, dirty) values (?, 0) on duplicate key update dirty = 0", version)
+	return err
+}
+
+// prepare creates the version table if missing, and tells the version to migrate from
+func (m *Migrator) prepare(ctx context.Context) (int, error) {
+	_, err := m.db.ExecContext(ctx, createSchemaVersionTable)
+	if err != nil {
+		return 0, fmt.Errorf("create schema_version fail: %w", err)
+	}
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return version, err
+	}
+	err = checkVersion(version, dirty, len(m.migrations))
+	if err != nil && !errors.Is(err, ErrSchemaOutdated) {
+		return version, err
+	}
+	return version, nil
+}
+
+func (m *Migrator) exec(ctx context.Context, statements []string) error {
+	for _, statement := range statements {
+		_, err := m.db.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package migration
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_EmbeddedMigrations(t *testing.T) {
+	assert.Equal(t, 4, LatestVersion())
+	// the baseline only creates tables missing, and never goes down
+	assert.Equal(t, "baseline", embeddedMigrations[0].name)
+	assert.Nil(t, embeddedMigrations[0].down)
+	for _, statement := range embeddedMigrations[0].up {
+		assert.True(t, strings.HasPrefix(statement, "create table if not exists "), statement)
+	}
+
+	addColumn := regexp.MustCompile(`(?m)^\s*add column (\w+)`)
+	for i, m := range embeddedMigrations {
+		assert.Equal(t, i+1, m.version)
+		if i == 0 {
+			continue
+		}
+		// every table and column added is dropped on the way down
+		down := strings.Join(m.down, "\n")
+		for _, statement := range m.up {
+			if strings.HasPrefix(statement, "create table ") {
+				table := strings.Fields(strings.TrimPrefix(statement, "create table if not exists "))[0]
+				assert.Contains(t, m.down, "drop table if exists "+table, m.name)
+			}
+			for _, match := range addColumn.FindAllStringSubmatch(statement, -1) {
+				assert.Contains(t, down, "drop column "+match[1], m.name)
+			}
+		}
+	}
+}
+
+func Test_UnitTest_SplitStatements(t *testing.T) {
+	script := `-- comment
+create table a
+(
+    id bigint not null -- trailing comment is kept for mysql
+);
+
+drop table b;
+insert into c values ('x')`
+	assert.Equal(t, []string{
+		"create table a\n(\n    id bigint not null -- trailing comment is kept for mysql\n)",
+		"drop table b",
+		"insert into c values ('x')",
+	}, splitStatements(script))
+	assert.Nil(t, splitStatements("-- nothing\n\n"))
+}
+
+func Test_UnitTest_LoadMigrations(t *testing.T) {
+	script := &fstest.MapFile{Data: []byte("select 1;")}
+	testCases := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{"valid", fstest.MapFS{
+			"scripts/0002_b.up.sql": script, "scripts/0002_b.down.sql": script,
+			"scripts/0001_a.up.sql": script, "scripts/0001_a.down.sql": script,
+		}, ""},
+		{"irreversible", fstest.MapFS{
+			"scripts/0002_b.up.sql": script, "scripts/0002_b.down.sql": script, "scripts/0001_a.up.sql": script,
+		}, ""},
+		{"missing up", fstest.MapFS{"scripts/0001_a.down.sql": script}, "version 1 needs an up script"},
+		{"missing version", fstest.MapFS{"scripts/0002_b.up.sql": script, "scripts/0002_b.down.sql": script},
+			"version 1 is missing"},
+		{"bad name", fstest.MapFS{"scripts/a.up.sql": script}, "script a.up.sql is not named <version>_<name>.up.sql"},
+		{"neither up nor down", fstest.MapFS{"scripts/0001_a.sql": script}, "script 0001_a.sql is neither up nor down"},
+		{"names differ", fstest.MapFS{"scripts/0001_a.up.sql": script, "scripts/0001_b.down.sql": script},
+			"scripts of version 1 are named both"},
+		{"empty", fstest.MapFS{"scripts/0001_a.up.sql": {Data: []byte("-- todo")}}, "script 0001_a.up.sql has no statement"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tc.fsys)
+			if len(tc.wantErr) > 0 {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tc.wantErr)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			if assert.Len(t, migrations, 2) {
+				assert.Equal(t, "a", migrations[0].name)
+				assert.Equal(t, []string{"select 1"}, migrations[1].down)
+			}
+		})
+	}
+}
+
+func Test_UnitTest_PlanDown(t *testing.T) {
+	migrations := []migration{
+		{version: 1, name: "baseline", up: []string{"create table a"}},
+		{version: 2, name: "b", up: []string{"create table b"}, down: []string{"drop table b"}},
+		{version: 3, name: "c", up: []string{"create table c"}, down: []string{"drop table c"}},
+	}
+
+	plan, err := planDown(migrations, 3, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, plan, 2) {
+		assert.Equal(t, 3, plan[0].version)
+		assert.Equal(t, 2, plan[1].version)
+	}
+	plan, err = planDown(migrations, 2, 5)
+	assert.True(t, errors.Is(err, ErrIrreversible))
+	assert.Contains(t, err.Error(), "1_baseline has no down script, revert it by hand then run migrate force 0")
+	assert.Nil(t, plan)
+	plan, err = planDown(migrations, 0, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, plan)
+}
+
+func Test_UnitTest_CheckVersion(t *testing.T) {
+	assert.Nil(t, checkVersion(2, false, 2))
+	assert.True(t, errors.Is(checkVersion(3, false, 2), ErrSchemaTooNew))
+	assert.True(t, errors.Is(checkVersion(1, false, 2), ErrSchemaOutdated))
+	assert.True(t, errors.Is(checkVersion(0, false, 2), ErrSchemaOutdated))
+	assert.True(t, errors.Is(checkVersion(2, true, 2), ErrSchemaDirty))
+}
@@ -0,0 +1,36 @@
+-- tables as they were before migrations, deployments made them by hand, so that this is a no-op there. It creates them
+-- on a new database, columns added since are added by later migrations. It has no down script, as reverting it drops
+-- data made before migrations.
+
+-- reviews submitted by users
+create table if not exists review
+(
+    id             bigint unsigned not null auto_increment,
+    tg_user_id     bigint          not null,
+    review_content json            not null,
+    created_at     timestamp       not null default current_timestamp,
+    primary key (id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- sessions of users drafting reviews
+create table if not exists review_user_session
+(
+    tg_user_id   bigint      not null,
+    phone_number varchar(32) not null default '',
+    `state`      int         not null default 0,
+    primary key (tg_user_id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- logs of bot_lambda, which has no log files to keep
+create table if not exists access_log
+(
+    id         bigint unsigned not null auto_increment,
+    `level`    varchar(8)      not null,
+    `content`  mediumtext      not null,
+    created_at timestamp       not null default current_timestamp,
+    primary key (id),
+    key idx_created_at (created_at)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1,3 @@
+drop table if exists tg_update_spill;
+drop table if exists tg_polling_offset;
+drop table if exists tg_update_dedupe;
@@ -0,0 +1,32 @@
+-- updates claimed by bot_lambda instances, telegram may redeliver an update to another instance
+create table if not exists tg_update_dedupe
+(
+    update_id  bigint  not null,
+    `status`   tinyint not null default 0,
+    err        text    not null,
+    claimed_at bigint  not null default 0 comment 'unix time, rows are purged two days after',
+    primary key (update_id),
+    key idx_claimed_at (claimed_at)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- offset of getUpdates of bot_server, so that a restart neither loses nor repeats updates
+create table if not exists tg_polling_offset
+(
+    bot_id        bigint not null,
+    update_offset bigint not null default 0,
+    primary key (bot_id)
+) engine = InnoDB
+  default charset = utf8mb4;
+
+-- updates overflowing the buffer of a user session, replayed in order by id
+create table if not exists tg_update_spill
+(
+    id             bigint unsigned not null auto_increment,
+    tg_user_id     bigint          not null,
+    chat_id        bigint          not null default 0,
+    update_content json            not null,
+    primary key (id),
+    key idx_tg_user_id_id (tg_user_id, id)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1 @@
+drop table if exists tg_update_journal;
@@ -0,0 +1,14 @@
+-- updates received and messages sent with personal data redacted, replayed by bot_server replay to reproduce replies
+create table if not exists tg_update_journal
+(
+    id         bigint unsigned not null auto_increment,
+    kind       varchar(16)     not null comment 'update or outbound',
+    update_id  bigint          not null default 0 comment 'the update an outbound message replies to, 0 if none',
+    chat_id    bigint          not null default 0,
+    payload    json            not null,
+    created_at bigint          not null default 0 comment 'unix time, rows can be purged when no longer investigated',
+    primary key (id),
+    key idx_chat_id_created_at (chat_id, created_at),
+    key idx_created_at (created_at)
+) engine = InnoDB
+  default charset = utf8mb4;
@@ -0,0 +1,16 @@
+alter table review_user_session
+    drop key idx_state_expire_at,
+    drop column updated_at,
+    drop column version,
+    drop column locale,
+    drop column reminder_sent,
+    drop column state_expire_at,
+    drop column chat_id,
+    drop column review_draft;
+
+alter table review
+    drop key uk_review_id,
+    drop column session_version,
+    drop column rating,
+    drop column order_id,
+    drop column review_id;
@@ -0,0 +1,24 @@
+-- columns of reviews and sessions added since the baseline
+alter table review
+    add column review_id       varchar(64) not null default '',
+    add column order_id        varchar(64) not null default '',
+    add column rating          tinyint     not null default 0 comment '1-5, 0 means not rated',
+    add column session_version bigint      not null default 0 comment 'session version committing it, a newer one replaces it';
+
+-- reviews stored before have no id, give them one before it's unique
+update review
+set review_id = uuid()
+where review_id = '';
+
+alter table review
+    add unique key uk_review_id (review_id);
+
+alter table review_user_session
+    add column review_draft    json        null,
+    add column chat_id         bigint      not null default 0,
+    add column state_expire_at bigint      not null default 0 comment 'unix time the state times out, 0 never',
+    add column reminder_sent   tinyint(1)  not null default 0,
+    add column locale          varchar(16) not null default '',
+    add column version         bigint      not null default 1 comment 'bumped by every update, for optimistic concurrency',
+    add column updated_at      timestamp   not null default current_timestamp on update current_timestamp,
+    add key idx_state_expire_at (state_expire_at);
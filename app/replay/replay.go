@@ -0,0 +1,190 @@
+// Package replay reproduces replies of the bot from the update journal, against a fake bot api. It's kept out of
+// bot_server so that the fake bot api isn't linked into the bot.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"rock_review/app/bot_server"
+	"rock_review/app/config"
+	"rock_review/util/telegramtest"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// replayBotToken is the token of the replaying bot, only the fake bot api sees it
+const replayBotToken = "1:replay"
+
+// Option is what the replaying bot needs besides the journal
+type Option struct {
+	Session  config.SessionConfig
+	RockShop bot_server.IRockShopSvc // RockShop is asked for orders by redacted phone numbers
+}
+
+type Report struct {
+	Updates      int    `json:"updates"`      // Updates is updates replayed
+	Matched      int    `json:"matched"`      // Matched is updates replied as originally
+	Unattributed int    `json:"unattributed"` // Unattributed is messages sent originally without an update, such as reminders, which replay doesn't reproduce
+	Diffs        []Diff `json:"diffs"`
+}
+
+// Diff is an update replied differently than originally
+type Diff struct {
+	UpdateId int                      `json:"update_id"`
+	Original []bot_server.JournalCall `json:"original"`
+	Replayed []bot_server.JournalCall `json:"replayed"`
+}
+
+// Journal feeds updates of entries one by one to a fresh bot, which talks to a fake bot api and keeps data in
+// memory, and compares the messages it sends for each update against the ones sent originally. Entries are expected to
+// start from the beginning of the conversations, as sessions start from scratch.
+//
+// Ids the replay mints, such as review ids, differ from the original ones. They are paired by position in the first
+// messages carrying them, then mapped back in comparison, and mapped forth in updates carrying them such as callback
+// data.
+func Journal(ctx context.Context, entries []bot_server.JournalEntry, opt Option) (Report, error) {
+	var (
+		report    Report
+		updates   []bot_server.JournalEntry
+		originals = map[int][]bot_server.JournalCall{}
+	)
+	for _, entry := range entries {
+		switch entry.Kind {
+		case bot_server.JournalKindUpdate:
+			updates = append(updates, entry)
+		case bot_server.JournalKindOutbound:
+			if entry.UpdateId == 0 {
+				report.Unattributed++
+				continue
+			}
+			call, err := decodeJournalCall(entry.Payload)
+			if err != nil {
+				return report, fmt.Errorf("decode journal entry %d fail: %w", entry.Id, err)
+			}
+			originals[entry.UpdateId] = append(originals[entry.UpdateId], call)
+		}
+	}
+
+	server := telegramtest.NewServer(replayBotToken)
+	defer server.Close()
+	journalRepo := bot_server.NewMemUpdateJournalRepo()
+	sessionMgr := bot_server.NewUserSessionMgr(bot_server.NewMemUserSessionRepo(), opt.Session)
+	defer sessionMgr.Shutdown(ctx)
+	bot := bot_server.NewReviewBotSvc(config.BotConfig{
+		Token:          replayBotToken,
+		Mode:           config.BotModeWebhook,
+		DedupeCapacity: len(updates) + 1,
+		ApiEndpoint:    server.APIEndpoint(),
+		FileEndpoint:   server.FileEndpoint(),
+	}, sessionMgr, bot_server.NewMemReviewRepo(), opt.RockShop).WithJournalRepo(journalRepo)
+	err := bot.Init()
+	if err != nil {
+		return report, err
+	}
+
+	ids := replayIdMap{toOriginal: map[string]string{}, toReplayed: map[string]string{}}
+	compared := 0
+	for _, entry := range updates {
+		var update tgbotapi.Update
+		err = json.Unmarshal(ids.replace(entry.Payload, ids.toReplayed), &update)
+		if err != nil {
+			return report, fmt.Errorf("decode journal entry %d fail: %w", entry.Id, err)
+		}
+		// updates failing are replied as well, replies are what's compared
+		_ = bot.HandleUpdate(ctx, update)
+
+		journaled, _ := journalRepo.ListJournal(ctx, bot_server.JournalFilter{})
+		var replayed []bot_server.JournalCall
+		for _, sent := range journaled[compared:] {
+			if sent.Kind != bot_server.JournalKindOutbound {
+				continue
+			}
+			call, err := decodeJournalCall(sent.Payload)
+			if err != nil {
+				return report, err
+			}
+			replayed = append(replayed, call)
+		}
+		compared = len(journaled)
+
+		// a redelivered update is compared against nothing, as the original replies belong to its first delivery
+		original := originals[update.UpdateID]
+		delete(originals, update.UpdateID)
+		ids.learn(original, replayed)
+		for i := range replayed {
+			replayed[i].Config = ids.replace(replayed[i].Config, ids.toOriginal)
+		}
+
+		report.Updates++
+		if equalJournalCalls(original, replayed) {
+			report.Matched++
+			continue
+		}
+		report.Diffs = append(report.Diffs, Diff{UpdateId: update.UpdateID, Original: original, Replayed: replayed})
+	}
+	return report, nil
+}
+
+// decodeJournalCall decodes the payload of a message sent, the config is re-encoded as the json from mysql is
+// formatted differently than the one encoded
+func decodeJournalCall(payload []byte) (bot_server.JournalCall, error) {
+	var call bot_server.JournalCall
+	err := json.Unmarshal(payload, &call)
+	if err != nil {
+		return call, err
+	}
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(call.Config))
+	decoder.UseNumber()
+	err = decoder.Decode(&v)
+	if err != nil {
+		return call, err
+	}
+	call.Config, err = json.Marshal(v)
+	return call, err
+}
+
+func equalJournalCalls(a []bot_server.JournalCall, b []bot_server.JournalCall) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Config, b[i].Config) {
+			return false
+		}
+	}
+	return true
+}
+
+// replayIdMap maps ids minted by the replay to the original ones and back
+type replayIdMap struct {
+	toOriginal map[string]string
+	toReplayed map[string]string
+}
+
+// learn pairs ids of messages sent for the same update by position, ids already paired are kept
+func (m replayIdMap) learn(original []bot_server.JournalCall, replayed []bot_server.JournalCall) {
+	for i := 0; i < len(original) && i < len(replayed); i++ {
+		originalIds := bot_server.MintedIdPattern.FindAllString(string(original[i].Config), -1)
+		replayedIds := bot_server.MintedIdPattern.FindAllString(string(replayed[i].Config), -1)
+		for j := 0; j < len(originalIds) && j < len(replayedIds); j++ {
+			_, paired := m.toOriginal[replayedIds[j]]
+			if _, ok := m.toReplayed[originalIds[j]]; ok || paired {
+				continue
+			}
+			m.toOriginal[replayedIds[j]] = originalIds[j]
+			m.toReplayed[originalIds[j]] = replayedIds[j]
+		}
+	}
+}
+
+func (m replayIdMap) replace(data []byte, ids map[string]string) []byte {
+	return bot_server.MintedIdPattern.ReplaceAllFunc(data, func(id []byte) []byte {
+		if mapped, ok := ids[string(id)]; ok {
+			return []byte(mapped)
+		}
+		return id
+	})
+}
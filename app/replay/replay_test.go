@@ -0,0 +1,95 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"rock_review/app/bot_server"
+	"rock_review/app/config"
+	"rock_review/util/telegramtest"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUserId = 3678
+
+func Test_UnitTest_Journal(t *testing.T) {
+	ctx := context.Background()
+	server := telegramtest.NewServer("123:secret")
+	defer server.Close()
+	journalRepo := bot_server.NewMemUpdateJournalRepo()
+	sessionMgr := bot_server.NewUserSessionMgr(bot_server.NewMemUserSessionRepo(),
+		config.SessionConfig{InactiveSeconds: 300, UpdateBufferSize: 10})
+	bot := bot_server.NewReviewBotSvc(config.BotConfig{
+		Token:          "123:secret",
+		Mode:           config.BotModeWebhook,
+		DedupeCapacity: 100,
+		ApiEndpoint:    server.APIEndpoint(),
+		FileEndpoint:   server.FileEndpoint(),
+	}, sessionMgr, bot_server.NewMemReviewRepo(), nil).WithJournalRepo(journalRepo)
+	if !assert.Nil(t, bot.Init()) {
+		return
+	}
+	user := tgbotapi.User{ID: testUserId, FirstName: "Rock"}
+
+	updateId := 100
+	handle := func(update tgbotapi.Update) {
+		updateId++
+		update.UpdateID = updateId
+		raw, _ := json.Marshal(update)
+		assert.Nil(t, bot.HandleRawUpdate(ctx, update, raw))
+	}
+	sendText := func(text string) {
+		handle(telegramtest.TextUpdate(user, text))
+	}
+	sendText("/comment")
+	// the review id is minted at random, the replay mints another one
+	entries, _ := journalRepo.ListJournal(ctx, bot_server.JournalFilter{})
+	reviewId := bot_server.MintedIdPattern.FindString(string(entries[len(entries)-1].Payload))
+	if !assert.NotEmpty(t, reviewId) {
+		return
+	}
+	handle(telegramtest.CallbackUpdate(user, "q1", 7, "rate:"+reviewId+":4"))
+	sendText("Loud, call me at 91234567")
+	sendText("/finish")
+	// redelivered
+	updateId--
+	sendText("/finish")
+	_, _ = bot.Send(ctx, tgbotapi.NewMessage(testUserId, "a reminder"))
+
+	entries, _ = journalRepo.ListJournal(ctx, bot_server.JournalFilter{ChatId: testUserId})
+	kinds := map[string]int{}
+	for _, entry := range entries {
+		kinds[entry.Kind]++
+		assert.NotContains(t, string(entry.Payload), `"Rock"`)
+		assert.NotContains(t, string(entry.Payload), "91234567")
+	}
+	// the redelivered update is journaled once
+	assert.Equal(t, map[string]int{bot_server.JournalKindUpdate: 4, bot_server.JournalKindOutbound: 6}, kinds)
+
+	report, err := Journal(ctx, entries, Option{Session: config.SessionConfig{InactiveSeconds: 300}})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Updates)
+	assert.Equal(t, 4, report.Matched)
+	assert.Equal(t, 1, report.Unattributed)
+	assert.Empty(t, report.Diffs)
+
+	// a reply changed since is reported along with the update, ids minted by the replay are mapped back
+	for i, entry := range entries {
+		if entry.Kind == bot_server.JournalKindOutbound && entry.UpdateId == 104 {
+			entries[i].Payload = []byte(`{"type":"MessageConfig","config":{"Text":"thanks"}}`)
+		}
+	}
+	report, err = Journal(ctx, entries, Option{Session: config.SessionConfig{InactiveSeconds: 300}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Matched)
+	if assert.Len(t, report.Diffs, 1) {
+		assert.Equal(t, 104, report.Diffs[0].UpdateId)
+		assert.Equal(t, `{"Text":"thanks"}`, string(report.Diffs[0].Original[0].Config))
+		if assert.Len(t, report.Diffs[0].Replayed, 1) {
+			assert.Equal(t, "MessageConfig", report.Diffs[0].Replayed[0].Type)
+			assert.Contains(t, string(report.Diffs[0].Replayed[0].Config), reviewId)
+		}
+	}
+}
@@ -1,20 +1,44 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"rock_review/app/bot_server"
+	"rock_review/app/config"
 	"rock_review/util/goutil"
 	"strings"
 )
 
 func main() {
-	botToken := "7131845071:AAFk2z4SVHpswj3ZAnC9LY7-UJBcOuM6qC4"
-	method, data := methodSetWebhook()
+	configPath := flag.String("config", "", "config file path, env "+config.EnvConfigPath+" is used if empty")
+	sessionGraph := flag.Bool("session_graph", false, "print the conversation state graph in DOT and exit")
+	checkTemplates := flag.String("check_templates", "", "validate the message template bundle in the directory and exit")
+	flag.Parse()
+
+	if *sessionGraph {
+		fmt.Print(bot_server.SessionGraphDot())
+		return
+	}
+	if len(*checkTemplates) > 0 {
+		err := bot_server.CheckTemplates(*checkTemplates)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid templates: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("templates ok")
+		return
+	}
+
+	cfg := mustLoadConfig(*configPath)
+	botToken := cfg.Bot.Token.Value()
+	method, data := methodSetWebhook(cfg.Bot.Webhook.Url, cfg.Bot.Webhook.SecretToken.Value())
 
 	bodyReader := strings.NewReader(goutil.JsonString(data))
 
-	resp, err := http.Post(fmt.Sprintf("https://api.telegram.org/bot%s/%s", botToken, method), "application/json", bodyReader)
+	resp, err := http.Post(fmt.Sprintf(cfg.Bot.ApiEndpoint, botToken, method), "application/json", bodyReader)
 	if err != nil {
 		panic(err)
 	}
@@ -26,11 +50,31 @@ func main() {
 	fmt.Printf("resp: %s", string(rawResp))
 }
 
-func methodSetWebhook() (string, map[string]any) {
+// mustLoadConfig loads config of the bot section only, as no other dependency is needed to call telegram api
+func mustLoadConfig(path string) *config.Config {
+	if len(path) == 0 {
+		path = os.Getenv(config.EnvConfigPath)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		panic(err)
+	}
+	err = cfg.ValidateBot()
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func methodSetWebhook(webhookUrl string, secretToken string) (string, map[string]any) {
 	method := "setWebhook"
 
 	data := map[string]any{
-		"url": "https://review-bot-svc-renrxplzls.ap-southeast-1.fcapp.run",
+		"url": webhookUrl,
+	}
+	// telegram sends the secret token back in header X-Telegram-Bot-Api-Secret-Token of every webhook request
+	if len(secretToken) > 0 {
+		data["secret_token"] = secretToken
 	}
 	return method, data
 }
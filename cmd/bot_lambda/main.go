@@ -7,9 +7,14 @@ import (
 	"net/http"
 	"os"
 	"rock_review/app/bot_server"
+	"rock_review/app/config"
+	"rock_review/app/migration"
 	"rock_review/util/goutil"
+	"rock_review/util/oss"
 	"rock_review/util/persist"
 	"rock_review/util/xlogger"
+	"strings"
+	"time"
 
 	"github.com/aliyun/fc-runtime-go-sdk/fc"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -80,8 +85,37 @@ func (h *HTTPTriggerResponse) WithBody(body string) *HTTPTriggerResponse {
 	return h
 }
 
+// TimerTriggerEvent is the event of the timer trigger, which shares the function with the http trigger
+type TimerTriggerEvent struct {
+	TriggerTime string `json:"triggerTime"`
+	TriggerName string `json:"triggerName"`
+	Payload     string `json:"payload"`
+}
+
 type httpHandler func(ctx context.Context, event HTTPTriggerEvent) (*HTTPTriggerResponse, error)
 
+type eventHandler func(ctx context.Context, event json.RawMessage) (*HTTPTriggerResponse, error)
+
+// triggerHandler tells events of the timer trigger from those of the http trigger by triggerName, the timer trigger
+// times out and reminds sessions
+func triggerHandler(handler httpHandler, expiry *bot_server.SessionExpiryScheduler) eventHandler {
+	return func(ctx context.Context, rawEvent json.RawMessage) (*HTTPTriggerResponse, error) {
+		var timerEvent TimerTriggerEvent
+		err := json.Unmarshal(rawEvent, &timerEvent)
+		if err == nil && len(timerEvent.TriggerName) > 0 {
+			report := expiry.RunOnce(ctx)
+			return NewHTTPTriggerResponse(http.StatusOK).WithBody(goutil.JsonString(report)), nil
+		}
+
+		var event HTTPTriggerEvent
+		err = json.Unmarshal(rawEvent, &event)
+		if err != nil {
+			return NewHTTPTriggerResponse(http.StatusBadRequest).WithBody(err.Error()), nil
+		}
+		return handler(ctx, event)
+	}
+}
+
 func botSvcHandler(botSvc *bot_server.ReviewBotSvc) httpHandler {
 	return func(ctx context.Context, event HTTPTriggerEvent) (*HTTPTriggerResponse, error) {
 		return botSvcHandle(ctx, botSvc, event)
@@ -89,6 +123,9 @@ func botSvcHandler(botSvc *bot_server.ReviewBotSvc) httpHandler {
 }
 
 func botSvcHandle(ctx context.Context, botSvc *bot_server.ReviewBotSvc, event HTTPTriggerEvent) (*HTTPTriggerResponse, error) {
+	if !botSvc.VerifySecretToken(headerValue(event.Headers, "X-Telegram-Bot-Api-Secret-Token")) {
+		return NewHTTPTriggerResponse(http.StatusUnauthorized).WithBody("unauthorized"), nil
+	}
 	if event.Body == nil {
 		return NewHTTPTriggerResponse(http.StatusBadRequest).WithBody("body is nil"), nil
 	}
@@ -102,8 +139,11 @@ func botSvcHandle(ctx context.Context, botSvc *bot_server.ReviewBotSvc, event HT
 	if err != nil {
 		return NewHTTPTriggerResponse(http.StatusBadRequest).WithBody(err.Error()), nil
 	}
-
-	err = botSvc.HandleUpdate(ctx, update)
+	err = botSvc.HandleRawUpdate(ctx, update, []byte(*event.Body))
+	if bot_server.IsRetryableErr(err) {
+		// telegram redelivers the update on failure responses
+		return NewHTTPTriggerResponse(http.StatusServiceUnavailable).WithBody(err.Error()), nil
+	}
 	if err != nil {
 		return NewHTTPTriggerResponse(http.StatusBadRequest).WithBody(err.Error()), nil
 	}
@@ -111,6 +151,16 @@ func botSvcHandle(ctx context.Context, botSvc *bot_server.ReviewBotSvc, event HT
 	return NewHTTPTriggerResponse(http.StatusOK), nil
 }
 
+// headerValue looks up header case-insensitively, as the trigger doesn't canonicalize header keys
+func headerValue(headers map[string]string, key string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
 func debugMiddleware(handler httpHandler) httpHandler {
 	return func(ctx context.Context, event HTTPTriggerEvent) (*HTTPTriggerResponse, error) {
 		var (
@@ -157,30 +207,67 @@ func logRequest(req HTTPTriggerEvent, resp *HTTPTriggerResponse, err, panicErr e
 	xlogger.InfoF(context.TODO(), goutil.JsonString(l))
 }
 
-func initBotSvc() (*bot_server.ReviewBotSvc, *sqlx.DB) {
-	//dbUri := "iamrock:pwd_159jkl@tcp(localhost:3306)/rock_review?charset=utf8mb4"
-	dbUri := "iamrock:pwd_159jkl@tcp(rm-cn-27a3newvh0002rbo.rwlb.rds.aliyuncs.com:3306)/rock_review?charset=utf8mb4"
-	reviewDb := persist.MustNewMysqlClient(dbUri).Unsafe()
-	userSessionRepo := bot_server.NewUserSessionRepo(reviewDb)
-	userSessionMgr := bot_server.NewUserSessionMgr(userSessionRepo)
+func initBotSvc(cfg *config.Config) (*bot_server.ReviewBotSvc, *bot_server.SessionExpiryScheduler, *sqlx.DB) {
+	reviewDb := persist.MustNewMysqlClient(cfg.Mysql.Dsn.Value(), cfg.Mysql.MaxOpenConns, cfg.Mysql.MaxIdleConns).Unsafe()
+	// the schema is migrated by bot_server migrate before deploying, instances never migrate it on their own
+	err := migration.NewMigrator(reviewDb).Check(context.Background())
+	if err != nil {
+		xlogger.FatalF(context.Background(), "check schema failed: %v", err)
+	}
+	var userSessionRepo bot_server.ISessionRepo = bot_server.NewUserSessionRepo(reviewDb)
+	if cfg.Session.Store == config.SessionStoreRedis {
+		redisCli := persist.NewRedisClient(cfg.Redis.Addr, cfg.Redis.Password.Value())
+		userSessionRepo = bot_server.NewCachedUserSessionRepo(redisCli, userSessionRepo, time.Duration(cfg.Session.CacheTtl)*time.Second)
+	}
+	userSessionMgr := bot_server.NewUserSessionMgr(userSessionRepo, cfg.Session)
 	reviewRepo := bot_server.NewReviewRepo(reviewDb)
-	botSvc := bot_server.NewReviewBotSvc("7131845071:AAFk2z4SVHpswj3ZAnC9LY7-UJBcOuM6qC4", userSessionMgr, reviewRepo)
+	rockShopSvc := bot_server.NewRockShopSvc(cfg.RockShop.BaseUrl)
+	// telegram may redeliver an update to another instance, dedupe by mysql instead of memory
+	updateDedupeRepo := bot_server.NewUpdateDedupeRepo(reviewDb)
+	botSvc := bot_server.NewReviewBotSvc(cfg.Bot, userSessionMgr, reviewRepo, rockShopSvc).WithDedupeRepo(updateDedupeRepo)
+	if cfg.Journal.Enabled {
+		botSvc.WithJournalRepo(bot_server.NewUpdateJournalRepo(reviewDb))
+	}
+	if cfg.Admin.ChatId != 0 {
+		botSvc.WithAdminInbox(cfg.Admin)
+	}
+	// instances don't live long enough to scan periodically, sessions are scanned by the timer trigger instead
+	expiryScheduler := bot_server.NewSessionExpiryScheduler(botSvc, userSessionRepo)
 
-	return botSvc, reviewDb
+	return botSvc, expiryScheduler, reviewDb
 }
 
 func main() {
-	botSvc, db := initBotSvc()
+	// function instances are configured by env, see config.EnvConfigPath and env tags of config.Config
+	cfg := config.MustLoad("")
+	if cfg.Mysql.Driver != config.MysqlDriverMysql {
+		// instances don't share memory
+		xlogger.FatalF(context.Background(), "bot_lambda needs mysql.driver %s", config.MysqlDriverMysql)
+	}
+	botSvc, expiryScheduler, db := initBotSvc(cfg)
 	xlogger.Logger = dbLogger{db: db}
 
-	err := botSvc.Init()
+	storage, err := cfg.Oss.NewStorage()
+	if err != nil {
+		xlogger.FatalF(context.Background(), "init oss storage failed: %v", err)
+	}
+	oss.Init(storage)
+
+	if len(cfg.Templates.Dir) > 0 {
+		err = bot_server.LoadTemplates(cfg.Templates.Dir)
+		if err != nil {
+			xlogger.FatalF(context.Background(), "load templates failed: %v", err)
+		}
+	}
+
+	err = botSvc.Init()
 	if err != nil {
 		xlogger.FatalF(context.Background(), "run bot serviced failed: %v", err)
 	}
 
 	xlogger.InfoF(context.TODO(), "lambda service started")
 
-	fc.Start(debugMiddleware(botSvcHandler(botSvc)))
+	fc.Start(triggerHandler(debugMiddleware(botSvcHandler(botSvc)), expiryScheduler))
 }
 
 var _ xlogger.ILogger = dbLogger{}
@@ -2,30 +2,116 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"rock_review/app/bot_server"
+	"rock_review/app/config"
+	"rock_review/app/migration"
+	"rock_review/app/replay"
+	"rock_review/util/oss"
 	"rock_review/util/persist"
 	"rock_review/util/xlogger"
+	"strconv"
 	"syscall"
+	"time"
 )
 
-func initBotSvc() *bot_server.ReviewBotSvc {
-	db := persist.MustNewMysqlClient("iamrock:pwd_159jkl@tcp(localhost:3306)/rock_review?charset=utf8mb4").Unsafe()
+// repos are where bot_server keeps data, in mysql or in memory by mysql.driver
+type repos struct {
+	session       bot_server.ISessionRepo
+	updateSpill   bot_server.IUpdateSpillRepo
+	review        bot_server.IReviewRepo
+	pollingOffset bot_server.IPollingOffsetRepo
+	journal       bot_server.IUpdateJournalRepo
+}
 
-	userSessionRepo := bot_server.NewUserSessionRepo(db)
-	userSessionMgr := bot_server.NewUserSessionMgr(userSessionRepo)
-	reviewRepo := bot_server.NewReviewRepo(db)
-	botSvc := bot_server.NewReviewBotSvc("7131845071:AAFk2z4SVHpswj3ZAnC9LY7-UJBcOuM6qC4", userSessionMgr, reviewRepo)
+func initRepos(cfg *config.Config) repos {
+	if cfg.Mysql.Driver == config.MysqlDriverMemory {
+		xlogger.InfoF(context.Background(), "mysql.driver is memory, all data is lost on exit")
+		return repos{
+			session:       bot_server.NewMemUserSessionRepo(),
+			updateSpill:   bot_server.NewMemUpdateSpillRepo(),
+			review:        bot_server.NewMemReviewRepo(),
+			pollingOffset: bot_server.NewMemPollingOffsetRepo(),
+			journal:       bot_server.NewMemUpdateJournalRepo(),
+		}
+	}
+
+	db := persist.MustNewMysqlClient(cfg.Mysql.Dsn.Value(), cfg.Mysql.MaxOpenConns, cfg.Mysql.MaxIdleConns).Unsafe()
+	err := migration.NewMigrator(db).Check(context.Background())
+	if err != nil {
+		xlogger.FatalF(context.Background(), "check schema failed, run migrate: %v", err)
+	}
+	return repos{
+		session:       bot_server.NewUserSessionRepo(db),
+		updateSpill:   bot_server.NewUpdateSpillRepo(db),
+		review:        bot_server.NewReviewRepo(db),
+		pollingOffset: bot_server.NewPollingOffsetRepo(db),
+		journal:       bot_server.NewUpdateJournalRepo(db),
+	}
+}
+
+func initBotSvc(cfg *config.Config) *bot_server.ReviewBotSvc {
+	repos := initRepos(cfg)
+
+	userSessionRepo := repos.session
+	if cfg.Session.Store == config.SessionStoreRedis {
+		redisCli := persist.NewRedisClient(cfg.Redis.Addr, cfg.Redis.Password.Value())
+		userSessionRepo = bot_server.NewCachedUserSessionRepo(redisCli, userSessionRepo, time.Duration(cfg.Session.CacheTtl)*time.Second)
+	}
+	userSessionMgr := bot_server.NewUserSessionMgr(userSessionRepo, cfg.Session).WithSpillRepo(repos.updateSpill)
+	rockShopSvc := bot_server.NewRockShopSvc(cfg.RockShop.BaseUrl)
+	botSvc := bot_server.NewReviewBotSvc(cfg.Bot, userSessionMgr, repos.review, rockShopSvc).
+		WithPollingOffsetRepo(repos.pollingOffset)
+	if cfg.Journal.Enabled {
+		botSvc.WithJournalRepo(repos.journal)
+	}
+	if cfg.Admin.ChatId != 0 {
+		botSvc.WithAdminInbox(cfg.Admin)
+	}
+	userSessionMgr.WithExpiryScheduler(bot_server.NewSessionExpiryScheduler(botSvc, userSessionRepo))
 
 	return botSvc
 }
 
 func main() {
-	botSvc := initBotSvc()
+	configPath := flag.String("config", "", "config file path, env "+config.EnvConfigPath+" is used if empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] [migrate up|down [steps]|version|force <version>] [replay -chat <chat_id> [replay flags]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "migrate":
+		migrate(*configPath, flag.Args()[1:])
+		return
+	case "replay":
+		replayJournal(*configPath, flag.Args()[1:])
+		return
+	}
+
+	cfg := config.MustLoad(*configPath)
+	botSvc := initBotSvc(cfg)
 	ctx, cancelF := context.WithCancel(context.Background())
 
-	err := botSvc.Init()
+	storage, err := cfg.Oss.NewStorage()
+	if err != nil {
+		xlogger.FatalF(ctx, "init oss storage failed: %v", err)
+	}
+	oss.Init(storage)
+
+	if len(cfg.Templates.Dir) > 0 {
+		err = bot_server.LoadTemplates(cfg.Templates.Dir)
+		if err != nil {
+			xlogger.FatalF(ctx, "load templates failed: %v", err)
+		}
+	}
+
+	err = botSvc.Init()
 	if err != nil {
 		xlogger.FatalF(ctx, "run bot serviced failed: %v", err)
 	}
@@ -34,10 +120,195 @@ func main() {
 	xlogger.InfoF(ctx, "bot service started")
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 
-	<-sigChan
+	for running := true; running; {
+		select {
+		case <-sigChan:
+			running = false
+		case <-reloadChan:
+			reloadTemplates(ctx, cfg.Templates.Dir)
+		}
+	}
 	xlogger.InfoF(ctx, "bot service terminating")
 
+	// stop intake, then drain sessions before exit
 	cancelF()
+	shutdownCtx, shutdownCancelF := context.WithTimeout(context.Background(), time.Duration(cfg.Bot.DrainTimeout)*time.Second)
+	defer shutdownCancelF()
+	botSvc.Shutdown(shutdownCtx)
+
+	xlogger.InfoF(ctx, "bot service terminated")
+}
+
+// reloadTemplates swaps in the template bundle without touching sessions, the templates in use are kept if the bundle
+// is invalid
+func reloadTemplates(ctx context.Context, dir string) {
+	if len(dir) == 0 {
+		xlogger.InfoF(ctx, "templates.dir is not configured, embedded templates are kept")
+		return
+	}
+	err := bot_server.LoadTemplates(dir)
+	if err != nil {
+		xlogger.ErrorF(ctx, "reload templates from %s failed, keep the templates in use: %v", dir, err)
+		return
+	}
+	xlogger.InfoF(ctx, "templates reloaded from %s", dir)
+}
+
+// loadSubcommandConfig loads config for subcommands, which need it partially and skip the checks of MustLoad
+func loadSubcommandConfig(ctx context.Context, configPath string) *config.Config {
+	if len(configPath) == 0 {
+		configPath = os.Getenv(config.EnvConfigPath)
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		xlogger.FatalF(ctx, "load config failed: %v", err)
+	}
+	return cfg
+}
+
+// migrate runs the migrate subcommand, it needs the mysql section of config only
+func migrate(configPath string, args []string) {
+	ctx := context.Background()
+	cfg := loadSubcommandConfig(ctx, configPath)
+	db, err := persist.NewMysqlClient(cfg.Mysql.Dsn.Value(), 1, 1)
+	if err != nil {
+		xlogger.FatalF(ctx, "connect mysql failed: %v", err)
+	}
+	defer db.Close()
+	migrator := migration.NewMigrator(db)
+
+	var (
+		command = "up"
+		version int
+	)
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		version, err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				xlogger.FatalF(ctx, "steps of migrate down must be a positive number, got %s", args[1])
+			}
+		}
+		version, err = migrator.Down(ctx, steps)
+	case "force":
+		if len(args) < 2 {
+			xlogger.FatalF(ctx, "migrate force needs the version the schema is at")
+		}
+		version, err = strconv.Atoi(args[1])
+		if err != nil {
+			xlogger.FatalF(ctx, "version of migrate force must be a number, got %s", args[1])
+		}
+		err = migrator.Force(ctx, version)
+	case "version":
+		var dirty bool
+		version, dirty, err = migrator.Version(ctx)
+		if err == nil {
+			fmt.Printf("schema version: %d, dirty: %v, known: %d\n", version, dirty, migration.LatestVersion())
+			return
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		xlogger.FatalF(ctx, "migrate %s failed at version %d: %v", command, version, err)
+	}
+	xlogger.InfoF(ctx, "migrate %s done, schema version: %d", command, version)
+}
+
+// replayJournal runs the replay subcommand, it replays the journal of a chat from mysql and prints the updates replied
+// differently than originally, exiting 1 if any
+func replayJournal(configPath string, args []string) {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	chatId := flags.Int64("chat", 0, "chat to replay, which is the user id for private chats")
+	since := flags.String("since", "", "replay from the time in RFC3339, the conversation is expected to start then, from the earliest entry if empty")
+	until := flags.String("until", "", "replay until the time in RFC3339, to the latest entry if empty")
+	rockShopUrl := flags.String("rock_shop", "", "base url of RockShop api, rock_shop.base_url of config if empty, it's asked by redacted phone numbers")
+	_ = flags.Parse(args)
+	if *chatId == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	filter := bot_server.JournalFilter{ChatId: *chatId, Since: parseUnixTime(ctx, "since", *since), Until: parseUnixTime(ctx, "until", *until)}
+
+	cfg := loadSubcommandConfig(ctx, configPath)
+	if cfg.Mysql.Driver != config.MysqlDriverMysql {
+		xlogger.FatalF(ctx, "replay reads the journal from mysql, mysql.driver must be %s", config.MysqlDriverMysql)
+	}
+	db, err := persist.NewMysqlClient(cfg.Mysql.Dsn.Value(), 1, 1)
+	if err != nil {
+		xlogger.FatalF(ctx, "connect mysql failed: %v", err)
+	}
+	defer db.Close()
+	if len(cfg.Templates.Dir) > 0 {
+		err = bot_server.LoadTemplates(cfg.Templates.Dir)
+		if err != nil {
+			xlogger.FatalF(ctx, "load templates failed: %v", err)
+		}
+	}
+	if len(*rockShopUrl) == 0 {
+		*rockShopUrl = cfg.RockShop.BaseUrl
+	}
+
+	entries, err := bot_server.NewUpdateJournalRepo(db).ListJournal(ctx, filter)
+	if err != nil {
+		xlogger.FatalF(ctx, "list journal failed: %v", err)
+	}
+	report, err := replay.Journal(ctx, entries, replay.Option{
+		Session:  cfg.Session,
+		RockShop: bot_server.NewRockShopSvc(*rockShopUrl),
+	})
+	if err != nil {
+		xlogger.FatalF(ctx, "replay failed: %v", err)
+	}
+
+	for _, diff := range report.Diffs {
+		printReplayDiff(diff)
+	}
+	fmt.Printf("updates: %d, matched: %d, differed: %d, messages sent without update not replayed: %d\n",
+		report.Updates, report.Matched, len(report.Diffs), report.Unattributed)
+	if len(report.Diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// printReplayDiff prints messages sent for the update side by side, those sent originally are marked by -, those
+// sent by the replay by +
+func printReplayDiff(diff replay.Diff) {
+	fmt.Printf("update %d replied differently:\n", diff.UpdateId)
+	for i := 0; i < len(diff.Original) || i < len(diff.Replayed); i++ {
+		if i < len(diff.Original) && i < len(diff.Replayed) && diff.Original[i].Type == diff.Replayed[i].Type &&
+			string(diff.Original[i].Config) == string(diff.Replayed[i].Config) {
+			fmt.Printf("    %s %s\n", diff.Original[i].Type, diff.Original[i].Config)
+			continue
+		}
+		if i < len(diff.Original) {
+			fmt.Printf("  - %s %s\n", diff.Original[i].Type, diff.Original[i].Config)
+		}
+		if i < len(diff.Replayed) {
+			fmt.Printf("  + %s %s\n", diff.Replayed[i].Type, diff.Replayed[i].Config)
+		}
+	}
+}
+
+func parseUnixTime(ctx context.Context, name string, value string) int64 {
+	if len(value) == 0 {
+		return 0
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		xlogger.FatalF(ctx, "-%s must be a time in RFC3339, got %s", name, value)
+	}
+	return t.Unix()
 }
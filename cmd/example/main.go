@@ -5,6 +5,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"rock_review/app/config"
 	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -42,11 +43,18 @@ var (
 	)
 )
 
-const botToken = "7131845071:AAFk2z4SVHpswj3ZAnC9LY7-UJBcOuM6qC4"
-
 func main() {
-	var err error
-	bot, err = tgbotapi.NewBotAPI(botToken)
+	// Load bot token from config, see config.Config for env overrides
+	cfg, err := config.Load(os.Getenv(config.EnvConfigPath))
+	if err != nil {
+		log.Panic(err)
+	}
+	err = cfg.ValidateBot()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bot, err = tgbotapi.NewBotAPI(cfg.Bot.Token.Value())
 	if err != nil {
 		// Abort if something is wrong
 		log.Panic(err)
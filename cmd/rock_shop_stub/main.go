@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"rock_review/app/bot_server"
+	"rock_review/util/goutil"
+	"rock_review/util/xlogger"
+)
+
+// rock_shop_stub serves the RockShop order api locally, orders are read from a json file of phone_number -> orders
+func main() {
+	addr := flag.String("addr", "localhost:8081", "listen address")
+	ordersFile := flag.String("orders", "", "json file of phone_number -> orders, orders sorted from newest to oldest")
+	flag.Parse()
+
+	ctx := context.Background()
+	ordersByPhone := map[string][]bot_server.RockShopOrder{}
+	if len(*ordersFile) > 0 {
+		bs, err := os.ReadFile(*ordersFile)
+		if err != nil {
+			xlogger.FatalF(ctx, "read orders file fail: %v", err)
+		}
+		ordersByPhone, err = goutil.JsonValue[map[string][]bot_server.RockShopOrder](bs)
+		if err != nil {
+			xlogger.FatalF(ctx, "parse orders file fail: %v", err)
+		}
+	}
+
+	xlogger.InfoF(ctx, "rock shop stub listening on %s", *addr)
+	err := http.ListenAndServe(*addr, bot_server.NewRockShopStubHandler(ordersByPhone))
+	if err != nil {
+		xlogger.FatalF(ctx, "rock shop stub stopped: %v", err)
+	}
+}
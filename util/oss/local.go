@@ -0,0 +1,110 @@
+package oss
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ IStorage = &LocalStorage{}
+
+// LocalStorage stores objects on local filesystem as <rootDir>/<bucket>/<path>
+type LocalStorage struct {
+	rootDir string
+	baseUrl string
+}
+
+// NewLocalStorage creates a local storage, objects are addressed by baseUrl/<bucket>/<path>, such as a static file
+// server serving rootDir. Objects are addressed by file:// url if baseUrl is empty.
+func NewLocalStorage(rootDir string, baseUrl string) (*LocalStorage, error) {
+	absDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(absDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{
+		rootDir: absDir,
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+	}, nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, bucket string, path string, reader io.Reader, size int64, contentType string) (string, error) {
+	objectPath, err := objectKey(bucket, path)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(s.rootDir, filepath.FromSlash(objectPath))
+
+	err = os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temp file then rename, so that a half written object is never visible
+	tmpFile, err := os.CreateTemp(filepath.Dir(fullPath), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	written, err := io.Copy(tmpFile, reader)
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return "", err
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+	if size >= 0 && written != size {
+		return "", fmt.Errorf("incomplete object, expect %d bytes, got %d", size, written)
+	}
+
+	err = os.Rename(tmpFile.Name(), fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(s.baseUrl) == 0 {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(fullPath)}).String(), nil
+	}
+	return s.baseUrl + "/" + escapePath(objectPath), nil
+}
+
+// objectKey joins bucket and path, path must be relative and stay inside the bucket
+func objectKey(bucket string, path string) (string, error) {
+	if len(bucket) == 0 || strings.ContainsAny(bucket, "/\\") || bucket == "." || bucket == ".." {
+		return "", fmt.Errorf("invalid bucket: %s", bucket)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." || strings.Contains(segment, "\\") {
+			return "", fmt.Errorf("invalid object path: %s", path)
+		}
+	}
+	return bucket + "/" + path, nil
+}
+
+// escapePath escapes everything but unreserved characters and '/', which is also the uri encoding of signature v4
+func escapePath(path string) string {
+	const hexChars = "0123456789ABCDEF"
+
+	builder := strings.Builder{}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			builder.WriteByte(c)
+			continue
+		}
+		builder.WriteByte('%')
+		builder.WriteByte(hexChars[c>>4])
+		builder.WriteByte(hexChars[c&15])
+	}
+	return builder.String()
+}
@@ -1,11 +1,90 @@
 package oss
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
 
 const (
 	BucketRockReview = "ROCK_REVIEW"
 )
 
+// maxSourceSize limits the size of a downloaded source, telegram bot api serves files up to 20MB
+const maxSourceSize = 50 << 20
+
+// IStorage is implemented by storage drivers, the returned url must be durable and free of credentials
+type IStorage interface {
+	Put(ctx context.Context, bucket string, path string, reader io.Reader, size int64, contentType string) (url string, err error)
+}
+
+var storage IStorage
+
+var httpCli = &http.Client{Timeout: 60 * time.Second}
+
+// Init sets the storage driver used by Upload and Put
+func Init(s IStorage) {
+	storage = s
+}
+
+// Upload downloads the file at sourceUrl and stores it under targetBucket, sourceUrl is never included in errors
+// as it may carry credentials, such as the bot token in telegram file urls
 func Upload(ctx context.Context, targetBucket string, targetPath string, sourceUrl string) (newUrl string, err error) {
-	return sourceUrl, nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceUrl, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid source url")
+	}
+
+	resp, err := httpCli.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("download source fail: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download source fail, http status: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxSourceSize {
+		return "", fmt.Errorf("source too large: %d", resp.ContentLength)
+	}
+
+	// the length is unknown for a chunked response, the source is refused once more than the limit arrives
+	body := &sizeLimitReader{reader: resp.Body, remaining: maxSourceSize}
+	return Put(ctx, targetBucket, targetPath, body, resp.ContentLength, resp.Header.Get("Content-Type"))
+}
+
+// sizeLimitReader reads up to remaining bytes, it fails instead of ending if more are left, so that a source cut at
+// the limit is never stored as if complete
+type sizeLimitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	// read one byte over the limit to tell whether more are left
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) > r.remaining {
+		return 0, fmt.Errorf("source too large, over %d bytes", maxSourceSize)
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// Put stores content of reader, size is -1 if unknown
+func Put(ctx context.Context, bucket string, path string, reader io.Reader, size int64, contentType string) (newUrl string, err error) {
+	if storage == nil {
+		return "", fmt.Errorf("oss storage not initialized")
+	}
+	return storage.Put(ctx, bucket, path, reader, size, contentType)
 }
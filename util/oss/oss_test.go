@@ -0,0 +1,213 @@
+package oss
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testAccessKeyId     = "test_access_key"
+	testSecretAccessKey = "test_secret_key"
+	testRegion          = "us-east-1"
+	testContent         = "fake image content"
+)
+
+// fakeS3Server is a minio like stand-in serving path style PutObject and GetObject, requests are verified by
+// signature v4
+type fakeS3Server struct {
+	m       sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if !s.verify(r, body) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("SignatureDoesNotMatch"))
+			return
+		}
+		s.m.Lock()
+		s.objects[r.URL.EscapedPath()] = body
+		s.m.Unlock()
+	case http.MethodGet:
+		s.m.Lock()
+		body, ok := s.objects[r.URL.EscapedPath()]
+		s.m.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3Server) verify(r *http.Request, body []byte) bool {
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return false
+	}
+	amzDate, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	// rebuild the request as received and sign it again
+	resigned, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.EscapedPath(), nil)
+	if len(r.Header.Get("Content-Type")) > 0 {
+		resigned.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	}
+	signV4(resigned, body, testRegion, testAccessKeyId, testSecretAccessKey, amzDate)
+	return hmac.Equal([]byte(resigned.Header.Get("Authorization")), []byte(r.Header.Get("Authorization")))
+}
+
+func newSourceServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file/bot_secret_token/photos/file_1.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte(testContent))
+	}))
+}
+
+func Test_UnitTest_S3Storage(t *testing.T) {
+	var (
+		ctx = context.Background()
+	)
+
+	s3Server := httptest.NewServer(&fakeS3Server{objects: map[string][]byte{}})
+	defer s3Server.Close()
+	sourceServer := newSourceServer()
+	defer sourceServer.Close()
+
+	t.Run("upload", func(t *testing.T) {
+		Init(NewS3Storage(S3Option{
+			Endpoint:        s3Server.URL,
+			Region:          testRegion,
+			AccessKeyId:     testAccessKeyId,
+			SecretAccessKey: testSecretAccessKey,
+		}))
+
+		newUrl, err := Upload(ctx, BucketRockReview, "review/a b.jpg", sourceServer.URL+"/file/bot_secret_token/photos/file_1.jpg")
+		assert.Nil(t, err)
+		assert.Equal(t, s3Server.URL+"/rock-review/review/a%20b.jpg", newUrl)
+		assert.NotContains(t, newUrl, "secret_token")
+
+		resp, err := http.Get(newUrl)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, testContent, string(body))
+	})
+
+	t.Run("fail: wrong secret", func(t *testing.T) {
+		Init(NewS3Storage(S3Option{
+			Endpoint:        s3Server.URL,
+			Region:          testRegion,
+			AccessKeyId:     testAccessKeyId,
+			SecretAccessKey: "wrong_secret",
+		}))
+
+		_, err := Upload(ctx, BucketRockReview, "review/1.jpg", sourceServer.URL+"/file/bot_secret_token/photos/file_1.jpg")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("fail: source not found", func(t *testing.T) {
+		_, err := Upload(ctx, BucketRockReview, "review/1.jpg", sourceServer.URL+"/file/bot_secret_token/photos/file_2.jpg")
+		assert.NotNil(t, err)
+		assert.NotContains(t, err.Error(), "secret_token")
+	})
+
+	t.Run("fail: source unreachable", func(t *testing.T) {
+		_, err := Upload(ctx, BucketRockReview, "review/1.jpg", "http://127.0.0.1:1/file/bot_secret_token/photos/file_1.jpg")
+		assert.NotNil(t, err)
+		assert.NotContains(t, err.Error(), "secret_token")
+	})
+}
+
+func Test_UnitTest_LocalStorage(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		rootDir = t.TempDir()
+	)
+
+	sourceServer := newSourceServer()
+	defer sourceServer.Close()
+
+	t.Run("upload", func(t *testing.T) {
+		storage, err := NewLocalStorage(rootDir, "https://cdn.example.com/oss/")
+		assert.Nil(t, err)
+		Init(storage)
+
+		newUrl, err := Upload(ctx, BucketRockReview, "review/1.jpg", sourceServer.URL+"/file/bot_secret_token/photos/file_1.jpg")
+		assert.Nil(t, err)
+		assert.Equal(t, "https://cdn.example.com/oss/ROCK_REVIEW/review/1.jpg", newUrl)
+
+		content, err := os.ReadFile(filepath.Join(rootDir, BucketRockReview, "review", "1.jpg"))
+		assert.Nil(t, err)
+		assert.Equal(t, testContent, string(content))
+	})
+
+	t.Run("file url", func(t *testing.T) {
+		storage, err := NewLocalStorage(rootDir, "")
+		assert.Nil(t, err)
+
+		newUrl, err := storage.Put(ctx, BucketRockReview, "review/2.txt", strings.NewReader(testContent), -1, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "file://"+filepath.ToSlash(filepath.Join(rootDir, BucketRockReview, "review", "2.txt")), newUrl)
+	})
+
+	t.Run("fail: chunked source too large", func(t *testing.T) {
+		storage, err := NewLocalStorage(rootDir, "")
+		assert.Nil(t, err)
+		Init(storage)
+
+		// no Content-Length is sent for a body written by a single large write, it's chunked
+		chunkedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(make([]byte, maxSourceSize+1))
+		}))
+		defer chunkedServer.Close()
+
+		_, err = Upload(ctx, BucketRockReview, "review/4.bin", chunkedServer.URL)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "too large")
+		}
+		_, err = os.Stat(filepath.Join(rootDir, BucketRockReview, "review", "4.bin"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("fail: path traversal", func(t *testing.T) {
+		storage, err := NewLocalStorage(rootDir, "")
+		assert.Nil(t, err)
+
+		_, err = storage.Put(ctx, BucketRockReview, "../../etc/passwd", strings.NewReader(testContent), -1, "")
+		assert.NotNil(t, err)
+		_, err = storage.Put(ctx, "..", "passwd", strings.NewReader(testContent), -1, "")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("fail: incomplete", func(t *testing.T) {
+		storage, err := NewLocalStorage(rootDir, "")
+		assert.Nil(t, err)
+
+		_, err = storage.Put(ctx, BucketRockReview, "review/3.txt", strings.NewReader(testContent), 100, "")
+		assert.NotNil(t, err)
+		_, err = os.Stat(filepath.Join(rootDir, BucketRockReview, "review", "3.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
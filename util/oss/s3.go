@@ -0,0 +1,162 @@
+package oss
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var _ IStorage = &S3Storage{}
+
+type S3Option struct {
+	Endpoint        string // Endpoint such as https://s3.ap-southeast-1.amazonaws.com or http://localhost:9000 for minio
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	PublicBaseUrl   string // PublicBaseUrl addresses stored objects as PublicBaseUrl/<bucket>/<path>, Endpoint is used if empty
+}
+
+// S3Storage stores objects to an S3 compatible storage using path style requests signed by AWS signature v4.
+// Logical bucket names are mapped to valid S3 bucket names, e.g. ROCK_REVIEW is stored in bucket rock-review.
+type S3Storage struct {
+	opt     S3Option
+	httpCli *http.Client
+	now     func() time.Time
+}
+
+func NewS3Storage(opt S3Option) *S3Storage {
+	opt.Endpoint = strings.TrimSuffix(opt.Endpoint, "/")
+	opt.PublicBaseUrl = strings.TrimSuffix(opt.PublicBaseUrl, "/")
+	if len(opt.PublicBaseUrl) == 0 {
+		opt.PublicBaseUrl = opt.Endpoint
+	}
+	return &S3Storage{
+		opt:     opt,
+		httpCli: &http.Client{Timeout: 60 * time.Second},
+		now:     time.Now,
+	}
+}
+
+func (s *S3Storage) Put(ctx context.Context, bucket string, path string, reader io.Reader, size int64, contentType string) (string, error) {
+	objectPath, err := objectKey(s3BucketName(bucket), path)
+	if err != nil {
+		return "", err
+	}
+
+	// payload is buffered as signature v4 signs the payload hash
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if size >= 0 && int64(len(payload)) != size {
+		return "", fmt.Errorf("incomplete object, expect %d bytes, got %d", size, len(payload))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.opt.Endpoint+"/"+escapePath(objectPath), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	signV4(req, payload, s.opt.Region, s.opt.AccessKeyId, s.opt.SecretAccessKey, s.now())
+
+	resp, err := s.httpCli.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("put object fail: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("put object fail, http status: %d, body: %s", resp.StatusCode, string(body))
+	}
+	return s.opt.PublicBaseUrl + "/" + escapePath(objectPath), nil
+}
+
+func s3BucketName(bucket string) string {
+	return strings.ReplaceAll(strings.ToLower(bucket), "_", "-")
+}
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4Service   = "s3"
+	amzDateFormat  = "20060102T150405Z"
+)
+
+// signV4 signs req by AWS signature v4 with host, content-type and x-amz-* headers
+func signV4(req *http.Request, payload []byte, region string, accessKeyId string, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders, canonicalHeaders := canonicalSigV4Headers(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{amzDate[:8], region, sigV4Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+secretAccessKey), amzDate[:8])
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, sigV4Service)
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, accessKeyId, scope, signedHeaders, signature))
+}
+
+func canonicalSigV4Headers(req *http.Request) (signedHeaders string, canonicalHeaders string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		lowerKey := strings.ToLower(key)
+		if lowerKey == "content-type" || strings.HasPrefix(lowerKey, "x-amz-") {
+			headers[lowerKey] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	var keys []string
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	builder := strings.Builder{}
+	for _, key := range keys {
+		builder.WriteString(key + ":" + headers[key] + "\n")
+	}
+	return strings.Join(keys, ";"), builder.String()
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,82 @@
+package persist
+
+import (
+	"fmt"
+	"strings"
+)
+
+const DriverMysql = "mysql"
+
+// Dialect builds the statements which differ between databases. Other statements are plain sql with ? placeholders,
+// which all supported databases take. Repos in tests take the in-memory repos instead of a database.
+type Dialect interface {
+	// Quote quotes an identifier, which is needed by columns named by keywords such as state and status
+	Quote(ident string) string
+	// InsertIgnore inserts columns by ? placeholders, it does nothing if a row of the same keyColumns exists, so
+	// that rows affected tell whether the row is inserted
+	InsertIgnore(table string, columns []string, keyColumns []string) string
+	// Upsert inserts columns by ? placeholders, updateColumns are updated by the values inserted if a row of the same
+	// keyColumns exists
+	Upsert(table string, columns []string, keyColumns []string, updateColumns []string) string
+	// UpsertNewer upserts as Upsert does, but only if versionColumn inserted is not older than the one stored, the
+	// stored version is bumped to the one inserted as well
+	UpsertNewer(table string, columns []string, keyColumns []string, updateColumns []string, versionColumn string) string
+}
+
+// DialectOf tells the dialect of a database/sql driver, it panics on drivers not supported, as repos can't work
+// without the dialect
+func DialectOf(driverName string) Dialect {
+	switch driverName {
+	case DriverMysql:
+		return MysqlDialect{}
+	}
+	panic(fmt.Sprintf("sql driver %s is not supported", driverName))
+}
+
+type MysqlDialect struct{}
+
+func (MysqlDialect) Quote(ident string) string {
+	return "`" + strings.ReplaceAll(ident, "`", "``") + "`"
+}
+
+// InsertIgnore updates a key column to itself rather than insert ignore, which would ignore other errors as well
+func (d MysqlDialect) InsertIgnore(table string, columns []string, keyColumns []string) string {
+	key := d.Quote(keyColumns[0])
+	return insertInto(d, table, columns) + " on duplicate key update " + key + " = " + key
+}
+
+func (d MysqlDialect) Upsert(table string, columns []string, keyColumns []string, updateColumns []string) string {
+	sets := make([]string, 0, len(updateColumns))
+	for _, column := range updateColumns {
+		sets = append(sets, d.Quote(column)+" = values("+d.Quote(column)+")")
+	}
+	return insertInto(d, table, columns) + " on duplicate key update " + strings.Join(sets, ", ")
+}
+
+// UpsertNewer sets versionColumn last, as mysql assigns columns from left to right and later ones see the version
+// updated
+func (d MysqlDialect) UpsertNewer(table string, columns []string, keyColumns []string, updateColumns []string,
+	versionColumn string) string {
+	version := d.Quote(versionColumn)
+	newer := "values(" + version + ") >= " + version
+	sets := make([]string, 0, len(updateColumns)+1)
+	for _, column := range updateColumns {
+		quoted := d.Quote(column)
+		sets = append(sets, quoted+" = if("+newer+", values("+quoted+"), "+quoted+")")
+	}
+	sets = append(sets, version+" = greatest("+version+", values("+version+"))")
+	return insertInto(d, table, columns) + " on duplicate key update " + strings.Join(sets, ", ")
+}
+
+func insertInto(d Dialect, table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	return "insert into " + d.Quote(table) + " (" + quoteAll(d, columns) + ") values (" + placeholders + ")"
+}
+
+func quoteAll(d Dialect, idents []string) string {
+	quoted := make([]string, 0, len(idents))
+	for _, ident := range idents {
+		quoted = append(quoted, d.Quote(ident))
+	}
+	return strings.Join(quoted, ", ")
+}
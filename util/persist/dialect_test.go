@@ -0,0 +1,28 @@
+package persist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_Dialect(t *testing.T) {
+	columns := []string{"bot_id", "update_offset"}
+
+	mysql := DialectOf(DriverMysql)
+	assert.Equal(t, "`state`", mysql.Quote("state"))
+	assert.Equal(t, "insert into `tg_polling_offset` (`bot_id`, `update_offset`) values (?,?) "+
+		"on duplicate key update `bot_id` = `bot_id`", mysql.InsertIgnore("tg_polling_offset", columns, columns[:1]))
+	assert.Equal(t, "insert into `tg_polling_offset` (`bot_id`, `update_offset`) values (?,?) "+
+		"on duplicate key update `update_offset` = values(`update_offset`)",
+		mysql.Upsert("tg_polling_offset", columns, columns[:1], columns[1:]))
+	assert.Equal(t, "insert into `review` (`review_id`, `rating`, `session_version`) values (?,?,?) "+
+		"on duplicate key update `rating` = if(values(`session_version`) >= `session_version`, values(`rating`), `rating`), "+
+		"`session_version` = greatest(`session_version`, values(`session_version`))",
+		mysql.UpsertNewer("review", []string{"review_id", "rating", "session_version"}, []string{"review_id"},
+			[]string{"rating"}, "session_version"))
+
+	assert.Panics(t, func() {
+		DialectOf("sqlite3")
+	})
+}
@@ -5,20 +5,14 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-func MustNewMysqlClient(dbURI string) *sqlx.DB {
-	const maxOpenConns = 500
-	const maxIdleConns = maxOpenConns / 5
-
+func MustNewMysqlClient(dbURI string, maxOpenConns int, maxIdleConns int) *sqlx.DB {
 	tempDB := sqlx.MustConnect("mysql", dbURI)
 	tempDB.SetMaxOpenConns(maxOpenConns)
 	tempDB.SetMaxIdleConns(maxIdleConns)
 	return tempDB
 }
 
-func NewMysqlClient(dbURI string) (*sqlx.DB, error) {
-	const maxOpenConns = 500
-	const maxIdleConns = maxOpenConns / 5
-
+func NewMysqlClient(dbURI string, maxOpenConns int, maxIdleConns int) (*sqlx.DB, error) {
 	tempDB, err := sqlx.Connect("mysql", dbURI)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,374 @@
+// Package telegramtest is a fake telegram bot api for tests, it serves the methods the bots call over httptest, so that
+// tests script updates and files telegram holds, and assert the calls bots made.
+package telegramtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Call is a request of a bot api method, params are the form values sent, files uploaded by multipart are not kept
+type Call struct {
+	Method string
+	Params url.Values
+}
+
+type chatMemberKey struct {
+	chatId int64
+	userId int64
+}
+
+type file struct {
+	file    tgbotapi.File
+	content []byte
+}
+
+// Server is a fake bot api of a single bot. Methods not served are answered by 404 as telegram does for unknown
+// methods, and recorded as well.
+type Server struct {
+	*httptest.Server
+	Token string
+	Self  tgbotapi.User
+
+	m             sync.Mutex
+	updates       []tgbotapi.Update // updates are not confirmed yet by offset of getUpdates
+	lastUpdateId  int
+	lastMessageId int
+	files         map[string]file
+	members       map[chatMemberKey]tgbotapi.ChatMember
+	blocked       map[int64]bool // blocked are private chats of users who blocked the bot
+	calls         []Call
+	changed       chan struct{} // changed is closed and renewed when an update is pushed or a call is made
+}
+
+// NewServer starts a fake bot api for the bot of token, it's to be closed by Close
+func NewServer(token string) *Server {
+	id, _, _ := strings.Cut(token, ":")
+	botId, _ := strconv.ParseInt(id, 10, 64)
+	s := &Server{
+		Token:   token,
+		Self:    tgbotapi.User{ID: botId, IsBot: true, FirstName: "Test Bot", UserName: "test_bot"},
+		files:   map[string]file{},
+		members: map[chatMemberKey]tgbotapi.ChatMember{},
+		blocked: map[int64]bool{},
+		changed: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// APIEndpoint is the endpoint of methods for tgbotapi.NewBotAPIWithAPIEndpoint
+func (s *Server) APIEndpoint() string {
+	return s.URL + "/bot%s/%s"
+}
+
+// FileEndpoint is the endpoint of file downloads, formatted by bot token and file path as tgbotapi.FileEndpoint
+func (s *Server) FileEndpoint() string {
+	return s.URL + "/file/bot%s/%s"
+}
+
+// NewBotAPI connects a bot api client to the server
+func (s *Server) NewBotAPI() (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithAPIEndpoint(s.Token, s.APIEndpoint())
+}
+
+// PushUpdate queues an update for getUpdates, an update id is assigned if the update has none. It returns the id.
+func (s *Server) PushUpdate(update tgbotapi.Update) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if update.UpdateID == 0 {
+		update.UpdateID = s.lastUpdateId + 1
+	}
+	if update.UpdateID > s.lastUpdateId {
+		s.lastUpdateId = update.UpdateID
+	}
+	s.updates = append(s.updates, update)
+	s.notifyLocked()
+	return update.UpdateID
+}
+
+// PendingUpdates tells how many updates are not confirmed by offset of getUpdates yet
+func (s *Server) PendingUpdates() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return len(s.updates)
+}
+
+// AddFile makes a file available by getFile and download
+func (s *Server) AddFile(fileId string, filePath string, content []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.files[fileId] = file{
+		file: tgbotapi.File{
+			FileID:       fileId,
+			FileUniqueID: "u_" + fileId,
+			FileSize:     len(content),
+			FilePath:     filePath,
+		},
+		content: content,
+	}
+}
+
+// SetChatMember makes getChatMember of the chat tell the member, users not set are plain members
+func (s *Server) SetChatMember(chatId int64, member tgbotapi.ChatMember) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.members[chatMemberKey{chatId: chatId, userId: member.User.ID}] = member
+}
+
+// BlockBot makes sends to the private chat of the user fail as telegram does when the user blocked the bot
+func (s *Server) BlockBot(userId int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.blocked[userId] = true
+}
+
+// Calls returns calls made so far in order, calls of all methods if no method is given
+func (s *Server) Calls(methods ...string) []Call {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return filterCalls(s.calls, methods)
+}
+
+// TakeCalls returns calls made since the last take and forgets them, so that each step of a test asserts its own calls
+func (s *Server) TakeCalls() []Call {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	calls := s.calls
+	s.calls = nil
+	return calls
+}
+
+// WaitCalls waits until n calls of method are made, for bots calling from their own goroutines. It returns the calls
+// of method made before timeout, which are less than n if it times out.
+func (s *Server) WaitCalls(method string, n int, timeout time.Duration) []Call {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.m.Lock()
+		calls := filterCalls(s.calls, []string{method})
+		changed := s.changed
+		s.m.Unlock()
+		if len(calls) >= n {
+			return calls
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return calls
+		}
+	}
+}
+
+func filterCalls(calls []Call, methods []string) []Call {
+	var filtered []Call
+	for _, call := range calls {
+		if len(methods) == 0 || contains(methods, call.Method) {
+			filtered = append(filtered, call)
+		}
+	}
+	return filtered
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	filePrefix, methodPrefix := "/file/bot"+s.Token+"/", "/bot"+s.Token+"/"
+	if strings.HasPrefix(r.URL.Path, filePrefix) {
+		s.serveFile(w, r, strings.TrimPrefix(r.URL.Path, filePrefix))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, methodPrefix) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, methodPrefix)
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		writeError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	params := r.PostForm
+
+	chatId, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	s.m.Lock()
+	s.calls = append(s.calls, Call{Method: method, Params: params})
+	s.notifyLocked()
+	blocked := s.blocked[chatId]
+	s.m.Unlock()
+	if blocked && strings.HasPrefix(method, "send") {
+		writeError(w, http.StatusForbidden, "Forbidden: bot was blocked by the user")
+		return
+	}
+
+	switch method {
+	case "getMe":
+		writeResult(w, s.Self)
+	case "getUpdates":
+		s.serveGetUpdates(w, r, params)
+	case "sendMessage", "editMessageText", "editMessageReplyMarkup", "sendPhoto", "sendVideo", "sendAudio", "sendVoice":
+		writeResult(w, s.newMessage(params))
+	case "sendMediaGroup":
+		var medias []json.RawMessage
+		_ = json.Unmarshal([]byte(params.Get("media")), &medias)
+		messages := make([]tgbotapi.Message, 0, len(medias))
+		for range medias {
+			messages = append(messages, s.newMessage(params))
+		}
+		writeResult(w, messages)
+	case "answerCallbackQuery", "pinChatMessage", "unpinChatMessage":
+		writeResult(w, true)
+	case "getChatMember":
+		writeResult(w, s.chatMember(params))
+	case "getFile":
+		s.m.Lock()
+		f, ok := s.files[params.Get("file_id")]
+		s.m.Unlock()
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Bad Request: invalid file_id")
+			return
+		}
+		writeResult(w, f.file)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// serveGetUpdates confirms updates below offset, and long polls for timeout seconds if no update is pending
+func (s *Server) serveGetUpdates(w http.ResponseWriter, r *http.Request, params url.Values) {
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	limit, _ := strconv.Atoi(params.Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	timeout, _ := strconv.Atoi(params.Get("timeout"))
+	deadline := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer deadline.Stop()
+
+	for {
+		s.m.Lock()
+		pending := s.updates[:0]
+		for _, update := range s.updates {
+			if update.UpdateID >= offset {
+				pending = append(pending, update)
+			}
+		}
+		s.updates = pending
+		n := limit
+		if len(pending) < n {
+			n = len(pending)
+		}
+		updates := append([]tgbotapi.Update{}, pending[:n]...)
+		changed := s.changed
+		s.m.Unlock()
+
+		if len(updates) > 0 || timeout <= 0 {
+			writeResult(w, updates)
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			timeout = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) newMessage(params url.Values) tgbotapi.Message {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	chatId, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	chatType := "private"
+	if chatId < 0 {
+		chatType = "supergroup"
+	}
+	message := tgbotapi.Message{
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: chatId, Type: chatType},
+		From: &s.Self,
+		Text: params.Get("text"),
+	}
+	if messageId, err := strconv.Atoi(params.Get("message_id")); err == nil {
+		message.MessageID = messageId
+	} else {
+		s.lastMessageId++
+		message.MessageID = s.lastMessageId
+	}
+	_ = json.Unmarshal([]byte(params.Get("entities")), &message.Entities)
+	return message
+}
+
+func (s *Server) chatMember(params url.Values) tgbotapi.ChatMember {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	chatId, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	userId, _ := strconv.ParseInt(params.Get("user_id"), 10, 64)
+	member, ok := s.members[chatMemberKey{chatId: chatId, userId: userId}]
+	if !ok {
+		member = tgbotapi.ChatMember{User: &tgbotapi.User{ID: userId}, Status: "member"}
+	}
+	return member
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, f := range s.files {
+		if f.file.FilePath == filePath {
+			_, _ = w.Write(f.content)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	bs, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: bs})
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: false, ErrorCode: code, Description: description})
+}
@@ -0,0 +1,138 @@
+package telegramtest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UnitTest_Server(t *testing.T) {
+	server := NewServer("123:secret")
+	defer server.Close()
+	user := tgbotapi.User{ID: 42, FirstName: "Rock"}
+
+	botApi, err := server.NewBotAPI()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(123), botApi.Self.ID)
+
+	t.Run("getUpdates", func(t *testing.T) {
+		first := server.PushUpdate(TextUpdate(user, "/comment now"))
+		second := server.PushUpdate(CallbackUpdate(user, "q1", 7, "data"))
+		assert.Equal(t, first+1, second)
+
+		updates, err := botApi.GetUpdates(tgbotapi.UpdateConfig{Offset: 0, Limit: 1})
+		assert.Nil(t, err)
+		if assert.Len(t, updates, 1) {
+			assert.Equal(t, first, updates[0].UpdateID)
+			assert.Equal(t, "comment", updates[0].Message.Command())
+		}
+
+		// updates below offset are confirmed
+		updates, _ = botApi.GetUpdates(tgbotapi.UpdateConfig{Offset: second})
+		if assert.Len(t, updates, 1) {
+			assert.Equal(t, "data", updates[0].CallbackQuery.Data)
+		}
+		assert.Equal(t, 1, server.PendingUpdates())
+
+		// a long poll returns once an update is pushed
+		go func() {
+			server.WaitCalls("getUpdates", 3, time.Second)
+			server.PushUpdate(TextUpdate(user, "hello"))
+		}()
+		updates, _ = botApi.GetUpdates(tgbotapi.UpdateConfig{Offset: second + 1, Timeout: 5})
+		if assert.Len(t, updates, 1) {
+			assert.Equal(t, "hello", updates[0].Message.Text)
+		}
+		assert.Equal(t, 1, server.PendingUpdates())
+
+		updates, _ = botApi.GetUpdates(tgbotapi.UpdateConfig{Offset: second + 2, Timeout: 1})
+		assert.Empty(t, updates)
+		assert.Equal(t, 0, server.PendingUpdates())
+		server.TakeCalls()
+	})
+
+	t.Run("sendMessage", func(t *testing.T) {
+		sent, err := botApi.Send(tgbotapi.NewMessage(42, "hi"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hi", sent.Text)
+		edited, err := botApi.Send(tgbotapi.NewEditMessageText(42, sent.MessageID, "hi again"))
+		assert.Nil(t, err)
+		assert.Equal(t, sent.MessageID, edited.MessageID)
+
+		calls := server.TakeCalls()
+		if assert.Len(t, calls, 2) {
+			assert.Equal(t, "sendMessage", calls[0].Method)
+			assert.Equal(t, "42", calls[0].Params.Get("chat_id"))
+			assert.Equal(t, "hi again", calls[1].Params.Get("text"))
+		}
+		assert.Nil(t, server.TakeCalls())
+	})
+
+	t.Run("group", func(t *testing.T) {
+		server.SetChatMember(-100, tgbotapi.ChatMember{User: &user, Status: "administrator"})
+		member, err := botApi.GetChatMember(tgbotapi.GetChatMemberConfig{
+			ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: -100, UserID: 42}})
+		assert.Nil(t, err)
+		assert.True(t, member.IsAdministrator())
+		member, _ = botApi.GetChatMember(tgbotapi.GetChatMemberConfig{
+			ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: -100, UserID: 43}})
+		assert.Equal(t, "member", member.Status)
+
+		sent, err := botApi.SendMediaGroup(tgbotapi.NewMediaGroup(-100, []interface{}{
+			tgbotapi.NewInputMediaPhoto(tgbotapi.FileID("p1")), tgbotapi.NewInputMediaVideo(tgbotapi.FileID("v1")),
+		}))
+		assert.Nil(t, err)
+		if assert.Len(t, sent, 2) {
+			assert.Equal(t, "supergroup", sent[0].Chat.Type)
+		}
+		_, err = botApi.Request(tgbotapi.PinChatMessageConfig{ChatID: -100, MessageID: sent[0].MessageID})
+		assert.Nil(t, err)
+		server.TakeCalls()
+	})
+
+	t.Run("getFile", func(t *testing.T) {
+		server.AddFile("f1", "photos/file_1.jpg", []byte("jpeg"))
+		file, err := botApi.GetFile(tgbotapi.FileConfig{FileID: "f1"})
+		assert.Nil(t, err)
+		assert.Equal(t, "photos/file_1.jpg", file.FilePath)
+
+		resp, err := http.Get(server.URL + "/file/bot" + server.Token + "/" + file.FilePath)
+		if assert.Nil(t, err) {
+			content, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			assert.Equal(t, "jpeg", string(content))
+		}
+
+		_, err = botApi.GetFile(tgbotapi.FileConfig{FileID: "f2"})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "invalid file_id")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := botApi.Request(tgbotapi.NewChatPhoto(42, tgbotapi.FileID("p1")))
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Not Found")
+		}
+		assert.Len(t, server.Calls("setChatPhoto"), 1)
+
+		server.BlockBot(44)
+		_, err = botApi.Send(tgbotapi.NewMessage(44, "hi"))
+		var apiErr *tgbotapi.Error
+		if assert.ErrorAs(t, err, &apiErr) {
+			assert.Equal(t, http.StatusForbidden, apiErr.Code)
+		}
+		server.TakeCalls()
+
+		_, err = tgbotapi.NewBotAPIWithAPIEndpoint("123:wrong", server.APIEndpoint())
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Unauthorized")
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package telegramtest
+
+import (
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// TextUpdate is a text message of the user in the private chat with the bot, a leading command is marked by an entity
+// as telegram does
+func TextUpdate(from tgbotapi.User, text string) tgbotapi.Update {
+	message := &tgbotapi.Message{
+		From: &from,
+		Chat: &tgbotapi.Chat{ID: from.ID, Type: "private"},
+		Date: int(time.Now().Unix()),
+		Text: text,
+	}
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		message.Entities = []tgbotapi.MessageEntity{
+			{Type: "bot_command", Offset: 0, Length: len(utf16.Encode([]rune(command)))},
+		}
+	}
+	return tgbotapi.Update{Message: message}
+}
+
+// CallbackUpdate is a tap on an inline button carrying data, of a message the bot sent to the user
+func CallbackUpdate(from tgbotapi.User, queryId string, messageId int, data string) tgbotapi.Update {
+	return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   queryId,
+		From: &from,
+		Message: &tgbotapi.Message{
+			MessageID: messageId,
+			Chat:      &tgbotapi.Chat{ID: from.ID, Type: "private"},
+		},
+		Data: data,
+	}}
+}